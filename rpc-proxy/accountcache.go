@@ -0,0 +1,411 @@
+package main
+
+import (
+	"container/list"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// accountCache answers getAccountInfo and getMultipleAccounts from memory.
+// Every cached account has an accountSubscribe subscription upstream, at the
+// commitment it is read at, and its answers are dropped as soon as a
+// notification says it changed, so cached reads are as current as uncached
+// ones. The accounts in account_cache_accounts are always cached; up to
+// account_cache_size others are cached while recently requested.
+type accountCache struct {
+	url       string
+	tlsConfig *tls.Config
+	hot       map[string]bool
+	size      int
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	invalidations atomic.Int64
+
+	mu          sync.Mutex
+	conn        *websocket.Conn // nil while disconnected
+	nextReq     uint64
+	activations uint64                 // bumped whenever a subscription is confirmed
+	subs        map[string]*accountSub // by account and commitment
+	live        map[uint64]*accountSub // by upstream subscription id
+	pending     map[uint64]*accountSub // by upstream request id, awaiting the subscription id
+	recent      *list.List             // of *accountSub for accounts not in account_cache_accounts, most recently used first
+}
+
+// accountSub is the subscription to one account at one commitment and the
+// cached answers about it, one per request config (encoding, dataSlice)
+type accountSub struct {
+	key        string
+	account    string
+	commitment string
+	upstreamID uint64
+	active     bool          // notifications are flowing
+	activation uint64        // c.activations when confirmed
+	minSlot    uint64        // answers from before this slot may be outdated
+	el         *list.Element // in recent, nil for hot accounts
+	entries    map[string]accountEntry
+}
+
+type accountEntry struct {
+	context json.RawMessage
+	slot    uint64
+	value   json.RawMessage
+}
+
+// newAccountCache returns nil when account_cache is disabled, and otherwise
+// starts following the upstream's account changes
+func newAccountCache(config *Config) (*accountCache, error) {
+	if !config.AccountCache {
+		return nil, nil
+	}
+	wsURL, err := upstreamWebSocketURL(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newUpstreamTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	c := &accountCache{
+		url:       wsURL,
+		tlsConfig: tlsConfig,
+		hot:       make(map[string]bool),
+		size:      config.AccountCacheSize,
+		subs:      make(map[string]*accountSub),
+		live:      make(map[uint64]*accountSub),
+		pending:   make(map[uint64]*accountSub),
+		recent:    list.New(),
+	}
+	for _, account := range config.AccountCacheAccounts {
+		c.hot[account] = true
+	}
+	go c.follow()
+	return c, nil
+}
+
+// cached reports whether the method's answers are cached
+func (c *accountCache) cached(method string) bool {
+	return method == "getAccountInfo" || method == "getMultipleAccounts"
+}
+
+// accountRequest is a getAccountInfo or getMultipleAccounts request taken
+// apart
+type accountRequest struct {
+	accounts   []string
+	commitment string
+	config     string // the config, selecting the encoding and data slice
+}
+
+func parseAccountRequest(method string, params json.RawMessage) (accountRequest, bool) {
+	var req accountRequest
+	var args []json.RawMessage
+	if json.Unmarshal(params, &args) != nil || len(args) == 0 {
+		return req, false
+	}
+	if method == "getAccountInfo" {
+		var account string
+		if json.Unmarshal(args[0], &account) != nil {
+			return req, false
+		}
+		req.accounts = []string{account}
+	} else if json.Unmarshal(args[0], &req.accounts) != nil || len(req.accounts) == 0 {
+		return req, false
+	}
+	var config struct {
+		Commitment string `json:"commitment"`
+	}
+	if len(args) > 1 {
+		if json.Unmarshal(args[1], &config) != nil {
+			return req, false
+		}
+		req.config = compactParams(args[1])
+	}
+	req.commitment = commitmentNames[parseCommitment(config.Commitment)]
+	return req, true
+}
+
+// lookup returns the cached result for a request, if every account it asks
+// for is cached, and the generation to store a miss with. Accounts not
+// cached yet are subscribed to, so the next request finds them.
+func (c *accountCache) lookup(method string, params json.RawMessage) (json.RawMessage, uint64, bool) {
+	req, ok := parseAccountRequest(method, params)
+	if !ok {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	gen := c.activations
+	entries := make([]accountEntry, len(req.accounts))
+	hit := true
+	for i, account := range req.accounts {
+		sub := c.subscription(account, req.commitment)
+		if sub == nil {
+			hit = false
+			continue
+		}
+		entry, ok := sub.entries[req.config]
+		if !ok || !sub.active {
+			hit = false
+		}
+		entries[i] = entry
+	}
+	c.mu.Unlock()
+
+	if !hit {
+		c.misses.Add(1)
+		return nil, gen, false
+	}
+	c.hits.Add(1)
+
+	// The answer is current as of the newest entry, since none of the
+	// accounts changed after theirs
+	newest := entries[0]
+	for _, entry := range entries[1:] {
+		if entry.slot > newest.slot {
+			newest = entry
+		}
+	}
+	var value interface{} = newest.value
+	if method == "getMultipleAccounts" {
+		values := make([]json.RawMessage, len(entries))
+		for i, entry := range entries {
+			values[i] = entry.value
+		}
+		value = values
+	}
+	result, err := json.Marshal(map[string]interface{}{"context": newest.context, "value": value})
+	return result, gen, err == nil
+}
+
+// store caches the accounts in a response looked up at gen. Only reads sent
+// after an account's subscription was confirmed are cached, since a change
+// before then was never notified, and none older than what was already read
+// or notified about the account.
+func (c *accountCache) store(method string, params json.RawMessage, gen uint64, body []byte) {
+	req, ok := parseAccountRequest(method, params)
+	if !ok {
+		return
+	}
+	var resp struct {
+		Result struct {
+			Context json.RawMessage `json:"context"`
+			Value   json.RawMessage `json:"value"`
+		} `json:"result"`
+		Error *JSONRPCError `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error != nil || resp.Result.Value == nil {
+		return
+	}
+	var context struct {
+		Slot uint64 `json:"slot"`
+	}
+	if json.Unmarshal(resp.Result.Context, &context) != nil || context.Slot == 0 {
+		return
+	}
+	values := []json.RawMessage{resp.Result.Value}
+	if method == "getMultipleAccounts" {
+		if json.Unmarshal(resp.Result.Value, &values) != nil || len(values) != len(req.accounts) {
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, account := range req.accounts {
+		sub := c.subs[account+"|"+req.commitment]
+		if sub == nil || context.Slot < sub.minSlot {
+			continue
+		}
+		sub.minSlot = context.Slot
+		if !sub.active || sub.activation > gen {
+			continue
+		}
+		sub.entries[req.config] = accountEntry{context: resp.Result.Context, slot: context.Slot, value: values[i]}
+	}
+}
+
+// subscription returns the subscription to an account at a commitment,
+// subscribing when there is room for it, and marks it recently used; c.mu
+// must be held
+func (c *accountCache) subscription(account, commitment string) *accountSub {
+	key := account + "|" + commitment
+	if sub, ok := c.subs[key]; ok {
+		if sub.el != nil {
+			c.recent.MoveToFront(sub.el)
+		}
+		return sub
+	}
+	if !c.hot[account] && c.size <= 0 {
+		return nil
+	}
+
+	sub := &accountSub{key: key, account: account, commitment: commitment, entries: make(map[string]accountEntry)}
+	if !c.hot[account] {
+		sub.el = c.recent.PushFront(sub)
+		for c.recent.Len() > c.size {
+			c.unsubscribe(c.recent.Back().Value.(*accountSub))
+		}
+	}
+	c.subs[key] = sub
+	c.subscribe(sub)
+	return sub
+}
+
+// subscribe sends the subscription request if connected; c.mu must be held
+func (c *accountCache) subscribe(sub *accountSub) {
+	if c.conn == nil {
+		return
+	}
+	c.nextReq++
+	msg := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"accountSubscribe","params":[%q,{"commitment":%q,"encoding":"base64"}]}`,
+		c.nextReq, sub.account, sub.commitment)
+	if err := websocket.Message.Send(c.conn, msg); err != nil {
+		c.conn.Close() // the read loop reconnects and resubscribes
+		return
+	}
+	c.pending[c.nextReq] = sub
+}
+
+// unsubscribe drops a subscription and its answers; c.mu must be held
+func (c *accountCache) unsubscribe(sub *accountSub) {
+	if c.subs[sub.key] == sub {
+		delete(c.subs, sub.key)
+	}
+	if sub.el != nil {
+		c.recent.Remove(sub.el)
+	}
+	if sub.active {
+		delete(c.live, sub.upstreamID)
+		if c.conn != nil {
+			c.nextReq++
+			websocket.Message.Send(c.conn, fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"accountUnsubscribe","params":[%d]}`, c.nextReq, sub.upstreamID))
+		}
+	}
+	sub.active = false
+}
+
+// follow keeps the account subscriptions open, reconnecting with backoff
+func (c *accountCache) follow() {
+	backoff := time.Second
+	for {
+		conn, err := dialWebSocket(c.url, c.tlsConfig)
+		if err == nil {
+			c.mu.Lock()
+			c.conn = conn
+			for _, sub := range c.subs {
+				c.subscribe(sub)
+			}
+			c.mu.Unlock()
+			backoff = time.Second
+			err = c.read(conn)
+			conn.Close()
+		}
+
+		c.mu.Lock()
+		c.conn = nil
+		c.live = make(map[uint64]*accountSub)
+		c.pending = make(map[uint64]*accountSub)
+		for _, sub := range c.subs {
+			sub.active = false
+			sub.entries = make(map[string]accountEntry)
+		}
+		c.mu.Unlock()
+		log.Printf("[WS] Account cache feed from %s lost, retrying in %v: %v", redactURL(c.url), backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// read activates subscriptions as they are confirmed and drops the answers
+// about an account whenever it changes, until the connection fails
+func (c *accountCache) read(conn *websocket.Conn) error {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			return err
+		}
+		var msg struct {
+			ID     uint64          `json:"id"`
+			Result json.RawMessage `json:"result"`
+			Error  *JSONRPCError   `json:"error"`
+			Method string          `json:"method"`
+			Params struct {
+				Subscription uint64 `json:"subscription"`
+				Result       struct {
+					Context struct {
+						Slot uint64 `json:"slot"`
+					} `json:"context"`
+				} `json:"result"`
+			} `json:"params"`
+		}
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		if sub, ok := c.pending[msg.ID]; ok && msg.ID != 0 {
+			delete(c.pending, msg.ID)
+			var id uint64
+			switch {
+			case msg.Error != nil:
+				log.Printf("[WS] Account cache can't subscribe to %s: %s", sub.account, msg.Error.Message)
+				c.unsubscribe(sub)
+			case json.Unmarshal(msg.Result, &id) != nil:
+				c.mu.Unlock()
+				return errors.New("invalid accountSubscribe answer")
+			case c.subs[sub.key] != sub:
+				// Evicted while subscribing
+				sub.active, sub.upstreamID = true, id
+				c.unsubscribe(sub)
+			default:
+				c.activations++
+				sub.active, sub.upstreamID, sub.activation = true, id, c.activations
+				c.live[id] = sub
+			}
+		} else if msg.Method == "accountNotification" {
+			if sub, ok := c.live[msg.Params.Subscription]; ok {
+				sub.minSlot = max(sub.minSlot, msg.Params.Result.Context.Slot)
+				if len(sub.entries) > 0 {
+					sub.entries = make(map[string]accountEntry)
+					c.invalidations.Add(1)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// snapshot returns the cache statistics for /metrics
+func (c *accountCache) snapshot() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := 0
+	for _, sub := range c.subs {
+		entries += len(sub.entries)
+	}
+	return map[string]interface{}{
+		"live":          c.conn != nil,
+		"subscriptions": len(c.live),
+		"entries":       entries,
+		"hits":          c.hits.Load(),
+		"misses":        c.misses.Load(),
+		"invalidations": c.invalidations.Load(),
+	}
+}
+
+// resetCounters zeroes the cache statistics for /admin/metrics/reset
+func (c *accountCache) resetCounters() {
+	if c == nil {
+		return
+	}
+	c.hits.Store(0)
+	c.misses.Store(0)
+	c.invalidations.Store(0)
+}
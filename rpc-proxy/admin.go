@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// handleAdmin serves the /admin API. It is only enabled when an admin token
+// is configured, and every call must present it as a bearer token. Calls,
+// including refused ones, are recorded in the audit log.
+func (rt *Router) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	token := rt.defaultProxy.config.AdminToken
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	call := &auditCall{actor: "unauthenticated", claimed: claimedActor(r)}
+	if rt.audit != nil {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = rec
+		defer func() {
+			rt.audit.record(r, call, rec.status)
+		}()
+	}
+
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rpc-proxy admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	call.actor = "admin"
+	if rt.audit != nil {
+		call.captureBody(r)
+	}
+
+	switch r.URL.Path {
+	case "/admin/usage":
+		rt.handleUsage(w, r)
+	case "/admin/drain":
+		rt.handleDrain(w, r)
+	case "/admin/programs":
+		rt.handlePrograms(w, r)
+	case "/admin/config":
+		rt.handleConfig(w, r)
+	case "/admin/loglevel":
+		rt.handleLogLevel(w, r)
+	case "/admin/metrics/snapshot":
+		rt.handleMetricsSnapshot(w, r)
+	case "/admin/metrics/reset":
+		rt.handleMetricsReset(w, r)
+	case "/admin/traces":
+		rt.handleTraces(w, r)
+	case "/admin/analyze":
+		rt.handleAnalyze(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// adminProxy returns the proxy named by ?proxy= (default "default"), or
+// answers 404 and returns nil when there is none
+func (rt *Router) adminProxy(w http.ResponseWriter, r *http.Request) *RPCProxy {
+	name := r.URL.Query().Get("proxy")
+	if name == "" {
+		name = rt.defaultProxy.name
+	}
+	for _, p := range rt.proxies() {
+		if p.name == name {
+			return p
+		}
+	}
+	http.Error(w, "Unknown proxy: "+name, http.StatusNotFound)
+	return nil
+}
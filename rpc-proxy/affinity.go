@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// affinityTable pins clients to the upstream that last served them, so a
+// sendTransaction followed by getSignatureStatuses reads the same node's
+// state instead of racing replication between providers
+type affinityTable struct {
+	window time.Duration // how long a pin lasts after the client's last request
+	max    int           // pinned clients at most, new clients are balanced normally beyond that
+
+	mu   sync.Mutex
+	pins map[string]*affinityPin
+
+	repins atomic.Int64 // pins moved to another upstream after a failure
+}
+
+// affinityPin is the upstream a client is pinned to
+type affinityPin struct {
+	upstream *upstream
+	expires  time.Time
+}
+
+// newAffinityTable returns nil when session affinity is off
+func newAffinityTable(window time.Duration, max int) *affinityTable {
+	if window <= 0 {
+		return nil
+	}
+	t := &affinityTable{window: window, max: max, pins: make(map[string]*affinityPin)}
+	go t.cleanup()
+	return t
+}
+
+// lookup returns the upstream a client is pinned to, or nil. Pins to a
+// supervised node that fell behind are dropped, so its clients move to the
+// upstreams that have the latest state.
+func (t *affinityTable) lookup(key string, now time.Time) *upstream {
+	if t == nil || key == "" {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pin, ok := t.pins[key]
+	if !ok || !now.Before(pin.expires) {
+		return nil
+	}
+	if pin.upstream.catchingUp.Load() {
+		delete(t.pins, key)
+		return nil
+	}
+	return pin.upstream
+}
+
+// update pins a client to the upstream that served it, or unpins it when
+// that upstream failed so its next request is balanced afresh
+func (t *affinityTable) update(key string, u *upstream, ok bool, now time.Time) {
+	if t == nil || key == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pin, pinned := t.pins[key]
+	if pinned && !now.Before(pin.expires) {
+		pinned = false
+	}
+
+	if !ok || u.catchingUp.Load() {
+		// A node catching up served only because nothing else could, so
+		// clients aren't pinned to it
+		if pinned && pin.upstream == u {
+			delete(t.pins, key)
+		}
+		return
+	}
+	if !pinned {
+		if len(t.pins) >= t.max && t.max > 0 {
+			if _, exists := t.pins[key]; !exists {
+				return
+			}
+		}
+		t.pins[key] = &affinityPin{upstream: u, expires: now.Add(t.window)}
+		return
+	}
+	if pin.upstream != u {
+		t.repins.Add(1)
+		pin.upstream = u
+	}
+	pin.expires = now.Add(t.window)
+}
+
+// cleanup drops expired pins
+func (t *affinityTable) cleanup() {
+	for now := range time.Tick(t.window) {
+		t.mu.Lock()
+		for key, pin := range t.pins {
+			if !now.Before(pin.expires) {
+				delete(t.pins, key)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// snapshot returns the pinned client count and re-pins for /metrics
+func (t *affinityTable) snapshot() map[string]interface{} {
+	t.mu.Lock()
+	clients := len(t.pins)
+	t.mu.Unlock()
+	return map[string]interface{}{
+		"clients": clients,
+		"repins":  t.repins.Load(),
+	}
+}
+
+// preferUpstream moves the pinned upstream to the front of the candidates.
+// A pinned upstream that is no longer a candidate (down, throttled, over
+// budget) or is catching up is ignored, and the client is re-pinned to
+// whichever upstream serves it next.
+func preferUpstream(candidates []*upstream, pinned *upstream) []*upstream {
+	if pinned.catchingUp.Load() {
+		return candidates
+	}
+	for i, u := range candidates {
+		if u == pinned {
+			if i == 0 {
+				return candidates
+			}
+			ordered := make([]*upstream, 0, len(candidates))
+			ordered = append(ordered, u)
+			ordered = append(ordered, candidates[:i]...)
+			return append(ordered, candidates[i+1:]...)
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// captchaVerifyURLs are the token verification endpoints of the supported
+// captcha providers. All take secret, response and remoteip as a form and
+// answer {"success": bool, ...}.
+var captchaVerifyURLs = map[string]string{
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+}
+
+const (
+	// defaultCaptchaHeader carries the client's captcha token
+	defaultCaptchaHeader = "X-Captcha-Token"
+	// captchaVerifyTimeout bounds a token verification
+	captchaVerifyTimeout = 5 * time.Second
+)
+
+// AirdropConfig governs requestAirdrop on devnet and testnet endpoints
+type AirdropConfig struct {
+	Window         Duration `json:"window"`           // period the quotas apply to, default 24h
+	PerIPQuota     int      `json:"per_ip_quota"`     // airdrops per client IP (or network, with ipv4/ipv6_prefix_length) per window, 0 = unlimited
+	PerPubkeyQuota int      `json:"per_pubkey_quota"` // airdrops per recipient per window, 0 = unlimited
+	MaxLamports    uint64   `json:"max_lamports"`     // largest airdrop, 0 = the node's own limit
+	Captcha        string   `json:"captcha"`          // "turnstile", "hcaptcha" or "recaptcha" to require a solved captcha, empty = none
+	CaptchaSecret  string   `json:"captcha_secret"`   // the provider's secret key
+	CaptchaHeader  string   `json:"captcha_header"`   // header carrying the client's token, default X-Captcha-Token
+	FaucetURL      string   `json:"faucet_url"`       // send requestAirdrop to this JSON-RPC faucet instead of the upstream
+}
+
+// airdropPolicy applies quotas and captcha verification to requestAirdrop,
+// and optionally hands airdrops to a faucet service. Quotas are counted in
+// fixed windows starting at a client's (or recipient's) first airdrop.
+type airdropPolicy struct {
+	config    *AirdropConfig
+	window    time.Duration
+	verifyURL string
+	client    *http.Client
+
+	mu       sync.Mutex
+	byIP     map[string]*airdropCount
+	byPubkey map[string]*airdropCount
+
+	admitted       atomic.Int64
+	quotaRefused   atomic.Int64
+	captchaRefused atomic.Int64
+	faucetErrors   atomic.Int64
+}
+
+// airdropCount is the airdrops taken by one client or recipient in the
+// current window
+type airdropCount struct {
+	n     int
+	reset time.Time
+}
+
+// newAirdropPolicy returns nil when airdrop isn't configured
+func newAirdropPolicy(config *Config) (*airdropPolicy, error) {
+	ac := config.Airdrop
+	if ac == nil {
+		return nil, nil
+	}
+	a := &airdropPolicy{
+		config:   ac,
+		window:   ac.Window.Duration,
+		client:   &http.Client{Timeout: config.Timeout.Duration},
+		byIP:     make(map[string]*airdropCount),
+		byPubkey: make(map[string]*airdropCount),
+	}
+	if a.window <= 0 {
+		a.window = 24 * time.Hour
+	}
+	if ac.Captcha != "" {
+		a.verifyURL = captchaVerifyURLs[ac.Captcha]
+		if a.verifyURL == "" {
+			return nil, fmt.Errorf("airdrop.captcha: unknown provider %q (want turnstile, hcaptcha or recaptcha)", ac.Captcha)
+		}
+		if ac.CaptchaSecret == "" {
+			return nil, fmt.Errorf("airdrop.captcha_secret is required with captcha")
+		}
+	}
+	if ac.FaucetURL != "" {
+		if u, err := url.Parse(ac.FaucetURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("airdrop.faucet_url: %q is not an http(s) URL", ac.FaucetURL)
+		}
+	}
+	return a, nil
+}
+
+// airdropParams returns the recipient and lamports of a requestAirdrop
+func airdropParams(params json.RawMessage) (string, uint64, bool) {
+	var args []json.RawMessage
+	if json.Unmarshal(params, &args) != nil || len(args) < 2 {
+		return "", 0, false
+	}
+	var pubkey string
+	var lamports uint64
+	if json.Unmarshal(args[0], &pubkey) != nil || json.Unmarshal(args[1], &lamports) != nil {
+		return "", 0, false
+	}
+	if key, err := base58Decode(pubkey); err != nil || len(key) != 32 {
+		return "", 0, false
+	}
+	return pubkey, lamports, true
+}
+
+// quotaWait returns how long until the quotas admit another airdrop for the
+// client and recipient, 0 if they do now; a.mu must be held
+func (a *airdropPolicy) quotaWait(ip, pubkey string, now time.Time) time.Duration {
+	var wait time.Duration
+	check := func(counts map[string]*airdropCount, key string, quota int) {
+		if c, ok := counts[key]; ok && quota > 0 && c.n >= quota && now.Before(c.reset) {
+			wait = max(wait, c.reset.Sub(now))
+		}
+	}
+	check(a.byIP, ip, a.config.PerIPQuota)
+	check(a.byPubkey, pubkey, a.config.PerPubkeyQuota)
+	return wait
+}
+
+// waiting reports how long the client or recipient must wait for its next
+// airdrop, without taking one
+func (a *airdropPolicy) waiting(ip, pubkey string, now time.Time) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.quotaWait(ip, pubkey, now)
+}
+
+// airdropClaim is an airdrop taken from the quotas while it is being made.
+// It is given back unless kept, so failed airdrops don't use up quota.
+type airdropClaim struct {
+	policy *airdropPolicy
+	counts []*airdropCount
+	kept   bool
+}
+
+// keepIfMade keeps the claim if body is a successful requestAirdrop answer
+func (c *airdropClaim) keepIfMade(body []byte) {
+	var answer JSONRPCResponse
+	if c != nil && json.Unmarshal(body, &answer) == nil && answer.Error == nil && answer.Result != nil {
+		c.kept = true
+	}
+}
+
+// settle gives the claim back unless it was kept
+func (c *airdropClaim) settle() {
+	if c == nil || c.kept {
+		return
+	}
+	c.policy.mu.Lock()
+	defer c.policy.mu.Unlock()
+	for _, count := range c.counts {
+		if count.n > 0 {
+			count.n--
+		}
+	}
+}
+
+// take claims an airdrop for the client and recipient, or returns how long
+// until the quotas admit one
+func (a *airdropPolicy) take(ip, pubkey string, now time.Time) (*airdropClaim, time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if wait := a.quotaWait(ip, pubkey, now); wait > 0 {
+		return nil, wait
+	}
+	taken := &airdropClaim{policy: a}
+	claim := func(counts map[string]*airdropCount, key string, quota int) {
+		if quota <= 0 {
+			return
+		}
+		c, ok := counts[key]
+		if !ok || !now.Before(c.reset) {
+			c = &airdropCount{reset: now.Add(a.window)}
+			counts[key] = c
+		}
+		c.n++
+		taken.counts = append(taken.counts, c)
+	}
+	claim(a.byIP, ip, a.config.PerIPQuota)
+	claim(a.byPubkey, pubkey, a.config.PerPubkeyQuota)
+	return taken, 0
+}
+
+// expire drops the counts of windows that ended, every minute
+func (a *airdropPolicy) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		a.mu.Lock()
+		for _, counts := range []map[string]*airdropCount{a.byIP, a.byPubkey} {
+			for key, c := range counts {
+				if !now.Before(c.reset) {
+					delete(counts, key)
+				}
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// verifyCaptcha checks a client's captcha token with the provider
+func (a *airdropPolicy) verifyCaptcha(r *http.Request, token, clientIP string) (bool, error) {
+	form := url.Values{"secret": {a.config.CaptchaSecret}, "response": {token}, "remoteip": {strings.TrimSpace(clientIP)}}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, a.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := *a.client
+	client.Timeout = captchaVerifyTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s verification answered %s", a.config.Captcha, resp.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// captchaHeader is the header clients send their captcha token in
+func (a *airdropPolicy) captchaHeader() string {
+	if a.config.CaptchaHeader != "" {
+		return a.config.CaptchaHeader
+	}
+	return defaultCaptchaHeader
+}
+
+func (a *airdropPolicy) snapshot() map[string]interface{} {
+	a.mu.Lock()
+	ips, pubkeys := len(a.byIP), len(a.byPubkey)
+	a.mu.Unlock()
+	return map[string]interface{}{
+		"admitted":        a.admitted.Load(),
+		"quota_refused":   a.quotaRefused.Load(),
+		"captcha_refused": a.captchaRefused.Load(),
+		"faucet_errors":   a.faucetErrors.Load(),
+		"tracked_ips":     ips,
+		"tracked_pubkeys": pubkeys,
+	}
+}
+
+// admitAirdrop applies the airdrop policy to a requestAirdrop, answering it
+// with an error and returning false when it is refused. An admitted airdrop
+// holds a claim on the quotas that the caller keeps once it succeeded and
+// settles either way.
+func (p *RPCProxy) admitAirdrop(w http.ResponseWriter, r *http.Request, req JSONRPCRequest, clientIP, logIP string) (*airdropClaim, bool) {
+	a := p.airdrops
+	refuse := func(code int, message string, status int) (*airdropClaim, bool) {
+		p.metrics.FailedRequests.Add(1)
+		p.writeRPCError(w, req.ID, code, message, status)
+		return nil, false
+	}
+	pubkey, lamports, ok := airdropParams(req.Params)
+	if !ok {
+		return refuse(errInvalidParams, "Invalid params: requestAirdrop takes a base58 pubkey and a lamports amount", http.StatusOK)
+	}
+	if a.config.MaxLamports > 0 && lamports > a.config.MaxLamports {
+		return refuse(errInvalidParams, fmt.Sprintf("Airdrop of %d lamports exceeds the limit of %d", lamports, a.config.MaxLamports), http.StatusOK)
+	}
+
+	ip := ipPrefixKey(clientIP, p.config.IPv4PrefixLength, p.config.IPv6PrefixLength)
+	refuseQuota := func(wait time.Duration) (*airdropClaim, bool) {
+		a.quotaRefused.Add(1)
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		log.Printf("[WARN] IP: %s, requestAirdrop for %s refused: quota exceeded", logIP, pubkey)
+		p.metrics.FailedRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(JSONRPCResponse{JSONRPC: "2.0", ID: req.ID, Error: &JSONRPCError{
+			Code:    -32005,
+			Message: fmt.Sprintf("Airdrop quota exceeded. Please retry after %d seconds.", retryAfter),
+			Data:    map[string]interface{}{"retry_after_seconds": retryAfter},
+		}})
+		return nil, false
+	}
+	// Out of quota clients are refused before their captcha costs a
+	// verification call
+	if wait := a.waiting(ip, pubkey, time.Now()); wait > 0 {
+		return refuseQuota(wait)
+	}
+
+	if a.verifyURL != "" {
+		token := r.Header.Get(a.captchaHeader())
+		if token == "" {
+			a.captchaRefused.Add(1)
+			return refuse(errInvalidRequest, "Captcha required: send the solved captcha token in the "+a.captchaHeader()+" header", http.StatusForbidden)
+		}
+		solved, err := a.verifyCaptcha(r, token, clientIP)
+		if err != nil {
+			log.Printf("[ERROR] IP: %s, captcha verification failed: %v", logIP, err)
+			return refuse(-32603, "Captcha verification unavailable, please retry", http.StatusServiceUnavailable)
+		}
+		if !solved {
+			a.captchaRefused.Add(1)
+			return refuse(errInvalidRequest, "Captcha verification failed: solve a new captcha and retry", http.StatusForbidden)
+		}
+	}
+
+	claim, wait := a.take(ip, pubkey, time.Now())
+	if wait > 0 {
+		return refuseQuota(wait)
+	}
+	a.admitted.Add(1)
+	return claim, true
+}
+
+// forwardToFaucet sends a requestAirdrop to the faucet service and relays
+// its answer, keeping the claim if the faucet made the airdrop. Faucet
+// failures are logged and answered with a generic error, since their text
+// may reveal the faucet's internals.
+func (p *RPCProxy) forwardToFaucet(w http.ResponseWriter, r *http.Request, body []byte, id interface{}, logIP string, claim *airdropClaim) {
+	a := p.airdrops
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, a.config.FaucetURL, bytes.NewReader(body))
+	if err != nil {
+		a.faucetErrors.Add(1)
+		p.metrics.FailedRequests.Add(1)
+		log.Printf("[ERROR] IP: %s, Faucet error: %v", logIP, err)
+		p.writeRPCError(w, id, -32603, "Faucet unavailable, please retry later", http.StatusBadGateway)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	var out []byte
+	if err == nil {
+		out, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("faucet answered %s", resp.Status)
+		}
+	}
+	if err != nil {
+		a.faucetErrors.Add(1)
+		p.metrics.FailedRequests.Add(1)
+		log.Printf("[ERROR] IP: %s, Faucet error: %v", logIP, err)
+		p.writeRPCError(w, id, -32603, "Faucet unavailable, please retry later", http.StatusBadGateway)
+		return
+	}
+	claim.keepIfMade(out)
+
+	p.metrics.BytesOut.Add(int64(len(out)))
+	p.metrics.SuccessRequests.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
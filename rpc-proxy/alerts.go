@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Alert events a webhook can subscribe to
+const (
+	alertUpstreamUnhealthy = "upstream_unhealthy"
+	alertErrorRate         = "error_rate"
+	alertBudget            = "budget"
+	alertNodeBehind        = "node_behind"
+)
+
+var alertEvents = map[string]bool{alertUpstreamUnhealthy: true, alertErrorRate: true, alertBudget: true, alertNodeBehind: true}
+
+const (
+	// alertQueueSize bounds the notifications waiting to be sent
+	alertQueueSize = 100
+	// alertSendTimeout bounds a single webhook call
+	alertSendTimeout = 10 * time.Second
+	// alertUnhealthyChecks is the consecutive failed health checks after
+	// which an upstream is reported unhealthy, so one slow answer doesn't
+	// page anyone
+	alertUnhealthyChecks = 2
+)
+
+// AlertWebhook is an endpoint notified of operational problems
+type AlertWebhook struct {
+	URL    string   `json:"url"`
+	Format string   `json:"format"` // "generic" (default) posts the alert as JSON, "slack" and "discord" post a message
+	Events []string `json:"events"` // events to send, default all
+}
+
+// alert is one notification about a problem starting or ending
+type alert struct {
+	Event    string    `json:"event"`
+	Tenant   string    `json:"tenant"`
+	Subject  string    `json:"subject"` // the upstream concerned
+	Message  string    `json:"message"`
+	Resolved bool      `json:"resolved"`
+	Host     string    `json:"host"`
+	Time     time.Time `json:"time"`
+}
+
+// text renders the alert as a chat message
+func (a alert) text() string {
+	status := "ALERT"
+	if a.Resolved {
+		status = "RESOLVED"
+	}
+	return fmt.Sprintf("[%s] rpc-proxy %s/%s on %s: %s", status, a.Tenant, a.Subject, a.Host, a.Message)
+}
+
+// alerter sends alerts to the configured webhooks in the background. The
+// same problem is notified at most once per cooldown, and notifications over
+// the hourly rate limit are dropped, so a flapping upstream can't flood a
+// channel.
+type alerter struct {
+	webhooks []AlertWebhook
+	cooldown time.Duration
+	limiter  *rate.Limiter
+	client   *http.Client
+	host     string
+	queue    chan alert
+
+	mu   sync.Mutex
+	sent map[string]time.Time // dedup key -> last notified
+
+	notified   atomic.Int64
+	suppressed atomic.Int64 // duplicates within the cooldown
+	dropped    atomic.Int64 // over the rate limit or the queue
+	failed     atomic.Int64 // webhook calls that failed
+}
+
+// newAlerter returns nil when no webhooks are configured
+func newAlerter(config *Config) (*alerter, error) {
+	if len(config.Alerts) == 0 {
+		return nil, nil
+	}
+	for i, w := range config.Alerts {
+		if w.URL == "" {
+			return nil, fmt.Errorf("alerts[%d]: url is required", i)
+		}
+		switch w.Format {
+		case "", "generic", "slack", "discord":
+		default:
+			return nil, fmt.Errorf("alerts[%d]: unknown format %q (want generic, slack or discord)", i, w.Format)
+		}
+		for _, event := range w.Events {
+			if !alertEvents[event] {
+				return nil, fmt.Errorf("alerts[%d]: unknown event %q", i, event)
+			}
+		}
+	}
+
+	perHour := config.AlertRateLimit
+	if perHour <= 0 {
+		perHour = 30
+	}
+	host, _ := os.Hostname()
+	a := &alerter{
+		webhooks: config.Alerts,
+		cooldown: config.AlertCooldown.Duration,
+		limiter:  rate.NewLimiter(rate.Every(time.Hour/time.Duration(perHour)), perHour),
+		client:   &http.Client{Timeout: alertSendTimeout},
+		host:     host,
+		queue:    make(chan alert, alertQueueSize),
+		sent:     make(map[string]time.Time),
+	}
+	go a.run()
+	return a, nil
+}
+
+// notify queues an alert unless the same problem was notified within the
+// cooldown. A resolution is deduplicated separately from the alert itself.
+func (a *alerter) notify(event, tenant, subject string, resolved bool, format string, args ...interface{}) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	key := fmt.Sprintf("%s|%s|%s|%t", event, tenant, subject, resolved)
+
+	a.mu.Lock()
+	if last, ok := a.sent[key]; ok && now.Sub(last) < a.cooldown {
+		a.mu.Unlock()
+		a.suppressed.Add(1)
+		return
+	}
+	a.sent[key] = now
+	a.mu.Unlock()
+
+	msg := alert{
+		Event:    event,
+		Tenant:   tenant,
+		Subject:  subject,
+		Message:  fmt.Sprintf(format, args...),
+		Resolved: resolved,
+		Host:     a.host,
+		Time:     now.UTC(),
+	}
+	state := "firing"
+	if resolved {
+		state = "resolved"
+	}
+	log.Printf("[ALERT] %s %s/%s %s: %s", event, tenant, subject, state, msg.Message)
+	if !a.limiter.Allow() {
+		a.dropped.Add(1)
+		log.Printf("[WARN] Alert rate limit reached, not sending: %s", msg.text())
+		return
+	}
+	select {
+	case a.queue <- msg:
+	default:
+		a.dropped.Add(1)
+		log.Printf("[WARN] Alert queue full, not sending: %s", msg.text())
+	}
+}
+
+// run sends queued alerts to every webhook subscribed to their event
+func (a *alerter) run() {
+	for msg := range a.queue {
+		for _, w := range a.webhooks {
+			if !w.wants(msg.Event) {
+				continue
+			}
+			if err := a.send(w, msg); err != nil {
+				a.failed.Add(1)
+				log.Printf("[ERROR] Failed to send %s alert to webhook %s: %v", msg.Event, redactURL(w.URL), err)
+				continue
+			}
+			a.notified.Add(1)
+		}
+	}
+}
+
+func (w AlertWebhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// send posts an alert in the webhook's format
+func (a *alerter) send(w AlertWebhook, msg alert) error {
+	var payload interface{} = msg
+	switch w.Format {
+	case "slack":
+		payload = map[string]string{"text": msg.text()}
+	case "discord":
+		payload = map[string]string{"content": msg.text()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), alertSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (a *alerter) snapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"sent":       a.notified.Load(),
+		"suppressed": a.suppressed.Load(),
+		"dropped":    a.dropped.Load(),
+		"failed":     a.failed.Load(),
+	}
+}
+
+// upstreamAlertState is what the alert checks remember about an upstream
+// between checks
+type upstreamAlertState struct {
+	failedChecks int
+	unhealthy    bool
+	requests     int64
+	failures     int64
+	errorRate    bool   // over alert_error_rate at the last check
+	budgetPeriod string // period already alerted for
+}
+
+// watchAlerts checks the upstreams for alert conditions every
+// alert_check_interval
+func (p *RPCProxy) watchAlerts(interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	states := make(map[*upstream]*upstreamAlertState, len(p.pool.upstreams))
+	for _, u := range p.pool.upstreams {
+		states[u] = &upstreamAlertState{requests: u.requests.Load(), failures: u.failures.Load()}
+	}
+	for {
+		time.Sleep(interval)
+		for _, u := range p.pool.upstreams {
+			p.checkUpstreamAlerts(u, states[u])
+		}
+	}
+}
+
+// checkUpstreamAlerts probes an upstream's health and compares its error
+// rate and budget with the alert thresholds
+func (p *RPCProxy) checkUpstreamAlerts(u *upstream, s *upstreamAlertState) {
+	ctx, cancel := context.WithTimeout(context.Background(), readyProbeTimeout)
+	err := p.pool.call(ctx, u, "getHealth", nil, nil)
+	cancel()
+	if err != nil {
+		s.failedChecks++
+		if !s.unhealthy && s.failedChecks >= alertUnhealthyChecks {
+			s.unhealthy = true
+			p.alerts.notify(alertUpstreamUnhealthy, p.name, u.name, false, "upstream unhealthy after %d failed health checks: %v", s.failedChecks, err)
+		}
+	} else {
+		s.failedChecks = 0
+		if s.unhealthy {
+			s.unhealthy = false
+			p.alerts.notify(alertUpstreamUnhealthy, p.name, u.name, true, "upstream healthy again")
+		}
+	}
+
+	requests, failures := u.requests.Load(), u.failures.Load()
+	n, failed := requests-s.requests, failures-s.failures
+	s.requests, s.failures = requests, failures
+	if threshold := p.config.AlertErrorRate; threshold > 0 && n >= shedMinSamples {
+		errorRate := float64(failed) / float64(n)
+		switch {
+		case errorRate >= threshold && !s.errorRate:
+			s.errorRate = true
+			p.alerts.notify(alertErrorRate, p.name, u.name, false, "error rate %.1f%% (%d of %d requests) exceeds %.1f%%", errorRate*100, failed, n, threshold*100)
+		case errorRate < threshold && s.errorRate:
+			s.errorRate = false
+			p.alerts.notify(alertErrorRate, p.name, u.name, true, "error rate back to %.1f%%", errorRate*100)
+		}
+	}
+
+	if threshold := p.config.AlertBudgetFraction; threshold > 0 && u.budget != nil {
+		used, period := u.budget.used()
+		if used >= threshold && s.budgetPeriod != period {
+			s.budgetPeriod = period
+			p.alerts.notify(alertBudget, p.name, u.name, false, "%.0f%% of the %s budget used", used*100, u.budget.config.Period)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Thresholds of the recommended config
+const (
+	// analyzeMinShare is the share of requests a method needs before a
+	// per-method setting is recommended for it
+	analyzeMinShare = 0.01
+	// analyzeTimeoutFactor is the headroom of the recommended timeout over
+	// the slowest forwarded method's p99 latency
+	analyzeTimeoutFactor = 3
+	// analyzeLargeResponse is the response size from which a method gets a
+	// max_response_sizes entry
+	analyzeLargeResponse = 1 << 20
+	// analyzeMaxMethods bounds the methods told apart, further methods are
+	// summed as "other"
+	analyzeMaxMethods = 200
+)
+
+// histogramGrowth is the ratio of a histogram bucket's bounds, so the
+// quantiles are within 5% of the true value
+const histogramGrowth = 1.05
+
+// histogramBuckets covers values up to about 10^11 at histogramGrowth
+const histogramBuckets = 520
+
+// methodAnalysis is a method's traffic in the request log
+type methodAnalysis struct {
+	Method    string    `json:"method"`
+	Requests  int64     `json:"requests"`
+	Share     float64   `json:"share"`
+	Errors    int64     `json:"errors"`     // status 400 and above
+	Local     int64     `json:"local"`      // answered without an upstream: caches, GET facade pages, idempotent replays
+	HitRate   float64   `json:"hit_rate"`   // local share of the successful requests
+	LatencyMs quantiles `json:"latency_ms"` // of the requests forwarded upstream
+	BytesIn   quantiles `json:"bytes_in"`
+	BytesOut  quantiles `json:"bytes_out"`
+
+	latency, in, out histogram
+}
+
+// histogram counts values in logarithmic buckets, so a day of requests
+// takes the same memory as a minute
+type histogram struct {
+	counts [histogramBuckets]int64
+	total  int64
+	max    float64
+}
+
+func (h *histogram) add(v float64) {
+	i := 0
+	if v > 0 {
+		i = min(int(math.Log1p(v)/math.Log(histogramGrowth)), histogramBuckets-1)
+	}
+	h.counts[i]++
+	h.total++
+	h.max = max(h.max, v)
+}
+
+// quantile returns the upper bound of the bucket holding the q-th quantile,
+// capped at the largest value seen
+func (h *histogram) quantile(q float64) float64 {
+	rank := int64(math.Ceil(q * float64(h.total)))
+	var seen int64
+	for i, n := range h.counts {
+		if seen += n; seen >= rank {
+			upper := math.Expm1(float64(i+1) * math.Log(histogramGrowth))
+			return math.Min(math.Round(upper*1000)/1000, h.max)
+		}
+	}
+	return h.max
+}
+
+// quantiles summarizes a distribution
+type quantiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func newQuantiles(h *histogram) quantiles {
+	if h.total == 0 {
+		return quantiles{}
+	}
+	return quantiles{P50: h.quantile(0.5), P95: h.quantile(0.95), P99: h.quantile(0.99), Max: h.max}
+}
+
+// analysis is the method mix of the request log over a period, with the
+// config it suggests
+type analysis struct {
+	From        time.Time              `json:"from"`
+	To          time.Time              `json:"to"`
+	Tenant      string                 `json:"tenant,omitempty"`
+	Requests    int64                  `json:"requests"`
+	HitRate     float64                `json:"hit_rate"`
+	Methods     []*methodAnalysis      `json:"methods"` // busiest first
+	Recommended map[string]interface{} `json:"recommended_config"`
+	Notes       []string               `json:"notes"` // why each setting is recommended
+}
+
+// analyzeRequestLog reads the request log since a time, for a tenant or
+// all of them, and recommends a config for the traffic it finds
+func analyzeRequestLog(ctx context.Context, db *sql.DB, table, tenant string, since time.Time) (*analysis, error) {
+	query := `SELECT time, method, requests, status, latency_ms, bytes_in, bytes_out, upstream FROM ` + table + ` WHERE time >= ?`
+	args := []interface{}{since.UTC().Format(time.RFC3339Nano)}
+	if tenant != "" {
+		query += ` AND tenant = ?`
+		args = append(args, tenant)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	a := &analysis{Tenant: tenant}
+	methods := make(map[string]*methodAnalysis)
+	var local, ok int64
+	for rows.Next() {
+		var at, method, upstream string
+		var requests, status int64
+		var latency float64
+		var in, out int64
+		if err := rows.Scan(&at, &method, &requests, &status, &latency, &in, &out, &upstream); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339Nano, at); err == nil {
+			if a.From.IsZero() || t.Before(a.From) {
+				a.From = t
+			}
+			if t.After(a.To) {
+				a.To = t
+			}
+		}
+		m := methods[method]
+		if m == nil {
+			if len(methods) >= analyzeMaxMethods {
+				method = "other"
+				m = methods[method]
+			}
+			if m == nil {
+				m = &methodAnalysis{Method: method}
+				methods[method] = m
+			}
+		}
+		// A row is one HTTP request, of requests calls when it is a batch
+		requests = max(requests, 1)
+		m.Requests += requests
+		a.Requests += requests
+		m.in.add(float64(in))
+		m.out.add(float64(out))
+		switch {
+		case status >= 400:
+			m.Errors += requests
+		case upstream == "":
+			m.Local += requests
+			local += requests
+			ok += requests
+		default:
+			m.latency.add(latency)
+			ok += requests
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	a.Methods = make([]*methodAnalysis, 0, len(methods))
+	for _, m := range methods {
+		m.Share = roundRatio(float64(m.Requests) / float64(a.Requests))
+		if successful := m.Requests - m.Errors; successful > 0 {
+			m.HitRate = roundRatio(float64(m.Local) / float64(successful))
+		}
+		m.LatencyMs = newQuantiles(&m.latency)
+		m.BytesIn = newQuantiles(&m.in)
+		m.BytesOut = newQuantiles(&m.out)
+		a.Methods = append(a.Methods, m)
+	}
+	sort.Slice(a.Methods, func(i, j int) bool {
+		if a.Methods[i].Requests != a.Methods[j].Requests {
+			return a.Methods[i].Requests > a.Methods[j].Requests
+		}
+		return a.Methods[i].Method < a.Methods[j].Method
+	})
+	if ok > 0 {
+		a.HitRate = roundRatio(float64(local) / float64(ok))
+	}
+	a.recommend()
+	return a, nil
+}
+
+// share returns the combined share of requests of some methods
+func (a *analysis) share(methods ...string) float64 {
+	var share float64
+	for _, m := range a.Methods {
+		for _, name := range methods {
+			if m.Method == name {
+				share += m.Share
+			}
+		}
+	}
+	return share
+}
+
+// recommend fills in the config the traffic suggests: a timeout with
+// headroom over the slowest method, rate limit costs by relative latency,
+// response size limits for the methods with large answers, and the caches
+// the method mix would benefit from
+func (a *analysis) recommend() {
+	a.Recommended = map[string]interface{}{}
+	a.Notes = []string{}
+	note := func(format string, args ...interface{}) {
+		a.Notes = append(a.Notes, fmt.Sprintf(format, args...))
+	}
+	if a.Requests == 0 {
+		note("no requests logged in the period, nothing to recommend")
+		return
+	}
+
+	// Timeout and method costs, from the methods common enough to measure
+	var forwarded []float64
+	var slowest *methodAnalysis
+	for _, m := range a.Methods {
+		if m.Share < analyzeMinShare || m.latency.total == 0 || m.Method == "batch" {
+			continue
+		}
+		forwarded = append(forwarded, m.LatencyMs.P50)
+		if slowest == nil || m.LatencyMs.P99 > slowest.LatencyMs.P99 {
+			slowest = m
+		}
+	}
+	if slowest != nil {
+		timeout := time.Duration(math.Ceil(slowest.LatencyMs.P99*analyzeTimeoutFactor/1000)) * time.Second
+		timeout = max(timeout, 5*time.Second)
+		a.Recommended["timeout"] = timeout.String()
+		note("timeout %v: %d× the p99 latency of %s, the slowest common method (%.0fms)", timeout, analyzeTimeoutFactor, slowest.Method, slowest.LatencyMs.P99)
+
+		sort.Float64s(forwarded)
+		typical := forwarded[len(forwarded)/2]
+		costs := map[string]int{}
+		for _, m := range a.Methods {
+			if m.Share < analyzeMinShare || m.latency.total == 0 || m.Method == "batch" || typical <= 0 {
+				continue
+			}
+			if cost := min(int(math.Round(m.LatencyMs.P50/typical)), 100); cost > 1 {
+				costs[m.Method] = cost
+				note("method_costs %s: %d, its median latency is %.0fms against %.0fms for a typical method", m.Method, cost, m.LatencyMs.P50, typical)
+			}
+		}
+		if len(costs) > 0 {
+			a.Recommended["method_costs"] = costs
+		}
+	}
+
+	// Response size limits with room over the largest answer seen
+	sizes := map[string]int64{}
+	for _, m := range a.Methods {
+		if m.BytesOut.Max < analyzeLargeResponse || m.Method == "batch" {
+			continue
+		}
+		limit := int64(math.Ceil(m.BytesOut.Max*2/(1<<20))) << 20
+		sizes[m.Method] = limit
+		note("max_response_sizes %s: %d MiB, twice its largest response", m.Method, limit>>20)
+	}
+	if len(sizes) > 0 {
+		a.Recommended["max_response_sizes"] = sizes
+	}
+
+	// Caches for the reads that are a large part of the traffic
+	var slotMethods []string
+	for _, method := range []string{"getSlot", "getBlockHeight", "getEpochInfo", "getLatestBlockhash", "getRecentBlockhash"} {
+		if a.share(method) >= analyzeMinShare {
+			slotMethods = append(slotMethods, method)
+		}
+	}
+	if share := a.share(slotMethods...); share >= 0.05 {
+		a.Recommended["slot_cache"] = true
+		a.Recommended["slot_cache_methods"] = slotMethods
+		note("slot_cache: %.0f%% of requests are slot-sensitive reads one answer per slot can serve", share*100)
+	}
+	if share := a.share("getEpochSchedule", "getLeaderSchedule"); share >= analyzeMinShare {
+		a.Recommended["epoch_cache"] = true
+		note("epoch_cache: %.0f%% of requests ask for the epoch or leader schedule, which change once an epoch", share*100)
+	}
+	if share := a.share("getAccountInfo", "getMultipleAccounts"); share >= 0.1 {
+		a.Recommended["account_cache"] = true
+		note("account_cache: %.0f%% of requests read accounts; list the hot ones in account_cache_accounts", share*100)
+	}
+	if share := a.share("getSignatureStatuses", "getTransaction"); share >= 0.05 {
+		a.Recommended["tx_status_cache_ttl"] = "2s"
+		note("tx_status_cache_ttl 2s: %.0f%% of requests poll transaction status", share*100)
+	}
+}
+
+// handleAnalyze serves /admin/analyze: the method mix of the SQLite request
+// log over ?since= (default 24h), for ?tenant= or every tenant, with a
+// recommended config
+func (rt *Router) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	config := rt.defaultProxy.config
+	if rt.requestLog == nil || config.RequestLogSink != "sqlite" {
+		http.Error(w, "Analyze reads the request log, set request_log_sink to sqlite", http.StatusNotImplemented)
+		return
+	}
+	since := 24 * time.Hour
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		since = d
+	}
+
+	// A connection of its own, so reading doesn't hold up the writes
+	db, err := openRequestLog(config.RequestLogPath)
+	if err != nil {
+		http.Error(w, "Failed to open the request log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+	a, err := analyzeRequestLog(r.Context(), db, config.RequestLogTable, r.URL.Query().Get("tenant"), time.Now().Add(-since))
+	if err != nil {
+		http.Error(w, "Failed to read the request log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// openRequestLog opens a SQLite request log read-only
+func openRequestLog(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(5000)")
+}
+
+// analyzeCommand analyzes a SQLite request log offline, e.g. a copy taken
+// from a production host
+func analyzeCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "analyze",
+		Usage:     "report the method mix of a SQLite request log and recommend a config",
+		ArgsUsage: " ",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "db", Usage: "request log database `file` (request_log_path)", Required: true},
+			&cli.StringFlag{Name: "table", Usage: "request log table (request_log_table)", Value: "requests"},
+			&cli.StringFlag{Name: "tenant", Usage: "only this tenant's requests"},
+			&cli.DurationFlag{Name: "since", Usage: "analyze this far back", Value: 24 * time.Hour},
+			&cli.BoolFlag{Name: "config-only", Usage: "print only the recommended config"},
+		},
+		Action: runAnalyze,
+	}
+}
+
+func runAnalyze(c *cli.Context) error {
+	table := c.String("table")
+	if !requestLogTableName.MatchString(table) {
+		return cli.Exit(fmt.Sprintf("invalid table name %q", table), 2)
+	}
+	db, err := openRequestLog(c.String("db"))
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	defer db.Close()
+
+	a, err := analyzeRequestLog(c.Context, db, table, c.String("tenant"), time.Now().Add(-c.Duration("since")))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("%s: %v", c.String("db"), err), 1)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if c.Bool("config-only") {
+		return encoder.Encode(a.Recommended)
+	}
+	return encoder.Encode(a)
+}
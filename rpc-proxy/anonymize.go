@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// ipAnonymizer hides client IPs in logs, metrics and admin listings. Rate
+// limiting always uses the full address.
+type ipAnonymizer struct {
+	mode string // "", "none", "truncate" or "hash"
+	salt []byte
+}
+
+func newIPAnonymizer(mode, salt string) (*ipAnonymizer, error) {
+	a := &ipAnonymizer{mode: mode}
+
+	switch mode {
+	case "", "none", "truncate":
+	case "hash":
+		if salt != "" {
+			a.salt = []byte(salt)
+		} else {
+			// A random salt means hashes can't be linked across restarts
+			a.salt = make([]byte, 32)
+			if _, err := rand.Read(a.salt); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown ip_anonymization %q (want none, truncate or hash)", mode)
+	}
+
+	return a, nil
+}
+
+// anonymize returns the displayable form of an IP
+func (a *ipAnonymizer) anonymize(ip string) string {
+	switch a.mode {
+	case "truncate":
+		return truncateIP(ip)
+	case "hash":
+		mac := hmac.New(sha256.New, a.salt)
+		mac.Write([]byte(ip))
+		return "ip-" + hex.EncodeToString(mac.Sum(nil))[:16]
+	default:
+		return ip
+	}
+}
+
+// truncateIP zeroes the last octet of an IPv4 address or the last 80 bits of
+// an IPv6 address
+func truncateIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "invalid"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
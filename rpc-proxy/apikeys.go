@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+)
+
+// APIKeyConfig is an API key clients can present to identify themselves
+type APIKeyConfig struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`     // account name used in usage analytics, defaults to a key prefix
+	Priority string `json:"priority"` // "high", "normal" (default) or "low" for queueing and load shedding
+}
+
+// getAPIKey extracts the API key from the X-API-Key header or the api-key
+// query parameter
+func getAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api-key")
+}
+
+// buildAPIKeys indexes the configured keys by key value
+func buildAPIKeys(keys []APIKeyConfig) map[string]string {
+	index := make(map[string]string, len(keys))
+	for _, k := range keys {
+		if k.Key == "" {
+			continue
+		}
+		name := k.Name
+		if name == "" {
+			name = keyPrefix(k.Key)
+		}
+		index[k.Key] = name
+	}
+	return index
+}
+
+// keyPrefix returns a short, loggable prefix of a key
+func keyPrefix(key string) string {
+	if len(key) <= 8 {
+		return key
+	}
+	return key[:8] + "..."
+}
+
+// apiKeyName returns the name of the API key a request presents, from
+// api_keys or the keys file
+func (p *RPCProxy) apiKeyName(r *http.Request) (string, bool) {
+	key := getAPIKey(r)
+	if key == "" {
+		return "", false
+	}
+	if name, ok := p.apiKeys[key]; ok {
+		return name, true
+	}
+	return p.keys.fileKeyName(key)
+}
+
+// clientAccount returns the usage account for a request: the API key name
+// when a known key is presented, otherwise the client IP
+func (p *RPCProxy) clientAccount(r *http.Request, clientIP string) (account, kind string) {
+	if name, ok := p.apiKeyName(r); ok {
+		return name, "key"
+	}
+	return clientIP, "ip"
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxAuditBody bounds the request body kept in an audit record
+const maxAuditBody = 16 << 10
+
+// auditRecord is one line of the admin audit log
+type auditRecord struct {
+	Time          time.Time       `json:"time"`
+	Actor         string          `json:"actor"`                   // "admin" with the token, "unauthenticated" without
+	ClaimedActor  string          `json:"claimed_actor,omitempty"` // X-Admin-Actor as sent, not verified
+	IP            string          `json:"ip"`
+	RemoteAddr    string          `json:"remote_addr"`
+	Method        string          `json:"method"`
+	Path          string          `json:"path"`
+	Query         string          `json:"query,omitempty"`
+	Body          json.RawMessage `json:"body,omitempty"` // of changing calls, secrets redacted
+	BodyTruncated bool            `json:"body_truncated,omitempty"`
+	Status        int             `json:"status"`
+	Result        string          `json:"result"` // "ok", "denied" or "failed"
+}
+
+// auditCall is what is known about an admin call before it is answered
+type auditCall struct {
+	actor     string
+	claimed   string
+	body      json.RawMessage
+	truncated bool
+}
+
+// auditLog appends a record of every admin API call to its own file
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newAuditLog returns nil when no audit log is configured
+func newAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("admin_audit_log: %w", err)
+	}
+	return &auditLog{file: file}, nil
+}
+
+// record writes and syncs one record, so it survives a crash right after
+// the call
+func (a *auditLog) record(r *http.Request, call *auditCall, status int) {
+	if a == nil {
+		return
+	}
+	result := "ok"
+	switch {
+	case status == http.StatusUnauthorized:
+		result = "denied"
+	case status >= 400:
+		result = "failed"
+	}
+	line, _ := json.Marshal(auditRecord{
+		Time:          time.Now().UTC(),
+		Actor:         call.actor,
+		ClaimedActor:  call.claimed,
+		IP:            getClientIP(r),
+		RemoteAddr:    r.RemoteAddr,
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Query:         r.URL.RawQuery,
+		Body:          call.body,
+		BodyTruncated: call.truncated,
+		Status:        status,
+		Result:        result,
+	})
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("[ERROR] Failed to write admin audit record for %s %s: %v", r.Method, r.URL.Path, err)
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		log.Printf("[ERROR] Failed to sync admin audit log: %v", err)
+	}
+}
+
+// claimedActor is the operator an admin call says it is from. The admin
+// token is shared, so the name is only as trustworthy as its callers.
+func claimedActor(r *http.Request) string {
+	return truncateString(r.Header.Get("X-Admin-Actor"), 64)
+}
+
+// adminActor describes the caller of an admin call in log lines, with the
+// name it claims to be
+func adminActor(r *http.Request) string {
+	if claimed := claimedActor(r); claimed != "" {
+		return fmt.Sprintf("admin (claims %q)", claimed)
+	}
+	return "admin"
+}
+
+// captureBody keeps the first maxAuditBody bytes of a changing call's body
+// for its audit record, with the secrets of a JSON body redacted, and
+// leaves the whole body for the handler to read
+func (c *auditCall) captureBody(r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return
+	}
+	if r.Body == nil {
+		return
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil || len(head) == 0 {
+		return
+	}
+	if len(head) > maxAuditBody {
+		// Cut short, it can't be parsed to redact, so none of it is kept
+		c.truncated = true
+		return
+	}
+	var doc interface{}
+	if json.Unmarshal(head, &doc) != nil {
+		c.body, _ = json.Marshal(fmt.Sprintf("<%d bytes, not JSON>", len(head)))
+		return
+	}
+	c.body, _ = json.Marshal(redactConfig("", doc))
+}
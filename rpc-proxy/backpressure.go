@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// expectedWait estimates how long a new request from the same client would
+// wait for a rate limit slot right now, without taking one
+func (p *RPCProxy) expectedWait(limiter requestLimiter) time.Duration {
+	if p.fairQueue != nil {
+		return p.fairQueue.expectedWait()
+	}
+	return limiter.wait(time.Now())
+}
+
+// setBackpressureHeaders tells clients in wait mode how many requests are
+// queued and how long their next request would wait, so well-behaved clients
+// can slow down before they are rejected
+func (p *RPCProxy) setBackpressureHeaders(w http.ResponseWriter, limiter requestLimiter) {
+	w.Header().Set("X-Queue-Depth", strconv.FormatInt(p.queueDepth.Load(), 10))
+	w.Header().Set("X-Expected-Wait-Ms", strconv.FormatInt(p.expectedWait(limiter).Milliseconds(), 10))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// egressAccount tracks the response bandwidth and daily egress of a client
+type egressAccount struct {
+	limiter    *rate.Limiter
+	day        string // UTC day the egress counter belongs to
+	bytes      int64
+	lastAccess time.Time
+}
+
+// egressLimiter throttles response bytes per client (API key or IP) and
+// enforces an optional daily egress quota
+type egressLimiter struct {
+	mu       sync.Mutex
+	accounts map[string]*egressAccount
+	rate     int64 // bytes per second, 0 = unlimited
+	burst    int
+	quota    int64 // bytes per UTC day, 0 = unlimited
+}
+
+// newEgressLimiter returns a limiter for the config, or nil when neither
+// bandwidth limiting nor egress quotas are enabled
+func newEgressLimiter(config *Config) *egressLimiter {
+	if config.EgressBytesPerSecond <= 0 && config.DailyEgressQuota <= 0 {
+		return nil
+	}
+
+	burst := config.EgressBurstBytes
+	if burst <= 0 {
+		burst = config.EgressBytesPerSecond
+	}
+	return &egressLimiter{
+		accounts: make(map[string]*egressAccount),
+		rate:     config.EgressBytesPerSecond,
+		burst:    int(burst),
+		quota:    config.DailyEgressQuota,
+	}
+}
+
+// account returns the egress state for a client, resetting the daily
+// counter when the UTC day has changed. Must be called with e.mu held.
+func (e *egressLimiter) account(client string, now time.Time) *egressAccount {
+	today := now.UTC().Format("2006-01-02")
+
+	a, exists := e.accounts[client]
+	if !exists {
+		a = &egressAccount{day: today}
+		if e.rate > 0 {
+			a.limiter = rate.NewLimiter(rate.Limit(e.rate), e.burst)
+		}
+		e.accounts[client] = a
+	}
+	if a.day != today {
+		a.day = today
+		a.bytes = 0
+	}
+	a.lastAccess = now
+	return a
+}
+
+// quotaExceeded reports whether the client has used up its daily egress
+// quota, and the seconds until it resets
+func (e *egressLimiter) quotaExceeded(client string) (bool, int) {
+	if e.quota <= 0 {
+		return false, 0
+	}
+
+	now := time.Now()
+	e.mu.Lock()
+	used := e.account(client, now).bytes
+	e.mu.Unlock()
+
+	if used < e.quota {
+		return false, 0
+	}
+	midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	return true, int(midnight.Sub(now).Seconds()) + 1
+}
+
+// write counts body against the client's quota and writes it to w, paced to
+// the client's bandwidth limit
+func (e *egressLimiter) write(ctx context.Context, w http.ResponseWriter, client string, body []byte) error {
+	e.mu.Lock()
+	a := e.account(client, time.Now())
+	a.bytes += int64(len(body))
+	limiter := a.limiter
+	e.mu.Unlock()
+
+	if limiter == nil {
+		_, err := w.Write(body)
+		return err
+	}
+
+	// Flush each chunk so the pacing reaches the client instead of the
+	// response buffer
+	rc := http.NewResponseController(w)
+	for len(body) > 0 {
+		n := len(body)
+		if n > e.burst {
+			n = e.burst
+		}
+		if err := limiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return err
+		}
+		rc.Flush()
+		body = body[n:]
+	}
+	return nil
+}
+
+// cleanup removes idle clients, keeping today's egress counters while a
+// quota is enforced
+func (e *egressLimiter) cleanup(ttl time.Duration) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		today := now.UTC().Format("2006-01-02")
+		e.mu.Lock()
+		for client, a := range e.accounts {
+			if now.Sub(a.lastAccess) > ttl && (e.quota <= 0 || a.day != today) {
+				delete(e.accounts, client)
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+// egressClient identifies the client for bandwidth accounting: the API key
+// name when a known key is presented, otherwise the client IP
+func (p *RPCProxy) egressClient(r *http.Request, clientIP string) string {
+	account, kind := p.clientAccount(r, clientIP)
+	return kind + ":" + account
+}
+
+func (p *RPCProxy) writeQuotaError(w http.ResponseWriter, id interface{}, retryAfter int) {
+	resp := JSONRPCResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error: &JSONRPCError{
+			Code:    -32005,
+			Message: fmt.Sprintf("Daily egress quota of %d bytes exceeded. Please retry after %d seconds.", p.config.DailyEgressQuota, retryAfter),
+			Data: map[string]interface{}{
+				"retry_after_seconds": retryAfter,
+				"quota_bytes":         p.config.DailyEgressQuota,
+			},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(resp)
+}
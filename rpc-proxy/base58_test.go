@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBase58(t *testing.T) {
+	tests := []struct {
+		name    string
+		decoded []byte
+		encoded string
+	}{
+		{name: "empty", decoded: []byte{}, encoded: ""},
+		{name: "zero byte", decoded: []byte{0}, encoded: "1"},
+		{name: "leading zeros", decoded: []byte{0, 0, 1}, encoded: "112"},
+		{name: "one byte", decoded: []byte{57}, encoded: "z"},
+		{name: "carry", decoded: []byte{58}, encoded: "21"},
+		{name: "text", decoded: []byte("Hello World!"), encoded: "2NEpo7TZRRrLZSi2U"},
+		{name: "system program", decoded: make([]byte, 32), encoded: strings.Repeat("1", 32)},
+		{
+			name: "token program",
+			decoded: []byte{
+				6, 221, 246, 225, 215, 101, 161, 147, 217, 203, 225, 70, 206, 235, 121, 172,
+				28, 180, 133, 237, 95, 91, 55, 145, 58, 140, 245, 133, 126, 255, 0, 169,
+			},
+			encoded: "TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := base58Encode(tt.decoded); got != tt.encoded {
+				t.Errorf("base58Encode = %q, want %q", got, tt.encoded)
+			}
+			got, err := base58Decode(tt.encoded)
+			if err != nil {
+				t.Fatalf("base58Decode: %v", err)
+			}
+			if !bytes.Equal(got, tt.decoded) {
+				t.Errorf("base58Decode = %v, want %v", got, tt.decoded)
+			}
+		})
+	}
+}
+
+func TestBase58DecodeInvalid(t *testing.T) {
+	// 0, O, I and l are left out of the alphabet
+	for _, s := range []string{"0", "O", "I", "l", "abc+", "1 1", "é"} {
+		if _, err := base58Decode(s); err != errInvalidBase58 {
+			t.Errorf("base58Decode(%q): error %v, want %v", s, err, errInvalidBase58)
+		}
+	}
+}
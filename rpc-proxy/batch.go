@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// batchItem is one request of a batch as the client sent it
+type batchItem struct {
+	raw    json.RawMessage
+	id     json.RawMessage // nil when absent, i.e. a notification
+	object bool            // false for junk like a bare number, which gets an error with a null id
+	method string
+	params json.RawMessage
+}
+
+// parseBatchItems splits a batch body into its requests
+func parseBatchItems(body []byte) ([]batchItem, bool) {
+	var raws []json.RawMessage
+	if json.Unmarshal(body, &raws) != nil {
+		return nil, false
+	}
+	items := make([]batchItem, len(raws))
+	for i, raw := range raws {
+		var fields struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		items[i] = batchItem{raw: raw}
+		if json.Unmarshal(raw, &fields) == nil && bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			items[i] = batchItem{raw: raw, id: fields.ID, object: true, method: fields.Method, params: fields.Params}
+		}
+	}
+	return items, true
+}
+
+// expectsResponse reports whether the item must get an entry in the
+// response: every request except notifications
+func (item batchItem) expectsResponse() bool {
+	return item.id != nil || !item.object
+}
+
+// responseID is the id the item's response carries
+func (item batchItem) responseID() json.RawMessage {
+	if item.id == nil {
+		return json.RawMessage("null")
+	}
+	return item.id
+}
+
+// batchEntry encodes one response of a batch
+func batchEntry(id, result json.RawMessage, rpcErr interface{}) json.RawMessage {
+	entry, _ := json.Marshal(struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  json.RawMessage `json:"result,omitempty"`
+		Error   interface{}     `json:"error,omitempty"`
+	}{"2.0", id, result, rpcErr})
+	return entry
+}
+
+// cacheGen holds the slot and account cache generations a miss was looked
+// up at, to store the upstream's answer with
+type cacheGen struct {
+	slot    uint64
+	account uint64
+}
+
+// cachedResult answers a request from the transaction status, slot, epoch or
+// account cache,
+// returning the cache generations to store a miss with
+func (p *RPCProxy) cachedResult(method string, params json.RawMessage) (json.RawMessage, cacheGen, bool) {
+	if p.txCache != nil && txCached(method) {
+		result, ok := p.txCache.lookup(method, params)
+		debugf(debugCache, "tx status %s hit=%t", method, ok)
+		return result, cacheGen{}, ok
+	}
+	if p.slotCache != nil && p.slotCache.cached(method) {
+		result, gen, ok := p.slotCache.lookup(method, params)
+		debugf(debugCache, "slot %s hit=%t", method, ok)
+		return result, cacheGen{slot: gen}, ok
+	}
+	if p.epochCache != nil && p.epochCache.cached(method) {
+		result, ok := p.epochCache.lookup(method, params)
+		debugf(debugCache, "epoch %s hit=%t", method, ok)
+		return result, cacheGen{}, ok
+	}
+	if p.accountCache != nil && p.accountCache.cached(method) {
+		result, gen, ok := p.accountCache.lookup(method, params)
+		debugf(debugCache, "account %s hit=%t", method, ok)
+		return result, cacheGen{account: gen}, ok
+	}
+	return nil, cacheGen{}, false
+}
+
+// storeResult feeds a successful upstream response to the caches and
+// policies that learn from responses
+func (p *RPCProxy) storeResult(method string, params json.RawMessage, gen cacheGen, body []byte) {
+	if p.txCache != nil && (txCached(method) || method == "sendTransaction") {
+		p.txCache.store(method, params, body)
+	}
+	if p.signatures != nil && method == "getSignaturesForAddress" {
+		p.signatures.observe(params, body)
+	}
+	if p.slotCache != nil && p.slotCache.cached(method) {
+		p.slotCache.store(method, params, gen.slot, body)
+	} else if p.epochCache != nil && p.epochCache.cached(method) {
+		p.epochCache.store(method, params, body)
+	}
+	if p.accountCache != nil && p.accountCache.cached(method) {
+		p.accountCache.store(method, params, gen.account, body)
+	}
+}
+
+// splitBatch answers what it can of a batch from the caches. It returns the
+// cached entries (nil where the upstream must answer) and the body of the
+// remaining requests, nil when every request was answered.
+func (p *RPCProxy) splitBatch(items []batchItem) ([]json.RawMessage, []byte, cacheGen) {
+	entries := make([]json.RawMessage, len(items))
+	var rest []json.RawMessage
+	var batchGen cacheGen
+	for i, item := range items {
+		if !item.object || item.id == nil {
+			rest = append(rest, item.raw)
+			continue
+		}
+		result, gen, ok := p.cachedResult(item.method, item.params)
+		if gen.slot != 0 && batchGen.slot == 0 {
+			batchGen.slot = gen.slot
+		}
+		// Every lookup happens before the batch is sent upstream
+		batchGen.account = max(batchGen.account, gen.account)
+		if !ok {
+			rest = append(rest, item.raw)
+			continue
+		}
+		entries[i] = batchEntry(item.id, result, nil)
+	}
+	if len(rest) == 0 {
+		return entries, nil, batchGen
+	}
+	body, _ := json.Marshal(rest)
+	return entries, body, batchGen
+}
+
+// mergeBatch assembles the response to a batch from the cached entries and
+// the upstream's response to the rest, in request order with exactly one
+// entry per request that expects one. Upstream entries are matched by id,
+// since nodes may answer out of order; a request the upstream didn't answer
+// gets the error the upstream returned for the whole batch, or a
+// synthesized one. It also returns each request's entry, nil for
+// notifications.
+func mergeBatch(items []batchItem, entries []json.RawMessage, upstream []byte) ([]byte, []json.RawMessage) {
+	var responses []json.RawMessage
+	var batchErr json.RawMessage
+	trimmed := bytes.TrimSpace(upstream)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		json.Unmarshal(trimmed, &responses)
+	} else {
+		var single struct {
+			Error json.RawMessage `json:"error"`
+		}
+		json.Unmarshal(trimmed, &single)
+		batchErr = single.Error
+	}
+
+	byID := make(map[string][]json.RawMessage)
+	for _, response := range responses {
+		var fields struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.Unmarshal(response, &fields)
+		key := compactParams(fields.ID)
+		if len(fields.ID) == 0 {
+			key = "null"
+		}
+		byID[key] = append(byID[key], response)
+	}
+
+	merged := make([]json.RawMessage, len(items))
+	out := make([]json.RawMessage, 0, len(items))
+	for i, item := range items {
+		entry := entries[i]
+		if entry == nil && item.expectsResponse() {
+			key := compactParams(item.responseID())
+			if queue := byID[key]; len(queue) > 0 {
+				entry, byID[key] = queue[0], queue[1:]
+			} else if batchErr != nil {
+				entry = batchEntry(item.responseID(), nil, batchErr)
+			} else if !item.object {
+				entry = batchEntry(item.responseID(), nil, &JSONRPCError{Code: -32600, Message: "Invalid Request"})
+			} else {
+				entry = batchEntry(item.responseID(), nil, &JSONRPCError{Code: -32603, Message: "Upstream returned no response for this request"})
+			}
+		}
+		if entry != nil {
+			merged[i] = entry
+			out = append(out, entry)
+		}
+	}
+
+	if len(out) == 0 {
+		return upstream, merged // only notifications
+	}
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for i, entry := range out {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(entry)
+	}
+	body.WriteByte(']')
+	return body.Bytes(), merged
+}
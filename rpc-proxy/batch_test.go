@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// sameJSON reports whether two JSON documents are equal, ignoring spacing
+// and key order
+func sameJSON(t *testing.T, got, want []byte) bool {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal(want, &w); err != nil {
+		t.Fatalf("invalid JSON %s: %v", want, err)
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+func TestMergeBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		batch    string
+		cached   map[int]string // entries answered from a cache, by position
+		upstream string
+		want     string
+	}{
+		{
+			name:     "in order",
+			batch:    `[{"jsonrpc":"2.0","id":1,"method":"getSlot"},{"jsonrpc":"2.0","id":2,"method":"getHealth"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":1,"result":100},{"jsonrpc":"2.0","id":2,"result":"ok"}]`,
+			want:     `[{"jsonrpc":"2.0","id":1,"result":100},{"jsonrpc":"2.0","id":2,"result":"ok"}]`,
+		},
+		{
+			name:     "reordered",
+			batch:    `[{"jsonrpc":"2.0","id":1,"method":"a"},{"jsonrpc":"2.0","id":"two","method":"b"},{"jsonrpc":"2.0","id":3,"method":"c"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":3,"result":"c"},{"jsonrpc":"2.0","id":1,"result":"a"},{"jsonrpc":"2.0","id":"two","result":"b"}]`,
+			want:     `[{"jsonrpc":"2.0","id":1,"result":"a"},{"jsonrpc":"2.0","id":"two","result":"b"},{"jsonrpc":"2.0","id":3,"result":"c"}]`,
+		},
+		{
+			name:     "string and number ids differ",
+			batch:    `[{"jsonrpc":"2.0","id":1,"method":"a"},{"jsonrpc":"2.0","id":"1","method":"b"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":"1","result":"b"},{"jsonrpc":"2.0","id":1,"result":"a"}]`,
+			want:     `[{"jsonrpc":"2.0","id":1,"result":"a"},{"jsonrpc":"2.0","id":"1","result":"b"}]`,
+		},
+		{
+			name:     "missing",
+			batch:    `[{"jsonrpc":"2.0","id":1,"method":"a"},{"jsonrpc":"2.0","id":2,"method":"b"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":1,"result":"a"}]`,
+			want:     `[{"jsonrpc":"2.0","id":1,"result":"a"},{"jsonrpc":"2.0","id":2,"error":{"code":-32603,"message":"Upstream returned no response for this request"}}]`,
+		},
+		{
+			name:     "duplicate ids",
+			batch:    `[{"jsonrpc":"2.0","id":7,"method":"a"},{"jsonrpc":"2.0","id":7,"method":"b"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":7,"result":"a"},{"jsonrpc":"2.0","id":7,"result":"b"}]`,
+			want:     `[{"jsonrpc":"2.0","id":7,"result":"a"},{"jsonrpc":"2.0","id":7,"result":"b"}]`,
+		},
+		{
+			name:     "duplicate answer dropped",
+			batch:    `[{"jsonrpc":"2.0","id":1,"method":"a"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":1,"result":"a"},{"jsonrpc":"2.0","id":1,"result":"again"}]`,
+			want:     `[{"jsonrpc":"2.0","id":1,"result":"a"}]`,
+		},
+		{
+			name:     "unknown id dropped",
+			batch:    `[{"jsonrpc":"2.0","id":1,"method":"a"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":9,"result":"stray"},{"jsonrpc":"2.0","id":1,"result":"a"}]`,
+			want:     `[{"jsonrpc":"2.0","id":1,"result":"a"}]`,
+		},
+		{
+			name:     "whole batch error",
+			batch:    `[{"jsonrpc":"2.0","id":1,"method":"a"},{"jsonrpc":"2.0","id":2,"method":"b"}]`,
+			upstream: `{"jsonrpc":"2.0","id":null,"error":{"code":-32005,"message":"Too many requests"}}`,
+			want:     `[{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"Too many requests"}},{"jsonrpc":"2.0","id":2,"error":{"code":-32005,"message":"Too many requests"}}]`,
+		},
+		{
+			name:     "unparseable upstream",
+			batch:    `[{"jsonrpc":"2.0","id":1,"method":"a"}]`,
+			upstream: `<html>Bad Gateway</html>`,
+			want:     `[{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"Upstream returned no response for this request"}}]`,
+		},
+		{
+			name:     "cached entries keep their place",
+			batch:    `[{"jsonrpc":"2.0","id":1,"method":"a"},{"jsonrpc":"2.0","id":2,"method":"getSlot"},{"jsonrpc":"2.0","id":3,"method":"c"}]`,
+			cached:   map[int]string{1: `{"jsonrpc":"2.0","id":2,"result":100}`},
+			upstream: `[{"jsonrpc":"2.0","id":3,"result":"c"},{"jsonrpc":"2.0","id":1,"result":"a"}]`,
+			want:     `[{"jsonrpc":"2.0","id":1,"result":"a"},{"jsonrpc":"2.0","id":2,"result":100},{"jsonrpc":"2.0","id":3,"result":"c"}]`,
+		},
+		{
+			name:     "notifications get no entry",
+			batch:    `[{"jsonrpc":"2.0","method":"a"},{"jsonrpc":"2.0","id":2,"method":"b"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":2,"result":"b"}]`,
+			want:     `[{"jsonrpc":"2.0","id":2,"result":"b"}]`,
+		},
+		{
+			name:     "invalid item",
+			batch:    `[1,{"jsonrpc":"2.0","id":2,"method":"b"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":2,"result":"b"}]`,
+			want:     `[{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid Request"}},{"jsonrpc":"2.0","id":2,"result":"b"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, ok := parseBatchItems([]byte(tt.batch))
+			if !ok {
+				t.Fatalf("invalid batch %s", tt.batch)
+			}
+			entries := make([]json.RawMessage, len(items))
+			for i, entry := range tt.cached {
+				entries[i] = json.RawMessage(entry)
+			}
+			got, merged := mergeBatch(items, entries, []byte(tt.upstream))
+			if !sameJSON(t, got, []byte(tt.want)) {
+				t.Fatalf("got %s\nwant %s", got, tt.want)
+			}
+			for i, item := range items {
+				if item.expectsResponse() != (merged[i] != nil) {
+					t.Errorf("item %d: entry %s, expects a response: %t", i, merged[i], item.expectsResponse())
+				}
+			}
+		})
+	}
+}
+
+func TestMergeBatchOnlyNotifications(t *testing.T) {
+	items, _ := parseBatchItems([]byte(`[{"jsonrpc":"2.0","method":"a"},{"jsonrpc":"2.0","method":"b"}]`))
+	upstream := []byte(``)
+	got, merged := mergeBatch(items, make([]json.RawMessage, len(items)), upstream)
+	if string(got) != string(upstream) {
+		t.Fatalf("got %q, want the upstream body", got)
+	}
+	for i, entry := range merged {
+		if entry != nil {
+			t.Errorf("notification %d got entry %s", i, entry)
+		}
+	}
+}
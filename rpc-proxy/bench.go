@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func benchFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "url", Usage: "proxy `URL` to load", Value: "http://localhost:8899"},
+		&cli.StringFlag{Name: "method", Usage: "JSON-RPC method to call", Value: "getSlot"},
+		&cli.StringFlag{Name: "params", Usage: "params as a JSON array", Value: "[]"},
+		&cli.IntFlag{Name: "n", Usage: "total requests", Value: 1000},
+		&cli.IntFlag{Name: "c", Usage: "concurrent clients", Value: 10},
+		&cli.StringFlag{Name: "api-key", Usage: "sent as X-API-Key"},
+		&cli.DurationFlag{Name: "timeout", Usage: "per-request timeout", Value: 30 * time.Second},
+	}
+}
+
+// benchResult is the outcome of one bench request
+type benchResult struct {
+	latency time.Duration
+	status  int // 0 for transport errors
+	rpcErr  bool
+}
+
+// runBench sends -n requests from -c concurrent clients and prints the
+// throughput, outcome counts and latency percentiles
+func runBench(c *cli.Context) error {
+	var params []json.RawMessage
+	if err := json.Unmarshal([]byte(c.String("params")), &params); err != nil {
+		return cli.Exit("params must be a JSON array", 2)
+	}
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": c.String("method"), "params": params})
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+
+	total, clients := c.Int("n"), c.Int("c")
+	if total <= 0 || clients <= 0 {
+		return cli.Exit("-n and -c must be positive", 2)
+	}
+	if clients > total {
+		clients = total
+	}
+
+	url, apiKey := c.String("url"), c.String("api-key")
+	client := &http.Client{
+		Timeout:   c.Duration("timeout"),
+		Transport: &http.Transport{MaxIdleConnsPerHost: clients},
+	}
+
+	results := make([]benchResult, total)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= total {
+					return
+				}
+				results[i] = benchRequest(client, url, apiKey, body)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	statuses := make(map[int]int)
+	var rpcErrors int
+	latencies := make([]time.Duration, 0, total)
+	for _, r := range results {
+		statuses[r.status]++
+		if r.rpcErr {
+			rpcErrors++
+		}
+		if r.status == http.StatusOK {
+			latencies = append(latencies, r.latency)
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("%d requests to %s (%s) from %d clients in %s: %.1f req/s\n",
+		total, url, c.String("method"), clients, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		label := fmt.Sprintf("HTTP %d", code)
+		if code == 0 {
+			label = "transport error"
+		}
+		fmt.Printf("  %-16s %d\n", label, statuses[code])
+	}
+	if rpcErrors > 0 {
+		fmt.Printf("  %-16s %d\n", "JSON-RPC error", rpcErrors)
+	}
+
+	if len(latencies) > 0 {
+		fmt.Printf("Latency of 200 responses: min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+			latencies[0].Round(time.Microsecond),
+			percentile(latencies, 0.50).Round(time.Microsecond),
+			percentile(latencies, 0.90).Round(time.Microsecond),
+			percentile(latencies, 0.99).Round(time.Microsecond),
+			latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+	return nil
+}
+
+func benchRequest(client *http.Client, url, apiKey string, body []byte) benchResult {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return benchResult{}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return benchResult{latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+
+	var rpcResp JSONRPCResponse
+	data, err := io.ReadAll(resp.Body)
+	result := benchResult{latency: time.Since(start), status: resp.StatusCode}
+	if err != nil {
+		result.status = 0
+	} else if resp.StatusCode == http.StatusOK && (json.Unmarshal(data, &rpcResp) != nil || rpcResp.Error != nil) {
+		result.rpcErr = true
+	}
+	return result
+}
+
+// percentile returns the q-th percentile of sorted latencies
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(q*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
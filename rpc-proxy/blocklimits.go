@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Error codes of a node for blocks it no longer has and ranges it won't serve
+const (
+	errBlockCleanedUp = -32001
+	errInvalidParams  = -32602
+)
+
+// blockLimits reports whether max_block_depth or max_block_range apply to a
+// method, and how its params are laid out
+func blockLimits(method string) (ranged, limited, ok bool) {
+	switch method {
+	case "getBlock", "getConfirmedBlock":
+		return false, false, true
+	case "getBlocks", "getConfirmedBlocks":
+		return true, false, true
+	case "getBlocksWithLimit", "getConfirmedBlocksWithLimit":
+		return false, true, true
+	}
+	return false, false, false
+}
+
+// checkHistory refuses a request reaching further into the ledger than
+// this node serves
+func (p *RPCProxy) checkHistory(method string, params json.RawMessage) *JSONRPCError {
+	if rpcErr := p.checkBlockLimits(method, params); rpcErr != nil {
+		p.blockRefusals.Add(1)
+		return rpcErr
+	}
+	if rpcErr := p.checkLedger(method, params); rpcErr != nil {
+		return rpcErr
+	}
+	return p.signatures.check(method, params)
+}
+
+// checkBlockLimits refuses a block request that reaches further back than
+// max_block_depth or spans more than max_block_range slots, with the error
+// a node that has pruned those blocks would return, so clients fall back to
+// an archive endpoint instead of making the node dig through its ledger
+func (p *RPCProxy) checkBlockLimits(method string, params json.RawMessage) *JSONRPCError {
+	if p.config.MaxBlockDepth == 0 && p.config.MaxBlockRange == 0 {
+		return nil
+	}
+	ranged, limited, ok := blockLimits(method)
+	if !ok {
+		return nil
+	}
+	var args []json.RawMessage
+	var start uint64
+	if json.Unmarshal(params, &args) != nil || len(args) == 0 || json.Unmarshal(args[0], &start) != nil {
+		return nil // the node reports malformed params
+	}
+	tip := p.pool.tip()
+
+	if limit := p.config.MaxBlockRange; limit > 0 && (ranged || limited) {
+		var n uint64
+		hasN := len(args) > 1 && json.Unmarshal(args[1], &n) == nil
+		if ranged && !hasN && tip > 0 {
+			// getBlocks without an end slot runs to the tip
+			n, hasN = tip, true
+		}
+		if limited && hasN && n > limit {
+			return &JSONRPCError{Code: errInvalidParams, Message: fmt.Sprintf("Limit too large; max %d", limit)}
+		}
+		if ranged && hasN && n >= start && n-start+1 > limit {
+			return &JSONRPCError{Code: errInvalidParams, Message: fmt.Sprintf("Slot range too large; max %d", limit)}
+		}
+	}
+
+	if depth := p.config.MaxBlockDepth; depth > 0 && tip > depth && start < tip-depth {
+		return &JSONRPCError{
+			Code:    errBlockCleanedUp,
+			Message: fmt.Sprintf("Block %d cleaned up, does not exist on node. First available block: %d", start, tip-depth),
+		}
+	}
+	return nil
+}
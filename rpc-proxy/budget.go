@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// BudgetConfig is a provider plan allowance for an upstream, e.g. 10M
+// requests a month
+type BudgetConfig struct {
+	Requests      int64              `json:"requests"`       // requests per period, 0 = unlimited
+	Credits       float64            `json:"credits"`        // credits per period, 0 = unlimited
+	MethodCredits map[string]float64 `json:"method_credits"` // credits per method, "*" for unlisted methods, default 1
+	Period        string             `json:"period"`         // "month" (default) or "day", in UTC
+	Threshold     float64            `json:"threshold"`      // fraction of the budget at which action applies, default 1
+	Action        string             `json:"action"`         // "fallback" (default) prefers other upstreams, "reject" stops routing here
+}
+
+// upstreamBudget tracks an upstream's consumption in the current period
+type upstreamBudget struct {
+	config BudgetConfig
+
+	mu       sync.Mutex
+	period   time.Time // start of the current period
+	requests int64
+	credits  float64
+	over     bool // past the threshold, logged once per period
+}
+
+// budgetState is the persisted consumption of an upstream
+type budgetState struct {
+	Period   time.Time `json:"period"`
+	Requests int64     `json:"requests"`
+	Credits  float64   `json:"credits"`
+}
+
+func newUpstreamBudget(config *BudgetConfig) (*upstreamBudget, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	c := *config
+	switch c.Period {
+	case "":
+		c.Period = "month"
+	case "month", "day":
+	default:
+		return nil, fmt.Errorf("unknown budget period %q (want month or day)", c.Period)
+	}
+	switch c.Action {
+	case "":
+		c.Action = "fallback"
+	case "fallback", "reject":
+	default:
+		return nil, fmt.Errorf("unknown budget action %q (want fallback or reject)", c.Action)
+	}
+	if c.Threshold <= 0 {
+		c.Threshold = 1
+	}
+
+	b := &upstreamBudget{config: c}
+	b.period = b.periodStart(time.Now())
+	return b, nil
+}
+
+// periodStart returns the start of the budget period containing t
+func (b *upstreamBudget) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	if b.config.Period == "day" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// rollover starts a new period when the current one has ended. Must be
+// called with b.mu held.
+func (b *upstreamBudget) rollover(now time.Time) {
+	if start := b.periodStart(now); start.After(b.period) {
+		b.period = start
+		b.requests = 0
+		b.credits = 0
+		b.over = false
+	}
+}
+
+// cost returns the credits a method consumes
+func (b *upstreamBudget) cost(method string) float64 {
+	if c, ok := b.config.MethodCredits[method]; ok {
+		return c
+	}
+	if c, ok := b.config.MethodCredits["*"]; ok {
+		return c
+	}
+	return 1
+}
+
+// consume records requests sent to the upstream, one per method for batches
+func (b *upstreamBudget) consume(name string, methods []string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rollover(time.Now())
+	b.requests += int64(len(methods))
+	for _, m := range methods {
+		b.credits += b.cost(m)
+	}
+
+	if !b.over && b.overThreshold() {
+		b.over = true
+		log.Printf("[BUDGET] %s: %.0f%% of %s budget used (%d requests, %.0f credits), action %s",
+			name, b.config.Threshold*100, b.config.Period, b.requests, b.credits, b.config.Action)
+	}
+}
+
+// overThreshold reports whether requests or credits have reached the
+// threshold. Must be called with b.mu held.
+func (b *upstreamBudget) overThreshold() bool {
+	if b.config.Requests > 0 && float64(b.requests) >= float64(b.config.Requests)*b.config.Threshold {
+		return true
+	}
+	return b.config.Credits > 0 && b.credits >= b.config.Credits*b.config.Threshold
+}
+
+// exhausted reports whether the upstream is past its budget threshold in the
+// current period
+func (b *upstreamBudget) exhausted() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(time.Now())
+	return b.overThreshold()
+}
+
+// used returns the fraction of the budget consumed, the larger of requests
+// and credits, and the current period
+func (b *upstreamBudget) used() (float64, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(time.Now())
+
+	var used float64
+	if b.config.Requests > 0 {
+		used = float64(b.requests) / float64(b.config.Requests)
+	}
+	if b.config.Credits > 0 {
+		used = max(used, b.credits/b.config.Credits)
+	}
+	return used, b.period.Format(time.RFC3339)
+}
+
+// state returns the consumption for persistence
+func (b *upstreamBudget) state() budgetState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return budgetState{Period: b.period, Requests: b.requests, Credits: b.credits}
+}
+
+// restore resumes consumption saved in the current period
+func (b *upstreamBudget) restore(s budgetState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.Period.Equal(b.period) {
+		b.requests += s.Requests
+		b.credits += s.Credits
+	}
+}
+
+// snapshot returns the consumption for /metrics
+func (b *upstreamBudget) snapshot() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(time.Now())
+
+	return map[string]interface{}{
+		"period":          b.config.Period,
+		"period_start":    b.period.Format(time.RFC3339),
+		"requests":        b.requests,
+		"requests_budget": b.config.Requests,
+		"credits":         b.credits,
+		"credits_budget":  b.config.Credits,
+		"exhausted":       b.overThreshold(),
+		"action":          b.config.Action,
+	}
+}
+
+// candidates returns the upstreams to try for the next request in order:
+// primaries within budget, then fallbacks within budget, then a supervised
+// node catching up, then upstreams past a "fallback" budget. Upstreams
+// serving the wrong cluster or past a "reject" budget are left out.
+func (p *upstreamPool) candidates() []*upstream {
+	var primary, fallback, catchingUp, overBudget []*upstream
+	for _, u := range p.order() {
+		if !u.routable(p.expectedGenesis) {
+			continue
+		}
+		if u.budget.exhausted() {
+			if u.budget.config.Action == "fallback" {
+				overBudget = append(overBudget, u)
+			}
+			continue
+		}
+		switch {
+		case u.fallback:
+			fallback = append(fallback, u)
+		case u.catchingUp.Load():
+			catchingUp = append(catchingUp, u)
+		default:
+			primary = append(primary, u)
+		}
+	}
+	return append(append(append(primary, fallback...), catchingUp...), overBudget...)
+}
+
+// budgetSnapshot returns the consumption of every upstream with a budget
+func (p *upstreamPool) budgetSnapshot() map[string]interface{} {
+	budgets := make(map[string]interface{})
+	for _, u := range p.upstreams {
+		if u.budget != nil {
+			budgets[u.name] = u.budget.snapshot()
+		}
+	}
+	return budgets
+}
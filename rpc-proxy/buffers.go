@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Buffer size classes. Buffers that grew beyond the largest class are left
+// to the garbage collector rather than pinned in a pool.
+var bufferClasses = []int{4 << 10, 64 << 10, 1 << 20, 16 << 20}
+
+var bufferPools = func() []*sync.Pool {
+	pools := make([]*sync.Pool, len(bufferClasses))
+	for i, size := range bufferClasses {
+		size := size
+		pools[i] = &sync.Pool{New: func() interface{} {
+			return bytes.NewBuffer(make([]byte, 0, size))
+		}}
+	}
+	return pools
+}()
+
+// getBuffer returns an empty pooled buffer large enough for sizeHint bytes
+// (the smallest class when the size is unknown)
+func getBuffer(sizeHint int64) *bytes.Buffer {
+	for i, size := range bufferClasses {
+		if sizeHint <= int64(size) {
+			return bufferPools[i].Get().(*bytes.Buffer)
+		}
+	}
+	return bufferPools[len(bufferPools)-1].Get().(*bytes.Buffer)
+}
+
+// putBuffer returns a buffer to the pool of the largest class it can hold.
+// The buffer's bytes must no longer be referenced.
+func putBuffer(buf *bytes.Buffer) {
+	c := buf.Cap()
+	for i := len(bufferClasses) - 1; i >= 0; i-- {
+		if c >= bufferClasses[i] {
+			if i == len(bufferClasses)-1 && c > 2*bufferClasses[i] {
+				return
+			}
+			buf.Reset()
+			bufferPools[i].Put(buf)
+			return
+		}
+	}
+}
+
+// readBuffered reads r into a pooled buffer sized for sizeHint
+func readBuffered(r io.Reader, sizeHint int64) (*bytes.Buffer, error) {
+	buf := getBuffer(sizeHint)
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// bufferBudget caps the bytes buffered by in-flight requests across the
+// process. Requests wait for budget to free up or are shed.
+type bufferBudget struct {
+	mu      sync.Mutex
+	max     int64
+	used    int64
+	release chan struct{} // closed and replaced whenever budget is freed
+}
+
+func newBufferBudget(max int64) *bufferBudget {
+	return &bufferBudget{max: max, release: make(chan struct{})}
+}
+
+// acquire reserves n bytes while no more than limit bytes would be in use,
+// waiting until they are available or ctx is done. A request larger than the
+// whole budget is admitted once nothing else is buffered so it can't wait
+// forever.
+func (b *bufferBudget) acquire(ctx context.Context, n, limit int64) error {
+	for {
+		b.mu.Lock()
+		if b.used+n <= limit || b.used == 0 {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		release := b.release
+		b.mu.Unlock()
+
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryAcquire reserves n bytes if no more than limit bytes would be in use
+func (b *bufferBudget) tryAcquire(n, limit int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n <= limit || b.used == 0 {
+		b.used += n
+		return true
+	}
+	return false
+}
+
+// add reserves n bytes that have already been buffered, even past the cap,
+// so new requests wait until they are released
+func (b *bufferBudget) add(n int64) {
+	b.mu.Lock()
+	b.used += n
+	b.mu.Unlock()
+}
+
+// free releases n bytes and wakes waiting requests
+func (b *bufferBudget) free(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	close(b.release)
+	b.release = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// buffered returns the bytes currently reserved
+func (b *bufferBudget) buffered() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// reserveBuffer reserves n bytes of the buffer budget for the request, waiting
+// up to max_wait_time in wait mode. It returns false after writing a busy
+// error when the budget stays exhausted. With priorities configured, lower
+// priority requests may only fill part of the budget so they are shed first.
+func (p *RPCProxy) reserveBuffer(w http.ResponseWriter, r *http.Request, n int64, logIP string, prio priority) bool {
+	limit := p.buffers.max
+	if p.priorities != nil {
+		limit = int64(float64(limit) * prio.budgetShare())
+	}
+
+	if p.config.WaitForSlot {
+		ctx := r.Context()
+		if p.config.MaxWaitTime.Duration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.config.MaxWaitTime.Duration)
+			defer cancel()
+		}
+		if p.buffers.acquire(ctx, n, limit) == nil {
+			return true
+		}
+	} else if p.buffers.tryAcquire(n, limit) {
+		return true
+	}
+
+	p.metrics.RateLimited.Add(1)
+
+	if p.config.LogRequests {
+		log.Printf("[RATE] IP: %s shed, buffer budget of %d bytes exhausted for %s priority", logIP, limit, prio)
+	}
+
+	w.Header().Set("Retry-After", "1")
+	p.writeRPCError(w, nil, -32005, "Server busy. Please retry after 1 seconds.", http.StatusServiceUnavailable)
+	return false
+}
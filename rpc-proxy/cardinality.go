@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// labelTrackFactor is how many more distinct values a labelCounter tracks
+// than it reports, so the reported top values stay accurate while junk
+// values come and go
+const labelTrackFactor = 10
+
+// labelCounter counts requests per value of a metrics label, such as the
+// method or the API key, and reports only the busiest values so the metrics
+// endpoint stays small on a proxy serving thousands of keys
+type labelCounter struct {
+	limit int // values reported, the rest are summed as "other"
+
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// newLabelCounter reports the top limit values, 0 = the default of 200
+func newLabelCounter(limit int) *labelCounter {
+	if limit <= 0 {
+		limit = 200
+	}
+	return &labelCounter{limit: limit, counts: make(map[string]int64)}
+}
+
+// add counts n requests for a value. Values beyond the tracked ones go
+// straight to "other".
+func (c *labelCounter) add(value string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.counts[value]; !ok && len(c.counts) >= c.limit*labelTrackFactor {
+		value = "other"
+	}
+	c.counts[value] += n
+}
+
+// top returns the counts of the busiest values, with the rest summed as
+// "other"
+func (c *labelCounter) top() map[string]int64 {
+	c.mu.Lock()
+	values := make([]string, 0, len(c.counts))
+	counts := make(map[string]int64, len(c.counts))
+	for value, n := range c.counts {
+		values = append(values, value)
+		counts[value] = n
+	}
+	c.mu.Unlock()
+
+	if len(values) <= c.limit {
+		return counts
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	top := make(map[string]int64, c.limit+1)
+	for i, value := range values {
+		if i < c.limit && value != "other" {
+			top[value] = counts[value]
+		} else {
+			top["other"] += counts[value]
+		}
+	}
+	return top
+}
+
+// reset forgets every count
+func (c *labelCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = make(map[string]int64)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// catchupWindow is the stretch of samples the catch-up rate is
+	// measured over
+	catchupWindow = time.Minute
+	// maxCatchupSamples bounds the samples kept at short intervals
+	maxCatchupSamples = 600
+)
+
+// catchupSample is the node's and the cluster's slot at one check
+type catchupSample struct {
+	at          time.Time
+	nodeSlot    uint64
+	clusterSlot uint64
+}
+
+// recordSample keeps a check's slots for the catch-up rate, with s.mu held
+func (s *supervisor) recordSample(sample catchupSample) {
+	s.samples = append(s.samples, sample)
+	// Drop the samples older than the window, keeping one to measure from
+	drop := 0
+	for drop < len(s.samples)-2 && sample.at.Sub(s.samples[drop+1].at) >= catchupWindow {
+		drop++
+	}
+	if n := len(s.samples) - maxCatchupSamples; n > drop {
+		drop = n
+	}
+	s.samples = s.samples[drop:]
+}
+
+// catchup reports the node's progress the way solana catchup does: how far
+// behind it is, how fast it is gaining on the cluster over the last minute,
+// and when it will have caught up at that rate
+func (s *supervisor) catchup() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := map[string]interface{}{
+		"upstream":  s.node.name,
+		"state":     s.state,
+		"caught_up": s.state == nodeHealthy,
+	}
+	if s.lastErr != "" {
+		report["error"] = s.lastErr
+	}
+	if len(s.samples) == 0 {
+		return report
+	}
+	last := s.samples[len(s.samples)-1]
+	lag := int64(last.clusterSlot) - int64(last.nodeSlot)
+	report["node_slot"] = last.nodeSlot
+	report["cluster_slot"] = last.clusterSlot
+	report["lag"] = max(lag, 0)
+	report["sampled_at"] = last.at.UTC()
+	if len(s.samples) < 2 {
+		return report
+	}
+
+	first := s.samples[0]
+	elapsed := last.at.Sub(first.at).Seconds()
+	nodeRate := float64(int64(last.nodeSlot)-int64(first.nodeSlot)) / elapsed
+	clusterRate := float64(int64(last.clusterSlot)-int64(first.clusterSlot)) / elapsed
+	gaining := nodeRate - clusterRate
+	report["node_slots_per_second"] = roundRate(nodeRate)
+	report["cluster_slots_per_second"] = roundRate(clusterRate)
+	report["catchup_slots_per_second"] = roundRate(gaining)
+	report["window_seconds"] = math.Round(elapsed)
+	if lag > 0 && gaining > 0 {
+		eta := time.Duration(float64(lag) / gaining * float64(time.Second)).Round(time.Second)
+		report["eta_seconds"] = eta.Seconds()
+		report["eta"] = eta.String()
+	}
+	return report
+}
+
+func roundRate(r float64) float64 {
+	return math.Round(r*10) / 10
+}
+
+// catchupText renders a report as the line solana catchup prints
+func catchupText(report map[string]interface{}) string {
+	if _, ok := report["node_slot"]; !ok {
+		return fmt.Sprintf("%s: %s, no slots sampled yet\n", report["upstream"], report["state"])
+	}
+	if report["lag"].(int64) == 0 {
+		return fmt.Sprintf("%s has caught up (us:%d them:%d)\n", report["upstream"], report["node_slot"], report["cluster_slot"])
+	}
+	line := fmt.Sprintf("%s is %d slot(s) behind (us:%d them:%d)", report["upstream"], report["lag"], report["node_slot"], report["cluster_slot"])
+	if gaining, ok := report["catchup_slots_per_second"].(float64); ok {
+		switch {
+		case gaining > 0:
+			line += fmt.Sprintf(", gaining at %.1f slots/second", gaining)
+		case gaining < 0:
+			line += fmt.Sprintf(", falling behind at %.1f slots/second", -gaining)
+		default:
+			line += ", not gaining"
+		}
+	}
+	if eta, ok := report["eta"]; ok {
+		line += fmt.Sprintf(" (ETA: %s)", eta)
+	}
+	return line + "\n"
+}
+
+// handleCatchup serves /catchup: the supervised node's catch-up progress as
+// JSON, or with ?format=text as one line to watch
+func (p *RPCProxy) handleCatchup(w http.ResponseWriter, r *http.Request) {
+	report := p.supervisor.catchup()
+	report["tenant"] = p.name
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, catchupText(report))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// newApp builds the command line: serve (the default), check-config, bench,
+// health, keys, analyze and version. Flags use the standard library syntax,
+// so the single-dash flags from before subcommands (-config, -health-check,
+// -version) keep working without a command.
+func newApp() *cli.App {
+	return &cli.App{
+		Name:  "rpc-proxy",
+		Usage: "Rate-limited Solana JSON-RPC proxy",
+		Flags: append(serveFlags(),
+			// Flags from before subcommands, kept for existing Docker
+			// healthchecks and scripts
+			&cli.BoolFlag{Name: "health-check", Usage: "run the health check and exit (same as the health command)", Hidden: true},
+			&cli.BoolFlag{Name: "version", Usage: "show version and exit (same as the version command)", Hidden: true},
+			&cli.BoolFlag{Name: "health-check-rpc", EnvVars: []string{"RPC_HEALTHCHECK_RPC"}, Hidden: true},
+			&cli.StringFlag{Name: "health-check-reference", EnvVars: []string{"RPC_HEALTHCHECK_REFERENCE_URL"}, Hidden: true},
+			&cli.Uint64Flag{Name: "health-check-max-lag", Value: 150, EnvVars: []string{"RPC_HEALTHCHECK_MAX_LAG"}, Hidden: true},
+		),
+		Action: func(c *cli.Context) error {
+			if c.NArg() > 0 {
+				return cli.Exit(fmt.Sprintf("unknown command %q, see rpc-proxy help", c.Args().First()), 2)
+			}
+			switch {
+			case c.Bool("health-check"):
+				return runHealthCheck(c.Bool("health-check-rpc"), c.String("health-check-reference"), c.Uint64("health-check-max-lag"))
+			case c.Bool("version"):
+				printVersion()
+				return nil
+			}
+			return serve(c)
+		},
+		Commands: []*cli.Command{
+			{
+				Name:   "serve",
+				Usage:  "run the proxy (the default without a command)",
+				Flags:  serveFlags(),
+				Action: serve,
+			},
+			{
+				Name:  "check-config",
+				Usage: "validate the configuration and exit",
+				Flags: append(serveFlags(),
+					&cli.BoolFlag{Name: "self-test", Usage: "also check that every pool has a reachable upstream"},
+				),
+				Action: checkConfig,
+			},
+			{
+				Name:      "bench",
+				Usage:     "send load through a proxy and report latency",
+				ArgsUsage: " ",
+				Flags:     benchFlags(),
+				Action:    runBench,
+			},
+			{
+				Name:  "health",
+				Usage: "check a running proxy and exit non-zero if unhealthy",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "rpc", Usage: "also send getSlot through the proxy", EnvVars: []string{"RPC_HEALTHCHECK_RPC"}},
+					&cli.StringFlag{Name: "reference", Usage: "fail when the proxied slot lags this RPC `URL`", EnvVars: []string{"RPC_HEALTHCHECK_REFERENCE_URL"}},
+					&cli.Uint64Flag{Name: "max-lag", Usage: "slots the proxied chain may lag the reference", Value: 150, EnvVars: []string{"RPC_HEALTHCHECK_MAX_LAG"}},
+				},
+				Action: func(c *cli.Context) error {
+					return runHealthCheck(c.Bool("rpc"), c.String("reference"), c.Uint64("max-lag"))
+				},
+			},
+			keysCommand(),
+			analyzeCommand(),
+			{
+				Name:  "version",
+				Usage: "show version",
+				Action: func(c *cli.Context) error {
+					printVersion()
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// serveFlags are the config overrides accepted by serve and check-config
+func serveFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "config", Usage: "path to config `file` (JSON)"},
+		&cli.StringFlag{Name: "profile", Usage: "apply the config file's profile `name`, e.g. prod", EnvVars: []string{"RPC_PROFILE"}},
+		&cli.StringFlag{Name: "listen", Usage: "listen address (overrides config)", EnvVars: []string{"RPC_LISTEN_ADDR"}},
+		&cli.StringFlag{Name: "upstream", Usage: "upstream RPC `URL` (overrides config)", EnvVars: []string{"RPC_UPSTREAM_URL"}},
+		&cli.StringFlag{Name: "upstream-file", Usage: "read the upstream RPC URL from `file`, e.g. a Docker secret (overrides config)", EnvVars: []string{"RPC_UPSTREAM_URL_FILE"}},
+		&cli.StringFlag{Name: "mode", Usage: "rate limit mode: global, per_ip, none (overrides config)", EnvVars: []string{"RPC_RATE_MODE"}},
+		&cli.Float64Flag{Name: "rate", Usage: "global rate limit (requests/second)"},
+		&cli.IntFlag{Name: "burst", Usage: "global burst size"},
+		&cli.Float64Flag{Name: "ip-rate", Usage: "per-IP rate limit (requests/second)"},
+		&cli.IntFlag{Name: "ip-burst", Usage: "per-IP burst size"},
+		&cli.BoolFlag{Name: "wait", Usage: "wait for slot instead of rejecting (overrides config)"},
+		&cli.BoolFlag{Name: "no-wait", Usage: "reject immediately when rate limited"},
+		&cli.BoolFlag{Name: "require-upstream", Usage: "refuse to start unless the upstream self-test passes (overrides config)"},
+		&cli.BoolFlag{Name: "no-persist-metrics", Usage: "don't restore or snapshot metrics_state_file"},
+	}
+}
+
+// configFromFlags loads the config file and applies command line and
+// environment overrides
+func configFromFlags(c *cli.Context) (*Config, error) {
+	config, err := loadConfig(c.String("config"), c.String("profile"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if v := c.String("listen"); v != "" {
+		config.ListenAddr = v
+	}
+
+	// An upstream given on the command line wins over the other one's
+	// environment variable
+	upstream, upstreamFile := c.String("upstream"), c.String("upstream-file")
+	fromFlag, fileFromFlag := onCommandLine(c, "upstream", "RPC_UPSTREAM_URL"), onCommandLine(c, "upstream-file", "RPC_UPSTREAM_URL_FILE")
+	if fromFlag && !fileFromFlag {
+		upstreamFile = ""
+	} else if fileFromFlag && !fromFlag {
+		upstream = ""
+	}
+	if upstream != "" {
+		config.UpstreamURL = upstream
+	}
+	if v := upstreamFile; v != "" {
+		if upstream != "" {
+			config.secrets.cleanup()
+			return nil, fmt.Errorf("set either --upstream or --upstream-file, not both")
+		}
+		b, err := os.ReadFile(v)
+		if err != nil {
+			config.secrets.cleanup()
+			return nil, fmt.Errorf("failed to read upstream URL: %w", err)
+		}
+		config.UpstreamURL = strings.TrimSpace(string(b))
+	}
+	if v := c.String("mode"); v != "" {
+		config.RateLimitMode = v
+	}
+	if v := c.Float64("rate"); v > 0 {
+		config.GlobalRateLimit = v
+	}
+	if v := c.Int("burst"); v > 0 {
+		config.GlobalBurstSize = v
+	}
+	if v := c.Float64("ip-rate"); v > 0 {
+		config.PerIPRateLimit = v
+	}
+	if v := c.Int("ip-burst"); v > 0 {
+		config.PerIPBurstSize = v
+	}
+	if c.Bool("wait") {
+		config.WaitForSlot = true
+	}
+	if c.Bool("no-wait") {
+		config.WaitForSlot = false
+	}
+	if c.Bool("require-upstream") {
+		config.RequireUpstream = true
+	}
+	return config, nil
+}
+
+// onCommandLine reports whether a flag was given on the command line rather
+// than through its environment variable
+func onCommandLine(c *cli.Context, name, env string) bool {
+	return c.IsSet(name) && c.String(name) != os.Getenv(env)
+}
+
+// checkConfig validates the configuration the way serve would load it,
+// without opening listeners
+func checkConfig(c *cli.Context) error {
+	config, err := configFromFlags(c)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	defer config.secrets.cleanup()
+	router, err := NewRouter(config)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Invalid config: %v", err), 1)
+	}
+
+	if c.Bool("self-test") {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := router.selfTest(ctx); err != nil {
+			return cli.Exit(fmt.Sprintf("Upstream self-test failed: %v", err), 1)
+		}
+	}
+
+	upstreams := 0
+	for _, p := range router.proxies() {
+		upstreams += len(p.pool.upstreams)
+	}
+	fmt.Printf("Config OK: %d listeners, %d tenants, %d vhosts, %d upstreams\n",
+		len(config.listenerConfigs()), len(config.Tenants), len(config.VHosts), upstreams)
+	return nil
+}
+
+// runHealthCheck checks the proxy on RPC_LISTEN_ADDR (default :8899)
+func runHealthCheck(rpc bool, reference string, maxLag uint64) error {
+	addr := os.Getenv("RPC_LISTEN_ADDR")
+	if addr == "" {
+		addr = ":8899"
+	}
+
+	result, err := newHealthCheck(addr, rpc, reference, maxLag).run()
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Health check failed: %v", err), 1)
+	}
+	fmt.Println(result)
+	return nil
+}
+
+func printVersion() {
+	fmt.Printf("solana-rpc-proxy version %s\n", Version)
+}
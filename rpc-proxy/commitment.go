@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// CommitmentPolicy rewrites the commitment of a method's requests
+type CommitmentPolicy struct {
+	Force   string `json:"force"`   // always use this commitment
+	Default string `json:"default"` // used when the request has none, instead of the node's default (finalized)
+	Min     string `json:"min"`     // raise lower commitments, e.g. "confirmed" to refuse processed reads
+	Max     string `json:"max"`     // lower higher commitments, e.g. "confirmed" to spare clients the finalized lag
+}
+
+// commitmentNames are the canonical commitment names by level
+var commitmentNames = [...]string{commitmentProcessed: "processed", commitmentConfirmed: "confirmed", commitmentFinalized: "finalized"}
+
+// commitmentPolicies applies commitment_policies to requests
+type commitmentPolicies struct {
+	policies map[string]CommitmentPolicy
+
+	rewritten atomic.Int64 // requests whose commitment was changed
+}
+
+// newCommitmentPolicies validates commitment_policies, returning nil when
+// there are none
+func newCommitmentPolicies(policies map[string]CommitmentPolicy) (*commitmentPolicies, error) {
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	for method, policy := range policies {
+		for _, name := range []string{policy.Force, policy.Default, policy.Min, policy.Max} {
+			if name != "" && !validCommitment(name) {
+				return nil, fmt.Errorf("commitment_policies: %s: unknown commitment %q (want processed, confirmed or finalized)", method, name)
+			}
+		}
+		if policy.Min != "" && policy.Max != "" && parseCommitment(policy.Min) > parseCommitment(policy.Max) {
+			return nil, fmt.Errorf("commitment_policies: %s: min %s is above max %s", method, policy.Min, policy.Max)
+		}
+	}
+	return &commitmentPolicies{policies: policies}, nil
+}
+
+// validCommitment reports whether name is a commitment, including the
+// deprecated names
+func validCommitment(name string) bool {
+	switch name {
+	case "processed", "confirmed", "finalized", "recent", "single", "singleGossip", "root", "max":
+		return true
+	}
+	return false
+}
+
+// rewrite applies the policies to every request of a single or batch body
+func (c *commitmentPolicies) rewrite(body []byte, isBatch bool) []byte {
+	if c == nil {
+		return body
+	}
+	return rewriteCalls(body, isBatch, func(i int, call *rpcCall) bool {
+		policy, ok := c.policies[call.method]
+		if !ok {
+			if policy, ok = c.policies["*"]; !ok {
+				return false
+			}
+		}
+		config, ok := call.config()
+		if !ok {
+			return false
+		}
+		var current string
+		json.Unmarshal(config["commitment"], &current)
+
+		commitment := policy.apply(current)
+		if commitment == current {
+			return false
+		}
+		config["commitment"], _ = json.Marshal(commitment)
+		if !call.setConfig(config) {
+			return false
+		}
+		c.rewritten.Add(1)
+		return true
+	})
+}
+
+// apply returns the commitment a request with current ("" = none) is sent
+// with
+func (policy CommitmentPolicy) apply(current string) string {
+	if policy.Force != "" {
+		return policy.Force
+	}
+	commitment := current
+	if commitment == "" {
+		commitment = policy.Default
+	}
+	level := parseCommitment(commitment)
+	if policy.Min != "" && level < parseCommitment(policy.Min) {
+		return commitmentNames[parseCommitment(policy.Min)]
+	}
+	if policy.Max != "" && level > parseCommitment(policy.Max) {
+		return commitmentNames[parseCommitment(policy.Max)]
+	}
+	return commitment
+}
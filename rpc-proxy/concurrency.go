@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyCap bounds the requests in flight to one upstream, whatever the
+// client limits allow, for nodes whose RPC thread pool collapses under too
+// many parallel requests. Requests over the cap queue for a free slot.
+type concurrencyCap struct {
+	slots chan struct{}
+
+	queued        atomic.Int64 // requests waiting for a slot
+	queueTimeouts atomic.Int64 // requests that gave up waiting
+}
+
+// newConcurrencyCap returns nil for an unlimited upstream
+func newConcurrencyCap(limit int) *concurrencyCap {
+	if limit <= 0 {
+		return nil
+	}
+	return &concurrencyCap{slots: make(chan struct{}, limit)}
+}
+
+// acquire waits for a slot until the request is cancelled or, if timeout is
+// positive, for at most timeout
+func (c *concurrencyCap) acquire(ctx context.Context, timeout time.Duration) error {
+	if c == nil {
+		return nil
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	c.queued.Add(1)
+	defer c.queued.Add(-1)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-expired:
+		c.queueTimeouts.Add(1)
+		return fmt.Errorf("no free slot within %v (max_concurrency %d)", timeout, cap(c.slots))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// resetCounters zeroes the queue timeout count
+func (c *concurrencyCap) resetCounters() {
+	if c == nil {
+		return
+	}
+	c.queueTimeouts.Store(0)
+}
+
+func (c *concurrencyCap) release() {
+	if c != nil {
+		<-c.slots
+	}
+}
+
+// hold keeps the slot until the response body is closed
+func (c *concurrencyCap) hold(body io.ReadCloser) io.ReadCloser {
+	if c == nil {
+		return body
+	}
+	return &slotBody{ReadCloser: body, slot: c}
+}
+
+func (c *concurrencyCap) snapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"limit":          cap(c.slots),
+		"in_use":         len(c.slots),
+		"queued":         c.queued.Load(),
+		"queue_timeouts": c.queueTimeouts.Load(),
+	}
+}
+
+// slotBody releases its concurrency slot when closed
+type slotBody struct {
+	io.ReadCloser
+	slot *concurrencyCap
+	once sync.Once
+}
+
+func (b *slotBody) Close() error {
+	b.once.Do(b.slot.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// redactedConfigValue replaces secret values in /admin/config
+	redactedConfigValue = "<redacted>"
+	// redactedURLPart replaces credentials within URLs
+	redactedURLPart = "REDACTED"
+	// minURLTokenLength is the shortest URL path segment taken for an API
+	// key, as providers put them in paths like /v2/<key>
+	minURLTokenLength = 16
+)
+
+// configSecretKeys are config keys holding credentials that sensitiveKey
+// doesn't recognize by name
+var configSecretKeys = map[string]bool{
+	"admin_token":    true,
+	"ip_hash_salt":   true,
+	"key":            true,
+	"upstream_token": true,
+	"exempt_keys":    true,
+	"trace_token":    true,
+}
+
+// redactConfig replaces the secrets in a decoded config: credential fields
+// entirely, and the credentials, query values and key-like path segments of
+// URLs, so the hosts stay visible
+func redactConfig(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = redactConfig(k, child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactConfig(key, child)
+		}
+	case string:
+		switch {
+		case v == "" || strings.HasSuffix(key, "_file"):
+		case configSecretKeys[key] || sensitiveKey(key):
+			return redactedConfigValue
+		case strings.Contains(v, "://"):
+			return redactConfigURL(v)
+		}
+	}
+	return value
+}
+
+// redactConfigURL hides the credentials in a URL
+func redactConfigURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return redactedConfigValue
+	}
+	if u.User != nil {
+		u.User = url.User(redactedURLPart)
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		if len(segment) >= minURLTokenLength {
+			segments[i] = redactedURLPart
+		}
+	}
+	u.Path, u.RawPath = strings.Join(segments, "/"), ""
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			query[name] = []string{redactedURLPart}
+		}
+		u.RawQuery = query.Encode()
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// handleConfig serves /admin/config: the configuration the proxy named by
+// ?proxy= (default "default") runs with, after file, profile, environment
+// and command line layering, with secrets redacted
+func (rt *Router) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	proxy := rt.adminProxy(w, r)
+	if proxy == nil {
+		return
+	}
+
+	data, err := json.Marshal(proxy.config)
+	if err != nil {
+		http.Error(w, "Failed to encode config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var config map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&config); err != nil {
+		http.Error(w, "Failed to encode config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{
+		"proxy":  proxy.name,
+		"config": redactConfig("", config),
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxIncludeDepth bounds nested includes
+const maxIncludeDepth = 10
+
+// readConfigDocument reads a config file with its includes merged in and the
+// named profile applied. "include" lists files, relative to the including
+// file, merged in order beneath the file's own settings; "profiles" maps
+// names to settings merged over everything else when selected. Objects are
+// merged key by key, while arrays and other values replace what was there.
+func readConfigDocument(path, profile string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if profile == "" && !bytes.Contains(data, []byte(`"include"`)) && !bytes.Contains(data, []byte(`"profiles"`)) {
+		return data, nil
+	}
+
+	doc, err := readConfigIncludes(path, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	profiles, _ := doc["profiles"].(map[string]interface{})
+	delete(doc, "profiles")
+	if profile != "" {
+		settings, ok := profiles[profile].(map[string]interface{})
+		if !ok {
+			names := make([]string, 0, len(profiles))
+			for name := range profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if len(names) == 0 {
+				return nil, fmt.Errorf("profile %q: the config defines no profiles", profile)
+			}
+			return nil, fmt.Errorf("unknown profile %q (have %s)", profile, strings.Join(names, ", "))
+		}
+		mergeConfigObjects(doc, settings)
+	}
+	return json.Marshal(doc)
+}
+
+// readConfigIncludes decodes a config file and merges its includes beneath
+// it. seen holds the files being read, to refuse include cycles.
+func readConfigIncludes(path string, data []byte, seen []string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range seen {
+		if s == abs {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(seen, abs), " -> "))
+		}
+	}
+	if len(seen) == maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes nested more than %d deep", path, maxIncludeDepth)
+	}
+	seen = append(seen, abs)
+
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var includes []string
+	if raw, ok := doc["include"]; ok {
+		b, _ := json.Marshal(raw)
+		if json.Unmarshal(b, &includes) != nil {
+			return nil, fmt.Errorf("%s: include must be a list of files", path)
+		}
+		delete(doc, "include")
+	}
+
+	merged := make(map[string]interface{})
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		data, err := os.ReadFile(include)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include: %w", path, err)
+		}
+		included, err := readConfigIncludes(include, data, seen)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfigObjects(merged, included)
+	}
+	mergeConfigObjects(merged, doc)
+	return merged, nil
+}
+
+// mergeConfigObjects merges src into dst, recursing into objects present in
+// both
+func mergeConfigObjects(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if obj, ok := value.(map[string]interface{}); ok {
+			if existing, ok := dst[key].(map[string]interface{}); ok {
+				mergeConfigObjects(existing, obj)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Defaults sent when no CORS policy overrides them
+const (
+	corsDefaultMethods = "GET, POST, OPTIONS"
+	corsDefaultHeaders = "Content-Type, Authorization, Solana-Client, X-Idempotency-Key, X-Omit-Fields, X-Captcha-Token"
+)
+
+// CORSPolicy overrides the allowed methods and headers for matching origins
+type CORSPolicy struct {
+	Origins []string `json:"origins"` // exact origins or patterns like "https://*.example.com"
+	Methods []string `json:"methods"` // empty = default
+	Headers []string `json:"headers"` // empty = default
+}
+
+// originPattern is a parsed allowed origin. "*" matches any origin,
+// "*.example.com" any subdomain of example.com (not example.com itself) with
+// any scheme, and "https://*.example.com" only over https.
+type originPattern struct {
+	any      bool
+	scheme   string // empty = any
+	host     string // exact host, or the suffix after "*" for wildcards
+	port     string // empty = any
+	wildcard bool
+}
+
+func parseOriginPattern(s string) (originPattern, error) {
+	if s == "*" {
+		return originPattern{any: true}, nil
+	}
+
+	var o originPattern
+	rest := s
+	if i := strings.Index(rest, "://"); i >= 0 {
+		o.scheme = strings.ToLower(rest[:i])
+		rest = rest[i+3:]
+	}
+	if strings.HasPrefix(rest, "*.") {
+		o.wildcard = true
+		rest = rest[1:]
+	}
+	if strings.Contains(rest, "*") || strings.Contains(rest, "/") || rest == "" {
+		return o, fmt.Errorf("invalid origin pattern %q", s)
+	}
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.HasSuffix(rest, "]") {
+		o.port = rest[i+1:]
+		rest = rest[:i]
+	}
+	o.host = strings.ToLower(rest)
+	return o, nil
+}
+
+// match reports whether the parsed Origin header matches the pattern
+func (o originPattern) match(origin *url.URL) bool {
+	if o.any {
+		return true
+	}
+	if o.scheme != "" && o.scheme != strings.ToLower(origin.Scheme) {
+		return false
+	}
+	// A full origin like "https://app.example.com" matches exactly, other
+	// patterns allow any port unless they name one
+	exact := o.scheme != "" && !o.wildcard
+	if (o.port != "" || exact) && o.port != origin.Port() {
+		return false
+	}
+	host := strings.ToLower(origin.Hostname())
+	if o.wildcard {
+		return strings.HasSuffix(host, o.host) && len(host) > len(o.host)
+	}
+	return host == strings.Trim(o.host, "[]")
+}
+
+// corsRules are the compiled allowed_origins and cors_policies
+type corsRules struct {
+	origins  []originPattern
+	policies []corsPolicyRule
+	strict   bool
+}
+
+type corsPolicyRule struct {
+	origins []originPattern
+	methods string
+	headers string
+}
+
+func newCORSRules(config *Config) (*corsRules, error) {
+	c := &corsRules{strict: config.CORSStrict}
+	for _, s := range config.AllowedOrigins {
+		o, err := parseOriginPattern(s)
+		if err != nil {
+			return nil, fmt.Errorf("allowed_origins: %w", err)
+		}
+		c.origins = append(c.origins, o)
+	}
+
+	for i, policy := range config.CORSPolicies {
+		if len(policy.Origins) == 0 {
+			return nil, fmt.Errorf("cors_policies[%d]: no origins", i)
+		}
+		rule := corsPolicyRule{
+			methods: corsDefaultMethods,
+			headers: corsDefaultHeaders,
+		}
+		for _, s := range policy.Origins {
+			o, err := parseOriginPattern(s)
+			if err != nil {
+				return nil, fmt.Errorf("cors_policies[%d]: %w", i, err)
+			}
+			rule.origins = append(rule.origins, o)
+		}
+		if len(policy.Methods) > 0 {
+			rule.methods = strings.Join(policy.Methods, ", ")
+		}
+		if len(policy.Headers) > 0 {
+			rule.headers = strings.Join(policy.Headers, ", ")
+		}
+		c.policies = append(c.policies, rule)
+	}
+	return c, nil
+}
+
+// lookup returns whether the origin is allowed and the methods and headers
+// to allow it. Without allowed_origins or cors_policies every origin is
+// allowed.
+func (c *corsRules) lookup(origin string) (allowed bool, methods, headers string) {
+	methods, headers = corsDefaultMethods, corsDefaultHeaders
+	if len(c.origins) == 0 && len(c.policies) == 0 {
+		return true, methods, headers
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false, methods, headers
+	}
+
+	for _, rule := range c.policies {
+		for _, o := range rule.origins {
+			if o.match(u) {
+				return true, rule.methods, rule.headers
+			}
+		}
+	}
+	for _, o := range c.origins {
+		if o.match(u) {
+			return true, methods, headers
+		}
+	}
+	return false, methods, headers
+}
+
+// allowsMethod reports whether a preflight's requested method is in the
+// allowed list
+func allowsMethod(methods, method string) bool {
+	for _, m := range strings.Split(methods, ",") {
+		if strings.EqualFold(strings.TrimSpace(m), method) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeOriginError rejects a request from a disallowed origin in strict mode
+func writeOriginError(w http.ResponseWriter) {
+	http.Error(w, "Origin not allowed", http.StatusForbidden)
+}
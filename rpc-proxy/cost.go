@@ -0,0 +1,41 @@
+package main
+
+import "fmt"
+
+// validateMethodCosts checks method_costs. Every request takes a slot on
+// arrival, before its method is known, so no method can cost less than 1.
+func validateMethodCosts(costs map[string]int) error {
+	for method, cost := range costs {
+		if cost < 1 {
+			return fmt.Errorf("method_costs: %s has cost %d, the minimum is 1", method, cost)
+		}
+	}
+	return nil
+}
+
+// methodCost returns the rate limit slots a method takes, so that expensive
+// calls like getProgramAccounts use up a limit faster than getSlot
+func (p *RPCProxy) methodCost(method string) int {
+	if cost, ok := p.config.MethodCosts[method]; ok {
+		return cost
+	}
+	if cost, ok := p.config.MethodCosts["*"]; ok {
+		return cost
+	}
+	return 1
+}
+
+// requestCost returns the slots a request takes, the sum over a batch,
+// raised during warmup. It is capped at the limiter's burst, since a bigger
+// claim could never be granted.
+func (p *RPCProxy) requestCost(methods []string, limiter requestLimiter) int {
+	cost := 0
+	for _, m := range methods {
+		cost += p.methodCost(m)
+	}
+	cost = p.warmup.scale(cost)
+	if burst := limiter.Burst(); cost > burst {
+		cost = burst
+	}
+	return cost
+}
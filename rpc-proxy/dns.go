@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamResolver resolves upstream hostnames for new connections. It can
+// use its own DNS servers, pin hosts to fixed IPs, and cache addresses for a
+// TTL while re-resolving in the background, so a provider's DNS failover is
+// picked up without restarting even though keep-alive connections would
+// otherwise stay on the old address.
+type upstreamResolver struct {
+	resolver *net.Resolver
+	pinned   map[string][]string
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string][]string // host -> addresses, only with a TTL
+}
+
+// newUpstreamResolver returns nil when no DNS settings are configured, so
+// the transport keeps Go's default dialer
+func newUpstreamResolver(config *Config) (*upstreamResolver, error) {
+	if len(config.UpstreamDNSServers) == 0 && config.UpstreamDNSTTL.Duration <= 0 && len(config.UpstreamPinnedIPs) == 0 {
+		return nil, nil
+	}
+
+	r := &upstreamResolver{
+		resolver: net.DefaultResolver,
+		pinned:   make(map[string][]string),
+		ttl:      config.UpstreamDNSTTL.Duration,
+		cache:    make(map[string][]string),
+	}
+
+	if len(config.UpstreamDNSServers) > 0 {
+		servers := make([]string, len(config.UpstreamDNSServers))
+		for i, s := range config.UpstreamDNSServers {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				s = net.JoinHostPort(s, "53")
+			}
+			servers[i] = s
+		}
+		// Go retries a failed query by dialing again, so rotating through
+		// the servers fails over between them
+		var next atomic.Uint32
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				server := servers[int(next.Add(1)-1)%len(servers)]
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	for host, ips := range config.UpstreamPinnedIPs {
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("upstream_pinned_ips: no IPs for %s", host)
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("upstream_pinned_ips: invalid IP %q for %s", ip, host)
+			}
+		}
+		r.pinned[strings.ToLower(host)] = ips
+	}
+	return r, nil
+}
+
+// lookup returns the addresses to dial for a host
+func (r *upstreamResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(host)
+	if ips, ok := r.pinned[host]; ok {
+		return ips, nil
+	}
+	if r.ttl <= 0 {
+		return r.resolver.LookupHost(ctx, host)
+	}
+
+	r.mu.Lock()
+	addrs, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok {
+		return addrs, nil
+	}
+
+	addrs, err := r.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[host] = addrs
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// dialer returns a dial function that connects with d to the first
+// reachable address of the host
+func (r *upstreamResolver) dialer(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+
+		addrs, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error
+		for _, ip := range addrs {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// refresh re-resolves the cached hosts every TTL. When a host's addresses
+// change, onChange closes idle connections so the next requests reconnect
+// to the new addresses; requests in flight finish on the old ones.
+func (r *upstreamResolver) refresh(onChange func()) {
+	if r.ttl <= 0 {
+		return
+	}
+	for range time.Tick(r.ttl) {
+		r.mu.Lock()
+		hosts := make([]string, 0, len(r.cache))
+		for host := range r.cache {
+			hosts = append(hosts, host)
+		}
+		r.mu.Unlock()
+
+		changed := false
+		for _, host := range hosts {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			addrs, err := r.resolver.LookupHost(ctx, host)
+			cancel()
+			if err != nil {
+				// Keep dialing the last known addresses
+				log.Printf("[ERROR] Failed to re-resolve upstream %s, keeping previous addresses: %v", host, err)
+				continue
+			}
+
+			r.mu.Lock()
+			old := r.cache[host]
+			r.cache[host] = addrs
+			r.mu.Unlock()
+			if !sameAddrs(old, addrs) {
+				log.Printf("[DNS] Upstream %s now resolves to %s (was %s)", host, strings.Join(addrs, ", "), strings.Join(old, ", "))
+				changed = true
+			}
+		}
+		if changed {
+			onChange()
+		}
+	}
+}
+
+// sameAddrs compares address lists regardless of order
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// drainState tracks whether the proxy is draining for maintenance. It is
+// shared by every tenant and vhost.
+type drainState struct {
+	mu     sync.RWMutex
+	active bool
+	since  time.Time
+}
+
+// set enables or disables drain mode, returning false if nothing changed
+func (d *drainState) set(active bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.active == active {
+		return false
+	}
+	d.active = active
+	if active {
+		d.since = time.Now()
+		log.Println("Drain mode enabled, health checks now fail")
+	} else {
+		d.since = time.Time{}
+		log.Println("Drain mode disabled")
+	}
+	return true
+}
+
+// toggle flips drain mode
+func (d *drainState) toggle() {
+	d.mu.RLock()
+	active := d.active
+	d.mu.RUnlock()
+	d.set(!active)
+}
+
+// status returns whether drain mode is active and since when
+func (d *drainState) status() (bool, time.Time) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.active, d.since
+}
+
+// rejecting reports whether new requests should be refused: drain mode is
+// active and the grace period for load balancers to notice has passed
+func (d *drainState) rejecting(config *Config) bool {
+	if !config.DrainRejectRequests {
+		return false
+	}
+	active, since := d.status()
+	return active && time.Since(since) >= config.DrainGracePeriod.Duration
+}
+
+// writeDrainingError tells the client to retry elsewhere
+func (p *RPCProxy) writeDrainingError(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(p.config.DrainRetryAfter.Duration.Seconds())))
+	p.writeRPCError(w, nil, -32005, "Proxy is draining for maintenance, please retry", http.StatusServiceUnavailable)
+}
+
+// handleDrain serves /admin/drain: GET returns the state, POST enables drain
+// mode and DELETE disables it
+func (rt *Router) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		rt.drain.set(true)
+	case http.MethodDelete:
+		rt.drain.set(false)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	active, since := rt.drain.status()
+	resp := map[string]interface{}{
+		"draining": active,
+	}
+	if active {
+		resp["since"] = since.UTC()
+		resp["rejecting"] = rt.drain.rejecting(rt.defaultProxy.config)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
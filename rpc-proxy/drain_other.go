@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// watchDrainSignal is a no-op without SIGUSR1; use /admin/drain instead
+func watchDrainSignal(drain *drainState) {}
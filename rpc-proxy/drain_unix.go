@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchDrainSignal toggles drain mode on SIGUSR1
+func watchDrainSignal(drain *drainState) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+
+	for range sigChan {
+		drain.toggle()
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Binary response encodings clients can ask for with Accept
+const (
+	encodingCBOR    = "cbor"
+	encodingMsgpack = "msgpack"
+)
+
+// binaryEncoding returns the binary encoding an Accept header asks for, or
+// "" for JSON. The first supported type listed wins.
+func binaryEncoding(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/cbor":
+			return encodingCBOR
+		case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+			return encodingMsgpack
+		case "application/json", "*/*":
+			return ""
+		}
+	}
+	return ""
+}
+
+// binaryContentType returns the Content-Type of an encoding
+func binaryContentType(encoding string) string {
+	if encoding == encodingCBOR {
+		return "application/cbor"
+	}
+	return "application/msgpack"
+}
+
+// transcode converts a JSON document to CBOR or MessagePack. Integers keep
+// full 64-bit precision and map keys are sorted so the output is stable.
+func transcode(body []byte, encoding string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(body) / 2)
+	if encoding == encodingCBOR {
+		encodeCBOR(&buf, v)
+	} else {
+		encodeMsgpack(&buf, v)
+	}
+	return buf.Bytes(), nil
+}
+
+// parseNumber returns a JSON number as int64, uint64 or float64, in that
+// order of preference
+func parseNumber(n json.Number) interface{} {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return i
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return u
+	}
+	f, _ := strconv.ParseFloat(string(n), 64)
+	return f
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cborHead writes a CBOR major type with its argument
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeCBOR(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		switch n := parseNumber(v).(type) {
+		case int64:
+			if n >= 0 {
+				cborHead(buf, 0, uint64(n))
+			} else {
+				cborHead(buf, 1, uint64(-1-n))
+			}
+		case uint64:
+			cborHead(buf, 0, n)
+		case float64:
+			buf.WriteByte(0xfb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(n))
+		}
+	case string:
+		cborHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		cborHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			encodeCBOR(buf, item)
+		}
+	case map[string]interface{}:
+		cborHead(buf, 5, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			encodeCBOR(buf, k)
+			encodeCBOR(buf, v[k])
+		}
+	}
+}
+
+// msgpackHead writes a MessagePack length prefix for strings, arrays or
+// maps, using the fix format when n fits
+func msgpackHead(buf *bytes.Buffer, fix byte, fixMax int, code8, code16, code32 byte, n int) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		switch n := parseNumber(v).(type) {
+		case int64:
+			switch {
+			case n >= 0 && n < 128, n < 0 && n >= -32:
+				buf.WriteByte(byte(int8(n)))
+			case n >= 0:
+				encodeMsgpackUint(buf, uint64(n))
+			case n >= math.MinInt8:
+				buf.WriteByte(0xd0)
+				buf.WriteByte(byte(int8(n)))
+			case n >= math.MinInt16:
+				buf.WriteByte(0xd1)
+				binary.Write(buf, binary.BigEndian, int16(n))
+			case n >= math.MinInt32:
+				buf.WriteByte(0xd2)
+				binary.Write(buf, binary.BigEndian, int32(n))
+			default:
+				buf.WriteByte(0xd3)
+				binary.Write(buf, binary.BigEndian, n)
+			}
+		case uint64:
+			encodeMsgpackUint(buf, n)
+		case float64:
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(n))
+		}
+	case string:
+		msgpackHead(buf, 0xa0, 31, 0xd9, 0xda, 0xdb, len(v))
+		buf.WriteString(v)
+	case []interface{}:
+		msgpackHead(buf, 0x90, 15, 0, 0xdc, 0xdd, len(v))
+		for _, item := range v {
+			encodeMsgpack(buf, item)
+		}
+	case map[string]interface{}:
+		msgpackHead(buf, 0x80, 15, 0, 0xde, 0xdf, len(v))
+		for _, k := range sortedKeys(v) {
+			encodeMsgpack(buf, k)
+			encodeMsgpack(buf, v[k])
+		}
+	}
+}
+
+func encodeMsgpackUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n < 128:
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// transcodeCache keeps recently transcoded responses, so repeated large
+// responses (the same block fetched by many consumers) are converted once
+type transcodeCache struct {
+	maxBytes int64
+	hits     atomic.Int64
+	misses   atomic.Int64
+
+	mu    sync.Mutex
+	bytes int64
+	order *list.List // of *transcodeEntry, most recent first
+	index map[transcodeKey]*list.Element
+}
+
+type transcodeKey struct {
+	sum      [sha256.Size]byte
+	encoding string
+}
+
+type transcodeEntry struct {
+	key  transcodeKey
+	data []byte
+}
+
+// newTranscodeCache returns nil when caching is disabled
+func newTranscodeCache(maxBytes int64) *transcodeCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &transcodeCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		index:    make(map[transcodeKey]*list.Element),
+	}
+}
+
+// transcode returns the cached encoding of body, converting and caching it
+// on a miss
+func (c *transcodeCache) transcode(body []byte, encoding string) ([]byte, error) {
+	if c == nil {
+		return transcode(body, encoding)
+	}
+
+	key := transcodeKey{sum: sha256.Sum256(body), encoding: encoding}
+	c.mu.Lock()
+	if el, ok := c.index[key]; ok {
+		c.order.MoveToFront(el)
+		data := el.Value.(*transcodeEntry).data
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return data, nil
+	}
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	data, err := transcode(body, encoding)
+	if err != nil || int64(len(data)) > c.maxBytes/4 {
+		return data, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.index[key]; !ok {
+		c.index[key] = c.order.PushFront(&transcodeEntry{key: key, data: data})
+		c.bytes += int64(len(data))
+	}
+	for c.bytes > c.maxBytes {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*transcodeEntry)
+		c.order.Remove(oldest)
+		delete(c.index, entry.key)
+		c.bytes -= int64(len(entry.data))
+	}
+	return data, nil
+}
+
+// snapshot returns cache usage for /metrics
+func (c *transcodeCache) snapshot() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"hits":      c.hits.Load(),
+		"misses":    c.misses.Load(),
+		"entries":   c.order.Len(),
+		"bytes":     c.bytes,
+		"max_bytes": c.maxBytes,
+	}
+}
+
+// resetCounters zeroes the hit and miss counts for /admin/metrics/reset
+func (c *transcodeCache) resetCounters() {
+	if c == nil {
+		return
+	}
+	c.hits.Store(0)
+	c.misses.Store(0)
+}
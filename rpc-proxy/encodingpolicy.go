@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingBase64     = "base64"
+	encodingBase64Zstd = "base64+zstd"
+	// maxBase58Bytes is the largest account data a node encodes as base58
+	maxBase58Bytes = 128
+	// maxAccountDataBytes bounds decompressed account data
+	maxAccountDataBytes = 10 << 20
+	// errInvalidRequest is the node's error code for data too large for
+	// base58
+	errInvalidRequest = -32600
+)
+
+// encodingPaths are the places in each method's result holding encoded
+// account data or transactions, as dot paths stepped through arrays
+var encodingPaths = map[string][][]string{
+	"getAccountInfo":      {{"value", "data"}},
+	"getMultipleAccounts": {{"value", "data"}},
+	"getProgramAccounts":  {{"account", "data"}, {"value", "account", "data"}},
+	"getTransaction":      {{"transaction"}},
+	"getBlock":            {{"transactions", "transaction"}},
+}
+
+// encodingPolicy asks upstreams for account data as base64, or base64+zstd,
+// and for transactions as base64, whatever encoding the client asked for,
+// and converts the answers back. The upstream spends less CPU encoding, and
+// less bandwidth with zstd, while the proxy does the conversion. Requests
+// for jsonParsed are left alone, since only the node can parse them.
+type encodingPolicy struct {
+	accounts string
+	decoder  *zstd.Decoder
+
+	zstdRefused atomic.Bool  // an upstream refused base64+zstd, use base64
+	rewritten   atomic.Int64 // requests sent with the forced encoding
+}
+
+// forcedEncoding records how a request's encoding was rewritten
+type forcedEncoding struct {
+	method string
+	client string // encoding the client asked for, "" = the default
+	sent   string
+}
+
+// newEncodingPolicy returns nil when forced_encoding is empty
+func newEncodingPolicy(config *Config) (*encodingPolicy, error) {
+	switch config.ForcedEncoding {
+	case "":
+		return nil, nil
+	case encodingBase64, encodingBase64Zstd:
+	default:
+		return nil, fmt.Errorf("forced_encoding: unknown encoding %q (want base64 or base64+zstd)", config.ForcedEncoding)
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxAccountDataBytes))
+	if err != nil {
+		return nil, err
+	}
+	return &encodingPolicy{accounts: config.ForcedEncoding, decoder: decoder}, nil
+}
+
+// transactionMethod reports whether the method's result holds transactions
+// rather than account data
+func transactionMethod(method string) bool {
+	return method == "getTransaction" || method == "getBlock"
+}
+
+// rewrite sets the forced encoding in a request, returning the body to send
+// upstream and how it was rewritten, or nil when it is sent as it is
+func (e *encodingPolicy) rewrite(body []byte, method string) ([]byte, *forcedEncoding) {
+	if encodingPaths[method] == nil {
+		return body, nil
+	}
+	var forced *forcedEncoding
+	body = rewriteCalls(body, false, func(i int, call *rpcCall) bool {
+		config, ok := call.config()
+		if !ok {
+			return false
+		}
+		var client string
+		if raw, ok := config["encoding"]; ok && json.Unmarshal(raw, &client) != nil {
+			return false
+		}
+
+		sent := encodingBase64
+		if transactionMethod(method) {
+			// Blocks without full transaction details ignore the encoding
+			var details string
+			json.Unmarshal(config["transactionDetails"], &details)
+			if details != "" && details != "full" {
+				return false
+			}
+			switch client {
+			case "", "json", "base58":
+			default:
+				return false
+			}
+		} else {
+			// The default account encoding differs by method and node
+			// version, so only named ones are converted
+			if e.accounts == encodingBase64Zstd && !e.zstdRefused.Load() {
+				sent = encodingBase64Zstd
+			}
+			switch client {
+			case "binary", "base58", encodingBase64:
+			default:
+				return false
+			}
+		}
+		if client == sent {
+			return false
+		}
+
+		config["encoding"], _ = json.Marshal(sent)
+		if !call.setConfig(config) {
+			return false
+		}
+		forced = &forcedEncoding{method: method, client: client, sent: sent}
+		return true
+	})
+	if forced != nil {
+		e.rewritten.Add(1)
+	}
+	return body, forced
+}
+
+// restore converts a response to a rewritten request back to the encoding
+// the client asked for. Data the client's encoding can't carry gets the
+// error the node would have answered.
+func (e *encodingPolicy) restore(body []byte, forced *forcedEncoding) []byte {
+	var resp map[string]json.RawMessage
+	if json.Unmarshal(body, &resp) != nil {
+		return body
+	}
+	if resp["error"] != nil {
+		// Upstreams without zstd refuse the encoding by name
+		var rpcErr JSONRPCError
+		json.Unmarshal(resp["error"], &rpcErr)
+		if forced.sent == encodingBase64Zstd && strings.Contains(rpcErr.Message, "zstd") && e.zstdRefused.CompareAndSwap(false, true) {
+			log.Printf("[WARN] Upstream refused %s for %s, asking for %s from now on", encodingBase64Zstd, forced.method, encodingBase64)
+		}
+		return body
+	}
+	if resp["result"] == nil {
+		return body
+	}
+
+	convert := e.convertAccountData
+	if transactionMethod(forced.method) {
+		convert = convertTransaction
+	}
+	result := resp["result"]
+	for _, path := range encodingPaths[forced.method] {
+		out, _, err := mapPath(result, path, func(value json.RawMessage) (json.RawMessage, error) {
+			return convert(value, forced)
+		})
+		var tooLarge *base58TooLargeError
+		if errors.As(err, &tooLarge) {
+			return batchEntry(resp["id"], nil, &JSONRPCError{Code: errInvalidRequest, Message: tooLarge.Error()})
+		}
+		if err != nil {
+			return batchEntry(resp["id"], nil, &JSONRPCError{Code: -32603, Message: fmt.Sprintf("Failed to convert upstream answer to %s: %v", forced.clientName(), err)})
+		}
+		result = out
+	}
+	resp["result"] = result
+	return marshalRaw(resp)
+}
+
+// clientName is the encoding the client asked for, as the node names it
+func (f *forcedEncoding) clientName() string {
+	if f.client == "" {
+		return "json"
+	}
+	return f.client
+}
+
+// base58TooLargeError is the node's refusal to encode large data as base58
+type base58TooLargeError struct{}
+
+func (*base58TooLargeError) Error() string {
+	return fmt.Sprintf("Encoded binary (base 58) data should be less than %d bytes, please use Base64 encoding.", maxBase58Bytes)
+}
+
+// convertAccountData converts the data of one account, ["...", "base64"]
+// or ["...", "base64+zstd"], to the client's encoding
+func (e *encodingPolicy) convertAccountData(value json.RawMessage, forced *forcedEncoding) (json.RawMessage, error) {
+	var pair [2]string
+	if json.Unmarshal(value, &pair) != nil || pair[1] != forced.sent {
+		return value, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(pair[0])
+	if err != nil {
+		return nil, err
+	}
+	if forced.sent == encodingBase64Zstd {
+		if data, err = e.decoder.DecodeAll(data, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	switch forced.client {
+	case encodingBase64:
+		return json.Marshal([2]string{base64.StdEncoding.EncodeToString(data), encodingBase64})
+	case "base58", "binary":
+		if len(data) > maxBase58Bytes {
+			return nil, &base58TooLargeError{}
+		}
+		if forced.client == "binary" {
+			return json.Marshal(base58Encode(data))
+		}
+		return json.Marshal([2]string{base58Encode(data), "base58"})
+	}
+	return value, nil
+}
+
+// convertTransaction converts one ["...", "base64"] transaction to the
+// client's encoding
+func convertTransaction(value json.RawMessage, forced *forcedEncoding) (json.RawMessage, error) {
+	var pair [2]string
+	if json.Unmarshal(value, &pair) != nil || pair[1] != encodingBase64 {
+		return value, nil
+	}
+	tx, err := base64.StdEncoding.DecodeString(pair[0])
+	if err != nil {
+		return nil, err
+	}
+	if forced.client == "base58" {
+		return json.Marshal([2]string{base58Encode(tx), "base58"})
+	}
+	return jsonTransaction(tx)
+}
+
+// mapPath replaces the values at a dot path with what convert makes of
+// them, stepping through arrays, and reports whether any were found
+func mapPath(value json.RawMessage, path []string, convert func(json.RawMessage) (json.RawMessage, error)) (json.RawMessage, bool, error) {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return value, false, nil
+	}
+	switch value[0] {
+	case '[':
+		var items []json.RawMessage
+		if json.Unmarshal(value, &items) != nil {
+			return value, false, nil
+		}
+		found := false
+		for i, item := range items {
+			out, ok, err := mapPath(item, path, convert)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				items[i], found = out, true
+			}
+		}
+		if !found {
+			return value, false, nil
+		}
+		return marshalRaw(items), true, nil
+	case '{':
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(value, &fields) != nil {
+			return value, false, nil
+		}
+		field, ok := fields[path[0]]
+		if !ok {
+			return value, false, nil
+		}
+		var err error
+		if len(path) == 1 {
+			field, err = convert(field)
+		} else {
+			field, ok, err = mapPath(field, path[1:], convert)
+		}
+		if err != nil || !ok {
+			return value, false, err
+		}
+		fields[path[0]] = field
+		return marshalRaw(fields), true, nil
+	}
+	return value, false, nil
+}
+
+func (e *encodingPolicy) snapshot() map[string]interface{} {
+	accounts := e.accounts
+	if e.zstdRefused.Load() {
+		accounts = encodingBase64
+	}
+	return map[string]interface{}{
+		"accounts":  accounts,
+		"rewritten": e.rewritten.Load(),
+	}
+}
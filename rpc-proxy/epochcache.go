@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/bits"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// slotDuration is the target time between slots, used to estimate how
+	// close the epoch boundary is between checks
+	slotDuration = 400 * time.Millisecond
+	// epochGuardSlots is how close to the estimated epoch boundary
+	// epoch-dependent answers stop being served from the cache, so clock
+	// drift and skipped slots can't serve last epoch's leader schedule
+	epochGuardSlots = 150
+	// epochCheckInterval is how often the current epoch is checked, and
+	// epochBoundaryCheckInterval how often close to its end
+	epochCheckInterval         = 30 * time.Second
+	epochBoundaryCheckInterval = 2 * time.Second
+	// minimumSlotsPerEpoch is the length of the first warmup epoch
+	minimumSlotsPerEpoch = 32
+)
+
+// epochSchedule is the result of getEpochSchedule
+type epochSchedule struct {
+	SlotsPerEpoch    uint64 `json:"slotsPerEpoch"`
+	Warmup           bool   `json:"warmup"`
+	FirstNormalEpoch uint64 `json:"firstNormalEpoch"`
+	FirstNormalSlot  uint64 `json:"firstNormalSlot"`
+}
+
+// epoch returns the epoch of a slot. With warmup, epochs start at 32 slots
+// and double until the first normal epoch.
+func (s *epochSchedule) epoch(slot uint64) uint64 {
+	if s.Warmup && slot < s.FirstNormalSlot {
+		return uint64(bits.Len64(slot+minimumSlotsPerEpoch)) - uint64(bits.Len64(minimumSlotsPerEpoch))
+	}
+	if s.SlotsPerEpoch == 0 {
+		return 0
+	}
+	return s.FirstNormalEpoch + (slot-s.FirstNormalSlot)/s.SlotsPerEpoch
+}
+
+// epochCache answers getEpochSchedule, getLeaderSchedule and getEpochInfo
+// from memory. The epoch schedule never changes. Leader schedules change
+// only at epoch boundaries: the current epoch's is fetched as soon as the
+// epoch starts and served until it ends, and those asked for by slot are
+// kept while their epoch is recent. getEpochInfo answers are reused for
+// epoch_info_ttl. Near the estimated end of an epoch, answers that depend on
+// it go upstream until the new epoch has been seen.
+type epochCache struct {
+	infoTTL time.Duration
+
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	mu       sync.Mutex
+	schedule *epochSchedule // nil until fetched
+	epoch    uint64
+	lastSlot uint64    // last slot of the epoch, 0 = epoch not known yet
+	slot     uint64    // slot at the last check
+	checked  time.Time // when it was checked
+	entries  map[string]epochCacheEntry
+}
+
+type epochCacheEntry struct {
+	result  json.RawMessage
+	epoch   uint64    // epoch a leader schedule belongs to
+	current bool      // valid until the epoch changes
+	expires time.Time // zero = no expiry
+}
+
+// newEpochCache returns nil when epoch_cache is disabled
+func newEpochCache(config *Config) *epochCache {
+	if !config.EpochCache {
+		return nil
+	}
+	return &epochCache{
+		infoTTL: config.EpochInfoTTL.Duration,
+		entries: make(map[string]epochCacheEntry),
+	}
+}
+
+// cached reports whether the method's answers are cached
+func (c *epochCache) cached(method string) bool {
+	switch method {
+	case "getEpochSchedule", "getLeaderSchedule":
+		return true
+	case "getEpochInfo":
+		return c.infoTTL > 0
+	}
+	return false
+}
+
+// key returns the cache key of a request, the epoch a leader schedule asked
+// for by slot belongs to, and whether the request is cacheable
+func (c *epochCache) key(method string, params json.RawMessage) (string, uint64, bool) {
+	if method != "getLeaderSchedule" {
+		return method + compactParams(params), 0, true
+	}
+
+	// The slot is optional: [slot, config], [null, config], [config] or []
+	var args []json.RawMessage
+	if len(params) > 0 && json.Unmarshal(params, &args) != nil {
+		return "", 0, false
+	}
+	config := ""
+	if len(args) > 0 {
+		var slot *uint64
+		if json.Unmarshal(args[0], &slot) != nil {
+			config, args = compactParams(args[0]), nil
+		} else if slot != nil {
+			if c.schedule == nil {
+				return "", 0, false
+			}
+			epoch := c.schedule.epoch(*slot)
+			if len(args) > 1 {
+				config = compactParams(args[1])
+			}
+			return "getLeaderSchedule@" + strconv.FormatUint(epoch, 10) + config, epoch, true
+		}
+		if len(args) > 1 {
+			config = compactParams(args[1])
+		}
+	}
+	return "getLeaderSchedule" + config, 0, true
+}
+
+// nearBoundary reports whether the epoch may be ending, or its end isn't
+// known; c.mu must be held
+func (c *epochCache) nearBoundary(now time.Time) bool {
+	if c.lastSlot == 0 {
+		return true
+	}
+	estimated := c.slot + uint64(now.Sub(c.checked)/slotDuration)
+	return estimated+epochGuardSlots >= c.lastSlot
+}
+
+// lookup returns the cached result for a request
+func (c *epochCache) lookup(method string, params json.RawMessage) (json.RawMessage, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, _, ok := c.key(method, params)
+	var entry epochCacheEntry
+	if ok {
+		entry, ok = c.entries[key]
+	}
+	if ok && entry.current && c.nearBoundary(now) {
+		ok = false
+	}
+	if ok && !entry.expires.IsZero() && now.After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return entry.result, true
+}
+
+// store caches a response to a request
+func (c *epochCache) store(method string, params json.RawMessage, body []byte) {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *JSONRPCError   `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error != nil || resp.Result == nil || string(resp.Result) == "null" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(method, params, resp.Result, time.Now())
+}
+
+// put caches a result; c.mu must be held
+func (c *epochCache) put(method string, params, result json.RawMessage, now time.Time) {
+	key, epoch, ok := c.key(method, params)
+	if !ok {
+		return
+	}
+	entry := epochCacheEntry{result: result, epoch: epoch}
+	switch {
+	case method == "getEpochInfo":
+		entry.current = true
+		entry.expires = now.Add(c.infoTTL)
+	case method == "getLeaderSchedule" && epoch == 0:
+		entry.current = true
+	case method == "getLeaderSchedule" && epoch+1 < c.epoch:
+		return
+	}
+	if entry.current && c.nearBoundary(now) {
+		return
+	}
+	c.entries[key] = entry
+}
+
+// advance records the current epoch and slot, dropping the answers of past
+// epochs when it changed. It returns whether the epoch changed.
+func (c *epochCache) advance(info epochInfo, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := c.lastSlot != 0 && info.Epoch != c.epoch
+	c.epoch = info.Epoch
+	c.slot = info.AbsoluteSlot
+	c.lastSlot = info.AbsoluteSlot - info.SlotIndex + info.SlotsInEpoch - 1
+	c.checked = now
+	if changed {
+		for key, entry := range c.entries {
+			if entry.current || (entry.epoch != 0 && entry.epoch+1 < info.Epoch) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	return changed
+}
+
+func (c *epochCache) snapshot() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"epoch":   c.epoch,
+		"entries": len(c.entries),
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+	}
+}
+
+// resetCounters zeroes the hit and miss counts for /admin/metrics/reset
+func (c *epochCache) resetCounters() {
+	if c == nil {
+		return
+	}
+	c.hits.Store(0)
+	c.misses.Store(0)
+}
+
+// epochInfo is the part of getEpochInfo the cache tracks
+type epochInfo struct {
+	Epoch        uint64 `json:"epoch"`
+	SlotIndex    uint64 `json:"slotIndex"`
+	SlotsInEpoch uint64 `json:"slotsInEpoch"`
+	AbsoluteSlot uint64 `json:"absoluteSlot"`
+}
+
+// watchEpoch follows the current epoch, checking more often as its end
+// approaches, and fetches the new leader schedule as soon as an epoch
+// starts so monitoring stacks never wait for it
+func (p *RPCProxy) watchEpoch() {
+	c := p.epochCache
+	for {
+		interval := epochCheckInterval
+		if err := p.checkEpoch(); err != nil {
+			log.Printf("[WARN] %s: epoch cache: %v", p.name, err)
+			interval = epochBoundaryCheckInterval
+		}
+		c.mu.Lock()
+		if c.nearBoundary(time.Now()) {
+			interval = epochBoundaryCheckInterval
+		}
+		c.mu.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+// checkEpoch fetches the epoch schedule once and the current epoch, and
+// the leader schedule when the epoch is new
+func (p *RPCProxy) checkEpoch() error {
+	c := p.epochCache
+	c.mu.Lock()
+	known := c.schedule != nil
+	fresh := c.lastSlot == 0
+	c.mu.Unlock()
+
+	if !known {
+		var raw json.RawMessage
+		var schedule epochSchedule
+		if err := p.callAny("getEpochSchedule", nil, &raw); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &schedule); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.schedule = &schedule
+		c.put("getEpochSchedule", nil, raw, time.Now())
+		c.mu.Unlock()
+	}
+
+	var info epochInfo
+	if err := p.callAny("getEpochInfo", nil, &info); err != nil {
+		return err
+	}
+	if info.SlotsInEpoch == 0 {
+		return errors.New("getEpochInfo: no slotsInEpoch in answer")
+	}
+	if !c.advance(info, time.Now()) && !fresh {
+		return nil
+	}
+
+	// epoch_prewarm may have fetched it before the boundary
+	c.mu.Lock()
+	prewarmed, ok := c.entries["getLeaderSchedule@"+strconv.FormatUint(info.Epoch, 10)]
+	c.mu.Unlock()
+	leaders := prewarmed.result
+	if !ok {
+		if err := p.callAny("getLeaderSchedule", nil, &leaders); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	c.put("getLeaderSchedule", nil, leaders, time.Now())
+	c.mu.Unlock()
+	log.Printf("Epoch cache %s: epoch %d, ends at slot %d", p.name, info.Epoch, info.AbsoluteSlot-info.SlotIndex+info.SlotsInEpoch-1)
+	return nil
+}
+
+// callAny calls the first upstream the proxy would route to that answers
+func (p *RPCProxy) callAny(method string, params interface{}, result interface{}) error {
+	err := errors.New("no routable upstream")
+	for _, u := range p.pool.candidates() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout.Duration)
+		err = p.pool.call(ctx, u, method, params, result)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// featureCheckInterval is how often the watched feature gates are checked
+const featureCheckInterval = 5 * time.Minute
+
+// Feature gate states
+const (
+	featureInactive = "inactive" // no feature account: not scheduled
+	featurePending  = "pending"  // scheduled, activates at the next epoch boundary
+	featureActive   = "active"
+)
+
+// featureStatus is a watched feature gate's activation
+type featureStatus struct {
+	ID          string  `json:"id"`
+	Status      string  `json:"status"`
+	ActivatedAt *uint64 `json:"activated_at,omitempty"` // slot
+}
+
+// epochWatch follows the current epoch and the activation of watched
+// feature gates, for /health. Within epoch_boundary_window of an epoch
+// boundary, when upstreams are slow computing rewards and leader schedules,
+// requests get epoch_boundary_timeout and the next epoch's leader schedule
+// is fetched into the epoch cache ahead of time.
+type epochWatch struct {
+	features []string
+	window   time.Duration
+	prewarm  bool
+
+	mu          sync.Mutex
+	info        epochInfo
+	checked     time.Time // zero until the epoch is known
+	status      []featureStatus
+	featuresAt  time.Time
+	prewarmedTo uint64 // epoch whose leader schedule was fetched ahead
+}
+
+// newEpochWatch returns nil without epoch_tracking
+func newEpochWatch(config *Config) (*epochWatch, error) {
+	if !config.EpochTracking {
+		return nil, nil
+	}
+	for _, id := range config.WatchFeatures {
+		if key, err := base58Decode(id); err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("watch_features: %q is not a feature ID", id)
+		}
+	}
+	return &epochWatch{
+		features: config.WatchFeatures,
+		window:   config.EpochBoundaryWindow.Duration,
+		prewarm:  config.EpochPrewarm,
+	}, nil
+}
+
+// untilBoundary estimates the time left in the epoch, and the time since it
+// started; e.mu must be held
+func (e *epochWatch) untilBoundary(now time.Time) (left, since time.Duration) {
+	elapsed := now.Sub(e.checked)
+	index := time.Duration(e.info.SlotIndex) * slotDuration
+	left = time.Duration(e.info.SlotsInEpoch-e.info.SlotIndex)*slotDuration - elapsed
+	return max(left, 0), index + elapsed
+}
+
+// nearBoundary reports whether an epoch boundary is within the window;
+// e.mu must be held
+func (e *epochWatch) nearBoundary(now time.Time) bool {
+	if e.window <= 0 || e.checked.IsZero() {
+		return false
+	}
+	left, since := e.untilBoundary(now)
+	return left <= e.window || since <= e.window
+}
+
+// watchEpochBoundaries follows the epoch, checking more often as its end
+// approaches, and the watched feature gates
+func (p *RPCProxy) watchEpochBoundaries() {
+	e := p.epochWatch
+	for {
+		interval := epochCheckInterval
+		if err := p.checkEpochBoundary(); err != nil {
+			log.Printf("[WARN] %s: epoch tracking: %v", p.name, err)
+			interval = epochBoundaryCheckInterval
+		}
+		e.mu.Lock()
+		if left, _ := e.untilBoundary(time.Now()); left <= epochGuardSlots*slotDuration || e.nearBoundary(time.Now()) {
+			interval = epochBoundaryCheckInterval
+		}
+		e.mu.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+// checkEpochBoundary fetches the current epoch, and the feature gates when
+// they are due or the epoch changed
+func (p *RPCProxy) checkEpochBoundary() error {
+	e := p.epochWatch
+	var info epochInfo
+	if err := p.callAny("getEpochInfo", nil, &info); err != nil {
+		return err
+	}
+	if info.SlotsInEpoch == 0 {
+		return fmt.Errorf("getEpochInfo: no slotsInEpoch in answer")
+	}
+	now := time.Now()
+
+	e.mu.Lock()
+	changed := !e.checked.IsZero() && info.Epoch != e.info.Epoch
+	if changed {
+		log.Printf("%s: epoch %d started at slot %d", p.name, info.Epoch, info.AbsoluteSlot-info.SlotIndex)
+	}
+	e.info, e.checked = info, now
+	near := e.nearBoundary(now)
+	left, _ := e.untilBoundary(now)
+	featuresDue := len(e.features) > 0 && (changed || now.Sub(e.featuresAt) >= featureCheckInterval)
+	prewarm := e.prewarm && near && left <= e.window && e.prewarmedTo <= info.Epoch && p.epochCache != nil
+	e.mu.Unlock()
+
+	if p.pool.epochBoundary.Swap(near) != near && p.config.EpochBoundaryTimeout.Duration > 0 {
+		if near {
+			log.Printf("%s: epoch boundary near, upstream timeout raised to %v", p.name, p.config.EpochBoundaryTimeout.Duration)
+		} else {
+			log.Printf("%s: epoch boundary passed, upstream timeout back to %v", p.name, p.config.Timeout.Duration)
+		}
+	}
+	if prewarm {
+		p.prewarmLeaderSchedule(info)
+	}
+	if featuresDue {
+		return p.checkFeatures()
+	}
+	return nil
+}
+
+// prewarmLeaderSchedule fetches the next epoch's leader schedule into the
+// epoch cache, where checkEpoch picks it up when the epoch starts
+func (p *RPCProxy) prewarmLeaderSchedule(info epochInfo) {
+	e := p.epochWatch
+	next := info.AbsoluteSlot - info.SlotIndex + info.SlotsInEpoch
+	params := []interface{}{next}
+	var leaders json.RawMessage
+	if err := p.callAny("getLeaderSchedule", params, &leaders); err != nil || string(leaders) == "null" {
+		// Not computed yet this early in some clusters, tried again at the
+		// next check
+		return
+	}
+	c := p.epochCache
+	c.mu.Lock()
+	c.put("getLeaderSchedule", []byte(fmt.Sprintf("[%d]", next)), leaders, time.Now())
+	c.mu.Unlock()
+	e.mu.Lock()
+	e.prewarmedTo = info.Epoch + 1
+	e.mu.Unlock()
+	log.Printf("%s: leader schedule of epoch %d fetched ahead of the boundary", p.name, info.Epoch+1)
+}
+
+// checkFeatures reads the watched feature gate accounts. A feature account
+// holds an optional activation slot: absent while the feature is scheduled
+// for the next epoch.
+func (p *RPCProxy) checkFeatures() error {
+	e := p.epochWatch
+	var result struct {
+		Value []*struct {
+			Data []string `json:"data"`
+		} `json:"value"`
+	}
+	params := []interface{}{e.features, map[string]string{"encoding": "base64"}}
+	if err := p.callAny("getMultipleAccounts", params, &result); err != nil {
+		return fmt.Errorf("feature gates: %w", err)
+	}
+	if len(result.Value) != len(e.features) {
+		return fmt.Errorf("feature gates: %d accounts returned for %d features", len(result.Value), len(e.features))
+	}
+
+	status := make([]featureStatus, len(e.features))
+	for i, id := range e.features {
+		status[i] = featureStatus{ID: id, Status: featureInactive}
+		account := result.Value[i]
+		if account == nil || len(account.Data) == 0 {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(account.Data[0])
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		status[i].Status = featurePending
+		if data[0] == 1 && len(data) >= 9 {
+			slot := binary.LittleEndian.Uint64(data[1:9])
+			status[i].Status, status[i].ActivatedAt = featureActive, &slot
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, s := range status {
+		if e.status != nil && e.status[i].Status != s.Status {
+			switch s.Status {
+			case featurePending:
+				log.Printf("[WARN] %s: feature %s scheduled, activates at the start of epoch %d", p.name, s.ID, e.info.Epoch+1)
+			case featureActive:
+				log.Printf("[WARN] %s: feature %s activated at slot %d", p.name, s.ID, *s.ActivatedAt)
+			}
+		}
+	}
+	e.status = status
+	e.featuresAt = time.Now()
+	return nil
+}
+
+// health returns the epoch and feature gates for /health
+func (e *epochWatch) health() map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	health := map[string]interface{}{}
+	if !e.checked.IsZero() {
+		now := time.Now()
+		left, _ := e.untilBoundary(now)
+		health["epoch"] = map[string]interface{}{
+			"epoch":           e.info.Epoch,
+			"slot_index":      e.info.SlotIndex,
+			"slots_in_epoch":  e.info.SlotsInEpoch,
+			"progress":        roundRatio(float64(e.info.SlotIndex) / float64(e.info.SlotsInEpoch)),
+			"boundary_in":     left.Round(time.Second).String(),
+			"near_boundary":   e.nearBoundary(now),
+			"checked_at":      e.checked.UTC(),
+			"next_epoch_slot": e.info.AbsoluteSlot - e.info.SlotIndex + e.info.SlotsInEpoch,
+		}
+	}
+	if e.status != nil {
+		health["features"] = e.status
+	}
+	return health
+}
+
+// client returns the upstream's client for a request, with the looser
+// timeout near an epoch boundary
+func (p *upstreamPool) client(u *upstream) *http.Client {
+	if u.boundaryClient != nil && p.epochBoundary.Load() {
+		return u.boundaryClient
+	}
+	return u.client
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// exemptions are clients that bypass rate limiting, bandwidth limits and
+// egress quotas, e.g. our own indexer and monitoring
+type exemptions struct {
+	nets []*net.IPNet
+	keys map[string]bool
+}
+
+// newExemptions parses exempt_ips (addresses or CIDRs) and exempt_keys
+func newExemptions(ips, keys []string) (*exemptions, error) {
+	if len(ips) == 0 && len(keys) == 0 {
+		return nil, nil
+	}
+
+	e := &exemptions{keys: make(map[string]bool, len(keys))}
+	for _, s := range ips {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("exempt_ips: %w", err)
+		}
+		e.nets = append(e.nets, ipNet)
+	}
+	for _, k := range keys {
+		e.keys[k] = true
+	}
+	return e, nil
+}
+
+// match reports whether the request comes from an exempt IP or carries an
+// exempt API key. The IP is the connection's peer address: X-Forwarded-For
+// and X-Real-IP are set by the client and would let anyone claim an exempt
+// address.
+func (e *exemptions) match(r *http.Request) bool {
+	if e == nil {
+		return false
+	}
+	if key := getAPIKey(r); key != "" && e.keys[key] {
+		return true
+	}
+	if ip := net.ParseIP(peerIP(r)); ip != nil {
+		for _, ipNet := range e.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
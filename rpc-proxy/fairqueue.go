@@ -0,0 +1,199 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// fairQueue shares a limiter's waiting capacity evenly between clients. Each
+// client (rate limit key) has its own FIFO and slots are handed out round
+// robin across clients, so one client flooding the queue only delays its own
+// requests. Higher priority requests are always served before lower ones.
+// Requests may cost several slots (see method_costs).
+type fairQueue struct {
+	limiter requestLimiter
+	rate    float64 // requests per second, for Retry-After estimates
+
+	mu      sync.Mutex
+	rings   [numPriorities]*fairRing
+	waiting int // queued requests
+	cost    int // total slots the queued requests need
+	wake    chan struct{}
+}
+
+// fairRing is the round robin of waiting clients within one priority
+type fairRing struct {
+	queues map[string]*list.List // client -> *fairWaiter
+	active []string              // clients with waiters, in round robin order
+	next   int                   // index into active of the next client served
+}
+
+// fairWaiter is a request waiting in the queue
+type fairWaiter struct {
+	client  string
+	cost    int
+	ring    *fairRing
+	el      *list.Element
+	granted chan struct{}
+}
+
+func newFairQueue(limiter requestLimiter, rate float64) *fairQueue {
+	q := &fairQueue{
+		limiter: limiter,
+		rate:    rate,
+		wake:    make(chan struct{}, 1),
+	}
+	for i := range q.rings {
+		q.rings[i] = &fairRing{queues: make(map[string]*list.List)}
+	}
+	go q.dispatch()
+	return q
+}
+
+// wait blocks until the client is granted n slots or ctx is done. queued
+// reports whether the request had to wait in the queue.
+func (q *fairQueue) wait(ctx context.Context, client string, pr priority, n int) (queued bool, err error) {
+	q.mu.Lock()
+	if q.waiting == 0 && q.limiter.AllowN(n) {
+		q.mu.Unlock()
+		return false, nil
+	}
+
+	ring := q.rings[pr]
+	w := &fairWaiter{client: client, cost: n, ring: ring, granted: make(chan struct{})}
+	queue, exists := ring.queues[client]
+	if !exists {
+		queue = list.New()
+		ring.queues[client] = queue
+		ring.active = append(ring.active, client)
+	}
+	w.el = queue.PushBack(w)
+	q.waiting++
+	q.cost += n
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-w.granted:
+		return true, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		select {
+		case <-w.granted:
+			// Granted while giving up, so take the slot after all
+			return true, nil
+		default:
+		}
+		q.remove(w)
+		return true, ctx.Err()
+	}
+}
+
+// dispatch collects limiter slots one at a time whenever requests are queued
+// and grants them to the next client in turn once it has collected enough
+// for that client's request
+func (q *fairQueue) dispatch() {
+	credit := 0
+	for {
+		q.mu.Lock()
+		if q.waiting == 0 {
+			q.mu.Unlock()
+			<-q.wake
+			continue
+		}
+		if w := q.peek(); credit >= w.cost {
+			q.pop()
+			credit -= w.cost
+			close(w.granted)
+			q.mu.Unlock()
+			continue
+		}
+		q.mu.Unlock()
+
+		reservation := q.limiter.Reserve()
+		if !reservation.OK() {
+			time.Sleep(time.Second)
+			continue
+		}
+		time.Sleep(reservation.Delay())
+		credit++
+	}
+}
+
+// peek returns the head waiter of the next client in turn in the highest
+// priority ring with waiters. Must be called with q.mu held.
+func (q *fairQueue) peek() *fairWaiter {
+	for pr := numPriorities - 1; pr >= 0; pr-- {
+		ring := q.rings[pr]
+		if len(ring.active) == 0 {
+			continue
+		}
+		if ring.next >= len(ring.active) {
+			ring.next = 0
+		}
+		return ring.queues[ring.active[ring.next]].Front().Value.(*fairWaiter)
+	}
+	return nil
+}
+
+// pop removes and returns the waiter peek would return, moving its ring on
+// to the next client. Must be called with q.mu held.
+func (q *fairQueue) pop() *fairWaiter {
+	w := q.peek()
+	if w == nil {
+		return nil
+	}
+	q.remove(w)
+	if _, stillActive := w.ring.queues[w.client]; stillActive {
+		w.ring.next++
+	}
+	return w
+}
+
+// remove takes a waiter out of its client's queue, dropping the client from
+// the rotation once it has no waiters. Must be called with q.mu held.
+func (q *fairQueue) remove(w *fairWaiter) {
+	ring := w.ring
+	queue := ring.queues[w.client]
+	queue.Remove(w.el)
+	q.waiting--
+	q.cost -= w.cost
+	if queue.Len() > 0 {
+		return
+	}
+
+	delete(ring.queues, w.client)
+	for i, client := range ring.active {
+		if client == w.client {
+			ring.active = append(ring.active[:i], ring.active[i+1:]...)
+			if i < ring.next {
+				ring.next--
+			}
+			break
+		}
+	}
+}
+
+// expectedWait estimates how long a newly queued request would wait
+func (q *fairQueue) expectedWait() time.Duration {
+	q.mu.Lock()
+	cost := q.cost
+	q.mu.Unlock()
+
+	if cost == 0 || q.rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(cost) / q.rate * float64(time.Second))
+}
+
+// retryAfter estimates the seconds until the current queue has drained
+func (q *fairQueue) retryAfter() int {
+	return int(q.expectedWait().Seconds()) + 1
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// rateLimitKeyParts are the request attributes that can make up the per_ip
+// rate limiting key
+var rateLimitKeyParts = map[string]bool{
+	"ip":      true, // client IP, or its network with ipv4/ipv6_prefix_length
+	"client":  true, // Solana-Client header, e.g. "js/1.95.0"
+	"api_key": true, // name of a configured API key
+}
+
+// validateRateLimitKey checks the configured rate_limit_key parts
+func validateRateLimitKey(parts []string) error {
+	for _, part := range parts {
+		if !rateLimitKeyParts[part] {
+			return fmt.Errorf("unknown rate_limit_key part %q (want ip, client or api_key)", part)
+		}
+	}
+	return nil
+}
+
+// rateLimitKey returns the key a request is rate limited by in per_ip mode.
+// By default this is the client IP; with a composite rate_limit_key, clients
+// sharing an IP (e.g. a NAT'd campus network) get separate buckets per app or
+// API key.
+func (p *RPCProxy) rateLimitKey(r *http.Request, clientIP string) string {
+	parts := p.config.RateLimitKey
+	if len(parts) == 0 {
+		parts = []string{"ip"}
+	}
+
+	var key strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			key.WriteByte('|')
+		}
+		switch part {
+		case "ip":
+			key.WriteString(ipPrefixKey(clientIP, p.config.IPv4PrefixLength, p.config.IPv6PrefixLength))
+		case "client":
+			// Bound the header so it can't bloat the limiter map
+			key.WriteString("client=" + truncateString(r.Header.Get("Solana-Client"), 64))
+		case "api_key":
+			// Only configured keys count, or clients could mint unlimited
+			// buckets with random keys
+			name, _ := p.apiKeyName(r)
+			key.WriteString("key=" + name)
+		}
+	}
+	return key.String()
+}
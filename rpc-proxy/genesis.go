@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Genesis verification state of an upstream when expected_genesis_hash is set
+const (
+	genesisUnverified int32 = iota
+	genesisMatched
+	genesisMismatched
+)
+
+// routable reports whether requests may be sent to the upstream. With a
+// pinned genesis hash only upstreams verified to serve that cluster qualify.
+func (u *upstream) routable(expectedGenesis string) bool {
+	return expectedGenesis == "" || u.genesis.Load() == genesisMatched
+}
+
+// verifyGenesis records whether the upstream serves the expected cluster,
+// logging when it enters or leaves rotation
+func (p *RPCProxy) verifyGenesis(u *upstream, genesisHash string) bool {
+	expected := p.config.ExpectedGenesisHash
+	if expected == "" {
+		return true
+	}
+
+	if genesisHash != expected {
+		if u.genesis.Swap(genesisMismatched) != genesisMismatched {
+			log.Printf("[GENESIS] %s/%s: genesis %s does not match expected %s, removed from rotation",
+				p.name, u.name, genesisHash, expected)
+		}
+		return false
+	}
+
+	if u.genesis.Swap(genesisMatched) == genesisMismatched {
+		log.Printf("[GENESIS] %s/%s: genesis matches again, back in rotation", p.name, u.name)
+	}
+	return true
+}
+
+// checkGenesis verifies the genesis hash of every upstream in the pool.
+// Unreachable upstreams keep their last known state.
+func (p *RPCProxy) checkGenesis(ctx context.Context) {
+	for _, u := range p.pool.upstreams {
+		var genesisHash string
+		if err := p.pool.call(ctx, u, "getGenesisHash", nil, &genesisHash); err != nil {
+			if u.genesis.Load() == genesisUnverified {
+				log.Printf("[GENESIS] %s/%s: cannot verify genesis hash: %v", p.name, u.name, err)
+			}
+			continue
+		}
+		p.verifyGenesis(u, genesisHash)
+	}
+}
+
+// watchGenesis checks the pool against the pinned genesis hash immediately
+// and then every interval
+func (p *RPCProxy) watchGenesis(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		p.checkGenesis(ctx)
+		cancel()
+		time.Sleep(interval)
+	}
+}
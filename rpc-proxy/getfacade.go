@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// defaultGetMethods are the cheap read methods served over GET unless
+// get_methods says otherwise
+var defaultGetMethods = []string{
+	"getSlot", "getBlockHeight", "getHealth", "getVersion", "getGenesisHash",
+	"getEpochInfo", "getEpochSchedule", "getLatestBlockhash", "getBalance",
+	"getTransactionCount", "getMinimumBalanceForRentExemption", "getSlotLeader",
+	"getFirstAvailableBlock", "getIdentity", "getInflationRate", "getFeeForMessage",
+}
+
+// getFacadeRequest turns a GET like /v0/getSlot or
+// ?method=getBalance&params=["<pubkey>"] into the equivalent JSON-RPC POST,
+// so curl users, uptime checkers and browsers can call simple read methods.
+// Other GET requests are returned unchanged. It returns false once it has
+// written an error.
+func (p *RPCProxy) getFacadeRequest(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	query := r.URL.Query()
+	method := query.Get("method")
+	if strings.HasPrefix(r.URL.Path, "/v0/") {
+		method = strings.TrimPrefix(r.URL.Path, "/v0/")
+	}
+	if method == "" {
+		return r, true
+	}
+
+	if !p.isGetMethod(method) {
+		p.writeRPCError(w, 1, -32601, fmt.Sprintf("Method not available over GET: %s", method), http.StatusForbidden)
+		return nil, false
+	}
+
+	rpcReq := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method}
+	if params := query.Get("params"); params != "" {
+		var decoded []interface{}
+		if err := json.Unmarshal([]byte(params), &decoded); err != nil {
+			p.writeRPCError(w, 1, -32602, "Invalid params: must be a JSON array", http.StatusBadRequest)
+			return nil, false
+		}
+		rpcReq["params"] = decoded
+	}
+	body, err := json.Marshal(rpcReq)
+	if err != nil {
+		p.writeRPCError(w, 1, -32602, "Invalid params", http.StatusBadRequest)
+		return nil, false
+	}
+
+	post := r.Clone(r.Context())
+	post.Method = http.MethodPost
+	post.Body = io.NopCloser(bytes.NewReader(body))
+	post.ContentLength = int64(len(body))
+	post.Header.Set("Content-Type", "application/json")
+	return post, true
+}
+
+// isGetMethod reports whether a method may be called through the GET facade
+func (p *RPCProxy) isGetMethod(method string) bool {
+	methods := p.config.GetMethods
+	if len(methods) == 0 {
+		methods = defaultGetMethods
+	}
+	for _, m := range methods {
+		if m == method || m == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// geyserMaxMessageSize bounds a single Geyser message; full blocks with
+// transactions can be large
+const geyserMaxMessageSize = 64 << 20
+
+// geyserServicePrefix is the Yellowstone gRPC service; other services are
+// not proxied
+const geyserServicePrefix = "/geyser.Geyser/"
+
+// GeyserConfig shares one Yellowstone (Geyser plugin) gRPC endpoint between
+// internal consumers
+type GeyserConfig struct {
+	ListenAddr          string `json:"listen_addr"`            // gRPC address clients subscribe on
+	Upstream            string `json:"upstream"`               // host:port of the Yellowstone gRPC endpoint
+	UpstreamTLS         bool   `json:"upstream_tls"`           // connect to the upstream over TLS
+	UpstreamToken       string `json:"upstream_token"`         // sent upstream as x-token in place of the client's
+	MaxStreamsPerClient int    `json:"max_streams_per_client"` // concurrent streams per API key (or IP), default 5
+	MaxStreams          int    `json:"max_streams"`            // concurrent streams in total, 0 = unlimited
+	AllowAnonymous      bool   `json:"allow_anonymous"`        // accept clients without an API key, limited per IP
+}
+
+// rawFrame is a gRPC message passed through without decoding
+type rawFrame struct {
+	data []byte
+}
+
+// rawCodec passes message bytes through unchanged, so the proxy needs no
+// Yellowstone protobuf definitions
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	f, ok := v.(*rawFrame)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return f.data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	f, ok := v.(*rawFrame)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	f.data = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// geyserProxy forwards Yellowstone gRPC calls, including the Subscribe
+// stream, to the upstream with per-client stream limits
+type geyserProxy struct {
+	config  *GeyserConfig
+	apiKeys map[string]string // API key -> name
+	keys    *keyStore         // api_keys_file, nil when not configured
+	conn    *grpc.ClientConn
+
+	mu      sync.Mutex
+	streams map[string]int // client -> open streams
+	total   int
+}
+
+func newGeyserProxy(config *GeyserConfig, apiKeys []APIKeyConfig, keys *keyStore) (*geyserProxy, error) {
+	if config.Upstream == "" {
+		return nil, fmt.Errorf("geyser.upstream is required")
+	}
+	if config.MaxStreamsPerClient <= 0 {
+		config.MaxStreamsPerClient = 5
+	}
+
+	creds := insecure.NewCredentials()
+	if config.UpstreamTLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	conn, err := grpc.Dial(config.Upstream,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(geyserMaxMessageSize)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &geyserProxy{
+		config:  config,
+		apiKeys: buildAPIKeys(apiKeys),
+		keys:    keys,
+		conn:    conn,
+		streams: make(map[string]int),
+	}, nil
+}
+
+// newGeyserServer builds the gRPC server clients connect to, with TLS when
+// the proxy has a certificate
+func newGeyserServer(g *geyserProxy, config *Config) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(g.handle),
+		grpc.MaxRecvMsgSize(geyserMaxMessageSize),
+	}
+	if config.TLSCertFile != "" && config.TLSKeyFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	return grpc.NewServer(opts...), nil
+}
+
+// client identifies the caller by API key name, or by IP for anonymous
+// clients when allowed
+func (g *geyserProxy) client(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, header := range []string{"x-token", "x-api-key"} {
+		for _, key := range md.Get(header) {
+			if name, ok := g.apiKeys[key]; ok {
+				return "key:" + name, nil
+			}
+			if name, ok := g.keys.fileKeyName(key); ok {
+				return "key:" + name, nil
+			}
+		}
+	}
+	if len(md.Get("x-token")) > 0 || len(md.Get("x-api-key")) > 0 {
+		return "", status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	if !g.config.AllowAnonymous {
+		return "", status.Error(codes.Unauthenticated, "API key required (x-token or x-api-key)")
+	}
+
+	ip := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	return "ip:" + ip, nil
+}
+
+// acquire claims a stream slot for the client
+func (g *geyserProxy) acquire(client string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.streams[client] >= g.config.MaxStreamsPerClient {
+		return status.Errorf(codes.ResourceExhausted, "too many streams: limit is %d per client", g.config.MaxStreamsPerClient)
+	}
+	if g.config.MaxStreams > 0 && g.total >= g.config.MaxStreams {
+		return status.Error(codes.ResourceExhausted, "too many streams on this proxy")
+	}
+	g.streams[client]++
+	g.total++
+	return nil
+}
+
+// release frees a client's stream slot
+func (g *geyserProxy) release(client string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.total--
+	if g.streams[client]--; g.streams[client] <= 0 {
+		delete(g.streams, client)
+	}
+}
+
+// outgoingMetadata copies the client's metadata for the upstream, replacing
+// its credentials with the upstream token
+func (g *geyserProxy) outgoingMetadata(ctx context.Context) metadata.MD {
+	in, _ := metadata.FromIncomingContext(ctx)
+	out := metadata.MD{}
+	for k, v := range in {
+		switch {
+		case strings.HasPrefix(k, ":"), strings.HasPrefix(k, "grpc-"),
+			k == "x-token", k == "x-api-key", k == "authorization",
+			k == "content-type", k == "user-agent":
+			continue
+		}
+		out[k] = v
+	}
+	if g.config.UpstreamToken != "" {
+		out.Set("x-token", g.config.UpstreamToken)
+	}
+	return out
+}
+
+// handle proxies one call, unary or streaming, to the upstream
+func (g *geyserProxy) handle(_ interface{}, stream grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(stream)
+	if !ok || !strings.HasPrefix(method, geyserServicePrefix) {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+
+	client, err := g.client(stream.Context())
+	if err != nil {
+		return err
+	}
+	if err := g.acquire(client); err != nil {
+		log.Printf("[GEYSER] %s: %s rejected: %v", client, method, err)
+		return err
+	}
+	defer g.release(client)
+	log.Printf("[GEYSER] %s: %s opened", client, method)
+	defer log.Printf("[GEYSER] %s: %s closed", client, method)
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(stream.Context(), g.outgoingMetadata(stream.Context())))
+	defer cancel()
+
+	upstream, err := g.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return err
+	}
+
+	// Client to upstream
+	sent := make(chan error, 1)
+	go func() {
+		for {
+			f := &rawFrame{}
+			if err := stream.RecvMsg(f); err != nil {
+				if err == io.EOF {
+					err = upstream.CloseSend()
+				}
+				sent <- err
+				return
+			}
+			if err := upstream.SendMsg(f); err != nil {
+				sent <- err
+				return
+			}
+		}
+	}()
+
+	// Upstream to client
+	received := make(chan error, 1)
+	go func() {
+		if md, err := upstream.Header(); err == nil {
+			stream.SendHeader(md)
+		}
+		for {
+			f := &rawFrame{}
+			if err := upstream.RecvMsg(f); err != nil {
+				stream.SetTrailer(upstream.Trailer())
+				received <- err
+				return
+			}
+			if err := stream.SendMsg(f); err != nil {
+				received <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case err := <-sent:
+			if err != nil {
+				// The client went away or the upstream refused its messages
+				return err
+			}
+			// The client closed its side; keep relaying until the upstream
+			// finishes
+			sent = nil
+		case err := <-received:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// serveGeyser listens for Geyser clients until the server is stopped
+func serveGeyser(server *grpc.Server, addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen for Geyser on %s: %v", addr, err)
+	}
+	if err := server.Serve(l); err != nil {
+		log.Printf("[ERROR] Geyser server error: %v", err)
+	}
+}
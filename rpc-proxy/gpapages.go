@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// gpaPageStore serves getProgramAccounts results in pages. A request with
+// pageSize in its config is sent upstream without it, and the full result
+// is kept for gpa_page_ttl while the client gets the first page and a token
+// for the next. Clients on flaky links then fetch a large scan once and
+// page through it, instead of rerunning the scan whenever a 50 MB response
+// breaks off mid-transfer.
+type gpaPageStore struct {
+	ttl      time.Duration
+	maxBytes int64
+
+	scans atomic.Int64 // results kept for paging
+	pages atomic.Int64 // pages served from kept results
+
+	mu      sync.Mutex
+	bytes   int64
+	results map[string]*gpaResult
+	order   *list.List // of *gpaResult, oldest first
+}
+
+// gpaResult is a getProgramAccounts result kept for paging
+type gpaResult struct {
+	id       string
+	context  json.RawMessage // nil unless the request asked withContext
+	accounts []json.RawMessage
+	pageSize int
+	size     int64
+	expires  time.Time
+	el       *list.Element
+}
+
+// newGPAPageStore returns nil when gpa_page_ttl is 0
+func newGPAPageStore(config *Config) *gpaPageStore {
+	if config.GPAPageTTL.Duration <= 0 {
+		return nil
+	}
+	return &gpaPageStore{
+		ttl:      config.GPAPageTTL.Duration,
+		maxBytes: config.GPAPageCacheBytes,
+		results:  make(map[string]*gpaResult),
+		order:    list.New(),
+	}
+}
+
+// paging takes pageSize and pageToken out of a getProgramAccounts request's
+// config, returning them and the body to send upstream
+func (s *gpaPageStore) paging(body []byte) (int, string, []byte) {
+	var pageSize int
+	var token string
+	body = rewriteCalls(body, false, func(i int, call *rpcCall) bool {
+		if len(call.params) < 2 {
+			return false
+		}
+		var config map[string]json.RawMessage
+		if json.Unmarshal(call.params[1], &config) != nil || (config["pageSize"] == nil && config["pageToken"] == nil) {
+			return false
+		}
+		json.Unmarshal(config["pageSize"], &pageSize)
+		json.Unmarshal(config["pageToken"], &token)
+		delete(config, "pageSize")
+		delete(config, "pageToken")
+		call.params[1], _ = json.Marshal(config)
+		return true
+	})
+	return max(pageSize, 0), token, body
+}
+
+// firstPage keeps the full result of a paged request and returns the
+// response with its first page. Error answers are returned as they are.
+func (s *gpaPageStore) firstPage(id interface{}, body []byte, pageSize int) []byte {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error != nil || resp.Result == nil {
+		return body
+	}
+	result := &gpaResult{pageSize: pageSize}
+	if json.Unmarshal(resp.Result, &result.accounts) != nil {
+		var withContext struct {
+			Context json.RawMessage   `json:"context"`
+			Value   []json.RawMessage `json:"value"`
+		}
+		if json.Unmarshal(resp.Result, &withContext) != nil {
+			return body
+		}
+		result.context, result.accounts = withContext.Context, withContext.Value
+	}
+
+	// Results that need a single page, or can't be kept, are sent whole
+	result.size = int64(len(resp.Result))
+	if len(result.accounts) <= pageSize || result.size > s.maxBytes {
+		result.pageSize = len(result.accounts)
+		return result.page(id, 0, "")
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	result.id = hex.EncodeToString(b[:])
+	result.expires = time.Now().Add(s.ttl)
+	s.mu.Lock()
+	result.el = s.order.PushBack(result)
+	s.results[result.id] = result
+	s.bytes += result.size
+	for s.bytes > s.maxBytes {
+		s.remove(s.order.Front().Value.(*gpaResult))
+	}
+	s.mu.Unlock()
+	s.scans.Add(1)
+	return result.page(id, 0, result.id)
+}
+
+// page returns the response with the page starting at offset, and the token
+// of the next page if there is one
+func (r *gpaResult) page(id interface{}, offset int, resultID string) []byte {
+	end := min(offset+r.pageSize, len(r.accounts))
+	var next interface{}
+	if end < len(r.accounts) {
+		next = resultID + "." + strconv.Itoa(end)
+	}
+	page := map[string]interface{}{
+		"value":         r.accounts[offset:end],
+		"total":         len(r.accounts),
+		"nextPageToken": next,
+	}
+	if r.context != nil {
+		page["context"] = r.context
+	}
+	result, _ := json.Marshal(page)
+	out, _ := json.Marshal(JSONRPCResponse{JSONRPC: "2.0", ID: id, Result: result})
+	return out
+}
+
+// lookup returns a kept result and the offset a page token points at
+func (s *gpaPageStore) lookup(token string, now time.Time) (*gpaResult, int, bool) {
+	resultID, offsetText, ok := strings.Cut(token, ".")
+	offset, err := strconv.Atoi(offsetText)
+	if !ok || err != nil || offset < 0 {
+		return nil, 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[resultID]
+	if !ok || offset >= len(result.accounts) {
+		return nil, 0, false
+	}
+	if now.After(result.expires) {
+		s.remove(result)
+		return nil, 0, false
+	}
+	return result, offset, true
+}
+
+// remove drops a kept result; s.mu must be held
+func (s *gpaPageStore) remove(result *gpaResult) {
+	s.order.Remove(result.el)
+	delete(s.results, result.id)
+	s.bytes -= result.size
+}
+
+// expire drops the results past their ttl every minute
+func (s *gpaPageStore) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.mu.Lock()
+		for s.order.Len() > 0 {
+			oldest := s.order.Front().Value.(*gpaResult)
+			if now.Before(oldest.expires) {
+				break
+			}
+			s.remove(oldest)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *gpaPageStore) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"results": s.order.Len(),
+		"bytes":   s.bytes,
+		"scans":   s.scans.Load(),
+		"pages":   s.pages.Load(),
+	}
+}
+
+// writeGPAPage answers a request for a further page from a kept result. The
+// page counts toward the client's egress like an upstream response.
+func (p *RPCProxy) writeGPAPage(w http.ResponseWriter, r *http.Request, id interface{}, token string, pageSize int, egressClient string, exempt bool) {
+	result, offset, ok := p.gpaPages.lookup(token, time.Now())
+	if !ok {
+		p.metrics.FailedRequests.Add(1)
+		p.writeRPCError(w, id, errInvalidParams, "Unknown or expired pageToken: request the first page again", http.StatusOK)
+		return
+	}
+	if pageSize <= 0 {
+		pageSize = result.pageSize
+	}
+	page := *result
+	page.pageSize = pageSize
+	out := page.page(id, offset, result.id)
+
+	p.gpaPages.pages.Add(1)
+	p.metrics.BytesOut.Add(int64(len(out)))
+	p.metrics.SuccessRequests.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	if p.egress != nil && !exempt {
+		p.egress.write(r.Context(), w, egressClient, out)
+	} else {
+		w.Write(out)
+	}
+}
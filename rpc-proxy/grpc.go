@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/solana-retro/rpc-proxy/rpcpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcFrontend serves the rpcpb.RPC service. Every call becomes a JSON-RPC
+// request that goes through the router like an HTTP request, so tenants'
+// rate limits, method filtering, API keys and metrics all apply.
+type grpcFrontend struct {
+	rpcpb.UnimplementedRPCServer
+	handler http.Handler
+}
+
+// newGRPCServer builds the gRPC server, with TLS when the proxy has a
+// certificate
+func newGRPCServer(config *Config, handler http.Handler) (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+	if config.TLSCertFile != "" && config.TLSKeyFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	server := grpc.NewServer(opts...)
+	rpcpb.RegisterRPCServer(server, &grpcFrontend{handler: handler})
+	return server, nil
+}
+
+// commitmentConfig returns the JSON-RPC config object for a commitment, or
+// nil for the upstream default
+func commitmentConfig(c rpcpb.Commitment) map[string]interface{} {
+	switch c {
+	case rpcpb.Commitment_COMMITMENT_PROCESSED:
+		return map[string]interface{}{"commitment": "processed"}
+	case rpcpb.Commitment_COMMITMENT_CONFIRMED:
+		return map[string]interface{}{"commitment": "confirmed"}
+	case rpcpb.Commitment_COMMITMENT_FINALIZED:
+		return map[string]interface{}{"commitment": "finalized"}
+	}
+	return nil
+}
+
+// call runs a JSON-RPC request through the proxy and decodes its result
+func (g *grpcFrontend) call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	rpcReq := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method}
+	if params != nil {
+		rpcReq["params"] = params
+	}
+	body, err := json.Marshal(rpcReq)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return g.callRaw(ctx, body, result)
+}
+
+// callRaw runs a JSON-RPC request body through the proxy
+func (g *grpcFrontend) callRaw(ctx context.Context, body []byte, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", bytes.NewReader(body))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Metadata becomes headers, so x-api-key, authorization and the
+	// priority header work as over HTTP
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, values := range md {
+			if strings.HasPrefix(k, ":") {
+				if k == ":authority" && len(values) > 0 {
+					req.Host = values[0]
+				}
+				continue
+			}
+			for _, v := range values {
+				req.Header.Add(k, v)
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+		if _, _, err := net.SplitHostPort(req.RemoteAddr); err != nil {
+			req.RemoteAddr = net.JoinHostPort(req.RemoteAddr, "0")
+		}
+	}
+
+	resp := newBufferedResponse()
+	g.handler.ServeHTTP(resp, req)
+
+	if resp.status != http.StatusOK {
+		return grpcStatus(ctx, resp)
+	}
+
+	var rpcResp JSONRPCResponse
+	if err := json.Unmarshal(resp.body.Bytes(), &rpcResp); err != nil {
+		return status.Error(codes.Unavailable, "invalid upstream response")
+	}
+	if rpcResp.Error != nil {
+		code := codes.Unknown
+		if rpcResp.Error.Code == -32602 {
+			code = codes.InvalidArgument
+		}
+		return status.Errorf(code, "%s (code %d)", rpcResp.Error.Message, rpcResp.Error.Code)
+	}
+	if result == nil {
+		return nil
+	}
+	if raw, ok := result.(*json.RawMessage); ok {
+		*raw = rpcResp.Result
+		return nil
+	}
+	if err := json.Unmarshal(rpcResp.Result, result); err != nil {
+		return status.Error(codes.Unavailable, "unexpected upstream result")
+	}
+	return nil
+}
+
+// grpcStatus maps a failed HTTP response to a gRPC status, passing
+// Retry-After on as trailer metadata
+func grpcStatus(ctx context.Context, resp *bufferedResponse) error {
+	if retryAfter := resp.header.Get("Retry-After"); retryAfter != "" {
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retryAfter))
+	}
+
+	msg := strings.TrimSpace(resp.body.String())
+	var rpcResp JSONRPCResponse
+	if err := json.Unmarshal(resp.body.Bytes(), &rpcResp); err == nil && rpcResp.Error != nil {
+		msg = rpcResp.Error.Message
+	}
+
+	code := codes.Unavailable
+	switch resp.status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusInternalServerError:
+		code = codes.Internal
+	}
+	return status.Error(code, msg)
+}
+
+func (g *grpcFrontend) GetSlot(ctx context.Context, req *rpcpb.GetSlotRequest) (*rpcpb.GetSlotResponse, error) {
+	var params []interface{}
+	if c := commitmentConfig(req.Commitment); c != nil {
+		params = []interface{}{c}
+	}
+	var slot uint64
+	if err := g.call(ctx, "getSlot", params, &slot); err != nil {
+		return nil, err
+	}
+	return &rpcpb.GetSlotResponse{Slot: slot}, nil
+}
+
+func (g *grpcFrontend) GetBalance(ctx context.Context, req *rpcpb.GetBalanceRequest) (*rpcpb.GetBalanceResponse, error) {
+	params := []interface{}{req.Pubkey}
+	if c := commitmentConfig(req.Commitment); c != nil {
+		params = append(params, c)
+	}
+	var result struct {
+		Context struct {
+			Slot uint64 `json:"slot"`
+		} `json:"context"`
+		Value uint64 `json:"value"`
+	}
+	if err := g.call(ctx, "getBalance", params, &result); err != nil {
+		return nil, err
+	}
+	return &rpcpb.GetBalanceResponse{ContextSlot: result.Context.Slot, Lamports: result.Value}, nil
+}
+
+func (g *grpcFrontend) GetAccountInfo(ctx context.Context, req *rpcpb.GetAccountInfoRequest) (*rpcpb.GetAccountInfoResponse, error) {
+	opts := map[string]interface{}{"encoding": "base64"}
+	for k, v := range commitmentConfig(req.Commitment) {
+		opts[k] = v
+	}
+	var result struct {
+		Context struct {
+			Slot uint64 `json:"slot"`
+		} `json:"context"`
+		Value *struct {
+			Lamports   uint64   `json:"lamports"`
+			Owner      string   `json:"owner"`
+			Executable bool     `json:"executable"`
+			RentEpoch  uint64   `json:"rentEpoch"`
+			Data       []string `json:"data"`
+		} `json:"value"`
+	}
+	if err := g.call(ctx, "getAccountInfo", []interface{}{req.Pubkey, opts}, &result); err != nil {
+		return nil, err
+	}
+
+	resp := &rpcpb.GetAccountInfoResponse{ContextSlot: result.Context.Slot}
+	if v := result.Value; v != nil {
+		resp.Exists = true
+		resp.Lamports = v.Lamports
+		resp.Owner = v.Owner
+		resp.Executable = v.Executable
+		resp.RentEpoch = v.RentEpoch
+		if len(v.Data) > 0 {
+			data, err := base64.StdEncoding.DecodeString(v.Data[0])
+			if err != nil {
+				return nil, status.Error(codes.Unavailable, "invalid account data from upstream")
+			}
+			resp.Data = data
+		}
+	}
+	return resp, nil
+}
+
+func (g *grpcFrontend) GetLatestBlockhash(ctx context.Context, req *rpcpb.GetLatestBlockhashRequest) (*rpcpb.GetLatestBlockhashResponse, error) {
+	var params []interface{}
+	if c := commitmentConfig(req.Commitment); c != nil {
+		params = []interface{}{c}
+	}
+	var result struct {
+		Context struct {
+			Slot uint64 `json:"slot"`
+		} `json:"context"`
+		Value struct {
+			Blockhash            string `json:"blockhash"`
+			LastValidBlockHeight uint64 `json:"lastValidBlockHeight"`
+		} `json:"value"`
+	}
+	if err := g.call(ctx, "getLatestBlockhash", params, &result); err != nil {
+		return nil, err
+	}
+	return &rpcpb.GetLatestBlockhashResponse{
+		ContextSlot:          result.Context.Slot,
+		Blockhash:            result.Value.Blockhash,
+		LastValidBlockHeight: result.Value.LastValidBlockHeight,
+	}, nil
+}
+
+func (g *grpcFrontend) SendTransaction(ctx context.Context, req *rpcpb.SendTransactionRequest) (*rpcpb.SendTransactionResponse, error) {
+	if len(req.Transaction) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "transaction is required")
+	}
+	opts := map[string]interface{}{"encoding": "base64", "skipPreflight": req.SkipPreflight}
+	if c := commitmentConfig(req.PreflightCommitment); c != nil {
+		opts["preflightCommitment"] = c["commitment"]
+	}
+	if req.MaxRetries != nil {
+		opts["maxRetries"] = *req.MaxRetries
+	}
+
+	var signature string
+	tx := base64.StdEncoding.EncodeToString(req.Transaction)
+	if err := g.call(ctx, "sendTransaction", []interface{}{tx, opts}, &signature); err != nil {
+		return nil, err
+	}
+	return &rpcpb.SendTransactionResponse{Signature: signature}, nil
+}
+
+func (g *grpcFrontend) Call(ctx context.Context, req *rpcpb.CallRequest) (*rpcpb.CallResponse, error) {
+	if req.Method == "" {
+		return nil, status.Error(codes.InvalidArgument, "method is required")
+	}
+	rpcReq := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": req.Method}
+	if req.ParamsJson != "" {
+		var params []json.RawMessage
+		if err := json.Unmarshal([]byte(req.ParamsJson), &params); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "params_json must be a JSON array")
+		}
+		rpcReq["params"] = params
+	}
+	body, err := json.Marshal(rpcReq)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var result json.RawMessage
+	if err := g.callRaw(ctx, body, &result); err != nil {
+		return nil, err
+	}
+	return &rpcpb.CallResponse{ResultJson: string(result)}, nil
+}
+
+// serveGRPC listens on addr until the server is stopped
+func serveGRPC(server *grpc.Server, addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC on %s: %v", addr, err)
+	}
+	if err := server.Serve(l); err != nil {
+		log.Printf("[ERROR] gRPC server error: %v", err)
+	}
+}
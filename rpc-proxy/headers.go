@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers withheld unless the config lists its own. Requests never carry the
+// client's credentials for this proxy upstream; responses don't tell clients
+// which provider serves them or how close it is to its limits.
+var (
+	defaultBlockRequestHeaders  = []string{"Authorization", "Cookie", "X-API-Key", "X-Forwarded-*", "X-Real-IP", "Forwarded", "Proxy-*"}
+	defaultBlockResponseHeaders = []string{"Via", "Server", "X-Powered-By", "Set-Cookie", "Alt-Svc", "Access-Control-*", "X-RateLimit-*", "X-Rate-Limit-*", "RateLimit-*", "CF-*", "X-Amz-*", "X-Served-By", "X-Cache*"}
+)
+
+// hopHeaders belong to one connection and are never passed on. Content
+// headers are set by the proxy for the body it sends.
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+	"Content-Type":        true,
+	"Content-Encoding":    true,
+	"Accept":              true,
+	"Accept-Encoding":     true,
+	"Proxy-Authorization": true,
+	"Proxy-Authenticate":  true,
+}
+
+// headerPatterns matches header names exactly or, ending in "*", by prefix,
+// case-insensitively
+type headerPatterns struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+func parseHeaderPatterns(option string, patterns []string) (headerPatterns, error) {
+	h := headerPatterns{exact: make(map[string]bool)}
+	for _, pattern := range patterns {
+		name := http.CanonicalHeaderKey(pattern)
+		if i := strings.IndexByte(name, '*'); i >= 0 {
+			if i != len(name)-1 {
+				return h, fmt.Errorf("%s: %q may only end in *", option, pattern)
+			}
+			h.prefixes = append(h.prefixes, strings.ToLower(name[:i]))
+			continue
+		}
+		if name == "" {
+			return h, fmt.Errorf("%s: empty header name", option)
+		}
+		h.exact[name] = true
+	}
+	return h, nil
+}
+
+// match takes a canonical header name
+func (h headerPatterns) match(name string) bool {
+	if h.exact[name] {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, prefix := range h.prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerFilters decides which client headers reach the upstream and which
+// upstream headers reach the client: a header passes when it is allowed and
+// not blocked
+type headerFilters struct {
+	forwardRequest headerPatterns
+	blockRequest   headerPatterns
+	returnResponse headerPatterns
+	blockResponse  headerPatterns
+}
+
+func newHeaderFilters(config *Config) (*headerFilters, error) {
+	blockRequest, blockResponse := config.BlockRequestHeaders, config.BlockResponseHeaders
+	if blockRequest == nil {
+		blockRequest = defaultBlockRequestHeaders
+	}
+	if blockResponse == nil {
+		blockResponse = defaultBlockResponseHeaders
+	}
+	returnResponse := config.ReturnResponseHeaders
+	if returnResponse == nil {
+		returnResponse = []string{"*"}
+	}
+
+	f := &headerFilters{}
+	var err error
+	if f.forwardRequest, err = parseHeaderPatterns("forward_request_headers", config.ForwardRequestHeaders); err != nil {
+		return nil, err
+	}
+	if f.blockRequest, err = parseHeaderPatterns("block_request_headers", blockRequest); err != nil {
+		return nil, err
+	}
+	if f.returnResponse, err = parseHeaderPatterns("return_response_headers", returnResponse); err != nil {
+		return nil, err
+	}
+	if f.blockResponse, err = parseHeaderPatterns("block_response_headers", blockResponse); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// request returns the client headers to forward upstream, nil when there
+// are none
+func (f *headerFilters) request(header http.Header) http.Header {
+	if len(f.forwardRequest.exact) == 0 && len(f.forwardRequest.prefixes) == 0 {
+		return nil
+	}
+	var out http.Header
+	for name, values := range header {
+		if hopHeaders[name] || !f.forwardRequest.match(name) || f.blockRequest.match(name) {
+			continue
+		}
+		if out == nil {
+			out = make(http.Header)
+		}
+		out[name] = values
+	}
+	return out
+}
+
+// copyResponse copies the upstream headers clients may see
+func (f *headerFilters) copyResponse(dst, src http.Header) {
+	for name, values := range src {
+		if hopHeaders[name] || !f.returnResponse.match(name) || f.blockResponse.match(name) {
+			continue
+		}
+		dst[name] = values
+	}
+}
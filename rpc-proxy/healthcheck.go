@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthCheck is the -health-check mode run by Docker. By default it only
+// proves the listener answers /health; with rpc set it also sends a real
+// getSlot through the proxy, and with a reference URL it fails when the
+// proxied chain lags the reference by more than maxLag slots.
+type healthCheck struct {
+	addr      string // host:port of the proxy
+	rpc       bool
+	reference string
+	maxLag    uint64
+	client    *http.Client
+}
+
+// run performs the check, returning a description of the result
+func (h *healthCheck) run() (string, error) {
+	base := "http://" + h.addr
+	resp, err := h.client.Get(base + "/health")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if !h.rpc && h.reference == "" {
+		return "OK", nil
+	}
+
+	slot, err := h.getSlot(base + "/")
+	if err != nil {
+		return "", fmt.Errorf("getSlot through proxy: %w", err)
+	}
+	if h.reference == "" {
+		return fmt.Sprintf("OK (slot %d)", slot), nil
+	}
+
+	refSlot, err := h.getSlot(h.reference)
+	if err != nil {
+		// A reference outage says nothing about this proxy
+		return fmt.Sprintf("OK (slot %d, reference unavailable: %v)", slot, err), nil
+	}
+	if refSlot > slot && refSlot-slot > h.maxLag {
+		return "", fmt.Errorf("stale: slot %d is %d behind reference slot %d (max lag %d)", slot, refSlot-slot, refSlot, h.maxLag)
+	}
+	return fmt.Sprintf("OK (slot %d, reference %d)", slot, refSlot), nil
+}
+
+// getSlot calls getSlot on a JSON-RPC endpoint
+func (h *healthCheck) getSlot(url string) (uint64, error) {
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"getSlot"}`)
+	resp, err := h.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var rpcResp JSONRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return 0, fmt.Errorf("invalid response (status %d): %w", resp.StatusCode, err)
+	}
+	if rpcResp.Error != nil {
+		return 0, fmt.Errorf("%s (code %d)", rpcResp.Error.Message, rpcResp.Error.Code)
+	}
+	var slot uint64
+	if err := json.Unmarshal(rpcResp.Result, &slot); err != nil {
+		return 0, fmt.Errorf("unexpected result: %w", err)
+	}
+	return slot, nil
+}
+
+// newHealthCheck builds the check for the proxy listening on listenAddr
+func newHealthCheck(listenAddr string, rpc bool, reference string, maxLag uint64) *healthCheck {
+	// Extract just the port if it includes host
+	if listenAddr[0] == ':' {
+		listenAddr = "localhost" + listenAddr
+	}
+	return &healthCheck{
+		addr:      listenAddr,
+		rpc:       rpc,
+		reference: reference,
+		maxLag:    maxLag,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
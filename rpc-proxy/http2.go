@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newUpstreamTransport builds the transport used to reach an upstream, with
+// its pool tuned by tc and its connections counted in stats. HTTP/2 is
+// negotiated over TLS by default; "h2c" speaks cleartext HTTP/2 with prior
+// knowledge and "off" forces HTTP/1.1.
+func newUpstreamTransport(config *Config, tc TransportConfig, stats *connStats) (http.RoundTripper, error) {
+	tlsConfig, err := newUpstreamTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := upstreamProxyFunc(config)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver, err := newUpstreamResolver(config)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: tc.DialTimeout.Duration, KeepAlive: tc.KeepAlive.Duration}
+	dial := dialer.DialContext
+	if resolver != nil {
+		dial = resolver.dialer(dialer)
+	}
+	dial = stats.dial(dial)
+
+	switch config.UpstreamHTTP2 {
+	case "", "auto", "off":
+		transport := &http.Transport{
+			Proxy:               proxy,
+			DialContext:         dial,
+			MaxIdleConns:        tc.MaxIdleConns,
+			MaxIdleConnsPerHost: tc.MaxIdleConns,
+			MaxConnsPerHost:     tc.MaxConnsPerHost,
+			IdleConnTimeout:     tc.IdleConnTimeout.Duration,
+			TLSHandshakeTimeout: tc.TLSHandshakeTimeout.Duration,
+			DisableKeepAlives:   tc.DisableKeepAlives,
+			ForceAttemptHTTP2:   config.UpstreamHTTP2 != "off",
+			TLSClientConfig:     tlsConfig,
+		}
+		if resolver != nil {
+			go resolver.refresh(transport.CloseIdleConnections)
+		}
+		return transport, nil
+	case "h2c":
+		// One multiplexed connection serves many requests, so only the
+		// timeouts apply; http2.Transport has no connection cap, so
+		// max_conns_per_host is ignored (max_concurrency still applies)
+		transport := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			IdleConnTimeout: tc.IdleConnTimeout.Duration,
+			ReadIdleTimeout: 30 * time.Second,
+		}
+		if resolver != nil {
+			go resolver.refresh(transport.CloseIdleConnections)
+		}
+		return transport, nil
+	default:
+		return nil, fmt.Errorf("unknown upstream_http2 %q (want auto, off or h2c)", config.UpstreamHTTP2)
+	}
+}
+
+// withH2C wraps the handler so cleartext HTTP/2 (prior knowledge or
+// Upgrade: h2c) is accepted alongside HTTP/1.1
+func withH2C(handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{})
+}
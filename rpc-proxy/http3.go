@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server builds the experimental HTTP/3 (QUIC) listener. It serves
+// the same handler as the TCP listener and needs the TLS certificate.
+func newHTTP3Server(config *Config, handler http.Handler) *http3.Server {
+	addr := config.HTTP3ListenAddr
+	if addr == "" {
+		addr = config.ListenAddr
+	}
+	return &http3.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+}
+
+// withAltSvc advertises the HTTP/3 listener on TCP responses so clients can
+// switch to QUIC
+func withAltSvc(h3 *http3.Server, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			if err := h3.SetQUICHeaders(w.Header()); err != nil {
+				log.Printf("[ERROR] Failed to set Alt-Svc header: %v", err)
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// idempotencyHeader names a submission, so the client's retries get the
+	// first answer back
+	idempotencyHeader = "X-Idempotency-Key"
+	// maxIdempotencyKeyLength bounds client-chosen keys; longer ones are
+	// ignored in favour of the transaction signature
+	maxIdempotencyKeyLength = 256
+)
+
+// definitiveSendErrors are the sendTransaction error codes that a resend of
+// the same transaction would get again: invalid params, a failed signature
+// check or a failed preflight simulation. Others, such as an unhealthy node
+// or an internal error, may pass on a resend and are not remembered.
+var definitiveSendErrors = map[int]bool{
+	errInvalidParams: true,
+	-32003:           true, // transaction signature verification failure
+	-32002:           true, // transaction simulation failed
+}
+
+// idempotencyStore remembers the upstream's answer to each sendTransaction
+// for a window. A retry of the same submission gets that answer back
+// instead of reaching the upstream again; a retry arriving while the first
+// submission is still in flight waits for it. The idempotency_window store
+// recognises retries by their X-Idempotency-Key or transaction signature
+// and remembers only successful submissions, so after an error the retry
+// goes through. The send_dedup_window store recognises a client's repeats
+// of a transaction and remembers definitive error answers too.
+type idempotencyStore struct {
+	window     time.Duration
+	maxEntries int
+	keepErrors bool
+
+	mu      sync.Mutex
+	entries map[string]*idempotentCall
+	order   *list.List // of *idempotentCall, oldest first
+
+	replayed atomic.Int64
+}
+
+// idempotentCall is one submission and, once answered, its response
+type idempotentCall struct {
+	key     string
+	done    chan struct{}   // closed when the submission finished
+	result  json.RawMessage // the upstream's result, nil if it failed
+	rpcErr  json.RawMessage // the upstream's error answer, if errors are kept
+	expires time.Time
+	el      *list.Element
+}
+
+// newIdempotencyStore returns nil when the window is 0
+func newIdempotencyStore(window time.Duration, maxEntries int, keepErrors bool) *idempotencyStore {
+	if window <= 0 {
+		return nil
+	}
+	if maxEntries <= 0 {
+		maxEntries = 100000
+	}
+	return &idempotencyStore{
+		window:     window,
+		maxEntries: maxEntries,
+		keepErrors: keepErrors,
+		entries:    make(map[string]*idempotentCall),
+		order:      list.New(),
+	}
+}
+
+// begin returns the submission with the key, and whether the caller is the
+// first to submit it and so has to finish it
+func (s *idempotencyStore) begin(key string, now time.Time) (*idempotentCall, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if call, ok := s.entries[key]; ok {
+		if call.expires.IsZero() || now.Before(call.expires) {
+			return call, false
+		}
+		s.remove(call)
+	}
+	call := &idempotentCall{key: key, done: make(chan struct{})}
+	call.el = s.order.PushBack(call)
+	s.entries[key] = call
+	for s.order.Len() > s.maxEntries {
+		s.remove(s.order.Front().Value.(*idempotentCall))
+	}
+	return call, true
+}
+
+// complete records the upstream's response to a submission, if it
+// succeeded or the store keeps errors and the error is definitive
+func (s *idempotencyStore) complete(call *idempotentCall, body []byte) {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return
+	}
+	if resp.Error == nil && resp.Result != nil {
+		call.result = append(json.RawMessage(nil), resp.Result...)
+		return
+	}
+	var rpcErr JSONRPCError
+	if resp.Error != nil && s.keepErrors && json.Unmarshal(resp.Error, &rpcErr) == nil && definitiveSendErrors[rpcErr.Code] {
+		call.rpcErr = append(json.RawMessage(nil), resp.Error...)
+	}
+}
+
+// answered reports whether the submission's answer was recorded
+func (c *idempotentCall) answered() bool {
+	return c.result != nil || c.rpcErr != nil
+}
+
+// finish wakes the retries waiting for a submission. Without a completed
+// response the key is forgotten, so the next retry is sent upstream.
+func (s *idempotencyStore) finish(call *idempotentCall) {
+	s.mu.Lock()
+	if call.answered() {
+		call.expires = time.Now().Add(s.window)
+	} else if s.entries[call.key] == call {
+		s.remove(call)
+	}
+	s.mu.Unlock()
+	close(call.done)
+}
+
+// remove drops a submission; s.mu must be held
+func (s *idempotencyStore) remove(call *idempotentCall) {
+	if s.entries[call.key] == call {
+		delete(s.entries, call.key)
+	}
+	s.order.Remove(call.el)
+}
+
+func (s *idempotencyStore) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"entries":  s.order.Len(),
+		"replayed": s.replayed.Load(),
+	}
+}
+
+// resetCounters zeroes the replay count for /admin/metrics/reset
+func (s *idempotencyStore) resetCounters() {
+	if s == nil {
+		return
+	}
+	s.replayed.Store(0)
+}
+
+// idempotencyKey identifies a sendTransaction submission: the client's
+// X-Idempotency-Key, scoped to its API key or IP, or else the signature of
+// the transaction, which is the same for every resend of it
+func (p *RPCProxy) idempotencyKey(r *http.Request, clientIP string, params json.RawMessage) string {
+	if key := r.Header.Get(idempotencyHeader); key != "" && len(key) <= maxIdempotencyKeyLength {
+		account, kind := p.clientAccount(r, clientIP)
+		return kind + ":" + account + ":" + key
+	}
+	if signature := transactionSignature(params); signature != "" {
+		return "signature:" + signature
+	}
+	return ""
+}
+
+// transactionSignature returns the first signature of the transaction in
+// sendTransaction params, base58 encoded, or "" if it can't be decoded
+func transactionSignature(params json.RawMessage) string {
+	tx := transactionParam(params)
+	if tx == nil {
+		return ""
+	}
+
+	// A transaction starts with the compact-u16 number of signatures,
+	// followed by the 64-byte signatures
+	if tx[0] == 0 || tx[0]&0x80 != 0 || len(tx) < 1+64 {
+		return ""
+	}
+	return base58Encode(tx[1 : 1+64])
+}
+
+// transactionParam decodes the transaction in sendTransaction or
+// simulateTransaction params, or returns nil if it can't
+func transactionParam(params json.RawMessage) []byte {
+	var args []json.RawMessage
+	var encoded string
+	var config struct {
+		Encoding string `json:"encoding"`
+	}
+	if json.Unmarshal(params, &args) != nil || len(args) == 0 || json.Unmarshal(args[0], &encoded) != nil {
+		return nil
+	}
+	if len(args) > 1 {
+		json.Unmarshal(args[1], &config)
+	}
+
+	var tx []byte
+	var err error
+	if config.Encoding == "base64" {
+		tx, err = base64.StdEncoding.DecodeString(encoded)
+	} else {
+		tx, err = base58Decode(encoded)
+	}
+	if err != nil || len(tx) == 0 {
+		return nil
+	}
+	return tx
+}
+
+// sendDedupKey identifies a client's submissions of one transaction: its
+// API key or IP and the transaction signature
+func (p *RPCProxy) sendDedupKey(r *http.Request, clientIP string, params json.RawMessage) string {
+	signature := transactionSignature(params)
+	if signature == "" {
+		return ""
+	}
+	account, kind := p.clientAccount(r, clientIP)
+	return kind + ":" + account + ":" + signature
+}
+
+// replay begins the submission with the key, or answers the request with
+// the first submission's answer once it has one. It returns the submission
+// when the caller is first and has to complete and finish it, and whether
+// the request has been answered.
+func (p *RPCProxy) replay(w http.ResponseWriter, r *http.Request, store *idempotencyStore, key string, id interface{}) (*idempotentCall, bool) {
+	if key == "" {
+		return nil, false
+	}
+	call, first := store.begin(key, time.Now())
+	if first {
+		return call, false
+	}
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return nil, true
+	}
+	if !call.answered() {
+		return nil, false
+	}
+	p.writeReplay(w, id, store, call)
+	return nil, true
+}
+
+// writeReplay answers a retried submission with the answer to the first,
+// under the retry's id
+func (p *RPCProxy) writeReplay(w http.ResponseWriter, id interface{}, store *idempotencyStore, call *idempotentCall) {
+	var out []byte
+	if call.rpcErr != nil {
+		idJSON, _ := json.Marshal(id)
+		out = batchEntry(idJSON, nil, call.rpcErr)
+	} else {
+		out, _ = json.Marshal(JSONRPCResponse{JSONRPC: "2.0", ID: id, Result: call.result})
+	}
+	store.replayed.Add(1)
+	p.metrics.BytesOut.Add(int64(len(out)))
+	p.metrics.SuccessRequests.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Write(out)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ipLimiterShards is the number of independently locked shards. A power of
+// two so the shard can be picked with a mask.
+const ipLimiterShards = 64
+
+// ipLimiterMap holds the per-IP limiters, sharded by IP hash so concurrent
+// requests from different IPs rarely share a lock. Each shard is an LRU
+// capped at its share of max_ip_limiters, so a flood of unique (spoofed) IPs
+// evicts the least recently seen limiters instead of growing without bound.
+type ipLimiterMap struct {
+	shards   [ipLimiterShards]ipLimiterShard
+	shardCap int
+	size     atomic.Int64
+	evicted  atomic.Int64
+}
+
+type ipLimiterShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element // values are *ipLimiterEntry
+	lru     list.List                // front = most recently used
+}
+
+type ipLimiterEntry struct {
+	ip string
+	ipLimiter
+}
+
+func newIPLimiterMap(maxEntries int) *ipLimiterMap {
+	m := &ipLimiterMap{}
+	if maxEntries > 0 {
+		m.shardCap = (maxEntries + ipLimiterShards - 1) / ipLimiterShards
+	}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[string]*list.Element)
+	}
+	return m
+}
+
+// shard returns the shard for an IP (FNV-1a)
+func (m *ipLimiterMap) shard(ip string) *ipLimiterShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(ip); i++ {
+		h ^= uint32(ip[i])
+		h *= 16777619
+	}
+	return &m.shards[h&(ipLimiterShards-1)]
+}
+
+// get returns the limiter for an IP, creating it with newLimiter if needed
+func (m *ipLimiterMap) get(ip string, newLimiter func() requestLimiter) requestLimiter {
+	s := m.shard(ip)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, exists := s.entries[ip]; exists {
+		entry := el.Value.(*ipLimiterEntry)
+		entry.lastAccess = now
+		s.lru.MoveToFront(el)
+		return entry.limiter
+	}
+
+	entry := &ipLimiterEntry{ip: ip, ipLimiter: ipLimiter{limiter: newLimiter(), lastAccess: now}}
+	s.entries[ip] = s.lru.PushFront(entry)
+	m.size.Add(1)
+
+	// Evict the least recently used IPs once the shard is full
+	for m.shardCap > 0 && len(s.entries) > m.shardCap {
+		oldest := s.lru.Back()
+		delete(s.entries, oldest.Value.(*ipLimiterEntry).ip)
+		s.lru.Remove(oldest)
+		m.size.Add(-1)
+		m.evicted.Add(1)
+	}
+
+	return entry.limiter
+}
+
+// cleanup removes limiters not used within ttl
+func (m *ipLimiterMap) cleanup(ttl time.Duration) {
+	now := time.Now()
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		for el := s.lru.Back(); el != nil; el = s.lru.Back() {
+			entry := el.Value.(*ipLimiterEntry)
+			if now.Sub(entry.lastAccess) <= ttl {
+				break
+			}
+			delete(s.entries, entry.ip)
+			s.lru.Remove(el)
+			m.size.Add(-1)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// each calls fn with every tracked limiter
+func (m *ipLimiterMap) each(fn func(requestLimiter)) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		for _, el := range s.entries {
+			fn(el.Value.(*ipLimiterEntry).limiter)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// len returns the number of tracked IPs
+func (m *ipLimiterMap) len() int64 {
+	return m.size.Load()
+}
+
+// ipPrefixKey returns the rate limiting key for an IP: the IP itself, or its
+// network when a prefix length is configured for its address family, e.g.
+// 2001:db8:1:2::/64 so a client can't dodge limits by rotating through its
+// own IPv6 /64
+func ipPrefixKey(ip string, v4Prefix, v6Prefix int) string {
+	if v4Prefix <= 0 && v6Prefix <= 0 {
+		return ip
+	}
+
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		if v4Prefix <= 0 || v4Prefix >= 32 {
+			return ip
+		}
+		return fmt.Sprintf("%s/%d", v4.Mask(net.CIDRMask(v4Prefix, 32)), v4Prefix)
+	}
+	if v6Prefix <= 0 || v6Prefix >= 128 {
+		return ip
+	}
+	return fmt.Sprintf("%s/%d", parsed.Mask(net.CIDRMask(v6Prefix, 128)), v6Prefix)
+}
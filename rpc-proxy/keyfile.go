@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Errors for keys from the keys file that may no longer be used
+var (
+	errKeyRevoked = errors.New("API key revoked")
+	errKeyExpired = errors.New("API key expired")
+)
+
+// keyFileEntry is an API key in the keys file. Only the key's hash is
+// stored; the key itself is shown once, when it is generated.
+type keyFileEntry struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`       // "sha256:<hex>"
+	Prefix    string     `json:"prefix"`     // first characters of the key, to recognise it
+	Priority  string     `json:"priority"`   // "high", "normal" (default) or "low"
+	RateLimit float64    `json:"rate_limit"` // requests per second for this key, 0 = no per-key limit
+	BurstSize int        `json:"burst_size"` // defaults to the rate limit, at least 1
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// keyFile is the on-disk keys file managed by `rpc-proxy keys`
+type keyFile struct {
+	Keys []keyFileEntry `json:"keys"`
+}
+
+// hashAPIKey returns the stored form of a key
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// readKeyFile loads a keys file. A missing file is an empty one, so keys
+// generate can create it.
+func readKeyFile(path string) (*keyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &keyFile{}, nil
+		}
+		return nil, err
+	}
+
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &f, nil
+}
+
+// write replaces the keys file atomically, readable only by its owner
+func (f *keyFile) write(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keys-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileKey is a loaded keys file entry
+type fileKey struct {
+	keyFileEntry
+	priority priority
+	limiter  requestLimiter // nil without a per-key rate limit
+}
+
+// keyStore serves the keys file to the running proxy and reloads it when it
+// changes. It is shared by every tenant and vhost using the same file.
+type keyStore struct {
+	path string
+
+	mu      sync.RWMutex
+	byHash  map[string]*fileKey
+	modTime time.Time
+	size    int64
+}
+
+func newKeyStore(path string) (*keyStore, error) {
+	s := &keyStore{path: path}
+	if _, err := s.reload(); err != nil {
+		return nil, fmt.Errorf("api_keys_file: %w", err)
+	}
+	return s, nil
+}
+
+// reload reads the file if it changed since the last load, keeping the
+// limiters of keys whose limits are unchanged. It returns whether the keys
+// were replaced.
+func (s *keyStore) reload() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	unchanged := info.ModTime().Equal(s.modTime) && info.Size() == s.size
+	old := s.byHash
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	f, err := readKeyFile(s.path)
+	if err != nil {
+		return false, err
+	}
+
+	byHash := make(map[string]*fileKey, len(f.Keys))
+	for _, e := range f.Keys {
+		pr, err := parsePriority(e.Priority)
+		if err != nil {
+			return false, fmt.Errorf("key %s: %w", e.ID, err)
+		}
+		k := &fileKey{keyFileEntry: e, priority: pr}
+		if e.RateLimit > 0 {
+			if prev, ok := old[e.Hash]; ok && prev.RateLimit == e.RateLimit && prev.BurstSize == e.BurstSize {
+				k.limiter = prev.limiter
+			} else {
+				burst := e.BurstSize
+				if burst <= 0 {
+					// At least 1, or a key under 0.5 req/s could never send
+					burst = max(int(e.RateLimit+0.5), 1)
+				}
+				k.limiter = newRequestLimiter("", e.RateLimit, burst, 0)
+			}
+		}
+		byHash[e.Hash] = k
+	}
+
+	s.mu.Lock()
+	s.byHash = byHash
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads the file every interval until the process exits
+func (s *keyStore) watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	for range time.Tick(interval) {
+		changed, err := s.reload()
+		if err != nil {
+			log.Printf("[ERROR] Failed to reload api_keys_file, keeping previous keys: %v", err)
+			continue
+		}
+		if changed {
+			s.mu.RLock()
+			n := len(s.byHash)
+			s.mu.RUnlock()
+			log.Printf("[KEYS] Reloaded %s: %d keys", s.path, n)
+		}
+	}
+}
+
+// limiterUsage returns the slots in use of each key's limiter, by key ID
+func (s *keyStore) limiterUsage(now time.Time) map[string]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	usage := make(map[string]float64)
+	for _, k := range s.byHash {
+		if k.limiter != nil {
+			usage[k.ID] = k.limiter.used(now)
+		}
+	}
+	return usage
+}
+
+// restoreLimiters takes back the slots saved by limiterUsage
+func (s *keyStore) restoreLimiters(usage map[string]float64, savedAt, now time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.byHash {
+		if used, ok := usage[k.ID]; ok && k.limiter != nil {
+			k.limiter.restoreUsed(used, savedAt, now)
+		}
+	}
+}
+
+// lookup finds a presented key. Unknown keys return nil and no error;
+// revoked and expired keys return an error.
+func (s *keyStore) lookup(key string) (*fileKey, error) {
+	if s == nil || key == "" {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	k := s.byHash[hashAPIKey(key)]
+	s.mu.RUnlock()
+	switch {
+	case k == nil:
+		return nil, nil
+	case k.RevokedAt != nil:
+		return nil, errKeyRevoked
+	case k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt):
+		return nil, errKeyExpired
+	}
+	return k, nil
+}
+
+// fileKeyName returns the name of a valid key from the keys file
+func (s *keyStore) fileKeyName(key string) (string, bool) {
+	k, _ := s.lookup(key)
+	if k == nil {
+		return "", false
+	}
+	if k.Name != "" {
+		return k.Name, true
+	}
+	return k.Prefix + "...", true
+}
+
+// allowKey applies a key's own rate limit, rejecting the request when the
+// key has used it up
+func (p *RPCProxy) allowKey(w http.ResponseWriter, k *fileKey, logIP string) bool {
+	if k.limiter.Allow() {
+		return true
+	}
+	p.metrics.RateLimited.Add(1)
+
+	reservation := k.limiter.Reserve()
+	delay := reservation.Delay()
+	reservation.Cancel()
+	retryAfter := int(delay.Seconds()) + 1
+
+	if p.config.LogRequests {
+		log.Printf("[RATE] IP: %s key %s rate limited, retry in %ds", logIP, k.ID, retryAfter)
+	}
+	p.writeRateLimitError(w, nil, retryAfter)
+	return false
+}
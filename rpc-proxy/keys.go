@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// apiKeyPrefix marks generated keys so they are recognisable in logs and
+// secret scanners
+const apiKeyPrefix = "rpk_"
+
+// newAPIKey returns a random API key with 192 bits of entropy
+func newAPIKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// keysFileFlag names the keys file every keys subcommand works on
+func keysFileFlag(required bool) cli.Flag {
+	return &cli.StringFlag{
+		Name:     "file",
+		Usage:    "keys `file`, the proxy's api_keys_file",
+		EnvVars:  []string{"RPC_KEYS_FILE"},
+		Required: required,
+	}
+}
+
+// keysCommand is `rpc-proxy keys`
+func keysCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "keys",
+		Usage: "manage API keys in a keys file",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "generate",
+				Usage: "create a key and print it (only its hash is stored)",
+				Flags: []cli.Flag{
+					keysFileFlag(false),
+					&cli.StringFlag{Name: "name", Usage: "account name in usage analytics and logs"},
+					&cli.StringFlag{Name: "priority", Usage: "high, normal or low", Value: "normal"},
+					&cli.Float64Flag{Name: "rate", Usage: "requests per second for this key, 0 = no per-key limit"},
+					&cli.IntFlag{Name: "burst", Usage: "burst size, defaults to the rate"},
+					&cli.DurationFlag{Name: "expires-in", Usage: "expire the key after this long, e.g. 720h"},
+				},
+				Action: generateKey,
+			},
+			{
+				Name:   "list",
+				Usage:  "list the keys in a keys file",
+				Flags:  []cli.Flag{keysFileFlag(true)},
+				Action: listKeys,
+			},
+			{
+				Name:      "revoke",
+				Usage:     "revoke a key by ID, name, prefix or the key itself",
+				ArgsUsage: "<id|name|prefix|key>",
+				Flags:     []cli.Flag{keysFileFlag(true)},
+				Action:    revokeKey,
+			},
+		},
+	}
+}
+
+// generateKey creates a key. Without a keys file the key is only printed,
+// for the api_keys config.
+func generateKey(c *cli.Context) error {
+	key, err := newAPIKey()
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	path := c.String("file")
+	if path == "" {
+		fmt.Println(key)
+		return nil
+	}
+
+	if _, err := parsePriority(c.String("priority")); err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+	f, err := readKeyFile(path)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	entry := keyFileEntry{
+		ID:        hex.EncodeToString(id),
+		Name:      c.String("name"),
+		Hash:      hashAPIKey(key),
+		Prefix:    key[:len(apiKeyPrefix)+4],
+		Priority:  c.String("priority"),
+		RateLimit: c.Float64("rate"),
+		BurstSize: c.Int("burst"),
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if d := c.Duration("expires-in"); d > 0 {
+		expires := entry.CreatedAt.Add(d)
+		entry.ExpiresAt = &expires
+	}
+	f.Keys = append(f.Keys, entry)
+	if err := f.write(path); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Added key %s to %s. Store it now, it is not shown again:\n", entry.ID, path)
+	fmt.Println(key)
+	return nil
+}
+
+// listKeys prints the keys in a keys file, without the keys themselves
+func listKeys(c *cli.Context) error {
+	f, err := readKeyFile(c.String("file"))
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tPRIORITY\tRATE\tCREATED\tEXPIRES\tSTATUS")
+	for _, k := range f.Keys {
+		rate := "-"
+		if k.RateLimit > 0 {
+			rate = fmt.Sprintf("%g/s", k.RateLimit)
+		}
+		expires := "never"
+		if k.ExpiresAt != nil {
+			expires = k.ExpiresAt.Format(time.RFC3339)
+		}
+		status := "active"
+		switch {
+		case k.RevokedAt != nil:
+			status = "revoked"
+		case k.ExpiresAt != nil && now.After(*k.ExpiresAt):
+			status = "expired"
+		}
+		priority := k.Priority
+		if priority == "" {
+			priority = "normal"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s...\t%s\t%s\t%s\t%s\t%s\n",
+			k.ID, k.Name, k.Prefix, priority, rate, k.CreatedAt.Format(time.RFC3339), expires, status)
+	}
+	return tw.Flush()
+}
+
+// revokeKey marks a key revoked. The entry stays in the file so the proxy
+// can tell clients why their key stopped working.
+func revokeKey(c *cli.Context) error {
+	ref := c.Args().First()
+	if ref == "" || c.NArg() > 1 {
+		return cli.Exit("usage: rpc-proxy keys revoke -file <keys file> <id|name|prefix|key>", 2)
+	}
+
+	path := c.String("file")
+	f, err := readKeyFile(path)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	// The key itself also works, for revoking a leaked key
+	hash := hashAPIKey(ref)
+	ref = strings.TrimSuffix(ref, "...")
+	var matches []int
+	for i, k := range f.Keys {
+		if k.RevokedAt == nil && (k.ID == ref || k.Name == ref || k.Prefix == ref || k.Hash == hash) {
+			matches = append(matches, i)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return cli.Exit(fmt.Sprintf("no active key matches %q", ref), 1)
+	case 1:
+	default:
+		return cli.Exit(fmt.Sprintf("%d active keys match %q, revoke by ID", len(matches), ref), 1)
+	}
+
+	k := &f.Keys[matches[0]]
+	now := time.Now().UTC().Truncate(time.Second)
+	k.RevokedAt = &now
+	if err := f.write(path); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	fmt.Printf("Revoked key %s (%s)\n", k.ID, k.Name)
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyAlpha is the weight of a new sample in the moving averages
+	latencyAlpha = 0.2
+	// latencyIdleHalfLife halves the average of an upstream that hasn't
+	// been measured for that long, so a slow upstream that recovered gets
+	// tried again
+	latencyIdleHalfLife = 30 * time.Second
+	// maxLatencyMethods bounds the methods measured per upstream, further
+	// methods share the "other" average
+	maxLatencyMethods = 100
+)
+
+// ewma is an exponentially weighted moving average of latencies
+type ewma struct {
+	ms   float64
+	seen time.Time
+}
+
+func (e *ewma) add(ms float64, now time.Time) {
+	if e.seen.IsZero() {
+		e.ms = ms
+	} else {
+		e.ms += latencyAlpha * (ms - e.ms)
+	}
+	e.seen = now
+}
+
+// score is the average, decayed while the upstream goes unmeasured
+func (e *ewma) score(now time.Time) float64 {
+	idle := now.Sub(e.seen)
+	return e.ms * math.Pow(0.5, idle.Seconds()/latencyIdleHalfLife.Seconds())
+}
+
+// upstreamLatency tracks an upstream's response latency per method and
+// overall, measured to the response headers
+type upstreamLatency struct {
+	mu      sync.Mutex
+	overall ewma
+	methods map[string]*ewma
+}
+
+func newUpstreamLatency() *upstreamLatency {
+	return &upstreamLatency{methods: make(map[string]*ewma)}
+}
+
+func (l *upstreamLatency) observe(method string, d time.Duration, now time.Time) {
+	ms := float64(d.Microseconds()) / 1000
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.overall.add(ms, now)
+	if method == "" {
+		return
+	}
+	e := l.methods[method]
+	if e == nil {
+		if len(l.methods) >= maxLatencyMethods {
+			method = "other"
+			e = l.methods[method]
+		}
+		if e == nil {
+			e = &ewma{}
+			l.methods[method] = e
+		}
+	}
+	e.add(ms, now)
+}
+
+// score is the method's average, or the overall one while the method hasn't
+// been measured on this upstream. Unmeasured upstreams score 0, so they are
+// tried.
+func (l *upstreamLatency) score(method string, now time.Time) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e := l.methods[method]; e != nil {
+		return e.score(now)
+	}
+	if !l.overall.seen.IsZero() {
+		return l.overall.score(now)
+	}
+	return 0
+}
+
+// snapshot returns the averages in milliseconds for /metrics
+func (l *upstreamLatency) snapshot() map[string]float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	snapshot := make(map[string]float64, len(l.methods)+1)
+	if !l.overall.seen.IsZero() {
+		snapshot["*"] = math.Round(l.overall.ms*10) / 10
+	}
+	for method, e := range l.methods {
+		snapshot[method] = math.Round(e.ms*10) / 10
+	}
+	return snapshot
+}
+
+// preferFastest moves the faster of two random healthy primary upstreams to
+// the front (power of two choices), keeping the rest as failover. Picking
+// from two rather than always the fastest keeps load from piling onto one
+// upstream between measurements. A supervised node catching up is never
+// picked, however fast it answers.
+func preferFastest(candidates []*upstream, method string, now time.Time) []*upstream {
+	n := 0
+	for n < len(candidates) && !candidates[n].fallback && !candidates[n].catchingUp.Load() && !candidates[n].budget.exhausted() {
+		n++
+	}
+	if n < 2 {
+		return candidates
+	}
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	if b.latency.score(method, now) < a.latency.score(method, now) {
+		a = b
+	}
+	return preferUpstream(candidates, a)
+}
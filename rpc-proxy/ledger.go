@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ledgerSlot returns the first slot a block read needs
+func ledgerSlot(method string, params json.RawMessage) (uint64, bool) {
+	if _, _, ok := blockLimits(method); !ok && method != "getBlockTime" {
+		return 0, false
+	}
+	var args []json.RawMessage
+	var slot uint64
+	if json.Unmarshal(params, &args) != nil || len(args) == 0 || json.Unmarshal(args[0], &slot) != nil {
+		return 0, false
+	}
+	return slot, true
+}
+
+// holds reports whether the upstream's ledger reaches back to the slot, true
+// while that is unknown
+func (u *upstream) holds(slot uint64) bool {
+	first := u.ledgerFirst.Load()
+	return first < 0 || uint64(first) <= slot
+}
+
+// ledgerFloor returns the first slot any upstream of the pool serves blocks
+// from. It is false until every upstream has reported its ledger, so a slot
+// is only refused once it is known that nobody holds it.
+func (p *upstreamPool) ledgerFloor() (uint64, bool) {
+	var floor int64 = -1
+	for _, u := range p.upstreams {
+		first := u.ledgerFirst.Load()
+		if first < 0 {
+			return 0, false
+		}
+		if floor < 0 || first < floor {
+			floor = first
+		}
+	}
+	return uint64(floor), floor >= 0
+}
+
+// holding orders the candidates so upstreams whose ledger reaches back to
+// slot come first. The others stay at the end, as their ledger may have been
+// polled before a restore.
+func (p *upstreamPool) holding(candidates []*upstream, slot uint64) []*upstream {
+	if !p.ledgerAvailability || slot == 0 || len(candidates) < 2 {
+		return candidates
+	}
+	held := make([]*upstream, 0, len(candidates))
+	var purged []*upstream
+	for _, u := range candidates {
+		if u.holds(slot) {
+			held = append(held, u)
+		} else {
+			purged = append(purged, u)
+		}
+	}
+	if len(purged) > 0 && len(held) > 0 && purged[0] == candidates[0] {
+		debugf(debugUpstream, "slot %d: %s skipped, its ledger starts at %d", slot, purged[0].name, purged[0].ledgerFirst.Load())
+	}
+	return append(held, purged...)
+}
+
+// checkLedger refuses a read of a block purged from the ledger of every
+// upstream, answering with the error a node returns for it without the
+// round trip. Block ranges are left alone: a node answers those with the
+// blocks it still has.
+func (p *RPCProxy) checkLedger(method string, params json.RawMessage) *JSONRPCError {
+	if !p.pool.ledgerAvailability {
+		return nil
+	}
+	if ranged, limited, _ := blockLimits(method); ranged || limited {
+		return nil
+	}
+	slot, ok := ledgerSlot(method, params)
+	if !ok {
+		return nil
+	}
+	floor, known := p.pool.ledgerFloor()
+	if !known || slot >= floor {
+		return nil
+	}
+	p.ledgerRefusals.Add(1)
+	return &JSONRPCError{
+		Code:    errBlockCleanedUp,
+		Message: fmt.Sprintf("Block %d cleaned up, does not exist on node. First available block: %d", slot, floor),
+	}
+}
+
+// checkLedgers polls the first available block of every upstream, falling
+// back to its minimum ledger slot for nodes that don't answer
+// getFirstAvailableBlock. An upstream that answers neither keeps what it
+// reported last.
+func (p *RPCProxy) checkLedgers(ctx context.Context) {
+	for _, u := range p.pool.upstreams {
+		var first uint64
+		err := p.pool.call(ctx, u, "getFirstAvailableBlock", nil, &first)
+		if err != nil {
+			err = p.pool.call(ctx, u, "minimumLedgerSlot", nil, &first)
+		}
+		if err != nil {
+			debugf(debugUpstream, "%s: ledger check failed: %v", u.name, err)
+			continue
+		}
+		u.ledgerFirst.Store(int64(first))
+	}
+}
+
+// watchLedgers keeps the availability map current
+func (p *RPCProxy) watchLedgers(interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval+5*time.Second)
+		p.checkLedgers(ctx)
+		cancel()
+		time.Sleep(interval)
+	}
+}
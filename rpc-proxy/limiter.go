@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// requestLimiter admits requests according to a rate limiting algorithm
+type requestLimiter interface {
+	// Allow claims a slot if one is available now
+	Allow() bool
+	// AllowN claims n slots if they are all available now
+	AllowN(n int) bool
+	// Reserve claims the next available slot, which may be in the future
+	Reserve() limiterReservation
+	// ReserveN claims the next n slots
+	ReserveN(n int) limiterReservation
+	// Burst is the most slots a single claim can take
+	Burst() int
+	// wait is how long a claim of one slot would wait at now, without
+	// claiming it
+	wait(now time.Time) time.Duration
+	// used is how many slots are taken at now, saved across restarts
+	used(now time.Time) float64
+	// restoreUsed takes the slots that were in use at savedAt and haven't
+	// been freed since
+	restoreUsed(used float64, savedAt, now time.Time)
+	// setRate changes the rate and burst in place, keeping the slots in use
+	setRate(rps float64, burst int)
+}
+
+// limiterReservation is a claimed slot
+type limiterReservation interface {
+	// OK is false if the request can never be admitted
+	OK() bool
+	// Delay is how long to wait until the slot starts
+	Delay() time.Duration
+	// Cancel gives the slot back
+	Cancel()
+}
+
+// newRequestLimiter returns a limiter for the algorithm. Token bucket allows
+// rps with bursts of burst; the window algorithms allow rps*window requests
+// per window with no extra burst.
+func newRequestLimiter(algorithm string, rps float64, burst int, window time.Duration) requestLimiter {
+	switch algorithm {
+	case "sliding_window":
+		return &slidingWindowLimiter{limit: windowLimit(rps, window), window: window}
+	case "fixed_window":
+		return &fixedWindowLimiter{limit: windowLimit(rps, window), window: window, counts: make(map[int64]int)}
+	default:
+		return tokenBucketLimiter{rate.NewLimiter(rate.Limit(rps), burst)}
+	}
+}
+
+// validateLimiterAlgorithm checks a configured rate limiting algorithm
+func validateLimiterAlgorithm(algorithm string, window time.Duration) error {
+	switch algorithm {
+	case "", "token_bucket":
+		return nil
+	case "sliding_window", "fixed_window":
+		if window <= 0 {
+			return fmt.Errorf("%s requires a positive rate_limit_window", algorithm)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown rate limit algorithm %q (want token_bucket, sliding_window or fixed_window)", algorithm)
+}
+
+// windowLimit returns the number of requests allowed per window
+func windowLimit(rps float64, window time.Duration) int {
+	limit := int(math.Round(rps * window.Seconds()))
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// tokenBucketLimiter is the default algorithm, backed by x/time/rate
+type tokenBucketLimiter struct {
+	*rate.Limiter
+}
+
+func (l tokenBucketLimiter) AllowN(n int) bool {
+	return l.Limiter.AllowN(time.Now(), n)
+}
+
+func (l tokenBucketLimiter) Reserve() limiterReservation {
+	return l.Limiter.Reserve()
+}
+
+func (l tokenBucketLimiter) ReserveN(n int) limiterReservation {
+	return l.Limiter.ReserveN(time.Now(), n)
+}
+
+func (l tokenBucketLimiter) wait(now time.Time) time.Duration {
+	deficit := 1 - l.TokensAt(now)
+	if deficit <= 0 || l.Limit() == rate.Inf {
+		return 0
+	}
+	if l.Limit() <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(deficit / float64(l.Limit()) * float64(time.Second))
+}
+
+func (l tokenBucketLimiter) used(now time.Time) float64 {
+	return math.Max(0, math.Min(float64(l.Limiter.Burst()), float64(l.Limiter.Burst())-l.TokensAt(now)))
+}
+
+func (l tokenBucketLimiter) restoreUsed(used float64, savedAt, now time.Time) {
+	used -= now.Sub(savedAt).Seconds() * float64(l.Limit()) // refilled meanwhile
+	if n := int(math.Ceil(math.Min(used, float64(l.Limiter.Burst())))); n > 0 {
+		l.Limiter.AllowN(now, n)
+	}
+}
+
+func (l tokenBucketLimiter) setRate(rps float64, burst int) {
+	now := time.Now()
+	l.Limiter.SetLimitAt(now, rate.Limit(rps))
+	l.Limiter.SetBurstAt(now, burst)
+}
+
+// windowReservation is a slot claimed from a window limiter
+type windowReservation struct {
+	ok     bool
+	delay  time.Duration
+	cancel func()
+}
+
+func (r windowReservation) OK() bool             { return r.ok }
+func (r windowReservation) Delay() time.Duration { return r.delay }
+func (r windowReservation) Cancel()              { r.cancel() }
+
+// slidingWindowLimiter allows at most limit requests in any window-long
+// interval, using a log of admission times
+type slidingWindowLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	times  []time.Time // ascending, may include reserved future slots
+}
+
+func (l *slidingWindowLimiter) Allow() bool {
+	return l.AllowN(1)
+}
+
+func (l *slidingWindowLimiter) AllowN(n int) bool {
+	r := l.reserve(time.Now(), n)
+	if !r.ok || r.delay > 0 {
+		r.Cancel()
+		return false
+	}
+	return true
+}
+
+func (l *slidingWindowLimiter) Reserve() limiterReservation {
+	return l.reserve(time.Now(), 1)
+}
+
+func (l *slidingWindowLimiter) ReserveN(n int) limiterReservation {
+	return l.reserve(time.Now(), n)
+}
+
+func (l *slidingWindowLimiter) Burst() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *slidingWindowLimiter) setRate(rps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = windowLimit(rps, l.window)
+}
+
+func (l *slidingWindowLimiter) wait(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expired := 0
+	for expired < len(l.times) && !l.times[expired].After(now.Add(-l.window)) {
+		expired++
+	}
+	live := l.times[expired:]
+	if len(live) < l.limit {
+		return 0
+	}
+	return max(live[len(live)-l.limit].Add(l.window).Sub(now), 0)
+}
+
+func (l *slidingWindowLimiter) used(now time.Time) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, t := range l.times {
+		if t.After(now.Add(-l.window)) && !t.After(now) {
+			n++
+		}
+	}
+	return float64(n)
+}
+
+// restoreUsed counts the saved admissions as made at savedAt, the latest
+// they can have been
+func (l *slidingWindowLimiter) restoreUsed(used float64, savedAt, now time.Time) {
+	if !savedAt.After(now.Add(-l.window)) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	restored := make([]time.Time, 0, len(l.times)+int(used))
+	for i := 0; i < int(used) && i < l.limit; i++ {
+		restored = append(restored, savedAt)
+	}
+	l.times = append(restored, l.times...)
+}
+
+func (l *slidingWindowLimiter) reserve(now time.Time, n int) windowReservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n > l.limit {
+		return windowReservation{cancel: func() {}}
+	}
+
+	// Drop admissions that have left the window
+	expired := 0
+	for expired < len(l.times) && !l.times[expired].After(now.Add(-l.window)) {
+		expired++
+	}
+	l.times = l.times[expired:]
+
+	// n slots open once enough admissions have left the window to leave
+	// room for them
+	slot := now
+	if len(l.times)+n > l.limit {
+		if opens := l.times[len(l.times)+n-l.limit-1].Add(l.window); opens.After(slot) {
+			slot = opens
+		}
+	}
+	for i := 0; i < n; i++ {
+		l.times = append(l.times, slot)
+	}
+
+	return windowReservation{ok: true, delay: slot.Sub(now), cancel: func() { l.release(slot, n) }}
+}
+
+// release removes n cancelled slots from the log
+func (l *slidingWindowLimiter) release(slot time.Time, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.times) - 1; i >= 0 && n > 0; i-- {
+		if l.times[i].Equal(slot) {
+			l.times = append(l.times[:i], l.times[i+1:]...)
+			n--
+		}
+	}
+}
+
+// fixedWindowLimiter allows at most limit requests per aligned window, e.g.
+// per calendar minute
+type fixedWindowLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	counts map[int64]int // window index -> admitted or reserved requests
+}
+
+func (l *fixedWindowLimiter) Allow() bool {
+	return l.AllowN(1)
+}
+
+func (l *fixedWindowLimiter) AllowN(n int) bool {
+	r := l.reserve(time.Now(), n)
+	if !r.ok || r.delay > 0 {
+		r.Cancel()
+		return false
+	}
+	return true
+}
+
+func (l *fixedWindowLimiter) Reserve() limiterReservation {
+	return l.reserve(time.Now(), 1)
+}
+
+func (l *fixedWindowLimiter) ReserveN(n int) limiterReservation {
+	return l.reserve(time.Now(), n)
+}
+
+func (l *fixedWindowLimiter) Burst() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *fixedWindowLimiter) setRate(rps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = windowLimit(rps, l.window)
+}
+
+func (l *fixedWindowLimiter) wait(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := now.UnixNano() / int64(l.window)
+	idx := current
+	for l.counts[idx]+1 > l.limit {
+		idx++
+	}
+	if idx == current {
+		return 0
+	}
+	return time.Unix(0, idx*int64(l.window)).Sub(now)
+}
+
+func (l *fixedWindowLimiter) used(now time.Time) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return float64(l.counts[now.UnixNano()/int64(l.window)])
+}
+
+// restoreUsed resumes the count of the window the state was saved in
+func (l *fixedWindowLimiter) restoreUsed(used float64, savedAt, now time.Time) {
+	idx := now.UnixNano() / int64(l.window)
+	if savedAt.UnixNano()/int64(l.window) != idx {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts[idx] = min(l.counts[idx]+int(used), l.limit)
+}
+
+func (l *fixedWindowLimiter) reserve(now time.Time, n int) windowReservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n > l.limit {
+		return windowReservation{cancel: func() {}}
+	}
+
+	current := now.UnixNano() / int64(l.window)
+	for idx := range l.counts {
+		if idx < current {
+			delete(l.counts, idx)
+		}
+	}
+
+	// Take n slots in the first window with room for them
+	idx := current
+	for l.counts[idx]+n > l.limit {
+		idx++
+	}
+	l.counts[idx] += n
+
+	delay := time.Duration(0)
+	if idx > current {
+		delay = time.Unix(0, idx*int64(l.window)).Sub(now)
+	}
+	return windowReservation{ok: true, delay: delay, cancel: func() { l.release(idx, n) }}
+}
+
+// release gives back n cancelled slots
+func (l *fixedWindowLimiter) release(idx int64, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts[idx] -= n
+	if l.counts[idx] < 0 {
+		l.counts[idx] = 0
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListenerConfig is one address the proxy serves on. All listeners share the
+// same handler, so limiters and metrics are shared too.
+type ListenerConfig struct {
+	Addr        string `json:"addr"`          // host:port, or unix:/path/to.sock
+	TLSCertFile string `json:"tls_cert_file"` // serve HTTPS on this listener
+	TLSKeyFile  string `json:"tls_key_file"`
+}
+
+// tls reports whether the listener serves HTTPS
+func (l ListenerConfig) tls() bool {
+	return l.TLSCertFile != "" && l.TLSKeyFile != ""
+}
+
+// String returns the listener address with its scheme, for logging
+func (l ListenerConfig) String() string {
+	if strings.HasPrefix(l.Addr, "unix:") {
+		return l.Addr
+	}
+	if l.tls() {
+		return "https://" + l.Addr
+	}
+	return "http://" + l.Addr
+}
+
+// listenerConfigs returns the configured listeners, or a single listener on
+// listen_addr using the top-level TLS settings
+func (c *Config) listenerConfigs() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []ListenerConfig{{Addr: c.ListenAddr, TLSCertFile: c.TLSCertFile, TLSKeyFile: c.TLSKeyFile}}
+}
+
+// proxyListener is a bound listener and the server running on it
+type proxyListener struct {
+	config  ListenerConfig
+	ln      net.Listener
+	server  *http.Server
+	serving chan struct{} // closed once the server accepts connections
+}
+
+// openListeners binds every listener up front, so a bad address fails
+// startup instead of surfacing after the others are serving
+func openListeners(configs []ListenerConfig, handler http.Handler) ([]*proxyListener, error) {
+	// Listeners handed over by a previous process during an upgrade
+	inherited := inheritedListeners()
+
+	// With systemd socket activation, activated socket i serves configured
+	// listener i (for its TLS settings); extra sockets serve plain HTTP
+	for i, ln := range systemdListeners() {
+		var lc ListenerConfig
+		if i < len(configs) {
+			lc = configs[i]
+		} else {
+			lc = ListenerConfig{Addr: ln.Addr().String()}
+			configs = append(configs, lc)
+		}
+		if inherited == nil {
+			inherited = make(map[string]net.Listener)
+		}
+		inherited[lc.Addr] = ln
+	}
+
+	var listeners []*proxyListener
+	for _, lc := range configs {
+		ln, ok := inherited[lc.Addr]
+		var err error
+		if ok {
+			delete(inherited, lc.Addr)
+		} else {
+			ln, err = listen(lc.Addr)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.ln.Close()
+			}
+			return nil, fmt.Errorf("listen %s: %w", lc.Addr, err)
+		}
+
+		l := &proxyListener{config: lc, ln: ln, serving: make(chan struct{})}
+		var once sync.Once
+		l.server = &http.Server{
+			Handler:      handler,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 60 * time.Second,
+			IdleTimeout:  120 * time.Second,
+			// Called as Serve starts its accept loop
+			BaseContext: func(net.Listener) context.Context {
+				once.Do(func() { close(l.serving) })
+				return context.Background()
+			},
+		}
+		listeners = append(listeners, l)
+	}
+
+	// Close anything inherited that is no longer configured
+	for _, ln := range inherited {
+		ln.Close()
+	}
+	return listeners, nil
+}
+
+// listen binds a TCP address or, with a unix: prefix, a unix socket
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// Remove a stale socket left behind by a previous run
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serve runs the server until it is shut down
+func (l *proxyListener) serve() error {
+	var err error
+	if l.config.tls() {
+		err = l.server.ServeTLS(l.ln, l.config.TLSCertFile, l.config.TLSKeyFile)
+	} else {
+		err = l.server.Serve(l.ln)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// shutdownListeners gracefully shuts down every listener
+func shutdownListeners(ctx context.Context, listeners []*proxyListener) {
+	for _, l := range listeners {
+		l.server.Shutdown(ctx)
+	}
+}
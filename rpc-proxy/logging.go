@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Log severities, matching syslog priorities
+const (
+	severityErr     = 3
+	severityWarning = 4
+	severityInfo    = 6
+	severityDebug   = 7
+)
+
+// setupLogging directs the standard logger to the configured output, at the
+// configured level
+func setupLogging(config *Config) error {
+	if err := logLevels.configure(config.LogLevel); err != nil {
+		return err
+	}
+	output := config.LogOutput
+	if output == "auto" {
+		output = "stderr"
+		if journaldAvailable() {
+			output = "journald"
+		}
+	}
+
+	switch output {
+	case "", "stderr":
+	case "syslog":
+		w, err := newSyslogWriter(config.SyslogAddr, config.SyslogFacility, config.SyslogTag)
+		if err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+		log.SetFlags(0)
+		log.SetOutput(w)
+	case "journald":
+		w, err := newJournaldWriter(config.SyslogTag)
+		if err != nil {
+			return fmt.Errorf("journald: %w", err)
+		}
+		log.SetFlags(0)
+		log.SetOutput(w)
+	default:
+		return fmt.Errorf("unknown log_output %q (want stderr, syslog, journald or auto)", config.LogOutput)
+	}
+	log.SetOutput(&levelWriter{out: log.Writer()})
+	return nil
+}
+
+// parseLogLine splits a "[TAG] message" log line into its tag, message and
+// severity
+func parseLogLine(line string) (tag, msg string, severity int) {
+	msg = strings.TrimRight(line, "\n")
+	severity = severityInfo
+
+	if strings.HasPrefix(msg, "[") {
+		if end := strings.IndexByte(msg, ']'); end > 0 {
+			tag = msg[1:end]
+			msg = strings.TrimSpace(msg[end+1:])
+		}
+	}
+
+	switch tag {
+	case "ERROR", "PANIC":
+		severity = severityErr
+	case "WARN", "RATE":
+		severity = severityWarning
+	case "DEBUG":
+		severity = severityDebug
+	}
+	return tag, msg, severity
+}
@@ -0,0 +1,20 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func journaldAvailable() bool {
+	return false
+}
+
+func newSyslogWriter(addr, facility, tag string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func newJournaldWriter(identifier string) (io.Writer, error) {
+	return nil, errors.New("journald is not supported on this platform")
+}
@@ -0,0 +1,144 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"auth":   syslog.LOG_AUTH,
+	"syslog": syslog.LOG_SYSLOG,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// syslogWriter writes each log line to syslog at a severity derived from
+// its [TAG]
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// newSyslogWriter connects to the local syslog daemon, or to addr given as
+// udp://host:port or tcp://host:port
+func newSyslogWriter(addr, facility, tag string) (*syslogWriter, error) {
+	if facility == "" {
+		facility = "daemon"
+	}
+	prio, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", facility)
+	}
+
+	network, raddr := "", ""
+	if addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog_addr %q (want udp://host:port or tcp://host:port)", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	w, err := syslog.Dial(network, raddr, prio|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (s *syslogWriter) Write(p []byte) (int, error) {
+	_, _, severity := parseLogLine(string(p))
+	line := string(bytes.TrimRight(p, "\n"))
+
+	var err error
+	switch severity {
+	case severityErr:
+		err = s.w.Err(line)
+	case severityWarning:
+		err = s.w.Warning(line)
+	case severityDebug:
+		err = s.w.Debug(line)
+	default:
+		err = s.w.Info(line)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// journaldWriter sends log lines to journald using its native protocol, so
+// the [TAG] and severity survive as structured fields
+type journaldWriter struct {
+	conn       *net.UnixConn
+	addr       *net.UnixAddr
+	identifier string
+}
+
+// journaldAvailable reports whether stderr is connected to the journal
+func journaldAvailable() bool {
+	if os.Getenv("JOURNAL_STREAM") == "" {
+		return false
+	}
+	_, err := os.Stat(journaldSocket)
+	return err == nil
+}
+
+func newJournaldWriter(identifier string) (*journaldWriter, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{
+		conn:       conn,
+		addr:       &net.UnixAddr{Name: journaldSocket, Net: "unixgram"},
+		identifier: identifier,
+	}, nil
+}
+
+func (j *journaldWriter) Write(p []byte) (int, error) {
+	tag, msg, severity := parseLogLine(string(p))
+
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", msg)
+	journalField(&buf, "PRIORITY", fmt.Sprint(severity))
+	journalField(&buf, "SYSLOG_IDENTIFIER", j.identifier)
+	if tag != "" {
+		journalField(&buf, "RPC_PROXY_CATEGORY", tag)
+	}
+
+	if _, err := j.conn.WriteToUnix(buf.Bytes(), j.addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// journalField appends a field in the journald native format, using the
+// length-prefixed form for values containing newlines
+func journalField(buf *bytes.Buffer, name, value string) {
+	if !strings.ContainsRune(value, '\n') {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Subsystems whose debug logging can be switched on by itself
+const (
+	debugLimiter  = "limiter"
+	debugCache    = "cache"
+	debugUpstream = "upstream"
+)
+
+var debugSubsystems = []string{debugLimiter, debugCache, debugUpstream}
+
+// logSeverities are the log levels by name
+var logSeverities = map[string]int{
+	"error": severityErr,
+	"warn":  severityWarning,
+	"info":  severityInfo,
+	"debug": severityDebug,
+}
+
+// logControl holds the log level and the per-subsystem debug switches. The
+// standard logger is process-wide, so there is one, shared by every tenant
+// and vhost. Changes made through /admin/loglevel revert to the configured
+// level after a while, so a forgotten debug session doesn't flood the logs.
+type logControl struct {
+	level atomic.Int32
+	debug map[string]*atomic.Bool
+
+	mu         sync.Mutex
+	configured int
+	revertAt   time.Time
+	revert     *time.Timer
+	generation int // changes made, so a stale revert timer does nothing
+}
+
+var logLevels = newLogControl()
+
+func newLogControl() *logControl {
+	c := &logControl{configured: severityInfo, debug: make(map[string]*atomic.Bool)}
+	c.level.Store(severityInfo)
+	for _, subsystem := range debugSubsystems {
+		c.debug[subsystem] = &atomic.Bool{}
+	}
+	return c
+}
+
+// parseLogLevel returns the severity of a log level name
+func parseLogLevel(name string) (int, error) {
+	severity, ok := logSeverities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q (want error, warn, info or debug)", name)
+	}
+	return severity, nil
+}
+
+// configure sets the level the logs start at and revert to
+func (c *logControl) configure(level string) error {
+	severity := severityInfo
+	if level != "" {
+		var err error
+		if severity, err = parseLogLevel(level); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.configured = severity
+	c.level.Store(int32(severity))
+	return nil
+}
+
+// debugging reports whether debug lines of the subsystem are logged
+func (c *logControl) debugging(subsystem string) bool {
+	return c.level.Load() >= severityDebug || c.debug[subsystem].Load()
+}
+
+// set changes the level, 0 for the configured one, and the subsystems
+// logging debug lines until duration has passed
+func (c *logControl) set(severity int, subsystems []string, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if severity == 0 {
+		severity = c.configured
+	}
+	c.level.Store(int32(severity))
+	on := make(map[string]bool, len(subsystems))
+	for _, subsystem := range subsystems {
+		on[subsystem] = true
+	}
+	for subsystem, enabled := range c.debug {
+		enabled.Store(on[subsystem])
+	}
+	if c.revert != nil {
+		c.revert.Stop()
+	}
+	c.generation++
+	generation := c.generation
+	c.revertAt = time.Now().Add(duration)
+	c.revert = time.AfterFunc(duration, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// A later change replaced this one
+		if c.generation == generation {
+			c.resetLocked()
+			log.Printf("Log level reverted to %s", severityName(c.configured))
+		}
+	})
+}
+
+// reset returns to the configured level with every subsystem switch off,
+// returning the level's name
+func (c *logControl) reset() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetLocked()
+	return severityName(c.configured)
+}
+
+// resetLocked is reset with c.mu held
+func (c *logControl) resetLocked() {
+	if c.revert != nil {
+		c.revert.Stop()
+		c.revert = nil
+	}
+	c.generation++
+	c.revertAt = time.Time{}
+	c.level.Store(int32(c.configured))
+	for _, enabled := range c.debug {
+		enabled.Store(false)
+	}
+}
+
+func (c *logControl) snapshot() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	debug := []string{}
+	for _, subsystem := range debugSubsystems {
+		if c.debug[subsystem].Load() {
+			debug = append(debug, subsystem)
+		}
+	}
+	snapshot := map[string]interface{}{
+		"level":      severityName(int(c.level.Load())),
+		"configured": severityName(c.configured),
+		"debug":      debug,
+	}
+	if !c.revertAt.IsZero() {
+		snapshot["revert_at"] = c.revertAt.UTC()
+	}
+	return snapshot
+}
+
+// severityName is the log level name of a severity
+func severityName(severity int) string {
+	for name, s := range logSeverities {
+		if s == severity {
+			return name
+		}
+	}
+	return "info"
+}
+
+// debugf logs a [DEBUG] line for the subsystem if its debug logging is on
+func debugf(subsystem, format string, args ...interface{}) {
+	if logLevels.debugging(subsystem) {
+		log.Printf("[DEBUG] "+subsystem+": "+format, args...)
+	}
+}
+
+// levelWriter drops log lines above the current level. [DEBUG] lines are
+// only written when debugf found them enabled, so they always pass.
+type levelWriter struct {
+	out io.Writer
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	line := string(p)
+	// Skip the date and time the standard logger writes to stderr
+	if flags := log.Flags(); flags&(log.Ldate|log.Ltime) != 0 {
+		header := 0
+		if flags&log.Ldate != 0 {
+			header += len("2006/01/02 ")
+		}
+		if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+			header += len("15:04:05 ")
+			if flags&log.Lmicroseconds != 0 {
+				header += len(".000000")
+			}
+		}
+		if len(line) >= header {
+			line = line[header:]
+		}
+	}
+	if _, _, severity := parseLogLine(line); severity != severityDebug && severity > int(logLevels.level.Load()) {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+// handleLogLevel serves /admin/loglevel: GET shows the log level, PUT sets
+// {"level": "debug"} and/or {"debug": ["limiter", "cache", "upstream"]}
+// until "duration" (default log_level_ttl) has passed, and DELETE
+// reverts to the configured level now
+func (rt *Router) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Level    string   `json:"level"`
+			Debug    []string `json:"debug"`
+			Duration Duration `json:"duration"`
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var severity int
+		if req.Level != "" {
+			if severity, err = parseLogLevel(req.Level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, subsystem := range req.Debug {
+			if logLevels.debug[subsystem] == nil {
+				http.Error(w, fmt.Sprintf("Unknown subsystem %q (want %s)", subsystem, strings.Join(debugSubsystems, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+		duration := req.Duration.Duration
+		if duration <= 0 {
+			duration = rt.defaultProxy.config.LogLevelTTL.Duration
+		}
+		if duration <= 0 {
+			duration = 15 * time.Minute
+		}
+		sort.Strings(req.Debug)
+		logLevels.set(severity, req.Debug, duration)
+		debug := strings.Join(req.Debug, ", ")
+		if debug == "" {
+			debug = "none"
+		}
+		log.Printf("Log level set to %s (debug: %s) by %s for %v", logLevels.snapshot()["level"], debug, adminActor(r), duration)
+	case http.MethodDelete:
+		log.Printf("Log level reverted to %s by %s", logLevels.reset(), adminActor(r))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevels.snapshot())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// scrubbedStringLength is the longest string logged as is. Longer ones are
+// serialized transactions, account data and the like.
+const scrubbedStringLength = 128
+
+// sensitiveKeys are fragments of object keys whose values are never logged,
+// matched against the lowercased key without "_" and "-"
+var sensitiveKeys = []string{"password", "passphrase", "secret", "privatekey", "mnemonic", "seedphrase", "apikey", "accesstoken", "authtoken", "authorization", "credential"}
+
+// signedTransactionMethods take a signed transaction as their first param
+var signedTransactionMethods = map[string]bool{
+	"sendTransaction":     true,
+	"simulateTransaction": true,
+	"sendBundle":          true,
+	"simulateBundle":      true,
+}
+
+// scrubParams renders request params for the log with secrets and signed
+// transactions redacted, cut to maxLen bytes
+func scrubParams(method string, params json.RawMessage, maxLen int) string {
+	if len(params) == 0 {
+		return "none"
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.UseNumber() // keep large integers as sent
+	if decoder.Decode(&value) != nil {
+		return fmt.Sprintf("<invalid, %d bytes>", len(params))
+	}
+	if args, ok := value.([]interface{}); ok && len(args) > 0 && signedTransactionMethods[method] {
+		args[0] = redactedValue("transaction", args[0])
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false) // keep the placeholders readable
+	encoder.Encode(scrubValue(value))
+	scrubbed := bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+	if len(scrubbed) > maxLen {
+		return string(scrubbed[:maxLen]) + "..."
+	}
+	return string(scrubbed)
+}
+
+// scrubValue redacts sensitive fields and long strings in a decoded value
+func scrubValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if sensitiveKey(key) {
+				v[key] = "<redacted>"
+			} else {
+				v[key] = scrubValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = scrubValue(item)
+		}
+	case string:
+		if len(v) > scrubbedStringLength {
+			return fmt.Sprintf("<%d chars>", len(v))
+		}
+	}
+	return value
+}
+
+// redactedValue describes a value without its content
+func redactedValue(kind string, value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("<%s, %d chars>", kind, len(v))
+	case []interface{}:
+		return fmt.Sprintf("<%d %ss>", len(v), kind)
+	}
+	return "<" + kind + ">"
+}
+
+func sensitiveKey(key string) bool {
+	key = strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+	for _, fragment := range sensitiveKeys {
+		if strings.Contains(key, fragment) {
+			return true
+		}
+	}
+	return false
+}
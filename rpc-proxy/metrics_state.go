@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metricsCounters is the persisted form of a proxy's counters
+type metricsCounters struct {
+	Since           time.Time     `json:"since"`
+	TotalRequests   int64         `json:"total_requests"`
+	SuccessRequests int64         `json:"success_requests"`
+	FailedRequests  int64         `json:"failed_requests"`
+	RateLimited     int64         `json:"rate_limited"`
+	WaitedRequests  int64         `json:"waited_requests"`
+	SlowRequests    int64         `json:"slow_requests"`
+	ExemptRequests  int64         `json:"exempt_requests"`
+	ShedRequests    int64         `json:"shed_requests"`
+	TotalWaitTime   time.Duration `json:"total_wait_time_ns"`
+	BytesIn         int64         `json:"bytes_in"`
+	BytesOut        int64         `json:"bytes_out"`
+}
+
+// metricsState is the on-disk metrics snapshot, keyed by proxy name
+type metricsState struct {
+	SavedAt time.Time                  `json:"saved_at"`
+	Proxies map[string]metricsCounters `json:"proxies"`
+	Budgets map[string]budgetState     `json:"budgets,omitempty"` // keyed by proxy/upstream
+
+	// Slots in use of the global limiters, keyed by proxy, and of the keys
+	// file limiters, keyed by file and key ID, so a restart doesn't hand
+	// every client a full burst at once
+	GlobalLimiters map[string]float64            `json:"global_limiters,omitempty"`
+	KeyLimiters    map[string]map[string]float64 `json:"key_limiters,omitempty"`
+
+	// Hourly SLA buckets, keyed by proxy for the overall numbers and by
+	// proxy/upstream
+	SLIs map[string]sliState `json:"slis,omitempty"`
+}
+
+// counters returns a copy of the persistent counters
+func (m *Metrics) counters() metricsCounters {
+	m.mu.RLock()
+	since := m.Since
+	m.mu.RUnlock()
+
+	return metricsCounters{
+		Since:           since,
+		TotalRequests:   m.TotalRequests.Load(),
+		SuccessRequests: m.SuccessRequests.Load(),
+		FailedRequests:  m.FailedRequests.Load(),
+		RateLimited:     m.RateLimited.Load(),
+		WaitedRequests:  m.WaitedRequests.Load(),
+		SlowRequests:    m.SlowRequests.Load(),
+		ExemptRequests:  m.ExemptRequests.Load(),
+		ShedRequests:    m.ShedRequests.Load(),
+		TotalWaitTime:   time.Duration(m.TotalWaitTime.Load()),
+		BytesIn:         m.BytesIn.Load(),
+		BytesOut:        m.BytesOut.Load(),
+	}
+}
+
+// restore adds previously persisted counters to the current ones
+func (m *Metrics) restore(c metricsCounters) {
+	m.mu.Lock()
+	if !c.Since.IsZero() && c.Since.Before(m.Since) {
+		m.Since = c.Since
+	}
+	m.mu.Unlock()
+
+	m.TotalRequests.Add(c.TotalRequests)
+	m.SuccessRequests.Add(c.SuccessRequests)
+	m.FailedRequests.Add(c.FailedRequests)
+	m.RateLimited.Add(c.RateLimited)
+	m.WaitedRequests.Add(c.WaitedRequests)
+	m.SlowRequests.Add(c.SlowRequests)
+	m.ExemptRequests.Add(c.ExemptRequests)
+	m.ShedRequests.Add(c.ShedRequests)
+	m.TotalWaitTime.Add(int64(c.TotalWaitTime))
+	m.BytesIn.Add(c.BytesIn)
+	m.BytesOut.Add(c.BytesOut)
+}
+
+// reset zeroes the counters and the per-method and per-key breakdowns, and
+// starts counting again from now
+func (m *Metrics) reset(now time.Time) {
+	m.mu.Lock()
+	m.Since = now
+	m.mu.Unlock()
+
+	m.TotalRequests.Store(0)
+	m.SuccessRequests.Store(0)
+	m.FailedRequests.Store(0)
+	m.RateLimited.Store(0)
+	m.WaitedRequests.Store(0)
+	m.SlowRequests.Store(0)
+	m.ExemptRequests.Store(0)
+	m.ShedRequests.Store(0)
+	m.TotalWaitTime.Store(0)
+	m.BytesIn.Store(0)
+	m.BytesOut.Store(0)
+	m.methods.reset()
+	if m.keys != nil {
+		m.keys.reset()
+	}
+}
+
+// resetCounters zeroes the request counters along with the per-upstream and
+// cache counters reported next to them
+func (p *RPCProxy) resetCounters(now time.Time) {
+	p.metrics.reset(now)
+	p.pool.resetCounters()
+	p.txCache.resetCounters()
+	p.slotCache.resetCounters()
+	p.epochCache.resetCounters()
+	p.accountCache.resetCounters()
+	p.transcoder.resetCounters()
+	p.idempotency.resetCounters()
+	p.sendDedup.resetCounters()
+}
+
+// loadMetricsState restores counters from the state file, if it exists
+func (rt *Router) loadMetricsState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var state metricsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	restoredKeys := make(map[*keyStore]bool)
+	for _, p := range rt.proxies() {
+		if c, ok := state.Proxies[p.name]; ok {
+			p.metrics.restore(c)
+		}
+		if s, ok := state.SLIs[p.name]; ok && p.sli != nil {
+			p.sli.restore(s, now)
+		}
+		if used, ok := state.GlobalLimiters[p.name]; ok && p.globalLimiter != nil {
+			p.globalLimiter.restoreUsed(used, state.SavedAt, now)
+		}
+		if p.keys != nil && !restoredKeys[p.keys] {
+			restoredKeys[p.keys] = true
+			p.keys.restoreLimiters(state.KeyLimiters[p.keys.path], state.SavedAt, now)
+		}
+		for _, u := range p.pool.upstreams {
+			if b, ok := state.Budgets[p.name+"/"+u.name]; ok && u.budget != nil {
+				u.budget.restore(b)
+			}
+			if s, ok := state.SLIs[p.name+"/"+u.name]; ok && u.sli != nil {
+				u.sli.restore(s, now)
+			}
+		}
+	}
+
+	log.Printf("Restored metrics from %s (saved %s)", path, state.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// saveMetricsState atomically writes the counters of every proxy to the
+// state file
+func (rt *Router) saveMetricsState(path string) error {
+	now := time.Now()
+	state := metricsState{
+		SavedAt:        now.UTC(),
+		Proxies:        make(map[string]metricsCounters),
+		Budgets:        make(map[string]budgetState),
+		GlobalLimiters: make(map[string]float64),
+		KeyLimiters:    make(map[string]map[string]float64),
+		SLIs:           make(map[string]sliState),
+	}
+	for _, p := range rt.proxies() {
+		state.Proxies[p.name] = p.metrics.counters()
+		if p.globalLimiter != nil {
+			state.GlobalLimiters[p.name] = p.globalLimiter.used(now)
+		}
+		if p.sli != nil {
+			state.SLIs[p.name] = p.sli.state()
+		}
+		if p.keys != nil && state.KeyLimiters[p.keys.path] == nil {
+			state.KeyLimiters[p.keys.path] = p.keys.limiterUsage(now)
+		}
+		for _, u := range p.pool.upstreams {
+			if u.budget != nil {
+				state.Budgets[p.name+"/"+u.name] = u.budget.state()
+			}
+			if u.sli != nil {
+				state.SLIs[p.name+"/"+u.name] = u.sli.state()
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".metrics-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// persistMetrics snapshots the counters to the state file every interval
+func (rt *Router) persistMetrics(path string, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := rt.saveMetricsState(path); err != nil {
+			log.Printf("[ERROR] Failed to save metrics state: %v", err)
+		}
+	}
+}
+
+// metricsArchive is a timestamped copy of /metrics, for archiving or for
+// measuring the difference between two points in time
+type metricsArchive struct {
+	TakenAt time.Time              `json:"taken_at"`
+	Metrics map[string]interface{} `json:"metrics"`
+}
+
+// handleMetricsSnapshot serves GET /admin/metrics/snapshot
+func (rt *Router) handleMetricsSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metricsArchive{TakenAt: time.Now().UTC(), Metrics: rt.metricsSnapshot()})
+}
+
+// handleMetricsReset serves POST /admin/metrics/reset: it zeroes the request
+// counters of every proxy and answers with the metrics as they were just
+// before
+func (rt *Router) handleMetricsReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now().UTC()
+	before := metricsArchive{TakenAt: now, Metrics: rt.metricsSnapshot()}
+	for _, p := range rt.proxies() {
+		p.resetCounters(now)
+	}
+	log.Printf("Metrics counters reset by %s", adminActor(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reset_at": now,
+		"before":   before,
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import "encoding/json"
+
+// Commitment levels, indexing watermark.commitments
+const (
+	commitmentProcessed = iota
+	commitmentConfirmed
+	commitmentFinalized
+)
+
+// minContextSlotMethods are the reads accepting minContextSlot
+var minContextSlotMethods = map[string]bool{
+	"getAccountInfo":             true,
+	"getBalance":                 true,
+	"getBlockHeight":             true,
+	"getEpochInfo":               true,
+	"getInflationReward":         true,
+	"getLatestBlockhash":         true,
+	"getMultipleAccounts":        true,
+	"getProgramAccounts":         true,
+	"getSignaturesForAddress":    true,
+	"getSlot":                    true,
+	"getSlotLeader":              true,
+	"getTokenAccountsByDelegate": true,
+	"getTokenAccountsByOwner":    true,
+	"getTransactionCount":        true,
+	"isBlockhashValid":           true,
+	"simulateTransaction":        true,
+}
+
+// parseCommitment maps a commitment, including the deprecated names, to its
+// level. Solana defaults to finalized.
+func parseCommitment(commitment string) int {
+	switch commitment {
+	case "processed", "recent":
+		return commitmentProcessed
+	case "confirmed", "single", "singleGossip":
+		return commitmentConfirmed
+	default:
+		return commitmentFinalized
+	}
+}
+
+// injectMinContextSlot raises minContextSlot in the client's reads to the
+// highest slot it has been shown at the same commitment, so consecutive
+// reads never go back in time even when a load balancer behind one upstream
+// URL spreads them over nodes. After a sendTransaction, processed reads must
+// also have reached the tip the transaction was submitted at.
+//
+// It returns the possibly rewritten body and the commitment level of each
+// request, -1 for methods without minContextSlot, for recording the slots of
+// the responses.
+func (p *RPCProxy) injectMinContextSlot(body []byte, isBatch bool, client string) ([]byte, []int) {
+	w := p.pool.watermarks
+	var commitments []int
+	body = rewriteCalls(body, isBatch, func(i int, call *rpcCall) bool {
+		commitments = append(commitments, -1)
+		if call.method == "sendTransaction" {
+			w.raise(client, commitmentProcessed, p.pool.tip())
+			return false
+		}
+		if !minContextSlotMethods[call.method] {
+			return false
+		}
+		config, ok := call.config()
+		if !ok {
+			return false
+		}
+		var commitment string
+		json.Unmarshal(config["commitment"], &commitment)
+		commitments[i] = parseCommitment(commitment)
+
+		minSlot := w.getAt(client, commitments[i])
+		var current uint64
+		json.Unmarshal(config["minContextSlot"], &current)
+		if minSlot <= current {
+			return false
+		}
+		config["minContextSlot"], _ = json.Marshal(minSlot)
+		if !call.setConfig(config) {
+			return false
+		}
+		w.injected.Add(1)
+		return true
+	})
+	return body, commitments
+}
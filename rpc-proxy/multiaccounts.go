@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// accountChunks splits a getMultipleAccounts request asking for more than
+// multiple_accounts_chunk_size accounts into requests for at most that many,
+// or returns nil when it needn't be split
+func (p *RPCProxy) accountChunks(body []byte, isBatch bool, method string) [][]byte {
+	size := p.config.MultipleAccountsChunkSize
+	if size <= 0 || isBatch || method != "getMultipleAccounts" {
+		return nil
+	}
+	var req JSONRPCRequest
+	var args []json.RawMessage
+	var accounts []json.RawMessage
+	if json.Unmarshal(body, &req) != nil || json.Unmarshal(req.Params, &args) != nil || len(args) == 0 ||
+		json.Unmarshal(args[0], &accounts) != nil || len(accounts) <= size {
+		return nil
+	}
+
+	var chunks [][]byte
+	for start := 0; start < len(accounts); start += size {
+		part, _ := json.Marshal(accounts[start:min(start+size, len(accounts))])
+		params, _ := json.Marshal(append([]json.RawMessage{part}, args[1:]...))
+		chunk, _ := json.Marshal(JSONRPCRequest{JSONRPC: "2.0", ID: req.ID, Method: req.Method, Params: params})
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// accountChunk is the upstream's answer to one chunk
+type accountChunk struct {
+	resp *http.Response
+	body []byte
+	u    *upstream
+	err  error
+}
+
+// forwardChunks sends the chunks of a split getMultipleAccounts request,
+// multiple_accounts_parallel at a time, and stitches their answers back
+// together in request order, as the response of the upstream that answered
+// the first chunk. The first failure or error answer is returned instead.
+// Chunks may be answered at different slots; the context reports the
+// lowest. The response size cap applies to the chunks' answers together:
+// once they exceed it reading stops, and the oversized bytes are returned
+// for the caller to refuse.
+func (p *RPCProxy) forwardChunks(ctx context.Context, chunks [][]byte, header http.Header, timing *upstreamTiming, hint routeHint, methods []string) (*http.Response, *upstream, error) {
+	limit := p.maxResponseSize(methods)
+	n := p.config.MultipleAccountsParallel
+	if n <= 0 {
+		n = 4
+	}
+	parallel := make(chan struct{}, n)
+	results := make([]accountChunk, len(chunks))
+	var read atomic.Int64
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk []byte) {
+			defer wg.Done()
+			parallel <- struct{}{}
+			defer func() { <-parallel }()
+
+			var t upstreamTiming
+			r := &results[i]
+			r.resp, r.u, r.err = p.pool.forward(ctx, chunk, header, &t, hint)
+			if i == 0 {
+				*timing = t
+			}
+			if r.err != nil {
+				return
+			}
+			var body io.Reader = r.resp.Body
+			if limit > 0 {
+				body = &chunkLimitReader{r: body, read: &read, limit: limit}
+			}
+			r.body, r.err = io.ReadAll(body)
+			r.resp.Body.Close()
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.u, r.err
+		}
+	}
+	if limit > 0 && read.Load() > limit {
+		bodies := make([][]byte, len(results))
+		for i, r := range results {
+			bodies[i] = r.body
+		}
+		return chunkResponse(results[0].resp, bytes.Join(bodies, nil)), results[0].u, nil
+	}
+
+	var context json.RawMessage
+	var lowest uint64
+	var values []json.RawMessage
+	for i, r := range results {
+		var answer struct {
+			Result *struct {
+				Context json.RawMessage   `json:"context"`
+				Value   []json.RawMessage `json:"value"`
+			} `json:"result"`
+		}
+		if r.resp.StatusCode != http.StatusOK || json.Unmarshal(r.body, &answer) != nil || answer.Result == nil {
+			return chunkResponse(r.resp, r.body), r.u, nil
+		}
+		var slot struct {
+			Slot uint64 `json:"slot"`
+		}
+		json.Unmarshal(answer.Result.Context, &slot)
+		if context == nil || slot.Slot < lowest {
+			context, lowest = answer.Result.Context, slot.Slot
+		}
+		values = append(values, answer.Result.Value...)
+		if i > 0 {
+			r.u.budget.consume(r.u.name, methods)
+		}
+	}
+
+	var id json.RawMessage
+	var first struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal(results[0].body, &first) == nil {
+		id = first.ID
+	}
+	result, _ := json.Marshal(map[string]interface{}{"context": context, "value": values})
+	return chunkResponse(results[0].resp, batchEntry(id, result, nil)), results[0].u, nil
+}
+
+// chunkLimitReader counts what it reads into a total shared by the chunks,
+// and ends once the total is over the limit
+type chunkLimitReader struct {
+	r     io.Reader
+	read  *atomic.Int64
+	limit int64
+}
+
+func (c *chunkLimitReader) Read(b []byte) (int, error) {
+	if c.read.Load() > c.limit {
+		return 0, io.EOF
+	}
+	n, err := c.r.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// chunkResponse returns an upstream response with its body replaced
+func chunkResponse(resp *http.Response, body []byte) *http.Response {
+	stitched := *resp
+	stitched.Header = resp.Header.Clone()
+	stitched.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	stitched.ContentLength = int64(len(body))
+	stitched.Body = io.NopCloser(bytes.NewReader(body))
+	return &stitched
+}
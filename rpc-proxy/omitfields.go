@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// omitFieldsHeader lists result fields the client doesn't want, as
+	// comma-separated dot paths relative to the result
+	omitFieldsHeader = "X-Omit-Fields"
+	// maxOmitPaths bounds the paths taken from one request
+	maxOmitPaths = 32
+)
+
+// omitPaths parses an X-Omit-Fields header, e.g.
+// "rewards, transactions.meta.loadedAddresses", into paths
+func omitPaths(header string) [][]string {
+	var paths [][]string
+	for _, field := range strings.Split(header, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" || len(paths) == maxOmitPaths {
+			continue
+		}
+		path := strings.Split(field, ".")
+		valid := true
+		for _, name := range path {
+			valid = valid && name != ""
+		}
+		if valid {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// omitFields drops the fields at the paths from the result of a response,
+// or of each response in a batch. Arrays along a path are stepped through,
+// so "transactions.meta.logMessages" reaches every transaction of a block.
+// Everything else is passed through as the upstream wrote it.
+func omitFields(body []byte, paths [][]string) []byte {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return body
+	}
+	if trimmed[0] == '[' {
+		var responses []json.RawMessage
+		if json.Unmarshal(trimmed, &responses) != nil {
+			return body
+		}
+		changed := false
+		for i, resp := range responses {
+			if out, ok := omitResultFields(resp, paths); ok {
+				responses[i], changed = out, true
+			}
+		}
+		if !changed {
+			return body
+		}
+		return marshalRaw(responses)
+	}
+	if out, ok := omitResultFields(trimmed, paths); ok {
+		return out
+	}
+	return body
+}
+
+// omitResultFields applies the paths to the result of one response
+func omitResultFields(resp json.RawMessage, paths [][]string) (json.RawMessage, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(resp, &fields) != nil || fields["result"] == nil {
+		return nil, false
+	}
+	changed := false
+	for _, path := range paths {
+		if out, ok := omitPath(fields["result"], path); ok {
+			fields["result"], changed = out, true
+		}
+	}
+	if !changed {
+		return nil, false
+	}
+	return marshalRaw(fields), true
+}
+
+// omitPath drops the field at path from a value, reporting whether it was
+// there
+func omitPath(value json.RawMessage, path []string) (json.RawMessage, bool) {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return nil, false
+	}
+	switch value[0] {
+	case '[':
+		var items []json.RawMessage
+		if json.Unmarshal(value, &items) != nil {
+			return nil, false
+		}
+		changed := false
+		for i, item := range items {
+			if out, ok := omitPath(item, path); ok {
+				items[i], changed = out, true
+			}
+		}
+		if !changed {
+			return nil, false
+		}
+		return marshalRaw(items), true
+	case '{':
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(value, &fields) != nil {
+			return nil, false
+		}
+		field, ok := fields[path[0]]
+		if !ok {
+			return nil, false
+		}
+		if len(path) == 1 {
+			delete(fields, path[0])
+		} else if field, ok = omitPath(field, path[1:]); ok {
+			fields[path[0]] = field
+		} else {
+			return nil, false
+		}
+		return marshalRaw(fields), true
+	}
+	return nil, false
+}
+
+// marshalRaw encodes reassembled JSON without escaping HTML characters, so
+// the untouched parts stay as the upstream wrote them
+func marshalRaw(v interface{}) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// omitRequested drops the fields the client listed in X-Omit-Fields from a
+// response, counting the bytes saved
+func (p *RPCProxy) omitRequested(body []byte, paths [][]string) []byte {
+	if len(paths) == 0 {
+		return body
+	}
+	out := omitFields(body, paths)
+	p.omittedBytes.Add(int64(len(body) - len(out)))
+	return out
+}
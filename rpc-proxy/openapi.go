@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// apiObject is shorthand for the nested maps of the OpenAPI document
+type apiObject = map[string]interface{}
+
+// jsonContent describes a JSON body with the given schema
+func jsonContent(schema apiObject) apiObject {
+	return apiObject{"application/json": apiObject{"schema": schema}}
+}
+
+// schemaRef points at a schema under components
+func schemaRef(name string) apiObject {
+	return apiObject{"$ref": "#/components/schemas/" + name}
+}
+
+// apiResponse describes a JSON response, or one without a body when schema is
+// nil
+func apiResponse(description string, schema apiObject) apiObject {
+	resp := apiObject{"description": description}
+	if schema != nil {
+		resp["content"] = jsonContent(schema)
+	}
+	return resp
+}
+
+// rpcErrorResponses are the errors the proxy itself returns for JSON-RPC
+// requests, by HTTP status
+func rpcErrorResponses() apiObject {
+	retryAfter := apiObject{"Retry-After": apiObject{
+		"description": "Seconds to wait before retrying",
+		"schema":      apiObject{"type": "integer"},
+	}}
+	busy := apiResponse("Draining, shedding load or every upstream throttled (code -32005)", schemaRef("RPCErrorResponse"))
+	busy["headers"] = retryAfter
+	limited := apiResponse("Rate limited or egress quota exceeded (code -32005)", schemaRef("RPCErrorResponse"))
+	limited["headers"] = retryAfter
+
+	return apiObject{
+		"400": apiResponse("Parse error (-32700) or invalid params (-32602)", schemaRef("RPCErrorResponse")),
+		"401": apiResponse("Revoked or expired API key from api_keys_file (-32001)", schemaRef("RPCErrorResponse")),
+		"403": apiResponse("Method not allowed (-32601), or origin refused in strict CORS mode", schemaRef("RPCErrorResponse")),
+		"405": apiResponse("Method not allowed", nil),
+		"429": limited,
+		"502": apiResponse("Upstream error (-32603) or response too large (-32009)", schemaRef("RPCErrorResponse")),
+		"503": busy,
+	}
+}
+
+// openAPIDocument describes the endpoints this proxy serves, following its
+// configuration: method restrictions, GET facade, REST facade, metrics and
+// the admin API
+func (p *RPCProxy) openAPIDocument(base string) apiObject {
+	methodSchema := apiObject{"type": "string", "example": "getSlot"}
+	if len(p.config.AllowedMethods) > 0 {
+		var methods []string
+		for _, method := range p.config.AllowedMethods {
+			if !p.config.ReadOnly || !stateChangingMethods[method] {
+				methods = append(methods, method)
+			}
+		}
+		sort.Strings(methods)
+		methodSchema["enum"] = methods
+	}
+
+	schemas := apiObject{
+		"RPCRequest": apiObject{
+			"type":     "object",
+			"required": []string{"jsonrpc", "method"},
+			"properties": apiObject{
+				"jsonrpc": apiObject{"type": "string", "enum": []string{"2.0"}},
+				"id":      apiObject{"oneOf": []apiObject{{"type": "integer"}, {"type": "string"}}},
+				"method":  methodSchema,
+				"params":  apiObject{"type": "array", "items": apiObject{}},
+			},
+		},
+		"RPCResponse": apiObject{
+			"type": "object",
+			"properties": apiObject{
+				"jsonrpc": apiObject{"type": "string"},
+				"id":      apiObject{"oneOf": []apiObject{{"type": "integer"}, {"type": "string"}}, "nullable": true},
+				"result":  apiObject{},
+				"error":   schemaRef("RPCError"),
+			},
+		},
+		"RPCError": apiObject{
+			"type":     "object",
+			"required": []string{"code", "message"},
+			"properties": apiObject{
+				"code": apiObject{
+					"type": "integer",
+					"description": "-32700 parse error, -32601 method not allowed, -32602 invalid params, " +
+						"-32603 upstream error, -32005 busy or rate limited, -32009 response too large",
+				},
+				"message": apiObject{"type": "string"},
+				"data": apiObject{
+					"type": "object",
+					"properties": apiObject{
+						"retry_after_seconds": apiObject{"type": "integer"},
+					},
+				},
+			},
+		},
+		"RPCErrorResponse": apiObject{
+			"allOf": []apiObject{schemaRef("RPCResponse"), {"required": []string{"error"}}},
+		},
+		"RESTError": apiObject{
+			"type":       "object",
+			"properties": apiObject{"error": apiObject{"type": "string"}},
+		},
+		"Readiness": apiObject{
+			"type": "object",
+			"properties": apiObject{
+				"status": apiObject{"type": "string", "enum": []string{"ready", "not_ready"}},
+				"tenant": apiObject{"type": "string"},
+				"checks": apiObject{
+					"type":                 "object",
+					"description":          "drain, warmup, tls, upstream and limiter: \"ok\" or the reason the check failed",
+					"additionalProperties": apiObject{"type": "string"},
+				},
+			},
+		},
+		"Health": apiObject{
+			"type": "object",
+			"properties": apiObject{
+				"status":          apiObject{"type": "string", "enum": []string{"ok", "draining"}},
+				"uptime":          apiObject{"type": "string"},
+				"tenant":          apiObject{"type": "string"},
+				"upstream":        apiObject{"type": "string"},
+				"upstreams":       apiObject{"type": "array", "items": apiObject{"type": "string"}},
+				"rate_limit_mode": apiObject{"type": "string"},
+			},
+		},
+	}
+
+	rpcBody := apiObject{
+		"required": true,
+		"content": apiObject{
+			"application/json": apiObject{"schema": apiObject{"oneOf": []apiObject{
+				schemaRef("RPCRequest"),
+				{"type": "array", "items": schemaRef("RPCRequest")},
+			}}},
+		},
+	}
+	rpcResponses := rpcErrorResponses()
+	rpcResponses["200"] = apiObject{
+		"description": "JSON-RPC response, or an array of responses for a batch. Send Accept: application/cbor or application/msgpack for a binary encoding.",
+		"content": apiObject{
+			"application/json":    apiObject{"schema": apiObject{"oneOf": []apiObject{schemaRef("RPCResponse"), {"type": "array", "items": schemaRef("RPCResponse")}}}},
+			"application/cbor":    apiObject{},
+			"application/msgpack": apiObject{},
+		},
+	}
+	rpcOp := apiObject{
+		"summary":     "Call a Solana JSON-RPC method",
+		"operationId": "rpc",
+		"requestBody": rpcBody,
+		"responses":   rpcResponses,
+		"security":    []apiObject{{}, {"apiKeyHeader": []string{}}, {"apiKeyQuery": []string{}}},
+	}
+	root := apiObject{"post": rpcOp}
+
+	paths := apiObject{
+		"/": root,
+		"/health": apiObject{"get": apiObject{
+			"summary":     "Health check",
+			"operationId": "health",
+			"responses": apiObject{
+				"200": apiResponse("Serving", schemaRef("Health")),
+				"503": apiResponse("Draining", schemaRef("Health")),
+			},
+		}},
+		"/livez": apiObject{"get": apiObject{
+			"summary":     "Liveness probe: the process is up",
+			"operationId": "livez",
+			"responses":   apiObject{"200": apiResponse("Alive", apiObject{"type": "object"})},
+		}},
+		"/readyz": apiObject{"get": apiObject{
+			"summary":     "Readiness probe: not draining, warmed up, certificates valid, an upstream is reachable and the rate limiter is not saturated",
+			"operationId": "readyz",
+			"responses": apiObject{
+				"200": apiResponse("Ready", schemaRef("Readiness")),
+				"503": apiResponse("Not ready, see checks", schemaRef("Readiness")),
+			},
+		}},
+		"/openapi.json": apiObject{"get": apiObject{
+			"summary":     "This document",
+			"operationId": "openapi",
+			"responses":   apiObject{"200": apiResponse("OpenAPI document", apiObject{"type": "object"})},
+		}},
+	}
+
+	if p.config.EnableGet {
+		getMethods := p.config.GetMethods
+		if len(getMethods) == 0 {
+			getMethods = defaultGetMethods
+		}
+		getMethods = append([]string(nil), getMethods...)
+		sort.Strings(getMethods)
+		getMethodSchema := apiObject{"type": "string"}
+		if !contains(getMethods, "*") {
+			getMethodSchema["enum"] = getMethods
+		}
+
+		getResponses := rpcErrorResponses()
+		getResponses["200"] = apiResponse("JSON-RPC response", schemaRef("RPCResponse"))
+		paramsQuery := apiObject{
+			"name": "params", "in": "query",
+			"description": "JSON array of params, URL-encoded",
+			"schema":      apiObject{"type": "string", "example": `["<pubkey>"]`},
+		}
+
+		root["get"] = apiObject{
+			"summary":     "Call a read method over GET",
+			"operationId": "rpcGet",
+			"parameters": []apiObject{
+				{"name": "method", "in": "query", "required": true, "schema": getMethodSchema},
+				paramsQuery,
+			},
+			"responses": getResponses,
+		}
+		paths["/v0/{method}"] = apiObject{"get": apiObject{
+			"summary":     "Call a read method over GET",
+			"operationId": "rpcGetPath",
+			"parameters": []apiObject{
+				{"name": "method", "in": "path", "required": true, "schema": getMethodSchema},
+				paramsQuery,
+			},
+			"responses": getResponses,
+		}}
+	}
+
+	if p.config.EnableMetrics {
+		paths["/metrics"] = apiObject{"get": apiObject{
+			"summary":     "Proxy statistics",
+			"operationId": "metrics",
+			"responses":   apiObject{"200": apiResponse("Counters, latencies and upstream state", apiObject{"type": "object"})},
+		}}
+	}
+
+	if p.config.EnableSLA {
+		paths["/sla"] = apiObject{"get": apiObject{
+			"summary":     "Availability and latency report",
+			"operationId": "sla",
+			"responses":   apiObject{"200": apiResponse("Success ratio, p99 and downtime over 1h, 24h and 30d, overall and per upstream", apiObject{"type": "object"})},
+		}}
+	}
+
+	if p.supervisor != nil {
+		paths["/catchup"] = apiObject{"get": apiObject{
+			"summary":     "Catch-up progress of the supervised node",
+			"operationId": "catchup",
+			"parameters":  []apiObject{{"name": "format", "in": "query", "schema": apiObject{"type": "string", "enum": []string{"json", "text"}}}},
+			"responses":   apiObject{"200": apiResponse("Node and cluster slot, catch-up rate and ETA", apiObject{"type": "object"})},
+		}}
+	}
+
+	if p.config.EnableREST {
+		restErrors := apiObject{
+			"400": apiResponse("Invalid argument", schemaRef("RESTError")),
+			"404": apiResponse("Unknown endpoint", schemaRef("RESTError")),
+			"429": apiResponse("Rate limited", schemaRef("RESTError")),
+			"502": apiResponse("Upstream error", schemaRef("RESTError")),
+			"503": apiResponse("Busy", schemaRef("RESTError")),
+		}
+		restOp := func(id, summary string, params []apiObject, result apiObject) apiObject {
+			responses := apiObject{"200": apiResponse("OK", result)}
+			for status, resp := range restErrors {
+				responses[status] = resp
+			}
+			op := apiObject{"summary": summary, "operationId": id, "responses": responses}
+			if params != nil {
+				op["parameters"] = params
+			}
+			return op
+		}
+		props := func(names ...string) apiObject {
+			properties := apiObject{}
+			for i := 0; i < len(names); i += 2 {
+				properties[names[i]] = apiObject{"type": names[i+1]}
+			}
+			return apiObject{"type": "object", "properties": properties}
+		}
+
+		paths["/api/v1/slot"] = apiObject{"get": restOp("restSlot", "Current slot", nil, props("slot", "integer"))}
+		paths["/api/v1/blockhash"] = apiObject{"get": restOp("restBlockhash", "Latest blockhash", nil,
+			props("blockhash", "string", "last_valid_block_height", "integer", "slot", "integer"))}
+		paths["/api/v1/account/{pubkey}"] = apiObject{"get": restOp("restAccount", "Account balance and owner",
+			[]apiObject{
+				{"name": "pubkey", "in": "path", "required": true, "schema": apiObject{"type": "string"}},
+				{"name": "data", "in": "query", "description": "Include base64 account data", "schema": apiObject{"type": "boolean"}},
+			},
+			props("pubkey", "string", "slot", "integer", "exists", "boolean", "lamports", "integer", "sol", "number",
+				"owner", "string", "executable", "boolean", "rent_epoch", "integer", "data_len", "integer", "data", "string"))}
+		paths["/api/v1/tx/{signature}"] = apiObject{"get": restOp("restTransaction", "Transaction status",
+			[]apiObject{{"name": "signature", "in": "path", "required": true, "schema": apiObject{"type": "string"}}},
+			props("signature", "string", "found", "boolean", "slot", "integer", "confirmations", "integer",
+				"status", "string", "success", "boolean", "err", "object"))}
+	}
+
+	if p.config.AdminToken != "" {
+		unauthorized := apiResponse("Missing or wrong admin token", nil)
+		admin := func(id, summary string, extra apiObject) apiObject {
+			op := apiObject{
+				"summary":     summary,
+				"operationId": id,
+				"security":    []apiObject{{"adminToken": []string{}}},
+				"responses": apiObject{
+					"200": apiResponse("OK", apiObject{"type": "object"}),
+					"401": unauthorized,
+				},
+			}
+			for k, v := range extra {
+				op[k] = v
+			}
+			return op
+		}
+		// The admin API is served at the root for every tenant and host
+		rootServer := []apiObject{{"url": "/"}}
+		paths["/admin/usage"] = apiObject{
+			"servers": rootServer,
+			"get": admin("adminUsage", "Per-key and per-IP usage", apiObject{
+				"parameters": []apiObject{{"name": "format", "in": "query", "schema": apiObject{"type": "string", "enum": []string{"json", "csv"}}}},
+			}),
+		}
+		paths["/admin/drain"] = apiObject{
+			"servers": rootServer,
+			"get":     admin("adminDrainStatus", "Drain mode status", nil),
+			"post":    admin("adminDrainStart", "Enable drain mode", nil),
+			"delete":  admin("adminDrainStop", "Disable drain mode", nil),
+		}
+		paths["/admin/programs"] = apiObject{
+			"servers": rootServer,
+			"get": admin("adminProgramPolicies", "Program policies and refusals", apiObject{
+				"parameters": []apiObject{{"name": "proxy", "in": "query", "schema": apiObject{"type": "string"}}},
+			}),
+			"put": admin("adminSetProgramPolicies", "Replace the program policies", apiObject{
+				"parameters":  []apiObject{{"name": "proxy", "in": "query", "schema": apiObject{"type": "string"}}},
+				"requestBody": apiObject{"required": true, "content": apiObject{"application/json": apiObject{"schema": apiObject{"type": "object"}}}},
+			}),
+		}
+		paths["/admin/loglevel"] = apiObject{
+			"servers": rootServer,
+			"get":     admin("adminLogLevel", "Log level and subsystems logging debug lines", nil),
+			"put": admin("adminSetLogLevel", "Change the log level for a while", apiObject{
+				"requestBody": apiObject{"required": true, "content": apiObject{"application/json": apiObject{"schema": apiObject{"type": "object"}}}},
+			}),
+			"delete": admin("adminResetLogLevel", "Revert to the configured log level", nil),
+		}
+		paths["/admin/metrics/snapshot"] = apiObject{
+			"servers": rootServer,
+			"get":     admin("adminMetricsSnapshot", "Timestamped metrics snapshot", nil),
+		}
+		paths["/admin/metrics/reset"] = apiObject{
+			"servers": rootServer,
+			"post":    admin("adminMetricsReset", "Reset the request counters", nil),
+		}
+		paths["/admin/traces"] = apiObject{
+			"servers": rootServer,
+			"get": admin("adminTraces", "Recent request traces with their timing breakdown", apiObject{
+				"parameters": []apiObject{
+					{"name": "id", "in": "query", "schema": apiObject{"type": "string"}},
+					{"name": "method", "in": "query", "schema": apiObject{"type": "string"}},
+					{"name": "tenant", "in": "query", "schema": apiObject{"type": "string"}},
+					{"name": "min_ms", "in": "query", "schema": apiObject{"type": "number"}},
+					{"name": "limit", "in": "query", "schema": apiObject{"type": "integer"}},
+				},
+			}),
+		}
+		paths["/admin/analyze"] = apiObject{
+			"servers": rootServer,
+			"get": admin("adminAnalyze", "Method mix of the request log and a recommended config", apiObject{
+				"parameters": []apiObject{
+					{"name": "since", "in": "query", "schema": apiObject{"type": "string"}},
+					{"name": "tenant", "in": "query", "schema": apiObject{"type": "string"}},
+				},
+			}),
+		}
+		paths["/admin/config"] = apiObject{
+			"servers": rootServer,
+			"get": admin("adminConfig", "Effective configuration with secrets redacted", apiObject{
+				"parameters": []apiObject{{"name": "proxy", "in": "query", "schema": apiObject{"type": "string"}}},
+			}),
+		}
+	}
+
+	return apiObject{
+		"openapi": "3.0.3",
+		"info": apiObject{
+			"title":       "Solana RPC Proxy",
+			"version":     Version,
+			"description": "Rate-limited Solana JSON-RPC proxy. Errors from the proxy itself use JSON-RPC error objects, except the REST facade which returns {\"error\": \"...\"}.",
+		},
+		"servers": []apiObject{{"url": base}},
+		"paths":   paths,
+		"components": apiObject{
+			"schemas": schemas,
+			"securitySchemes": apiObject{
+				"apiKeyHeader": apiObject{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"apiKeyQuery":  apiObject{"type": "apiKey", "in": "query", "name": "api-key"},
+				"adminToken":   apiObject{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document. Tenants see the path without
+// their prefix, so the server URL comes from the original request URI.
+func (p *RPCProxy) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	base, _, _ := strings.Cut(r.RequestURI, "?")
+	base = strings.TrimSuffix(base, "/openapi.json")
+	if base == "" {
+		base = "/"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.openAPIDocument(base))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// priority is a request's class for queueing and load shedding
+type priority int
+
+const (
+	priorityLow priority = iota
+	priorityNormal
+	priorityHigh
+
+	numPriorities
+)
+
+// parsePriority parses "low", "normal" or "high" ("" is normal)
+func parsePriority(s string) (priority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low":
+		return priorityLow, nil
+	case "", "normal":
+		return priorityNormal, nil
+	case "high":
+		return priorityHigh, nil
+	}
+	return priorityNormal, fmt.Errorf("unknown priority %q (want low, normal or high)", s)
+}
+
+func (pr priority) String() string {
+	switch pr {
+	case priorityLow:
+		return "low"
+	case priorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// budgetShare returns the fraction of a shared budget (e.g. buffered bytes)
+// requests of this priority may fill, so lower classes are shed first
+func (pr priority) budgetShare() float64 {
+	switch pr {
+	case priorityLow:
+		return 0.8
+	case priorityHigh:
+		return 1
+	}
+	return 0.9
+}
+
+// priorities assigns request priorities from API keys and a header that
+// trusted internal services set
+type priorities struct {
+	keys       map[string]priority // API key -> priority
+	file       *keyStore           // api_keys_file, set by the router
+	header     string
+	trustedIPs *exemptions
+}
+
+// newPriorities returns nil when no priorities are configured
+func newPriorities(config *Config) (*priorities, error) {
+	p := &priorities{keys: make(map[string]priority), header: config.PriorityHeader}
+	for _, k := range config.APIKeys {
+		if k.Key == "" || k.Priority == "" {
+			continue
+		}
+		pr, err := parsePriority(k.Priority)
+		if err != nil {
+			return nil, fmt.Errorf("api key %s: %w", keyPrefix(k.Key), err)
+		}
+		p.keys[k.Key] = pr
+	}
+
+	if p.header != "" {
+		if len(config.PriorityHeaderTrustedIPs) == 0 {
+			return nil, fmt.Errorf("priority_header requires priority_header_trusted_ips")
+		}
+		trusted, err := newExemptions(config.PriorityHeaderTrustedIPs, nil)
+		if err != nil {
+			return nil, fmt.Errorf("priority_header_trusted_ips: %w", err)
+		}
+		p.trustedIPs = trusted
+	}
+
+	if len(p.keys) == 0 && p.header == "" && config.APIKeysFile == "" {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// of returns the priority of a request. The header is only honoured when the
+// connection's peer is a trusted IP, and takes precedence over the API key.
+func (p *priorities) of(r *http.Request) priority {
+	if p == nil {
+		return priorityNormal
+	}
+	if p.header != "" {
+		if value := r.Header.Get(p.header); value != "" && p.trustedIPs.match(r) {
+			if pr, err := parsePriority(value); err == nil {
+				return pr
+			}
+		}
+	}
+	key := getAPIKey(r)
+	if pr, ok := p.keys[key]; ok {
+		return pr
+	}
+	if k, _ := p.file.lookup(key); k != nil {
+		return k.priority
+	}
+	return priorityNormal
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Program policy actions
+const (
+	programAllow = "allow"
+	programDeny  = "deny"
+	programLimit = "limit"
+)
+
+// ProgramPolicy decides what happens to submitted transactions invoking a
+// program
+type ProgramPolicy struct {
+	Action    string  `json:"action"`               // allow, deny or limit
+	RateLimit float64 `json:"rate_limit,omitempty"` // transactions per second invoking the program, across all clients, for limit
+	BurstSize int     `json:"burst_size,omitempty"` // defaults to the rate limit
+	Reason    string  `json:"reason,omitempty"`     // told to clients refused by deny
+}
+
+// programPolicies applies allow, deny and rate limit policies to the
+// programs invoked by sendTransaction requests. Policies are keyed by
+// program ID; "*" applies to programs without a policy of their own, so
+// {"*": deny} with allowed programs is an allowlist. Only the top-level
+// instructions are seen: programs invoked through CPI are not. The policies
+// can be replaced at runtime through /admin/programs.
+type programPolicies struct {
+	mu    sync.RWMutex
+	rules map[string]*programRule
+
+	admit sync.Mutex // makes checking and taking the limiters' slots atomic
+}
+
+// programRule is a policy in force and its counters
+type programRule struct {
+	ProgramPolicy
+	limiter requestLimiter // nil unless the action is limit
+	refused atomic.Int64
+}
+
+// programRefusal is the answer to a transaction a policy refused
+type programRefusal struct {
+	program    string
+	err        *JSONRPCError
+	status     int
+	retryAfter int // seconds, for rate limited transactions
+}
+
+func newProgramPolicies(config *Config) (*programPolicies, error) {
+	pp := &programPolicies{}
+	if err := pp.set(config.ProgramPolicies); err != nil {
+		return nil, fmt.Errorf("program_policies: %w", err)
+	}
+	return pp, nil
+}
+
+// validateProgramPolicies checks the program IDs and actions of policies
+func validateProgramPolicies(policies map[string]ProgramPolicy) error {
+	for program, policy := range policies {
+		if program != "*" {
+			if key, err := base58Decode(program); err != nil || len(key) != 32 {
+				return fmt.Errorf("%q is not a program ID", program)
+			}
+		}
+		switch policy.Action {
+		case programAllow, programDeny:
+		case programLimit:
+			if policy.RateLimit <= 0 {
+				return fmt.Errorf("%s: limit needs a rate_limit", program)
+			}
+		default:
+			return fmt.Errorf("%s: unknown action %q (want allow, deny or limit)", program, policy.Action)
+		}
+	}
+	return nil
+}
+
+// set replaces the policies, keeping the limiters and counters of those
+// that didn't change
+func (pp *programPolicies) set(policies map[string]ProgramPolicy) error {
+	if err := validateProgramPolicies(policies); err != nil {
+		return err
+	}
+	pp.mu.RLock()
+	old := pp.rules
+	pp.mu.RUnlock()
+
+	rules := make(map[string]*programRule, len(policies))
+	for program, policy := range policies {
+		if prev, ok := old[program]; ok && prev.ProgramPolicy == policy {
+			rules[program] = prev
+			continue
+		}
+		rule := &programRule{ProgramPolicy: policy}
+		if policy.Action == programLimit {
+			burst := policy.BurstSize
+			if burst <= 0 {
+				burst = int(math.Ceil(policy.RateLimit))
+			}
+			rule.limiter = newRequestLimiter("", policy.RateLimit, burst, 0)
+		}
+		rules[program] = rule
+	}
+
+	pp.mu.Lock()
+	pp.rules = rules
+	pp.mu.Unlock()
+	return nil
+}
+
+// active reports whether any policy is configured
+func (pp *programPolicies) active() bool {
+	pp.mu.RLock()
+	defer pp.mu.RUnlock()
+	return len(pp.rules) > 0
+}
+
+// check applies the policies to the transaction in sendTransaction params,
+// returning nil when it may be sent. Transactions that can't be decoded are
+// left for the upstream to reject.
+func (pp *programPolicies) check(params json.RawMessage) *programRefusal {
+	data := transactionParam(params)
+	if data == nil {
+		return nil
+	}
+	tx, err := decodeTransaction(data)
+	if err != nil {
+		return nil
+	}
+	programs, err := tx.programs()
+	if err != nil {
+		return nil
+	}
+
+	pp.mu.RLock()
+	defer pp.mu.RUnlock()
+	rules := make([]*programRule, len(programs))
+	for i, program := range programs {
+		rule, ok := pp.rules[program]
+		if !ok {
+			rule = pp.rules["*"]
+		}
+		rules[i] = rule
+		if rule != nil && rule.Action == programDeny {
+			rule.refused.Add(1)
+			message := "Transaction refused: it invokes program " + program
+			if rule.Reason != "" {
+				message += ": " + rule.Reason
+			}
+			return &programRefusal{
+				program: program,
+				err:     &JSONRPCError{Code: errInvalidRequest, Message: message, Data: map[string]string{"program": program}},
+				status:  http.StatusForbidden,
+			}
+		}
+	}
+
+	// Check every limit before taking any slot, so a transaction refused
+	// by one program's limit doesn't use up the others'
+	pp.admit.Lock()
+	defer pp.admit.Unlock()
+	now := time.Now()
+	limited := make(map[*programRule]bool, len(rules))
+	for i, rule := range rules {
+		if rule == nil || rule.limiter == nil || limited[rule] {
+			continue
+		}
+		limited[rule] = true
+		if rule.limiter.wait(now) > 0 {
+			rule.refused.Add(1)
+			retryAfter := int(math.Ceil(1 / rule.RateLimit))
+			return &programRefusal{
+				program: programs[i],
+				err: &JSONRPCError{
+					Code:    -32005,
+					Message: fmt.Sprintf("Rate limited: transactions invoking program %s. Please retry after %d seconds.", programs[i], retryAfter),
+					Data:    map[string]interface{}{"program": programs[i], "retry_after_seconds": retryAfter},
+				},
+				status:     http.StatusTooManyRequests,
+				retryAfter: retryAfter,
+			}
+		}
+	}
+	for rule := range limited {
+		rule.limiter.Allow()
+	}
+	return nil
+}
+
+// policies returns the policies in force
+func (pp *programPolicies) policies() map[string]ProgramPolicy {
+	pp.mu.RLock()
+	defer pp.mu.RUnlock()
+	policies := make(map[string]ProgramPolicy, len(pp.rules))
+	for program, rule := range pp.rules {
+		policies[program] = rule.ProgramPolicy
+	}
+	return policies
+}
+
+// snapshot returns the transactions refused per program for /metrics
+func (pp *programPolicies) snapshot() map[string]int64 {
+	pp.mu.RLock()
+	defer pp.mu.RUnlock()
+	refused := make(map[string]int64, len(pp.rules))
+	for program, rule := range pp.rules {
+		refused[program] = rule.refused.Load()
+	}
+	return refused
+}
+
+// writeProgramRefusal answers a transaction refused by a program policy
+func (p *RPCProxy) writeProgramRefusal(w http.ResponseWriter, id interface{}, refusal *programRefusal) {
+	p.metrics.FailedRequests.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	if refusal.retryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(refusal.retryAfter))
+	}
+	w.WriteHeader(refusal.status)
+	json.NewEncoder(w).Encode(JSONRPCResponse{JSONRPC: "2.0", ID: id, Error: refusal.err})
+}
+
+// handlePrograms serves /admin/programs for the proxy named by ?proxy=
+// (default "default"): GET returns its program policies and the
+// transactions each refused, PUT replaces the policies
+func (rt *Router) handlePrograms(w http.ResponseWriter, r *http.Request) {
+	proxy := rt.adminProxy(w, r)
+	if proxy == nil {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+		var policies map[string]ProgramPolicy
+		if err := json.Unmarshal(body, &policies); err != nil {
+			http.Error(w, "Invalid policies: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := proxy.programs.set(policies); err != nil {
+			http.Error(w, "Invalid policies: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Program policies of %s replaced by %s: %d programs", proxy.name, adminActor(r), len(policies))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"proxy":    proxy.name,
+		"policies": proxy.programs.policies(),
+		"refused":  proxy.programs.snapshot(),
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readyProbeTimeout bounds the upstream probe behind /readyz, well inside
+// the default Kubernetes probe timeout
+const readyProbeTimeout = 3 * time.Second
+
+// readinessState caches the last upstream probe, so frequent readiness
+// probes from several kubelets don't each reach the upstream
+type readinessState struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+
+	warm atomic.Bool // startup warm-up finished or timed out
+
+	certsOnce sync.Once
+	certs     []servedCert
+	certsErr  error
+}
+
+// servedCert is the validity of a certificate a TLS listener serves
+type servedCert struct {
+	listener  string
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// checkUpstream reports whether at least one upstream the proxy would route
+// to answers getHealth. The result is reused for ready_check_interval.
+func (p *RPCProxy) checkUpstream(ctx context.Context) error {
+	s := &p.readiness
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.checked.IsZero() && time.Since(s.checked) < p.config.ReadyCheckInterval.Duration {
+		return s.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+	defer cancel()
+
+	err := errors.New("no routable upstream")
+	now := time.Now()
+	for _, u := range p.pool.candidates() {
+		if u.throttledFor(now) > 0 {
+			err = fmt.Errorf("%s: throttled", u.name)
+			continue
+		}
+		probeErr := p.pool.call(ctx, u, "getHealth", nil, nil)
+		if probeErr == nil {
+			err = nil
+			break
+		}
+		err = fmt.Errorf("%s: %w", u.name, probeErr)
+	}
+
+	// Don't cache a probe cut short by the client going away
+	if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.checked = time.Now()
+		s.err = err
+	}
+	return err
+}
+
+// checkLimiter reports whether the global rate limiter could still admit a
+// new request within max_wait_time. The estimate takes no slot, so frequent
+// probes don't eat into the capacity of real traffic.
+func (p *RPCProxy) checkLimiter() error {
+	if p.globalLimiter == nil || !p.config.WaitForSlot || p.config.MaxWaitTime.Duration <= 0 {
+		return nil
+	}
+	if wait := p.expectedWait(p.globalLimiter); wait >= p.config.MaxWaitTime.Duration {
+		return fmt.Errorf("rate limit queue full: expected wait %s exceeds max_wait_time", wait.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// checkWarm reports what is still warming up after startup: the slot cache
+// feed, so cached methods like getLatestBlockhash answer from the cache, and
+// the upstream slots behind the slot guard. Once everything was warm, or
+// ready_warm_timeout has passed, it stays ok: a later feed outage only
+// bypasses the cache.
+func (p *RPCProxy) checkWarm() error {
+	s := &p.readiness
+	if s.warm.Load() {
+		return nil
+	}
+
+	var pending []string
+	if p.slotCache != nil && !p.slotCache.ready() {
+		pending = append(pending, "slot cache feed")
+	}
+	if (p.pool.watermarks != nil || p.config.MaxBlockDepth > 0) && p.pool.tip() == 0 {
+		pending = append(pending, "upstream slots")
+	}
+	if len(pending) == 0 {
+		s.warm.Store(true)
+		return nil
+	}
+
+	if timeout := p.config.ReadyWarmTimeout.Duration; time.Since(p.metrics.StartTime) >= timeout {
+		if !s.warm.Swap(true) && timeout > 0 {
+			log.Printf("[WARN] %s: %s not warm after ready_warm_timeout, reporting ready anyway", p.name, strings.Join(pending, ", "))
+		}
+		return nil
+	}
+	return fmt.Errorf("warming up: %s", strings.Join(pending, ", "))
+}
+
+// checkTLS reports whether every TLS listener's certificate loads and is
+// valid now. The files are read once, as that is when the listeners load
+// them too.
+func (p *RPCProxy) checkTLS() error {
+	s := &p.readiness
+	s.certsOnce.Do(func() {
+		for _, l := range p.config.listenerConfigs() {
+			if !l.tls() {
+				continue
+			}
+			pair, err := tls.LoadX509KeyPair(l.TLSCertFile, l.TLSKeyFile)
+			if err == nil {
+				var leaf *x509.Certificate
+				if leaf, err = x509.ParseCertificate(pair.Certificate[0]); err == nil {
+					s.certs = append(s.certs, servedCert{listener: l.String(), notBefore: leaf.NotBefore, notAfter: leaf.NotAfter})
+					continue
+				}
+			}
+			s.certsErr = fmt.Errorf("%s: %w", l, err)
+			return
+		}
+	})
+	if s.certsErr != nil {
+		return s.certsErr
+	}
+
+	now := time.Now()
+	for _, c := range s.certs {
+		switch {
+		case now.Before(c.notBefore):
+			return fmt.Errorf("%s: certificate not valid before %s", c.listener, c.notBefore.UTC().Format(time.RFC3339))
+		case now.After(c.notAfter):
+			return fmt.Errorf("%s: certificate expired at %s", c.listener, c.notAfter.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// handleLivez reports that the process is up and serving HTTP. It never
+// looks at the upstream, so a provider outage doesn't get the pod restarted.
+func (p *RPCProxy) handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+		"uptime": time.Since(p.metrics.StartTime).String(),
+	})
+}
+
+// handleReadyz reports whether the proxy should receive traffic: it is not
+// draining, has warmed up, serves valid certificates, an upstream is
+// reachable and the rate limiter is not saturated
+func (p *RPCProxy) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"drain": "ok", "warmup": "ok", "tls": "ok", "upstream": "ok", "limiter": "ok"}
+	ready := true
+
+	if draining, _ := p.drain.status(); draining {
+		checks["drain"] = "draining"
+		ready = false
+	}
+	if err := p.checkWarm(); err != nil {
+		checks["warmup"] = err.Error()
+		ready = false
+	}
+	if err := p.checkTLS(); err != nil {
+		checks["tls"] = err.Error()
+		ready = false
+	}
+	if err := p.checkUpstream(r.Context()); err != nil {
+		checks["upstream"] = err.Error()
+		ready = false
+	}
+	if err := p.checkLimiter(); err != nil {
+		checks["limiter"] = err.Error()
+		ready = false
+	}
+
+	status := "ready"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		status = "not_ready"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"tenant": p.name,
+		"checks": checks,
+	})
+}
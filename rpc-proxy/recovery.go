@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// panicWriter remembers whether a response has started, so a panic can
+// still be answered with an error when nothing was sent
+type panicWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (pw *panicWriter) WriteHeader(code int) {
+	pw.started = true
+	pw.ResponseWriter.WriteHeader(code)
+}
+
+func (pw *panicWriter) Write(b []byte) (int, error) {
+	pw.started = true
+	return pw.ResponseWriter.Write(b)
+}
+
+// Hijack hands the connection to the WebSocket handler
+func (pw *panicWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	pw.started = true
+	return http.NewResponseController(pw.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (pw *panicWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// recoverPanic turns a panic in a handler into a -32603 response, logging
+// the stack with the request ID the client can quote. A response that had
+// already started is aborted instead, so the client sees a broken connection
+// rather than a truncated body that looks complete.
+func (rt *Router) recoverPanic(w *panicWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v) // deliberate aborts stay silent
+	}
+	rt.defaultProxy.panics.Add(1)
+
+	id := requestID(r)
+	log.Printf("[PANIC] Request %s, %s %s from %s: %v\n%s", id, r.Method, r.URL.Path, rt.defaultProxy.anonymizer.anonymize(getClientIP(r)), v, debug.Stack())
+	if w.started {
+		panic(http.ErrAbortHandler)
+	}
+
+	resp := JSONRPCResponse{
+		JSONRPC: "2.0",
+		Error: &JSONRPCError{
+			Code:    -32603, // Internal error
+			Message: "Internal error",
+			Data:    map[string]string{"request_id": id},
+		},
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Request-Id", id)
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// requestID returns the client's X-Request-Id, or a new random one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 64 {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// requestLogRetries is how often a batch that failed to write is retried
+// before it is dropped
+const requestLogRetries = 3
+
+// requestLogTableName restricts request_log_table to a plain identifier, as
+// it is spliced into SQL
+var requestLogTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// requestRecord is one proxied request in the request log
+type requestRecord struct {
+	Time      time.Time `json:"time"`
+	Tenant    string    `json:"tenant"`
+	Key       string    `json:"key"` // API key name, empty for anonymous requests
+	IP        string    `json:"ip"`  // anonymized when anonymize_ips is on
+	Method    string    `json:"method"`
+	Requests  int       `json:"requests"` // 1, or the size of a batch
+	Status    int       `json:"status"`
+	LatencyMs float64   `json:"latency_ms"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Upstream  string    `json:"upstream"` // empty when not forwarded
+}
+
+// requestSink stores batches of request records
+type requestSink interface {
+	write(ctx context.Context, records []requestRecord) error
+	close() error
+}
+
+// requestLog writes request records to a sink in the background, in
+// batches. The request path never waits for the sink: when the buffer is
+// full, because the sink is slow or down, further records are dropped and
+// counted.
+type requestLog struct {
+	sink          requestSink
+	records       chan requestRecord
+	batchSize     int
+	flushInterval time.Duration
+	stop          chan struct{}
+	done          chan struct{}
+
+	written atomic.Int64
+	dropped atomic.Int64 // buffer full
+	failed  atomic.Int64 // given up after requestLogRetries
+}
+
+// newRequestLog returns nil when no sink is configured
+func newRequestLog(config *Config) (*requestLog, error) {
+	if config.RequestLogSink == "" {
+		return nil, nil
+	}
+	table := config.RequestLogTable
+	if !requestLogTableName.MatchString(table) {
+		return nil, fmt.Errorf("request_log_table: invalid table name %q", table)
+	}
+
+	var sink requestSink
+	var err error
+	switch config.RequestLogSink {
+	case "sqlite":
+		sink, err = newSQLiteSink(config.RequestLogPath, table)
+	case "clickhouse":
+		sink, err = newClickHouseSink(config.RequestLogURL, table, config.Timeout.Duration)
+	default:
+		err = fmt.Errorf("unknown sink %q (want sqlite or clickhouse)", config.RequestLogSink)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("request_log_sink: %w", err)
+	}
+
+	l := &requestLog{
+		sink:          sink,
+		records:       make(chan requestRecord, max(config.RequestLogBufferSize, 1)),
+		batchSize:     max(config.RequestLogBatchSize, 1),
+		flushInterval: config.RequestLogFlushInterval.Duration,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if l.flushInterval <= 0 {
+		l.flushInterval = time.Second
+	}
+	go l.run()
+	return l, nil
+}
+
+// record queues a record without blocking
+func (l *requestLog) record(rec requestRecord) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.records <- rec:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// run writes a batch whenever it is full or flush_interval has passed
+func (l *requestLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]requestRecord, 0, l.batchSize)
+	for {
+		select {
+		case rec := <-l.records:
+			batch = append(batch, rec)
+			if len(batch) < l.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-l.stop:
+			for len(l.records) > 0 {
+				batch = append(batch, <-l.records)
+			}
+			if len(batch) > 0 {
+				l.flush(batch, 1)
+			}
+			return
+		}
+		l.flush(batch, requestLogRetries)
+		batch = batch[:0]
+	}
+}
+
+// flush writes a batch, retrying after flush_interval on failure. Records
+// keep queueing meanwhile, up to the buffer size.
+func (l *requestLog) flush(batch []requestRecord, attempts int) {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = l.sink.write(ctx, batch)
+		cancel()
+		if err == nil {
+			l.written.Add(int64(len(batch)))
+			return
+		}
+		if attempt < attempts {
+			time.Sleep(l.flushInterval)
+		}
+	}
+	l.failed.Add(int64(len(batch)))
+	log.Printf("[ERROR] Failed to write %d request log records: %v", len(batch), err)
+}
+
+// close writes the records still queued and closes the sink
+func (l *requestLog) close() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	if err := l.sink.close(); err != nil {
+		log.Printf("[ERROR] Failed to close request log: %v", err)
+	}
+}
+
+func (l *requestLog) snapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"queued":  len(l.records),
+		"written": l.written.Load(),
+		"dropped": l.dropped.Load(),
+		"failed":  l.failed.Load(),
+	}
+}
+
+// sqliteSink stores request records in a local SQLite database
+type sqliteSink struct {
+	db     *sql.DB
+	insert string
+}
+
+func newSQLiteSink(path, table string) (*sqliteSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("request_log_path is required for sqlite")
+	}
+	if strings.Contains(table, ".") {
+		return nil, fmt.Errorf("request_log_table %q: sqlite tables can't name a database", table)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // a single writer, so batches never contend for the lock
+
+	for _, stmt := range []string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA busy_timeout = 5000`,
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (
+			time       TEXT    NOT NULL,
+			tenant     TEXT    NOT NULL,
+			key        TEXT    NOT NULL,
+			ip         TEXT    NOT NULL,
+			method     TEXT    NOT NULL,
+			requests   INTEGER NOT NULL,
+			status     INTEGER NOT NULL,
+			latency_ms REAL    NOT NULL,
+			bytes_in   INTEGER NOT NULL,
+			bytes_out  INTEGER NOT NULL,
+			upstream   TEXT    NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_time ON ` + table + ` (time)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return &sqliteSink{
+		db:     db,
+		insert: `INSERT INTO ` + table + ` VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	}, nil
+}
+
+// write inserts a batch in one transaction
+func (s *sqliteSink) write(ctx context.Context, records []requestRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, s.insert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range records {
+		if _, err := stmt.ExecContext(ctx, r.Time.UTC().Format(time.RFC3339Nano), r.Tenant, r.Key, r.IP, r.Method,
+			r.Requests, r.Status, r.LatencyMs, r.BytesIn, r.BytesOut, r.Upstream); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteSink) close() error {
+	return s.db.Close()
+}
+
+// clickHouseSink stores request records in ClickHouse over its HTTP
+// interface
+type clickHouseSink struct {
+	url    *url.URL
+	table  string
+	client *http.Client
+}
+
+func newClickHouseSink(rawURL, table string, timeout time.Duration) (*clickHouseSink, error) {
+	if rawURL == "" {
+		return nil, fmt.Errorf("request_log_url is required for clickhouse")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &clickHouseSink{url: u, table: table, client: &http.Client{Timeout: timeout}}
+
+	// ClickHouse may still be starting, so a failure here isn't fatal:
+	// inserts are retried and fail loudly enough if the table is missing
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = s.exec(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+		time       DateTime64(3, 'UTC'),
+		tenant     LowCardinality(String),
+		key        String,
+		ip         String,
+		method     LowCardinality(String),
+		requests   UInt32,
+		status     UInt16,
+		latency_ms Float64,
+		bytes_in   UInt64,
+		bytes_out  UInt64,
+		upstream   LowCardinality(String)
+	) ENGINE = MergeTree ORDER BY time`, nil)
+	if err != nil {
+		log.Printf("[WARN] Failed to create ClickHouse table %s: %v", table, err)
+	}
+	return s, nil
+}
+
+// write inserts a batch as JSONEachRow
+func (s *clickHouseSink) write(ctx context.Context, records []requestRecord) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, r := range records {
+		r.Time = r.Time.UTC()
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	return s.exec(ctx, "INSERT INTO "+s.table+" SETTINGS date_time_input_format = 'best_effort' FORMAT JSONEachRow", &body)
+}
+
+// exec runs a query, with data as the body of an INSERT
+func (s *clickHouseSink) exec(ctx context.Context, query string, data io.Reader) error {
+	u := *s.url
+	q := u.Query()
+	q.Set("query", query)
+	u.RawQuery = q.Encode()
+	if data == nil {
+		data = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), data)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *clickHouseSink) close() error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonPresence records that a field was present, without copying its value
+type jsonPresence bool
+
+func (p *jsonPresence) UnmarshalJSON([]byte) error {
+	*p = true
+	return nil
+}
+
+// upstreamResponse is the envelope of an upstream JSON-RPC response
+type upstreamResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  jsonPresence    `json:"result"`
+	Error   jsonPresence    `json:"error"`
+}
+
+// validateResponse checks that an upstream body is a JSON-RPC response to
+// the request, returning what is wrong with it or "" when it is fine.
+// Responses may come back in any order and answer malformed requests with a
+// null id; a batch may be refused as a whole with a single error.
+func validateResponse(body []byte, isBatch bool, ids []interface{}) string {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return "empty body"
+	}
+	if !json.Valid(trimmed) {
+		return "not JSON"
+	}
+
+	expected := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		encoded, _ := json.Marshal(id)
+		expected[string(encoded)] = true
+	}
+	check := func(raw []byte) string {
+		var resp upstreamResponse
+		if json.Unmarshal(raw, &resp) != nil {
+			return "response is not an object"
+		}
+		if resp.JSONRPC != "2.0" {
+			return `jsonrpc is not "2.0"`
+		}
+		if bool(resp.Result) == bool(resp.Error) {
+			return "response needs exactly one of result and error"
+		}
+		id := "null"
+		if len(resp.ID) > 0 {
+			var value interface{}
+			json.Unmarshal(resp.ID, &value)
+			encoded, _ := json.Marshal(value)
+			id = string(encoded)
+		}
+		if id != "null" && !expected[id] {
+			return fmt.Sprintf("unexpected id %s", truncateString(id, 64))
+		}
+		if id == "null" && !bool(resp.Error) && !expected["null"] {
+			return "result without an id"
+		}
+		return ""
+	}
+
+	if trimmed[0] != '[' {
+		if reason := check(trimmed); reason != "" {
+			return reason
+		}
+		if isBatch {
+			// Only a whole-batch error may answer a batch with one object
+			var resp upstreamResponse
+			json.Unmarshal(trimmed, &resp)
+			if !resp.Error {
+				return "single result for a batch"
+			}
+		}
+		return ""
+	}
+	if !isBatch {
+		return "batch response to a single request"
+	}
+	var items []json.RawMessage
+	json.Unmarshal(trimmed, &items)
+	if len(items) > len(ids) {
+		return fmt.Sprintf("%d responses for %d requests", len(items), len(ids))
+	}
+	for i, item := range items {
+		if reason := check(item); reason != "" {
+			return fmt.Sprintf("response %d: %s", i, reason)
+		}
+	}
+	return ""
+}
+
+// writeInvalidResponse replaces a mangled upstream response, such as a CDN's
+// HTML error page, with a clean internal error describing it
+func (p *RPCProxy) writeInvalidResponse(w http.ResponseWriter, id interface{}, u *upstream, resp *http.Response, body []byte, reason string) {
+	p.invalidResponses.Add(1)
+	prefix := body
+	if len(prefix) > 200 {
+		prefix = prefix[:200]
+	}
+	out := JSONRPCResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error: &JSONRPCError{
+			Code:    -32603, // Internal error
+			Message: "Invalid response from upstream: " + reason,
+			Data: map[string]interface{}{
+				"upstream":     u.name,
+				"status":       resp.StatusCode,
+				"content_type": resp.Header.Get("Content-Type"),
+				"body_prefix":  strings.ToValidUTF8(string(prefix), string(utf8.RuneError)),
+			},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false) // keep the body prefix readable
+	encoder.Encode(out)
+}
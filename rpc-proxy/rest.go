@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// lamportsPerSOL converts account balances for REST responses
+const lamportsPerSOL = 1e9
+
+// bufferedResponse captures a response so the REST facade can trim it
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+// restRoute is a REST endpoint backed by one JSON-RPC call
+type restRoute struct {
+	method string
+	params func(arg string, r *http.Request) []interface{}
+	trim   func(arg string, r *http.Request, result json.RawMessage) (interface{}, error)
+}
+
+// restRoutes are the REST endpoints under /api/v1/, by their first path
+// segment. Routes with a params func that reads arg take the rest of the
+// path as their argument, e.g. /api/v1/account/<pubkey>.
+var restRoutes = map[string]restRoute{
+	"slot": {
+		method: "getSlot",
+		trim: func(_ string, _ *http.Request, result json.RawMessage) (interface{}, error) {
+			var slot uint64
+			err := json.Unmarshal(result, &slot)
+			return map[string]interface{}{"slot": slot}, err
+		},
+	},
+	"blockhash": {
+		method: "getLatestBlockhash",
+		trim: func(_ string, _ *http.Request, result json.RawMessage) (interface{}, error) {
+			var resp struct {
+				Context struct {
+					Slot uint64 `json:"slot"`
+				} `json:"context"`
+				Value struct {
+					Blockhash            string `json:"blockhash"`
+					LastValidBlockHeight uint64 `json:"lastValidBlockHeight"`
+				} `json:"value"`
+			}
+			err := json.Unmarshal(result, &resp)
+			return map[string]interface{}{
+				"blockhash":               resp.Value.Blockhash,
+				"last_valid_block_height": resp.Value.LastValidBlockHeight,
+				"slot":                    resp.Context.Slot,
+			}, err
+		},
+	},
+	"account": {
+		method: "getAccountInfo",
+		params: func(pubkey string, r *http.Request) []interface{} {
+			opts := map[string]interface{}{"encoding": "base64"}
+			if r.URL.Query().Get("data") != "true" {
+				opts["dataSlice"] = map[string]int{"offset": 0, "length": 0}
+			}
+			return []interface{}{pubkey, opts}
+		},
+		trim: func(pubkey string, r *http.Request, result json.RawMessage) (interface{}, error) {
+			var resp struct {
+				Context struct {
+					Slot uint64 `json:"slot"`
+				} `json:"context"`
+				Value *struct {
+					Lamports   uint64   `json:"lamports"`
+					Owner      string   `json:"owner"`
+					Executable bool     `json:"executable"`
+					RentEpoch  uint64   `json:"rentEpoch"`
+					Space      uint64   `json:"space"`
+					Data       []string `json:"data"`
+				} `json:"value"`
+			}
+			if err := json.Unmarshal(result, &resp); err != nil {
+				return nil, err
+			}
+
+			account := map[string]interface{}{
+				"pubkey": pubkey,
+				"slot":   resp.Context.Slot,
+				"exists": resp.Value != nil,
+			}
+			if v := resp.Value; v != nil {
+				account["lamports"] = v.Lamports
+				account["sol"] = float64(v.Lamports) / lamportsPerSOL
+				account["owner"] = v.Owner
+				account["executable"] = v.Executable
+				account["rent_epoch"] = v.RentEpoch
+				account["data_len"] = v.Space
+				if r.URL.Query().Get("data") == "true" && len(v.Data) > 0 {
+					account["data"] = v.Data[0]
+				}
+			} else {
+				account["lamports"] = 0
+				account["sol"] = 0
+			}
+			return account, nil
+		},
+	},
+	"tx": {
+		method: "getSignatureStatuses",
+		params: func(signature string, _ *http.Request) []interface{} {
+			return []interface{}{[]string{signature}, map[string]bool{"searchTransactionHistory": true}}
+		},
+		trim: func(signature string, _ *http.Request, result json.RawMessage) (interface{}, error) {
+			var resp struct {
+				Value []*struct {
+					Slot               uint64          `json:"slot"`
+					Confirmations      *uint64         `json:"confirmations"`
+					Err                json.RawMessage `json:"err"`
+					ConfirmationStatus string          `json:"confirmationStatus"`
+				} `json:"value"`
+			}
+			if err := json.Unmarshal(result, &resp); err != nil {
+				return nil, err
+			}
+
+			tx := map[string]interface{}{"signature": signature, "found": false}
+			if len(resp.Value) == 0 || resp.Value[0] == nil {
+				return tx, nil
+			}
+			v := resp.Value[0]
+			tx["found"] = true
+			tx["slot"] = v.Slot
+			tx["confirmations"] = v.Confirmations
+			tx["status"] = v.ConfirmationStatus
+			success := len(v.Err) == 0 || string(v.Err) == "null"
+			tx["success"] = success
+			if !success {
+				tx["err"] = v.Err
+			}
+			return tx, nil
+		},
+	},
+}
+
+// handleREST serves the REST facade under /api/v1/. Each endpoint becomes a
+// JSON-RPC request that goes through the normal pipeline (limits, metrics,
+// upstream failover), and the result is trimmed to the fields tools need.
+func (p *RPCProxy) handleREST(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeRESTError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name, arg, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	route, ok := restRoutes[name]
+	if !ok || (route.params != nil) != (arg != "") || strings.Contains(arg, "/") {
+		writeRESTError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	rpcReq := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": route.method}
+	if route.params != nil {
+		rpcReq["params"] = route.params(arg, r)
+	}
+	body, err := json.Marshal(rpcReq)
+	if err != nil {
+		writeRESTError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	post := r.Clone(r.Context())
+	post.Method = http.MethodPost
+	post.URL.Path = "/"
+	post.Body = io.NopCloser(bytes.NewReader(body))
+	post.ContentLength = int64(len(body))
+	post.Header.Set("Content-Type", "application/json")
+	// The result is decoded below, so it must come back as JSON even when
+	// the client asked for CBOR or MessagePack
+	post.Header.Set("Accept", "application/json")
+
+	resp := newBufferedResponse()
+	p.ServeHTTP(resp, post)
+
+	// Keep rate limit, CORS and backpressure headers
+	for k, v := range resp.header {
+		if k != "Content-Length" && k != "Content-Type" {
+			w.Header()[k] = v
+		}
+	}
+
+	var rpcResp JSONRPCResponse
+	if err := json.Unmarshal(resp.body.Bytes(), &rpcResp); err != nil {
+		status := resp.status
+		if status == http.StatusOK {
+			status = http.StatusBadGateway
+		}
+		writeRESTError(w, status, "invalid upstream response")
+		return
+	}
+	if rpcResp.Error != nil {
+		status := resp.status
+		if status == http.StatusOK {
+			status = http.StatusBadGateway
+			if rpcResp.Error.Code == -32602 {
+				status = http.StatusBadRequest
+			}
+		}
+		writeRESTError(w, status, rpcResp.Error.Message)
+		return
+	}
+
+	trimmed, err := route.trim(arg, r, rpcResp.Result)
+	if err != nil {
+		writeRESTError(w, http.StatusBadGateway, "unexpected upstream result")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trimmed)
+}
+
+// writeRESTError writes a REST facade error as {"error": "..."}
+func writeRESTError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
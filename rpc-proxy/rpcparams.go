@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// commitmentParams maps the methods accepting a commitment to the position
+// of their config object in params. -1 marks methods with optional leading
+// params, whose config is the last param when it is an object.
+var commitmentParams = map[string]int{
+	"getAccountInfo":                    1,
+	"getBalance":                        1,
+	"getBlock":                          1,
+	"getBlockHeight":                    0,
+	"getBlocks":                         -1,
+	"getBlocksWithLimit":                -1,
+	"getEpochInfo":                      0,
+	"getFeeForMessage":                  1,
+	"getInflationGovernor":              0,
+	"getInflationReward":                1,
+	"getLargestAccounts":                0,
+	"getLatestBlockhash":                0,
+	"getLeaderSchedule":                 -1,
+	"getMinimumBalanceForRentExemption": 1,
+	"getMultipleAccounts":               1,
+	"getProgramAccounts":                1,
+	"getSignaturesForAddress":           1,
+	"getSlot":                           0,
+	"getSlotLeader":                     0,
+	"getStakeMinimumDelegation":         0,
+	"getSupply":                         0,
+	"getTokenAccountBalance":            1,
+	"getTokenAccountsByDelegate":        2,
+	"getTokenAccountsByOwner":           2,
+	"getTokenLargestAccounts":           1,
+	"getTokenSupply":                    1,
+	"getTransaction":                    1,
+	"getTransactionCount":               0,
+	"getVoteAccounts":                   0,
+	"isBlockhashValid":                  1,
+	"requestAirdrop":                    2,
+	"simulateTransaction":               1,
+}
+
+// rpcCall is one request of a JSON-RPC body being rewritten. Only params is
+// decoded, so ids and other fields pass through byte for byte.
+type rpcCall struct {
+	fields map[string]json.RawMessage
+	method string
+	params []json.RawMessage
+}
+
+// rewriteCalls decodes each request of a single or batch body, lets rewrite
+// change its params and re-encodes the body if any call reports a change.
+// Requests that aren't objects with array params are passed to rewrite
+// without params and left as they are.
+func rewriteCalls(body []byte, isBatch bool, rewrite func(i int, call *rpcCall) bool) []byte {
+	var items []json.RawMessage
+	if isBatch {
+		if json.Unmarshal(body, &items) != nil {
+			return body
+		}
+	} else {
+		items = []json.RawMessage{body}
+	}
+
+	rewritten := false
+	for i, item := range items {
+		call := &rpcCall{}
+		if json.Unmarshal(item, &call.fields) != nil {
+			rewrite(i, call)
+			continue
+		}
+		json.Unmarshal(call.fields["method"], &call.method)
+		if len(call.fields["params"]) > 0 && json.Unmarshal(call.fields["params"], &call.params) != nil {
+			rewrite(i, &rpcCall{method: call.method})
+			continue
+		}
+		if !rewrite(i, call) {
+			continue
+		}
+
+		params, err := json.Marshal(call.params)
+		if err != nil {
+			continue
+		}
+		call.fields["params"] = params
+		encoded, err := json.Marshal(call.fields)
+		if err != nil {
+			continue
+		}
+		items[i] = encoded
+		rewritten = true
+	}
+
+	if !rewritten {
+		return body
+	}
+	if !isBatch {
+		return items[0]
+	}
+	out, err := json.Marshal(items)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// configIndex returns the position of the call's config object in params,
+// which may be len(params) when the client left it out, or -1 when the
+// method takes no commitment or the params are malformed
+func (c *rpcCall) configIndex() int {
+	index, ok := commitmentParams[c.method]
+	if !ok {
+		return -1
+	}
+	if index < 0 {
+		// Optional leading params: the config is the last param if that is
+		// an object, otherwise it goes after the others
+		index = len(c.params)
+		if index > 0 && bytes.HasPrefix(bytes.TrimSpace(c.params[index-1]), []byte("{")) {
+			index--
+		}
+	}
+	if index > len(c.params) {
+		return -1 // missing required params, left to the upstream to reject
+	}
+	return index
+}
+
+// config returns the call's config object, empty when it has none, and
+// false when the method takes none or it isn't an object
+func (c *rpcCall) config() (map[string]json.RawMessage, bool) {
+	index := c.configIndex()
+	if index < 0 {
+		return nil, false
+	}
+	config := make(map[string]json.RawMessage)
+	if index < len(c.params) && !bytes.Equal(bytes.TrimSpace(c.params[index]), []byte("null")) {
+		if json.Unmarshal(c.params[index], &config) != nil {
+			return nil, false
+		}
+	}
+	return config, true
+}
+
+// setConfig stores the call's config object
+func (c *rpcCall) setConfig(config map[string]json.RawMessage) bool {
+	index := c.configIndex()
+	if index < 0 {
+		return false
+	}
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return false
+	}
+	if index == len(c.params) {
+		c.params = append(c.params, encoded)
+	} else {
+		c.params[index] = encoded
+	}
+	return true
+}
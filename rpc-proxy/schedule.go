@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RateProfile replaces the rate limits while its schedule is active, e.g.
+// higher public limits off-peak or lower ones during a nightly backfill
+type RateProfile struct {
+	Name     string   `json:"name"`
+	Schedule string   `json:"schedule"` // cron expression for when the profile starts: minute hour day-of-month month day-of-week
+	Duration Duration `json:"duration"` // how long it stays active after each start
+	Timezone string   `json:"timezone"` // IANA time zone of the schedule, default UTC
+
+	GlobalRateLimit float64 `json:"global_rate_limit"` // 0 = keep the configured value
+	GlobalBurstSize int     `json:"global_burst_size"`
+	PerIPRateLimit  float64 `json:"per_ip_rate_limit"`
+	PerIPBurstSize  int     `json:"per_ip_burst_size"`
+}
+
+// rateSettings are the rate limits in effect
+type rateSettings struct {
+	profile     string // "" = the configured limits
+	globalRate  float64
+	globalBurst int
+	perIPRate   float64
+	perIPBurst  int
+}
+
+// rateSchedule switches between the configured rate limits and the
+// scheduled profiles
+type rateSchedule struct {
+	base     rateSettings
+	profiles []scheduledProfile
+	current  atomic.Pointer[rateSettings]
+}
+
+type scheduledProfile struct {
+	RateProfile
+	cron     cronSchedule
+	location *time.Location
+}
+
+// newRateSchedule returns nil when no profiles are configured
+func newRateSchedule(config *Config) (*rateSchedule, error) {
+	if len(config.RateProfiles) == 0 {
+		return nil, nil
+	}
+	s := &rateSchedule{base: rateSettings{
+		globalRate:  config.GlobalRateLimit,
+		globalBurst: config.GlobalBurstSize,
+		perIPRate:   config.PerIPRateLimit,
+		perIPBurst:  config.PerIPBurstSize,
+	}}
+	for i, rp := range config.RateProfiles {
+		if rp.Name == "" {
+			rp.Name = fmt.Sprintf("profile-%d", i)
+		}
+		cron, err := parseCron(rp.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("rate_profiles %s: %w", rp.Name, err)
+		}
+		if rp.Duration.Duration < time.Minute {
+			return nil, fmt.Errorf("rate_profiles %s: duration must be at least 1m", rp.Name)
+		}
+		location := time.UTC
+		if rp.Timezone != "" {
+			if location, err = time.LoadLocation(rp.Timezone); err != nil {
+				return nil, fmt.Errorf("rate_profiles %s: %w", rp.Name, err)
+			}
+		}
+		s.profiles = append(s.profiles, scheduledProfile{RateProfile: rp, cron: cron, location: location})
+	}
+	base := s.base
+	s.current.Store(&base)
+	return s, nil
+}
+
+// settings returns the rate limits for a moment: those of the first active
+// profile, or the configured ones
+func (s *rateSchedule) settings(now time.Time) rateSettings {
+	for _, p := range s.profiles {
+		if !p.active(now) {
+			continue
+		}
+		r := s.base
+		r.profile = p.Name
+		if p.GlobalRateLimit > 0 {
+			r.globalRate = p.GlobalRateLimit
+		}
+		if p.GlobalBurstSize > 0 {
+			r.globalBurst = p.GlobalBurstSize
+		}
+		if p.PerIPRateLimit > 0 {
+			r.perIPRate = p.PerIPRateLimit
+		}
+		if p.PerIPBurstSize > 0 {
+			r.perIPBurst = p.PerIPBurstSize
+		}
+		return r
+	}
+	return s.base
+}
+
+// active reports whether the profile started within its duration before now
+func (p scheduledProfile) active(now time.Time) bool {
+	now = now.In(p.location)
+	start := now.Truncate(time.Minute)
+	for t := start; now.Sub(t) < p.Duration.Duration; t = t.Add(-time.Minute) {
+		if p.cron.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRateSchedule switches the limiters to the rate limits of the moment
+func (p *RPCProxy) applyRateSchedule(now time.Time) {
+	next := p.rateSchedule.settings(now)
+	prev := p.rateSchedule.current.Load()
+	if *prev == next {
+		return
+	}
+	p.rateSchedule.current.Store(&next)
+
+	if p.globalLimiter != nil && (next.globalRate != prev.globalRate || next.globalBurst != prev.globalBurst) {
+		p.globalLimiter.setRate(next.globalRate, next.globalBurst)
+	}
+	if next.perIPRate != prev.perIPRate || next.perIPBurst != prev.perIPBurst {
+		p.ipLimiters.each(func(l requestLimiter) {
+			l.setRate(next.perIPRate, next.perIPBurst)
+		})
+	}
+
+	from, to := prev.profile, next.profile
+	if from == "" {
+		from = "configured limits"
+	}
+	if to == "" {
+		to = "configured limits"
+	}
+	log.Printf("[RATE] %s: switched from %s to %s (global %.0f req/s burst %d, per IP %.0f req/s burst %d)",
+		p.name, from, to, next.globalRate, next.globalBurst, next.perIPRate, next.perIPBurst)
+}
+
+// watchRateSchedule checks the schedule every 15 seconds
+func (p *RPCProxy) watchRateSchedule() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.applyRateSchedule(now)
+	}
+}
+
+// rates returns the rate limits in effect
+func (p *RPCProxy) rates() rateSettings {
+	if p.rateSchedule == nil {
+		return rateSettings{
+			globalRate:  p.config.GlobalRateLimit,
+			globalBurst: p.config.GlobalBurstSize,
+			perIPRate:   p.config.PerIPRateLimit,
+			perIPBurst:  p.config.PerIPBurstSize,
+		}
+	}
+	return *p.rateSchedule.current.Load()
+}
+
+// cronSchedule is a parsed five-field cron expression
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit sets of allowed values
+	domAny, dowAny                bool
+}
+
+// parseCron parses "minute hour day-of-month month day-of-week" with *,
+// lists, ranges and steps, e.g. "0 1 * * 1-5" or "*/30 22-23 * * *". Day of
+// week 0 and 7 are Sunday.
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("schedule %q needs 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return c, fmt.Errorf("schedule %q minute: %w", expr, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return c, fmt.Errorf("schedule %q hour: %w", expr, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return c, fmt.Errorf("schedule %q day of month: %w", expr, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return c, fmt.Errorf("schedule %q month: %w", expr, err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return c, fmt.Errorf("schedule %q day of week: %w", expr, err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max // "5/15" runs from 5 to the end
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// matches reports whether the schedule fires in t's minute. Like cron, a
+// restricted day of month and day of week match when either does.
+func (c cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domMatch := c.dom&(1<<t.Day()) != 0
+	dowMatch := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
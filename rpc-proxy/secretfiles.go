@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// secretFileFields are the config fields holding credentials. Each can be
+// set from a file instead with a <field>_file key, e.g. admin_token_file,
+// upstreams[].url_file or api_keys[].key_file, for Docker and Kubernetes
+// secrets.
+var secretFileFields = []string{
+	"admin_token", "ip_hash_salt", "upstream_url", "url", "key", "upstream_token",
+	"upstream_ws_url", "request_log_url", "captcha_secret", "faucet_url", "trace_token",
+}
+
+// secretFilePattern matches a <field>_file key of a secret field
+var secretFilePattern = regexp.MustCompile(`"(` + strings.Join(secretFileFields, "|") + `)_file"\s*:`)
+
+// resolveSecretFiles replaces every <field>_file key in a JSON config with
+// <field> set to the file's contents, without the trailing newline
+func resolveSecretFiles(data []byte) ([]byte, error) {
+	if !secretFilePattern.Match(data) {
+		return data, nil
+	}
+
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var walk func(v interface{}) error
+	walk = func(v interface{}) error {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, field := range secretFileFields {
+				path, ok := v[field+"_file"].(string)
+				if !ok {
+					continue
+				}
+				if _, ok := v[field]; ok {
+					return fmt.Errorf("set either %s or %s_file, not both", field, field)
+				}
+				b, err := os.ReadFile(path)
+				if err != nil {
+					return fmt.Errorf("%s_file: %w", field, err)
+				}
+				v[field] = strings.TrimRight(string(b), "\r\n")
+				delete(v, field+"_file")
+			}
+			for k, child := range v {
+				if k == "secrets" {
+					continue
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, child := range v {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SecretsConfig configures where ${vault:...}, ${aws-sm:...} and
+// ${gcp-sm:...} references in the config file are fetched from
+type SecretsConfig struct {
+	RefreshInterval Duration `json:"refresh_interval"` // re-fetch secrets this often and restart when one changed, 0 = only at startup
+
+	Vault *VaultSecretsConfig `json:"vault"`
+	AWS   *AWSSecretsConfig   `json:"aws"`
+	GCP   *GCPSecretsConfig   `json:"gcp"`
+}
+
+// secretRefPattern matches a secret reference: ${provider:path#field}
+var secretRefPattern = regexp.MustCompile(`\$\{(vault|aws-sm|gcp-sm):([^}#]+)(?:#([^}]+))?\}`)
+
+// secretTimeout bounds each secret manager call
+const secretTimeout = 10 * time.Second
+
+// secretResolver fetches secret references from the configured secret
+// managers
+type secretResolver struct {
+	config SecretsConfig
+	client *http.Client
+	dir    string // private directory for secrets used as *_file values
+
+	vault *vaultClient
+	aws   *awsSecretsClient
+	gcp   *gcpSecretsClient
+}
+
+func newSecretResolver(config SecretsConfig) *secretResolver {
+	r := &secretResolver{config: config, client: &http.Client{Timeout: secretTimeout}}
+	r.vault = newVaultClient(config.Vault, r.client)
+	r.aws = newAWSSecretsClient(config.AWS, r.client)
+	r.gcp = newGCPSecretsClient(config.GCP, r.client)
+	return r
+}
+
+// fetch returns the value of one reference. Documents are cached in docs
+// for the duration of a pass, so several fields of one secret cost one
+// call.
+func (r *secretResolver) fetch(ctx context.Context, provider, path, field string, docs map[string]string) (string, error) {
+	key := provider + ":" + path
+	doc, ok := docs[key]
+	if !ok {
+		var err error
+		switch provider {
+		case "vault":
+			doc, err = r.vault.read(ctx, path)
+		case "aws-sm":
+			doc, err = r.aws.read(ctx, path)
+		case "gcp-sm":
+			doc, err = r.gcp.read(ctx, path)
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", key, err)
+		}
+		docs[key] = doc
+	}
+	value, err := secretField(doc, field)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", key, err)
+	}
+	return value, nil
+}
+
+// secretField picks a field out of a secret. Secrets holding a JSON object
+// need a #field unless the object has a single key; other secrets are used
+// whole.
+func secretField(doc, field string) (string, error) {
+	var obj map[string]interface{}
+	if json.Unmarshal([]byte(doc), &obj) != nil {
+		if field != "" {
+			return "", fmt.Errorf("secret is not a JSON object, can't select #%s", field)
+		}
+		return doc, nil
+	}
+
+	if field == "" {
+		if len(obj) != 1 {
+			return "", fmt.Errorf("secret has %d fields, select one with #field", len(obj))
+		}
+		for k := range obj {
+			field = k
+		}
+	}
+	v, ok := obj[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// secretRefs is what a config resolved from secret managers remembers, so
+// the secrets can be re-checked later
+type secretRefs struct {
+	resolver *secretResolver
+	digests  map[string][32]byte // reference -> digest of its value
+}
+
+// resolveSecrets replaces the secret references in the string values of a
+// JSON config. A reference that makes up a whole *_file value (TLS
+// certificates and keys) is written to a private file whose path replaces
+// it. It returns nil refs when the config has no references.
+func resolveSecrets(data []byte) ([]byte, *secretRefs, error) {
+	if !secretRefPattern.Match(data) {
+		return data, nil, nil
+	}
+
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, nil, err
+	}
+	var settings struct {
+		Secrets SecretsConfig `json:"secrets"`
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, nil, err
+	}
+
+	refs := &secretRefs{resolver: newSecretResolver(settings.Secrets), digests: make(map[string][32]byte)}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	docs := make(map[string]string)
+
+	var walkErr error
+	var walk func(key string, v interface{}) interface{}
+	walk = func(key string, v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				if k != "secrets" {
+					v[k] = walk(k, child)
+				}
+			}
+		case []interface{}:
+			for i, child := range v {
+				v[i] = walk(key, child)
+			}
+		case string:
+			whole := secretRefPattern.FindStringSubmatchIndex(v)
+			if whole == nil {
+				return v
+			}
+			asFile := strings.HasSuffix(key, "_file") && whole[0] == 0 && whole[1] == len(v)
+			resolved := secretRefPattern.ReplaceAllStringFunc(v, func(ref string) string {
+				m := secretRefPattern.FindStringSubmatch(ref)
+				value, err := refs.resolver.fetch(ctx, m[1], m[2], m[3], docs)
+				if err != nil {
+					if walkErr == nil {
+						walkErr = err
+					}
+					return ""
+				}
+				refs.digests[ref] = sha256.Sum256([]byte(value))
+				return value
+			})
+			if asFile && walkErr == nil {
+				path, err := refs.resolver.writeFile(v, resolved)
+				if err != nil {
+					walkErr = err
+				}
+				return path
+			}
+			return resolved
+		}
+		return v
+	}
+	walk("", doc)
+	if walkErr != nil {
+		refs.cleanup()
+		return nil, nil, fmt.Errorf("secrets: %w", walkErr)
+	}
+
+	out, err := json.Marshal(doc)
+	if err != nil {
+		refs.cleanup()
+		return nil, nil, err
+	}
+	log.Printf("[SECRETS] Resolved %d secret references", len(refs.digests))
+	return out, refs, nil
+}
+
+// writeFile stores a secret used as a file, e.g. a TLS key, in a private
+// directory that is removed on shutdown
+func (r *secretResolver) writeFile(ref, value string) (string, error) {
+	if r.dir == "" {
+		dir, err := os.MkdirTemp("", "rpc-proxy-secrets-")
+		if err != nil {
+			return "", err
+		}
+		r.dir = dir
+	}
+	sum := sha256.Sum256([]byte(ref))
+	path := filepath.Join(r.dir, fmt.Sprintf("%x", sum[:8]))
+	if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// changed re-fetches every reference and lists those whose value changed
+func (s *secretRefs) changed() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	docs := make(map[string]string)
+
+	var changed []string
+	for ref, digest := range s.digests {
+		m := secretRefPattern.FindStringSubmatch(ref)
+		value, err := s.resolver.fetch(ctx, m[1], m[2], m[3], docs)
+		if err != nil {
+			return nil, err
+		}
+		if sha256.Sum256([]byte(value)) != digest {
+			changed = append(changed, m[1]+":"+m[2])
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// cleanup removes the files written for *_file secrets
+func (s *secretRefs) cleanup() {
+	if s != nil && s.resolver.dir != "" {
+		os.RemoveAll(s.resolver.dir)
+	}
+}
+
+// watchSecrets re-fetches the secrets every refresh_interval. Running
+// components hold on to the values they were built with, so when a secret
+// changes the proxy restarts itself with the zero-downtime upgrade, and the
+// new process loads the new values.
+func watchSecrets(s *secretRefs, listeners []*proxyListener) {
+	if s == nil || s.resolver.config.RefreshInterval.Duration <= 0 {
+		return
+	}
+	for range time.Tick(s.resolver.config.RefreshInterval.Duration) {
+		changed, err := s.changed()
+		if err != nil {
+			log.Printf("[ERROR] Failed to refresh secrets, keeping the current values: %v", err)
+			continue
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		log.Printf("[SECRETS] Changed: %s; restarting to apply", strings.Join(changed, ", "))
+		if err := upgrade(listeners); err != nil {
+			log.Printf("[ERROR] Restart failed, restart the proxy to apply the new secrets: %v", err)
+			continue
+		}
+		return
+	}
+}
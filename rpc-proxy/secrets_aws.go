@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWSSecretsConfig configures AWS Secrets Manager. Credentials come from
+// AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY, the ECS/EKS container
+// credentials endpoint or the EC2 instance role, in that order.
+type AWSSecretsConfig struct {
+	Region   string `json:"region"`   // defaults to AWS_REGION, or the region of an ARN reference
+	Endpoint string `json:"endpoint"` // override the API endpoint, e.g. for LocalStack
+}
+
+// awsSecretsClient reads secrets with the GetSecretValue API
+type awsSecretsClient struct {
+	config AWSSecretsConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	creds *awsCredentials // cached temporary credentials
+}
+
+// awsCredentials are the fields shared by the container and instance
+// credential endpoints
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func newAWSSecretsClient(config *AWSSecretsConfig, client *http.Client) *awsSecretsClient {
+	c := &awsSecretsClient{client: client}
+	if config != nil {
+		c.config = *config
+	}
+	if c.config.Region == "" {
+		c.config.Region = os.Getenv("AWS_REGION")
+	}
+	if c.config.Region == "" {
+		c.config.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return c
+}
+
+// read returns the SecretString of a secret, by name or ARN
+func (c *awsSecretsClient) read(ctx context.Context, secretID string) (string, error) {
+	region := c.config.Region
+	if parts := strings.Split(secretID, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		return "", fmt.Errorf("aws region not configured (secrets.aws.region or AWS_REGION)")
+	}
+	endpoint := c.config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+
+	creds, err := c.credentials(ctx)
+	if err != nil {
+		return "", fmt.Errorf("aws credentials: %w", err)
+	}
+
+	body, _ := json.Marshal(map[string]string{"SecretId": secretID})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, creds, region, "secretsmanager", time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &e)
+		return "", fmt.Errorf("secrets manager returned status %d: %s %s", resp.StatusCode, e.Type, e.Message)
+	}
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary string `json:"SecretBinary"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return "", err
+	}
+	if out.SecretString == "" && out.SecretBinary != "" {
+		b, err := base64.StdEncoding.DecodeString(out.SecretBinary)
+		return string(b), err
+	}
+	return out.SecretString, nil
+}
+
+// credentials returns static credentials from the environment, or cached
+// temporary ones until shortly before they expire
+func (c *awsSecretsClient) credentials(ctx context.Context) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds != nil && time.Until(c.creds.Expiration) > 5*time.Minute {
+		return c.creds, nil
+	}
+
+	var creds *awsCredentials
+	var err error
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		creds, err = c.containerCredentials(ctx)
+	} else {
+		creds, err = c.instanceCredentials(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+// containerCredentials fetches the task or pod role credentials on ECS and
+// EKS Pod Identity
+func (c *awsSecretsClient) containerCredentials(ctx context.Context) (*awsCredentials, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = "http://169.254.170.2" + rel
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	var creds awsCredentials
+	if err := getJSON(c.client, req, &creds); err != nil {
+		return nil, fmt.Errorf("container credentials: %w", err)
+	}
+	return &creds, nil
+}
+
+// instanceCredentials fetches the EC2 instance role credentials with IMDSv2
+func (c *awsSecretsClient) instanceCredentials(ctx context.Context) (*awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("no credentials in the environment and no instance metadata: %w", err)
+	}
+	token, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("instance metadata token: status %d", resp.StatusCode)
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, imds+path, nil)
+		if err == nil {
+			req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		}
+		return req, err
+	}
+	req, err = get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	resp, err = c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	role, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("instance has no IAM role (status %d)", resp.StatusCode)
+	}
+
+	req, err = get("/meta-data/iam/security-credentials/" + strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0]))
+	if err != nil {
+		return nil, err
+	}
+	var creds awsCredentials
+	if err := getJSON(c.client, req, &creds); err != nil {
+		return nil, fmt.Errorf("instance credentials: %w", err)
+	}
+	return &creds, nil
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	// Sign the host and every header set on the request
+	headers := []string{"host"}
+	for h := range req.Header {
+		headers = append(headers, strings.ToLower(h))
+	}
+	sort.Strings(headers)
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		req.Method, path, req.URL.Query().Encode(), canonicalHeaders.String(), signedHeaders, hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// getJSON sends a request and decodes a JSON response, failing on non-200
+// statuses
+func getJSON(client *http.Client, req *http.Request, result interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned status %d: %s", (&url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: req.URL.Path}).String(), resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(result)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCPSecretsConfig configures GCP Secret Manager. Without a service account
+// key the proxy uses the metadata server (GCE, GKE Workload Identity, Cloud
+// Run).
+type GCPSecretsConfig struct {
+	CredentialsFile string `json:"credentials_file"` // service account key, defaults to GOOGLE_APPLICATION_CREDENTIALS
+	Endpoint        string `json:"endpoint"`         // override the API endpoint
+}
+
+// gcpSecretsClient reads secret versions with the access API
+type gcpSecretsClient struct {
+	config GCPSecretsConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newGCPSecretsClient(config *GCPSecretsConfig, client *http.Client) *gcpSecretsClient {
+	c := &gcpSecretsClient{client: client}
+	if config != nil {
+		c.config = *config
+	}
+	if c.config.CredentialsFile == "" {
+		c.config.CredentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if c.config.Endpoint == "" {
+		c.config.Endpoint = "https://secretmanager.googleapis.com"
+	}
+	return c
+}
+
+// read returns the payload of a secret version. name is the resource name,
+// projects/<project>/secrets/<secret>, optionally with /versions/<version>
+// (default latest).
+func (c *gcpSecretsClient) read(ctx context.Context, name string) (string, error) {
+	name = strings.Trim(name, "/")
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("gcp credentials: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.config.Endpoint, "/")+"/v1/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := getJSON(c.client, req, &resp); err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	return string(data), err
+}
+
+// accessToken returns a cached OAuth token, fetching a new one shortly
+// before it expires
+func (c *gcpSecretsClient) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expires) > 5*time.Minute {
+		return c.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if c.config.CredentialsFile != "" {
+		req, err = c.serviceAccountTokenRequest(ctx)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := getJSON(c.client, req, &resp); err != nil {
+		return "", err
+	}
+	c.token = resp.AccessToken
+	c.expires = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// serviceAccountTokenRequest builds the JWT bearer grant for a service
+// account key
+func (c *gcpSecretsClient) serviceAccountTokenRequest(ctx context.Context) (*http.Request, error) {
+	data, err := os.ReadFile(c.config.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var key struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.config.CredentialsFile, err)
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("%s: credentials of type %q are not supported, use a service account key", c.config.CredentialsFile, key.Type)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: invalid private_key", c.config.CredentialsFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.config.CredentialsFile, err)
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private_key is not an RSA key", c.config.CredentialsFile)
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/cloud-platform",
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
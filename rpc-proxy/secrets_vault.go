@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// VaultSecretsConfig locates HashiCorp Vault. Without a token the proxy
+// logs in with its Kubernetes service account when role is set.
+type VaultSecretsConfig struct {
+	Addr      string `json:"addr"`       // e.g. https://vault.internal:8200, defaults to VAULT_ADDR
+	Namespace string `json:"namespace"`  // Vault Enterprise namespace, defaults to VAULT_NAMESPACE
+	TokenFile string `json:"token_file"` // file holding the token, defaults to VAULT_TOKEN from the environment
+	Role      string `json:"role"`       // Kubernetes auth role
+	AuthPath  string `json:"auth_path"`  // Kubernetes auth mount, default "kubernetes"
+}
+
+// kubernetesTokenFile is the service account token mounted into pods
+const kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultClient reads secrets from Vault's KV engines
+type vaultClient struct {
+	config VaultSecretsConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	token string // from Kubernetes login
+}
+
+func newVaultClient(config *VaultSecretsConfig, client *http.Client) *vaultClient {
+	c := &vaultClient{client: client}
+	if config != nil {
+		c.config = *config
+	}
+	if c.config.Addr == "" {
+		c.config.Addr = os.Getenv("VAULT_ADDR")
+	}
+	if c.config.Namespace == "" {
+		c.config.Namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if c.config.AuthPath == "" {
+		c.config.AuthPath = "kubernetes"
+	}
+	return c
+}
+
+// read returns the data of a KV secret as a JSON object. path is the API
+// path below /v1/, e.g. secret/data/rpc-proxy for KV version 2.
+func (c *vaultClient) read(ctx context.Context, path string) (string, error) {
+	if c.config.Addr == "" {
+		return "", fmt.Errorf("vault address not configured (secrets.vault.addr or VAULT_ADDR)")
+	}
+	token, err := c.authToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	err = c.do(ctx, http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), token, nil, &resp)
+	if err != nil && c.forgetLogin() {
+		// The Kubernetes login may have expired; log in again once
+		if token, err = c.authToken(ctx); err == nil {
+			err = c.do(ctx, http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), token, nil, &resp)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// KV version 2 nests the secret under data.data next to its metadata
+	var v2 struct {
+		Data     json.RawMessage `json:"data"`
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	if json.Unmarshal(resp.Data, &v2) == nil && v2.Data != nil && v2.Metadata != nil {
+		return string(v2.Data), nil
+	}
+	return string(resp.Data), nil
+}
+
+// authToken returns the configured token, logging in with Kubernetes auth
+// once when there is none
+func (c *vaultClient) authToken(ctx context.Context) (string, error) {
+	if c.config.TokenFile != "" {
+		b, err := os.ReadFile(c.config.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	if c.config.Role == "" {
+		return "", fmt.Errorf("no vault token (secrets.vault.token_file, VAULT_TOKEN or a Kubernetes auth role)")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" {
+		return c.token, nil
+	}
+	jwt, err := os.ReadFile(kubernetesTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("kubernetes auth: %w", err)
+	}
+	body, _ := json.Marshal(map[string]string{"role": c.config.Role, "jwt": strings.TrimSpace(string(jwt))})
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/auth/"+c.config.AuthPath+"/login", "", body, &resp); err != nil {
+		return "", fmt.Errorf("kubernetes auth: %w", err)
+	}
+	c.token = resp.Auth.ClientToken
+	return c.token, nil
+}
+
+// forgetLogin drops the token from a Kubernetes login, reporting whether
+// there was one
+func (c *vaultClient) forgetLogin() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	had := c.token != ""
+	c.token = ""
+	return had
+}
+
+// do calls the Vault API
+func (c *vaultClient) do(ctx context.Context, method, path, token string, body []byte, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.config.Addr, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.config.Namespace)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(data, &e)
+		return fmt.Errorf("vault returned status %d: %s", resp.StatusCode, strings.Join(e.Errors, "; "))
+	}
+	return json.Unmarshal(data, result)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// upstreamInfo is what the startup self-test learns about an upstream
+type upstreamInfo struct {
+	Version     string
+	GenesisHash string
+	Slot        uint64
+	Health      string
+}
+
+// inspect queries an upstream's version, genesis hash, slot and health
+func (p *upstreamPool) inspect(ctx context.Context, u *upstream) (*upstreamInfo, error) {
+	var version struct {
+		SolanaCore string `json:"solana-core"`
+	}
+	if err := p.call(ctx, u, "getVersion", nil, &version); err != nil {
+		return nil, err
+	}
+
+	info := &upstreamInfo{Version: version.SolanaCore, Health: "ok"}
+	if err := p.call(ctx, u, "getGenesisHash", nil, &info.GenesisHash); err != nil {
+		return nil, err
+	}
+	if err := p.call(ctx, u, "getSlot", nil, &info.Slot); err != nil {
+		return nil, err
+	}
+	// An unhealthy (e.g. behind) node still answers, so this isn't fatal
+	if err := p.call(ctx, u, "getHealth", nil, nil); err != nil {
+		info.Health = err.Error()
+	}
+	return info, nil
+}
+
+// selfTest probes every upstream of every proxy, logging what it finds. It
+// returns an error naming each proxy without a single reachable upstream
+// serving the expected cluster.
+func (rt *Router) selfTest(ctx context.Context) error {
+	var failed []string
+	for _, p := range rt.proxies() {
+		reachable := 0
+		for _, u := range p.pool.upstreams {
+			info, err := p.pool.inspect(ctx, u)
+			if err != nil {
+				log.Printf("[SELFTEST] %s/%s (%s): unreachable: %v", p.name, u.name, u.url, err)
+				continue
+			}
+			if !p.verifyGenesis(u, info.GenesisHash) {
+				continue
+			}
+			reachable++
+			log.Printf("[SELFTEST] %s/%s: solana-core %s, genesis %s, slot %d, health %s",
+				p.name, u.name, info.Version, info.GenesisHash, info.Slot, info.Health)
+		}
+		if reachable == 0 {
+			failed = append(failed, p.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("no reachable upstream for %v", failed)
+	}
+	return nil
+}
+
+// requireUpstream runs the self-test until it passes, retrying with backoff
+// for up to timeout (a single attempt when timeout is 0)
+func (rt *Router) requireUpstream(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := time.Second
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := rt.selfTest(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		log.Printf("[ERROR] Self-test failed, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the upstream latency histogram buckets, used to estimate
+// p99 without keeping samples
+var latencyBounds = func() []time.Duration {
+	var bounds []time.Duration
+	for d := 5 * time.Millisecond; d < 2*time.Minute; d = d * 3 / 2 {
+		bounds = append(bounds, d)
+	}
+	return bounds
+}()
+
+// latencyPercentile estimates a latency percentile from counts per
+// latencyBounds bucket, as the upper bound of the bucket holding it
+func latencyPercentile(latency []int64, requests int64, q float64) time.Duration {
+	if requests <= 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(float64(requests) * q))
+	var seen int64
+	for i, n := range latency {
+		seen += n
+		if seen >= rank {
+			return latencyBounds[min(i, len(latencyBounds)-1)]
+		}
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// shedMinSamples is the fewest upstream requests in the window needed before
+// latency or error rate can trigger shedding
+const shedMinSamples = 20
+
+// healthBucket holds the upstream outcomes of one slice of the window
+type healthBucket struct {
+	slot     int64 // window slice index, to detect stale buckets
+	requests int64
+	errors   int64
+	latency  []int64 // counts per latencyBounds bucket, plus overflow
+}
+
+// loadShedder tracks upstream latency and error rate over a rolling window and
+// sheds a growing fraction of normal and low priority requests while they are
+// over their thresholds
+type loadShedder struct {
+	latencyThreshold time.Duration // p99 that starts shedding, 0 = ignore latency
+	errorThreshold   float64       // error rate that starts shedding, 0 = ignore errors
+	maxRatio         float64       // highest fraction of normal priority requests shed
+
+	mu        sync.Mutex
+	buckets   []healthBucket
+	sliceSize time.Duration
+
+	ratio      atomic.Uint64 // float64 bits of the current shed ratio
+	p99        atomic.Int64  // nanoseconds
+	errorRate  atomic.Uint64 // float64 bits
+	lastLogged float64
+}
+
+// newLoadShedder returns nil when neither threshold is configured
+func newLoadShedder(config *Config) *loadShedder {
+	if config.ShedLatencyP99.Duration <= 0 && config.ShedErrorRate <= 0 {
+		return nil
+	}
+
+	const slices = 10
+	s := &loadShedder{
+		latencyThreshold: config.ShedLatencyP99.Duration,
+		errorThreshold:   config.ShedErrorRate,
+		maxRatio:         config.ShedMaxRatio,
+		buckets:          make([]healthBucket, slices),
+		sliceSize:        config.ShedWindow.Duration / slices,
+	}
+	if s.sliceSize <= 0 {
+		s.sliceSize = time.Second
+	}
+	for i := range s.buckets {
+		s.buckets[i].latency = make([]int64, len(latencyBounds)+1)
+	}
+	return s
+}
+
+// record adds an upstream outcome to the window
+func (s *loadShedder) record(latency time.Duration, failed bool) {
+	slot := time.Now().UnixNano() / int64(s.sliceSize)
+	bin := len(latencyBounds)
+	for i, bound := range latencyBounds {
+		if latency <= bound {
+			bin = i
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &s.buckets[slot%int64(len(s.buckets))]
+	if b.slot != slot {
+		b.slot = slot
+		b.requests = 0
+		b.errors = 0
+		for i := range b.latency {
+			b.latency[i] = 0
+		}
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	b.latency[bin]++
+}
+
+// update recomputes p99, error rate and shed ratio from the window
+func (s *loadShedder) update(name string) {
+	oldest := time.Now().UnixNano()/int64(s.sliceSize) - int64(len(s.buckets)) + 1
+	latency := make([]int64, len(latencyBounds)+1)
+	var requests, errors int64
+
+	s.mu.Lock()
+	for _, b := range s.buckets {
+		if b.slot < oldest {
+			continue
+		}
+		requests += b.requests
+		errors += b.errors
+		for i, n := range b.latency {
+			latency[i] += n
+		}
+	}
+	s.mu.Unlock()
+
+	p99 := latencyPercentile(latency, requests, 0.99)
+	var errorRate, ratio float64
+	if requests > 0 {
+		errorRate = float64(errors) / float64(requests)
+	}
+
+	// Shedding ramps up linearly from the threshold to twice the threshold
+	if requests >= shedMinSamples {
+		if s.latencyThreshold > 0 && p99 > s.latencyThreshold {
+			ratio = math.Max(ratio, float64(p99-s.latencyThreshold)/float64(s.latencyThreshold))
+		}
+		if s.errorThreshold > 0 && errorRate > s.errorThreshold {
+			ratio = math.Max(ratio, (errorRate-s.errorThreshold)/s.errorThreshold)
+		}
+		ratio = math.Min(ratio, 1) * s.maxRatio
+	}
+
+	s.p99.Store(int64(p99))
+	s.errorRate.Store(math.Float64bits(errorRate))
+	s.ratio.Store(math.Float64bits(ratio))
+
+	if (ratio > 0) != (s.lastLogged > 0) {
+		if ratio > 0 {
+			log.Printf("[SHED] %s: upstream degraded (p99 %v, error rate %.1f%%), shedding %.0f%% of requests",
+				name, p99, errorRate*100, ratio*100)
+		} else {
+			log.Printf("[SHED] %s: upstream recovered, no longer shedding", name)
+		}
+	}
+	s.lastLogged = ratio
+}
+
+// run recomputes the shed ratio every slice of the window
+func (s *loadShedder) run(name string) {
+	ticker := time.NewTicker(s.sliceSize)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.update(name)
+	}
+}
+
+// currentRatio returns the fraction of normal priority requests being shed
+func (s *loadShedder) currentRatio() float64 {
+	if s == nil {
+		return 0
+	}
+	return math.Float64frombits(s.ratio.Load())
+}
+
+// shouldShed decides whether to reject a request of the given priority. Low
+// priority requests are shed at twice the ratio, high priority never.
+func (s *loadShedder) shouldShed(pr priority) bool {
+	ratio := s.currentRatio()
+	switch {
+	case ratio <= 0 || pr == priorityHigh:
+		return false
+	case pr == priorityLow:
+		ratio = math.Min(1, 2*ratio)
+	}
+	return rand.Float64() < ratio
+}
+
+// snapshot returns the shedder state for /metrics
+func (s *loadShedder) snapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"shed_ratio":          s.currentRatio(),
+		"upstream_p99_ms":     time.Duration(s.p99.Load()).Milliseconds(),
+		"upstream_error_rate": math.Float64frombits(s.errorRate.Load()),
+	}
+}
+
+// writeShedError rejects a request shed because the upstream is degraded
+func (p *RPCProxy) writeShedError(w http.ResponseWriter) {
+	retryAfter := int(p.config.ShedRetryAfter.Duration.Seconds())
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	p.writeRPCError(w, nil, -32005, "Upstream degraded, request shed. Please retry after "+strconv.Itoa(retryAfter)+" seconds.", http.StatusServiceUnavailable)
+}
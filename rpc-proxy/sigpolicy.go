@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// nodeSignaturesLimit is the node's default and maximum limit for
+	// getSignaturesForAddress
+	nodeSignaturesLimit = 1000
+	// hugeAddressTTL is how long a detected huge address stays huge
+	hugeAddressTTL = time.Hour
+	// maxHugeAddresses bounds the detected huge addresses
+	maxHugeAddresses = 10000
+)
+
+// signaturePolicy keeps getSignaturesForAddress from scanning the ledger
+// for one busy wallet: it caps the page size, and requires busy ("huge")
+// addresses to be paged with before or until
+type signaturePolicy struct {
+	maxLimit  int
+	threshold int
+	static    map[string]bool
+
+	mu       sync.Mutex
+	detected map[string]time.Time // address -> when it stops counting as huge
+
+	capped  atomic.Int64 // requests whose limit was lowered
+	refused atomic.Int64 // unbounded requests for huge addresses
+}
+
+// newSignaturePolicy returns nil when no policy is configured
+func newSignaturePolicy(config *Config) (*signaturePolicy, error) {
+	if config.MaxSignaturesLimit <= 0 && len(config.HugeAddresses) == 0 && config.HugeAddressThreshold <= 0 {
+		return nil, nil
+	}
+	// A page never holds more signatures than the limit, so a higher
+	// threshold would never detect anything
+	maxPage := nodeSignaturesLimit
+	if config.MaxSignaturesLimit > 0 {
+		maxPage = config.MaxSignaturesLimit
+	}
+	if config.HugeAddressThreshold > maxPage {
+		return nil, fmt.Errorf("huge_address_threshold %d is above the largest page of %d signatures (max_signatures_limit)", config.HugeAddressThreshold, maxPage)
+	}
+	s := &signaturePolicy{
+		maxLimit:  config.MaxSignaturesLimit,
+		threshold: config.HugeAddressThreshold,
+		static:    make(map[string]bool),
+		detected:  make(map[string]time.Time),
+	}
+	for _, address := range config.HugeAddresses {
+		s.static[address] = true
+	}
+	return s, nil
+}
+
+// signaturesArgs returns the address and config of a getSignaturesForAddress
+// request
+func signaturesArgs(params json.RawMessage) (string, map[string]json.RawMessage, bool) {
+	var args []json.RawMessage
+	var address string
+	if json.Unmarshal(params, &args) != nil || len(args) == 0 || json.Unmarshal(args[0], &address) != nil {
+		return "", nil, false
+	}
+	config := make(map[string]json.RawMessage)
+	if len(args) > 1 {
+		json.Unmarshal(args[1], &config)
+	}
+	return address, config, true
+}
+
+// check refuses an unbounded request for a huge address
+func (s *signaturePolicy) check(method string, params json.RawMessage) *JSONRPCError {
+	if s == nil || method != "getSignaturesForAddress" {
+		return nil
+	}
+	address, config, ok := signaturesArgs(params)
+	if !ok || !s.huge(address) {
+		return nil
+	}
+	if bounded(config["before"]) || bounded(config["until"]) {
+		return nil
+	}
+	s.refused.Add(1)
+	return &JSONRPCError{
+		Code:    errInvalidParams,
+		Message: fmt.Sprintf("Address %s has too much history; page it with a before or until signature", address),
+	}
+}
+
+// bounded reports whether a before or until value is set
+func bounded(value json.RawMessage) bool {
+	var signature string
+	return json.Unmarshal(value, &signature) == nil && signature != ""
+}
+
+// capLimits lowers the limit of every getSignaturesForAddress request of a
+// single or batch body to max_signatures_limit
+func (s *signaturePolicy) capLimits(body []byte, isBatch bool) []byte {
+	if s == nil || s.maxLimit <= 0 || s.maxLimit >= nodeSignaturesLimit {
+		return body
+	}
+	return rewriteCalls(body, isBatch, func(i int, call *rpcCall) bool {
+		if call.method != "getSignaturesForAddress" {
+			return false
+		}
+		config, ok := call.config()
+		if !ok {
+			return false
+		}
+		limit := nodeSignaturesLimit
+		json.Unmarshal(config["limit"], &limit)
+		if limit <= s.maxLimit {
+			return false
+		}
+		config["limit"], _ = json.Marshal(s.maxLimit)
+		if !call.setConfig(config) {
+			return false
+		}
+		s.capped.Add(1)
+		return true
+	})
+}
+
+// observe marks an address huge when a page of its history returned at
+// least huge_address_threshold signatures
+func (s *signaturePolicy) observe(params json.RawMessage, body []byte) {
+	if s == nil || s.threshold <= 0 {
+		return
+	}
+	var resp struct {
+		Result []json.RawMessage `json:"result"`
+	}
+	if json.Unmarshal(body, &resp) != nil || len(resp.Result) < s.threshold {
+		return
+	}
+	address, _, ok := signaturesArgs(params)
+	if !ok || s.static[address] {
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, known := s.detected[address]; !known && len(s.detected) >= maxHugeAddresses {
+		for a, expires := range s.detected {
+			if now.After(expires) {
+				delete(s.detected, a)
+			}
+		}
+		if len(s.detected) >= maxHugeAddresses {
+			return
+		}
+	}
+	s.detected[address] = now.Add(hugeAddressTTL)
+}
+
+// huge reports whether an address is configured or detected as huge
+func (s *signaturePolicy) huge(address string) bool {
+	if s.static[address] {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.detected[address]
+	if ok && time.Now().After(expires) {
+		delete(s.detected, address)
+		return false
+	}
+	return ok
+}
+
+// snapshot returns the policy counters for /metrics
+func (s *signaturePolicy) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"capped":         s.capped.Load(),
+		"refused":        s.refused.Load(),
+		"huge_addresses": len(s.static) + len(s.detected),
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// slaMinutes keeps the last hour at minute resolution, plus the
+	// current minute
+	slaMinutes = 60 + 1
+	// slaHours keeps the last 30 days at hour resolution, plus the current
+	// hour, for the 24h and 30d windows
+	slaHours = 30*24 + 1
+	// slaMaxDowntimes bounds the downtime periods kept
+	slaMaxDowntimes = 1000
+	// slaDownRatio is the fraction of failed requests that makes a minute
+	// count as downtime
+	slaDownRatio = 0.5
+)
+
+// slaWindows are the rolling windows reported by /sla
+var slaWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// sliBucket holds the outcomes of one minute or hour
+type sliBucket struct {
+	Slot     int64   `json:"slot"` // minutes or hours since the epoch
+	Requests int64   `json:"requests"`
+	Errors   int64   `json:"errors"`
+	Latency  []int64 `json:"latency"` // counts per latencyBounds bucket, plus overflow
+}
+
+func (b *sliBucket) reset(slot int64) {
+	b.Slot = slot
+	b.Requests = 0
+	b.Errors = 0
+	if b.Latency == nil {
+		b.Latency = make([]int64, len(latencyBounds)+1)
+	}
+	for i := range b.Latency {
+		b.Latency[i] = 0
+	}
+}
+
+func (b *sliBucket) add(slot int64, bin int, failed bool) {
+	if b.Slot != slot || b.Latency == nil {
+		b.reset(slot)
+	}
+	b.Requests++
+	if failed {
+		b.Errors++
+	}
+	b.Latency[bin]++
+}
+
+// downtime is a period of consecutive minutes in which most requests failed
+type downtime struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// sliTracker records availability and latency of an upstream, or of the
+// proxy overall, for the SLA report. Minutes without requests count as up.
+type sliTracker struct {
+	mu        sync.Mutex
+	minutes   []sliBucket
+	hours     []sliBucket
+	downtimes []downtime
+	pending   int64 // minute not yet checked for downtime, 0 = none
+}
+
+// sliState is the persisted form of a tracker, so the 30d window survives
+// restarts
+type sliState struct {
+	Hours     []sliBucket `json:"hours"`
+	Downtimes []downtime  `json:"downtimes,omitempty"`
+}
+
+// newSLITracker returns nil when enable_sla is off
+func newSLITracker(config *Config) *sliTracker {
+	if !config.EnableSLA {
+		return nil
+	}
+	return &sliTracker{
+		minutes: make([]sliBucket, slaMinutes),
+		hours:   make([]sliBucket, slaHours),
+	}
+}
+
+// record adds a request outcome
+func (t *sliTracker) record(now time.Time, latency time.Duration, failed bool) {
+	if t == nil {
+		return
+	}
+	bin := len(latencyBounds)
+	for i, bound := range latencyBounds {
+		if latency <= bound {
+			bin = i
+			break
+		}
+	}
+	minute := now.Unix() / 60
+	hour := minute / 60
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(minute)
+	t.minutes[minute%slaMinutes].add(minute, bin, failed)
+	t.hours[hour%slaHours].add(hour, bin, failed)
+	t.pending = minute
+}
+
+// advance checks the pending minute for downtime once it is over, extending
+// the last downtime period when it directly precedes it. Must be called with
+// t.mu held.
+func (t *sliTracker) advance(minute int64) {
+	if t.pending == 0 || t.pending >= minute {
+		return
+	}
+	b := t.minutes[t.pending%slaMinutes]
+	if b.Slot == t.pending && b.Requests > 0 && float64(b.Errors) >= float64(b.Requests)*slaDownRatio {
+		start := time.Unix(t.pending*60, 0).UTC()
+		end := start.Add(time.Minute)
+		if n := len(t.downtimes); n > 0 && t.downtimes[n-1].End.Equal(start) {
+			t.downtimes[n-1].End = end
+		} else {
+			t.downtimes = append(t.downtimes, downtime{Start: start, End: end})
+			if len(t.downtimes) > slaMaxDowntimes {
+				t.downtimes = t.downtimes[len(t.downtimes)-slaMaxDowntimes:]
+			}
+		}
+	}
+	t.pending = 0
+}
+
+// report summarizes every window and lists the downtime periods within the
+// longest one. A window covers its full minutes or hours, e.g. 24 for 24h,
+// plus the current partial one.
+func (t *sliTracker) report(now time.Time) map[string]interface{} {
+	minute := now.Unix() / 60
+	hour := minute / 60
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(minute)
+
+	report := make(map[string]interface{}, len(slaWindows)+1)
+	for _, w := range slaWindows {
+		buckets, oldest := t.hours, hour-int64(w.duration/time.Hour)
+		if w.duration < 24*time.Hour {
+			buckets, oldest = t.minutes, minute-int64(w.duration/time.Minute)
+		}
+		latency := make([]int64, len(latencyBounds)+1)
+		var requests, errors int64
+		for _, b := range buckets {
+			if b.Slot < oldest || b.Latency == nil {
+				continue
+			}
+			requests += b.Requests
+			errors += b.Errors
+			for i, n := range b.Latency {
+				latency[i] += n
+			}
+		}
+
+		since := now.Add(-w.duration)
+		var down time.Duration
+		for _, d := range t.downtimes {
+			if d.End.After(since) {
+				down += d.End.Sub(maxTime(d.Start, since))
+			}
+		}
+
+		summary := map[string]interface{}{
+			"requests":         requests,
+			"errors":           errors,
+			"downtime_seconds": down.Seconds(),
+			"uptime_ratio":     roundRatio(1 - down.Seconds()/w.duration.Seconds()),
+		}
+		if requests > 0 {
+			summary["success_ratio"] = roundRatio(float64(requests-errors) / float64(requests))
+			summary["p99_ms"] = latencyPercentile(latency, requests, 0.99).Milliseconds()
+		}
+		report[w.name] = summary
+	}
+
+	since := now.Add(-slaWindows[len(slaWindows)-1].duration)
+	downtimes := []downtime{}
+	for _, d := range t.downtimes {
+		if d.End.After(since) {
+			downtimes = append(downtimes, d)
+		}
+	}
+	report["downtimes"] = downtimes
+	return report
+}
+
+// state returns the hourly buckets and downtimes for persistence
+func (t *sliTracker) state() sliState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var s sliState
+	for _, b := range t.hours {
+		if b.Requests > 0 {
+			b.Latency = append([]int64(nil), b.Latency...)
+			s.Hours = append(s.Hours, b)
+		}
+	}
+	s.Downtimes = append(s.Downtimes, t.downtimes...)
+	return s
+}
+
+// restore merges persisted buckets and downtimes still within 30 days
+func (t *sliTracker) restore(s sliState, now time.Time) {
+	oldest := now.Unix()/3600 - slaHours + 1
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, saved := range s.Hours {
+		if saved.Slot < oldest || len(saved.Latency) != len(latencyBounds)+1 {
+			continue
+		}
+		b := &t.hours[saved.Slot%slaHours]
+		if b.Slot != saved.Slot || b.Latency == nil {
+			b.reset(saved.Slot)
+		}
+		b.Requests += saved.Requests
+		b.Errors += saved.Errors
+		for i, n := range saved.Latency {
+			b.Latency[i] += n
+		}
+	}
+
+	since := now.Add(-slaWindows[len(slaWindows)-1].duration)
+	var restored []downtime
+	for _, d := range s.Downtimes {
+		if d.End.After(since) {
+			restored = append(restored, d)
+		}
+	}
+	t.downtimes = append(restored, t.downtimes...)
+}
+
+// handleSLA serves the availability and latency report of the proxy and of
+// each upstream
+func (p *RPCProxy) handleSLA(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	upstreams := make(map[string]interface{}, len(p.pool.upstreams))
+	for _, u := range p.pool.upstreams {
+		upstreams[u.name] = u.sli.report(now)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tenant":       p.name,
+		"generated_at": now.UTC().Format(time.RFC3339),
+		"overall":      p.sli.report(now),
+		"upstreams":    upstreams,
+	})
+}
+
+func roundRatio(r float64) float64 {
+	return math.Round(r*1e6) / 1e6
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// slotCacheStale is how long the slot feed may be silent before cached
+// answers are no longer trusted. Slots land every 400ms.
+const slotCacheStale = 5 * time.Second
+
+// defaultSlotCacheMethods answer differently only once a new slot lands
+var defaultSlotCacheMethods = []string{"getSlot", "getBlockHeight", "getEpochInfo", "getLatestBlockhash", "getRecentBlockhash"}
+
+// slotCache answers slot-sensitive reads from memory until the next slot
+// lands. A slotSubscribe connection to the upstream clears the cache on
+// every slot notification, so answers are exactly as fresh as uncached ones
+// instead of being kept for a guessed TTL.
+type slotCache struct {
+	url       string
+	tlsConfig *tls.Config
+	methods   map[string]bool
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	invalidations atomic.Int64
+
+	mu      sync.Mutex
+	live    bool      // the slot subscription is up
+	slot    uint64    // last notified slot
+	updated time.Time // when it was notified
+	gen     uint64    // bumped on every invalidation
+	entries map[string]json.RawMessage
+}
+
+// newSlotCache returns nil when slot_cache is disabled, and otherwise starts
+// following the upstream's slots
+func newSlotCache(config *Config) (*slotCache, error) {
+	if !config.SlotCache {
+		return nil, nil
+	}
+	wsURL, err := upstreamWebSocketURL(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newUpstreamTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	methods := config.SlotCacheMethods
+	if len(methods) == 0 {
+		methods = defaultSlotCacheMethods
+	}
+	c := &slotCache{
+		url:       wsURL,
+		tlsConfig: tlsConfig,
+		methods:   make(map[string]bool),
+		entries:   make(map[string]json.RawMessage),
+	}
+	for _, method := range methods {
+		c.methods[method] = true
+	}
+	go c.follow()
+	return c, nil
+}
+
+// cached reports whether the method's answers are cached
+func (c *slotCache) cached(method string) bool {
+	return c.methods[method]
+}
+
+// lookup returns the cached result for a request, and the generation to
+// store the upstream's answer with on a miss
+func (c *slotCache) lookup(method string, params json.RawMessage) (json.RawMessage, uint64, bool) {
+	key := method + compactParams(params)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.fresh() {
+		c.misses.Add(1)
+		return nil, 0, false
+	}
+	result, ok := c.entries[key]
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return result, c.gen, ok
+}
+
+// store caches a response, unless a slot has landed since the request was
+// looked up at gen
+func (c *slotCache) store(method string, params json.RawMessage, gen uint64, body []byte) {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *JSONRPCError   `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error != nil || resp.Result == nil {
+		return
+	}
+	key := method + compactParams(params)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fresh() && c.gen == gen {
+		c.entries[key] = resp.Result
+	}
+}
+
+// ready reports whether the slot feed is up to date, so cached answers are
+// served
+func (c *slotCache) ready() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fresh()
+}
+
+// fresh reports whether the slot feed is up to date; c.mu must be held
+func (c *slotCache) fresh() bool {
+	return c.live && time.Since(c.updated) < slotCacheStale
+}
+
+// invalidate empties the cache; c.mu must be held
+func (c *slotCache) invalidate() {
+	c.gen++
+	if len(c.entries) > 0 {
+		c.entries = make(map[string]json.RawMessage)
+		c.invalidations.Add(1)
+	}
+}
+
+// follow keeps a slot subscription open, reconnecting with backoff
+func (c *slotCache) follow() {
+	backoff := time.Second
+	for {
+		conn, err := dialWebSocket(c.url, c.tlsConfig)
+		if err == nil {
+			err = websocket.Message.Send(conn, `{"jsonrpc":"2.0","id":1,"method":"slotSubscribe"}`)
+			if err == nil {
+				backoff = time.Second
+				err = c.read(conn)
+			}
+			conn.Close()
+		}
+
+		c.mu.Lock()
+		c.live = false
+		c.invalidate()
+		c.mu.Unlock()
+		log.Printf("[WS] Slot cache feed from %s lost, retrying in %v: %v", redactURL(c.url), backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// read clears the cache on every new slot until the connection fails
+func (c *slotCache) read(conn *websocket.Conn) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(slotCacheStale))
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			return err
+		}
+		var msg struct {
+			Error  *JSONRPCError `json:"error"`
+			Method string        `json:"method"`
+			Params struct {
+				Result struct {
+					Slot uint64 `json:"slot"`
+				} `json:"result"`
+			} `json:"params"`
+		}
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		if msg.Error != nil {
+			return errors.New(msg.Error.Message)
+		}
+		if msg.Method != "slotNotification" {
+			continue
+		}
+		c.mu.Lock()
+		if msg.Params.Result.Slot != c.slot {
+			c.slot = msg.Params.Result.Slot
+			c.invalidate()
+		}
+		c.live = true
+		c.updated = time.Now()
+		c.mu.Unlock()
+	}
+}
+
+// compactParams returns params without insignificant whitespace, so
+// equivalent requests share an entry
+func compactParams(params json.RawMessage) string {
+	var compact bytes.Buffer
+	if len(params) == 0 || json.Compact(&compact, params) != nil {
+		return string(params)
+	}
+	return compact.String()
+}
+
+// snapshot returns the cache statistics for /metrics
+func (c *slotCache) snapshot() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"live":          c.fresh(),
+		"slot":          c.slot,
+		"entries":       len(c.entries),
+		"hits":          c.hits.Load(),
+		"misses":        c.misses.Load(),
+		"invalidations": c.invalidations.Load(),
+	}
+}
+
+// resetCounters zeroes the cache statistics for /admin/metrics/reset
+func (c *slotCache) resetCounters() {
+	if c == nil {
+		return
+	}
+	c.hits.Store(0)
+	c.misses.Store(0)
+	c.invalidations.Store(0)
+}
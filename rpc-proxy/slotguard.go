@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client slot watermarks are forgotten after watermarkTTL without requests,
+// and at most maxWatermarks clients are tracked
+const (
+	watermarkTTL  = 5 * time.Minute
+	maxWatermarks = 100000
+)
+
+// routeHint carries what forward needs to know about the client
+type routeHint struct {
+	client  string // affinity and watermark key, "" = untracked
+	minSlot uint64 // prefer upstreams at or past this slot, 0 = any
+	method  string // for latency routing, "batch" for batches
+
+	ledgerSlot uint64 // slot a block read needs, prefer upstreams holding it, 0 = any
+}
+
+// routeHint identifies the client of a request for session affinity and the
+// slot consistency guard
+func (p *RPCProxy) routeHint(r *http.Request, clientIP string) routeHint {
+	if p.pool.affinity == nil && p.pool.watermarks == nil {
+		return routeHint{}
+	}
+	account, kind := p.clientAccount(r, clientIP)
+	hint := routeHint{client: kind + ":" + account}
+	if p.config.SlotConsistency {
+		hint.minSlot = p.pool.watermarks.get(hint.client)
+	}
+	return hint
+}
+
+// slotWatermarks remember the highest slot each client has been shown, so
+// its next read isn't served by an upstream that is further behind and
+// e.g. a balance doesn't go backwards
+type slotWatermarks struct {
+	mu    sync.Mutex
+	slots map[string]*watermark
+
+	rerouted atomic.Int64 // requests steered away from a lagging upstream
+	injected atomic.Int64 // requests whose minContextSlot was injected or raised
+}
+
+type watermark struct {
+	slot        uint64    // highest slot at any commitment, for routing
+	commitments [3]uint64 // highest slot per commitment level, for minContextSlot
+	seen        time.Time
+}
+
+func newSlotWatermarks() *slotWatermarks {
+	w := &slotWatermarks{slots: make(map[string]*watermark)}
+	go w.cleanup()
+	return w
+}
+
+// get returns the client's watermark, 0 when unknown
+func (w *slotWatermarks) get(client string) uint64 {
+	if w == nil || client == "" {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if m, ok := w.slots[client]; ok {
+		return m.slot
+	}
+	return 0
+}
+
+// getAt returns the client's watermark at a commitment level, 0 when
+// unknown
+func (w *slotWatermarks) getAt(client string, commitment int) uint64 {
+	if w == nil || client == "" {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if m, ok := w.slots[client]; ok {
+		return m.commitments[commitment]
+	}
+	return 0
+}
+
+// raise records a slot the client was shown at a commitment level, or at
+// an unknown one when commitment is negative
+func (w *slotWatermarks) raise(client string, commitment int, slot uint64) {
+	if w == nil || client == "" || slot == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m, ok := w.slots[client]
+	if !ok {
+		if len(w.slots) >= maxWatermarks {
+			return
+		}
+		m = &watermark{}
+		w.slots[client] = m
+	}
+	if slot > m.slot {
+		m.slot = slot
+	}
+	if commitment >= 0 && slot > m.commitments[commitment] {
+		m.commitments[commitment] = slot
+	}
+	m.seen = time.Now()
+}
+
+// cleanup drops the watermarks of idle clients
+func (w *slotWatermarks) cleanup() {
+	for now := range time.Tick(time.Minute) {
+		w.mu.Lock()
+		for client, m := range w.slots {
+			if now.Sub(m.seen) > watermarkTTL {
+				delete(w.slots, client)
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// snapshot returns the tracked client count and reroutes for /metrics
+func (w *slotWatermarks) snapshot() map[string]interface{} {
+	w.mu.Lock()
+	clients := len(w.slots)
+	w.mu.Unlock()
+	return map[string]interface{}{
+		"clients":  clients,
+		"rerouted": w.rerouted.Load(),
+		"injected": w.injected.Load(),
+	}
+}
+
+// caughtUp orders the candidates so upstreams at or past minSlot come first.
+// Upstreams behind it stay at the end as failover, since a stale answer
+// beats none.
+func (w *slotWatermarks) caughtUp(candidates []*upstream, minSlot uint64) []*upstream {
+	if minSlot == 0 || len(candidates) < 2 {
+		return candidates
+	}
+	ahead := make([]*upstream, 0, len(candidates))
+	var behind []*upstream
+	for _, u := range candidates {
+		if u.slot.Load() >= minSlot {
+			ahead = append(ahead, u)
+		} else {
+			behind = append(behind, u)
+		}
+	}
+	if len(behind) > 0 && len(ahead) > 0 && behind[0] == candidates[0] {
+		w.rerouted.Add(1)
+	}
+	return append(ahead, behind...)
+}
+
+// observeSlot raises the upstream's known slot
+func (u *upstream) observeSlot(slot uint64) {
+	for {
+		old := u.slot.Load()
+		if slot <= old || u.slot.CompareAndSwap(old, slot) {
+			return
+		}
+	}
+}
+
+// tip returns the highest slot of any upstream in the pool
+func (p *upstreamPool) tip() uint64 {
+	var tip uint64
+	for _, u := range p.upstreams {
+		if slot := u.slot.Load(); slot > tip {
+			tip = slot
+		}
+	}
+	return tip
+}
+
+// contextSlots returns the context.slot of each response in a JSON-RPC
+// response or batch of responses, 0 for those without one
+func contextSlots(body []byte) []uint64 {
+	type contextResult struct {
+		Result struct {
+			Context struct {
+				Slot uint64 `json:"slot"`
+			} `json:"context"`
+		} `json:"result"`
+	}
+	var single contextResult
+	if json.Unmarshal(body, &single) == nil {
+		return []uint64{single.Result.Context.Slot}
+	}
+	var batch []contextResult
+	if json.Unmarshal(body, &batch) != nil {
+		return nil
+	}
+	slots := make([]uint64, len(batch))
+	for i, r := range batch {
+		slots[i] = r.Result.Context.Slot
+	}
+	return slots
+}
+
+// checkSlots polls the processed slot of every upstream in the pool
+func (p *RPCProxy) checkSlots(ctx context.Context) {
+	for _, u := range p.pool.upstreams {
+		var slot uint64
+		if err := p.pool.call(ctx, u, "getSlot", []interface{}{map[string]string{"commitment": "processed"}}, &slot); err == nil {
+			u.observeSlot(slot)
+		}
+	}
+}
+
+// watchSlots keeps the upstream slots current between the context slots
+// seen in responses
+func (p *RPCProxy) watchSlots(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval+5*time.Second)
+		p.checkSlots(ctx)
+		cancel()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// snapshotPrefix is where the files of snapshot_dir are served
+const snapshotPrefix = "/snapshots/"
+
+// snapshotName matches the files served: the genesis archive and full and
+// incremental snapshot archives, as named by solana-validator
+var snapshotName = regexp.MustCompile(`^(genesis\.tar\.bz2|(incremental-snapshot-[0-9]+|snapshot)-([0-9]+)-[1-9A-HJ-NP-Za-km-z]{32,44}\.tar(\.(bz2|zst|gz|lz4))?)$`)
+
+// snapshotServer serves snapshot archives and the genesis archive from a
+// directory, so bootstrapping validators can download them from the proxy
+// host. Besides /snapshots/<file>, it answers the root paths a validator
+// asks an RPC node for: /genesis.tar.bz2, /snapshot.tar.bz2 and
+// /incremental-snapshot.tar.bz2, the last two redirecting to the newest
+// archive.
+type snapshotServer struct {
+	dir     string
+	limiter *rate.Limiter // shared by every download, nil = unlimited
+	burst   int
+	slots   chan struct{} // nil = unlimited downloads at once
+
+	downloads atomic.Int64
+	bytes     atomic.Int64
+	busy      atomic.Int64 // downloads refused for snapshot_max_downloads
+}
+
+// newSnapshotServer returns nil without a snapshot_dir
+func newSnapshotServer(config *Config) (*snapshotServer, error) {
+	if config.SnapshotDir == "" {
+		return nil, nil
+	}
+	// Validators bootstrapping from the proxy can't authenticate, so the
+	// archives are served ahead of every other check; make the operator
+	// say so
+	if !config.SnapshotPublic {
+		return nil, fmt.Errorf("snapshot_dir serves the archives to every client without authentication or rate limits; set snapshot_public to confirm")
+	}
+	if info, err := os.Stat(config.SnapshotDir); err != nil {
+		return nil, fmt.Errorf("snapshot_dir: %w", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("snapshot_dir: %s is not a directory", config.SnapshotDir)
+	}
+	s := &snapshotServer{dir: config.SnapshotDir}
+	if config.SnapshotBytesPerSecond > 0 {
+		s.burst = int(config.SnapshotBytesPerSecond)
+		s.limiter = rate.NewLimiter(rate.Limit(config.SnapshotBytesPerSecond), s.burst)
+	}
+	if config.SnapshotMaxDownloads > 0 {
+		s.slots = make(chan struct{}, config.SnapshotMaxDownloads)
+	}
+	return s, nil
+}
+
+// file returns the name of the file a request path asks for, and the
+// prefix it was asked under
+func (s *snapshotServer) file(path string) (name, prefix string, ok bool) {
+	prefix = "/"
+	if strings.HasPrefix(path, snapshotPrefix) {
+		prefix = snapshotPrefix
+	}
+	name = strings.TrimPrefix(path, prefix)
+	switch {
+	case name == "snapshot.tar.bz2", name == "incremental-snapshot.tar.bz2":
+		return name, prefix, true
+	case snapshotName.MatchString(name):
+		return name, prefix, true
+	}
+	return "", "", false
+}
+
+// latest returns the newest full snapshot archive, or the newest incremental
+// one built on it
+func (s *snapshotServer) latest(incremental bool) (string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return "", err
+	}
+	var full, inc string
+	var fullSlot, incSlot uint64
+	for _, e := range entries {
+		m := snapshotName.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() || m[3] == "" {
+			continue
+		}
+		slot, _ := strconv.ParseUint(m[3], 10, 64)
+		if m[2] == "snapshot" && (full == "" || slot > fullSlot) {
+			full, fullSlot = e.Name(), slot
+		}
+	}
+	if !incremental {
+		return full, nil
+	}
+	base := fmt.Sprintf("incremental-snapshot-%d-", fullSlot)
+	for _, e := range entries {
+		m := snapshotName.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() || full == "" || !strings.HasPrefix(e.Name(), base) {
+			continue
+		}
+		slot, _ := strconv.ParseUint(m[3], 10, 64)
+		if inc == "" || slot > incSlot {
+			inc, incSlot = e.Name(), slot
+		}
+	}
+	return inc, nil
+}
+
+// serve answers a GET or HEAD for a snapshot file, with range requests, and
+// reports false for paths that aren't one
+func (s *snapshotServer) serve(w http.ResponseWriter, r *http.Request, logIP string) bool {
+	if s == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	name, prefix, ok := s.file(r.URL.Path)
+	if !ok {
+		return false
+	}
+
+	if name == "snapshot.tar.bz2" || name == "incremental-snapshot.tar.bz2" {
+		newest, err := s.latest(name != "snapshot.tar.bz2")
+		if err != nil {
+			log.Printf("[ERROR] Snapshot directory: %v", err)
+			http.Error(w, "Snapshot directory unavailable", http.StatusInternalServerError)
+			return true
+		}
+		if newest == "" {
+			http.NotFound(w, r)
+			return true
+		}
+		http.Redirect(w, r, prefix+newest, http.StatusSeeOther)
+		return true
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return true
+	}
+
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+		default:
+			s.busy.Add(1)
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Too many snapshot downloads, retry later", http.StatusServiceUnavailable)
+			return true
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		s.downloads.Add(1)
+		log.Printf("[SNAPSHOT] IP: %s, File: %s, Range: %q", logIP, name, r.Header.Get("Range"))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(&snapshotWriter{ResponseWriter: w, server: s, ctx: r.Context()}, r, name, info.ModTime(), f)
+	return true
+}
+
+// snapshotWriter paces a download to snapshot_bytes_per_second and counts
+// the bytes sent
+type snapshotWriter struct {
+	http.ResponseWriter
+	server *snapshotServer
+	ctx    context.Context
+}
+
+func (w *snapshotWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if w.server.limiter != nil {
+			n = min(n, w.server.burst)
+			if err := w.server.limiter.WaitN(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		w.server.bytes.Add(int64(m))
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (s *snapshotServer) snapshot() map[string]interface{} {
+	snapshot := map[string]interface{}{
+		"downloads": s.downloads.Load(),
+		"bytes":     s.bytes.Load(),
+		"busy":      s.busy.Load(),
+	}
+	if s.slots != nil {
+		snapshot["active"] = len(s.slots)
+	}
+	return snapshot
+}
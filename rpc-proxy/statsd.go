@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdMaxPacket keeps packets under a typical MTU
+const statsdMaxPacket = 1432
+
+// statsdSink buffers statsd lines and sends them over UDP. With Datadog tags
+// enabled, labels are sent as DogStatsD tags; otherwise they are folded into
+// the metric name.
+type statsdSink struct {
+	conn    net.Conn
+	prefix  string
+	dogTags bool
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newStatsdSink(addr, prefix string, dogTags bool) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &statsdSink{conn: conn, prefix: prefix, dogTags: dogTags}, nil
+}
+
+// count emits a counter delta
+func (s *statsdSink) count(tenant, name string, delta int64) {
+	s.write(tenant, name, strconv.FormatInt(delta, 10), "c")
+}
+
+// gauge emits a gauge value
+func (s *statsdSink) gauge(tenant, name string, value float64) {
+	s.write(tenant, name, strconv.FormatFloat(value, 'f', -1, 64), "g")
+}
+
+// timing emits a timing in milliseconds
+func (s *statsdSink) timing(tenant, name string, d time.Duration) {
+	s.write(tenant, name, strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 3, 64), "ms")
+}
+
+func (s *statsdSink) write(tenant, name, value, kind string) {
+	var line string
+	if s.dogTags {
+		line = fmt.Sprintf("%s%s:%s|%s|#tenant:%s\n", s.prefix, name, value, kind, tenant)
+	} else {
+		line = fmt.Sprintf("%s%s.%s:%s|%s\n", s.prefix, strings.NewReplacer(".", "_", "/", "_").Replace(tenant), name, value, kind)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.buf)+len(line) > statsdMaxPacket {
+		s.flushLocked()
+	}
+	s.buf = append(s.buf, line...)
+}
+
+// flush sends any buffered lines
+func (s *statsdSink) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+}
+
+func (s *statsdSink) flushLocked() {
+	if len(s.buf) == 0 {
+		return
+	}
+	// UDP is fire-and-forget; a missing statsd agent must not affect serving
+	s.conn.Write(s.buf)
+	s.buf = s.buf[:0]
+}
+
+// runStatsd emits counter deltas and gauges for every proxy each interval
+func (rt *Router) runStatsd(sink *statsdSink, interval time.Duration) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	last := make(map[*RPCProxy]metricsCounters)
+	for _, p := range rt.proxies() {
+		last[p] = p.metrics.counters()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, p := range rt.proxies() {
+			cur := p.metrics.counters()
+			prev := last[p]
+			last[p] = cur
+			if !cur.Since.Equal(prev.Since) {
+				// Reset through the admin API since the last flush
+				prev = metricsCounters{Since: cur.Since}
+			}
+
+			sink.count(p.name, "requests.total", cur.TotalRequests-prev.TotalRequests)
+			sink.count(p.name, "requests.success", cur.SuccessRequests-prev.SuccessRequests)
+			sink.count(p.name, "requests.failed", cur.FailedRequests-prev.FailedRequests)
+			sink.count(p.name, "requests.rate_limited", cur.RateLimited-prev.RateLimited)
+			sink.count(p.name, "requests.waited", cur.WaitedRequests-prev.WaitedRequests)
+			sink.count(p.name, "requests.slow", cur.SlowRequests-prev.SlowRequests)
+			sink.count(p.name, "requests.exempt", cur.ExemptRequests-prev.ExemptRequests)
+			sink.count(p.name, "requests.shed", cur.ShedRequests-prev.ShedRequests)
+			sink.count(p.name, "bytes.in", cur.BytesIn-prev.BytesIn)
+			sink.count(p.name, "bytes.out", cur.BytesOut-prev.BytesOut)
+
+			sink.gauge(p.name, "active_ip_limiters", float64(p.metrics.ActiveIPs.Load()))
+			sink.gauge(p.name, "uptime_seconds", time.Since(p.metrics.StartTime).Seconds())
+		}
+		sink.flush()
+	}
+}
+
+// startStatsd connects the statsd sink and attaches it to every proxy
+func (rt *Router) startStatsd(config *Config) {
+	sink, err := newStatsdSink(config.StatsdAddr, config.StatsdPrefix, config.StatsdDogTags)
+	if err != nil {
+		log.Printf("[ERROR] Failed to set up statsd sink: %v", err)
+		return
+	}
+
+	for _, p := range rt.proxies() {
+		p.statsd = sink
+	}
+	go rt.runStatsd(sink, config.StatsdFlushInterval.Duration)
+	log.Printf("Sending statsd metrics to %s every %s", config.StatsdAddr, config.StatsdFlushInterval.Duration)
+}
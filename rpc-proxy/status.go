@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+)
+
+// handleStatus serves the status dashboard. The page polls the metrics
+// endpoint next to it, so it also works under a tenant prefix.
+func (p *RPCProxy) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Write([]byte(statusPage))
+}
+
+// statusPage is the dashboard: request rate, per-method breakdown, upstream
+// health, IP limiters and cache hit rate, refreshed every two seconds.
+// Values from /metrics are only ever set as text, never as HTML.
+const statusPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>RPC Proxy Status</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 0; background: #111; color: #ddd; }
+header { padding: 12px 20px; background: #1c1c1c; display: flex; gap: 20px; align-items: baseline; }
+h1 { font-size: 18px; margin: 0; }
+h2 { font-size: 14px; text-transform: uppercase; color: #888; margin: 0 0 8px; }
+main { display: grid; grid-template-columns: repeat(auto-fit, minmax(340px, 1fr)); gap: 16px; padding: 16px 20px; }
+section { background: #1c1c1c; border-radius: 6px; padding: 12px 16px; }
+.tiles { display: grid; grid-template-columns: repeat(3, 1fr); gap: 8px; }
+.tile b { display: block; font-size: 22px; color: #fff; }
+.tile span { color: #888; font-size: 12px; }
+table { width: 100%; border-collapse: collapse; }
+td, th { text-align: left; padding: 3px 6px; border-bottom: 1px solid #2a2a2a; }
+th { color: #888; font-weight: normal; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+.ok { color: #4c4; } .warn { color: #db3; } .bad { color: #e55; }
+svg { width: 100%; height: 60px; }
+#error { color: #e55; }
+</style>
+</head>
+<body>
+<header><h1>RPC Proxy Status</h1><span id="tenant"></span><span id="uptime"></span><span id="error"></span></header>
+<main>
+<section>
+<h2>Traffic</h2>
+<div class="tiles">
+<div class="tile"><b id="rate">-</b><span>requests/s</span></div>
+<div class="tile"><b id="total">-</b><span>total requests</span></div>
+<div class="tile"><b id="errors">-</b><span>failed</span></div>
+<div class="tile"><b id="limited">-</b><span>rate limited</span></div>
+<div class="tile"><b id="queue">-</b><span>queue depth</span></div>
+<div class="tile"><b id="wait">-</b><span>avg wait (ms)</span></div>
+</div>
+<svg id="spark" viewBox="0 0 120 60" preserveAspectRatio="none"><polyline id="line" fill="none" stroke="#4a9" stroke-width="1.5"/></svg>
+</section>
+<section>
+<h2>Upstreams</h2>
+<table><thead><tr><th>Name</th><th>State</th><th class="n">Requests</th><th class="n">Failures</th><th class="n">Conns</th></tr></thead><tbody id="upstreams"></tbody></table>
+</section>
+<section>
+<h2>Methods</h2>
+<table><thead><tr><th>Method</th><th class="n">req/s</th><th class="n">Total</th></tr></thead><tbody id="methods"></tbody></table>
+</section>
+<section>
+<h2>Limiters &amp; Cache</h2>
+<div class="tiles">
+<div class="tile"><b id="ips">-</b><span>active IP limiters</span></div>
+<div class="tile"><b id="evicted">-</b><span>IP limiters evicted</span></div>
+<div class="tile"><b id="mode">-</b><span>rate limit mode</span></div>
+<div class="tile"><b id="hitrate">-</b><span>cache hit rate</span></div>
+<div class="tile"><b id="entries">-</b><span>cache entries</span></div>
+<div class="tile"><b id="cachemb">-</b><span>cache MiB</span></div>
+</div>
+</section>
+</main>
+<script>
+"use strict";
+var prev = null, history = [];
+
+function $(id) { return document.getElementById(id); }
+function set(id, v) { $(id).textContent = v; }
+function fmt(n) { return n >= 1e6 ? (n / 1e6).toFixed(1) + "M" : n >= 1e4 ? (n / 1e3).toFixed(1) + "k" : String(Math.round(n * 10) / 10); }
+
+function cell(text, cls) {
+	var td = document.createElement("td");
+	td.textContent = text;
+	if (cls) td.className = cls;
+	return td;
+}
+
+function row(tbody, cells) {
+	var tr = document.createElement("tr");
+	cells.forEach(function (c) { tr.appendChild(c); });
+	tbody.appendChild(tr);
+}
+
+function render(m, now) {
+	var dt = prev ? (now - prev.at) / 1000 : 0;
+	var rate = dt > 0 ? Math.max(0, m.total_requests - prev.m.total_requests) / dt : 0;
+
+	set("tenant", m.tenant);
+	set("uptime", "up " + Math.floor(m.uptime_seconds / 3600) + "h" + Math.floor(m.uptime_seconds % 3600 / 60) + "m");
+	set("rate", fmt(rate));
+	set("total", fmt(m.total_requests));
+	set("errors", fmt(m.failed_requests));
+	set("limited", fmt(m.rate_limited));
+	set("queue", fmt(m.queue_depth));
+	set("wait", fmt(m.avg_wait_time_ms));
+	set("ips", fmt(m.active_ip_limiters));
+	set("evicted", fmt(m.ip_limiter_evicted));
+	set("mode", m.rate_limit_mode);
+
+	var c = m.transcode_cache;
+	if (c && c.hits + c.misses > 0) {
+		set("hitrate", (100 * c.hits / (c.hits + c.misses)).toFixed(1) + "%");
+	} else {
+		set("hitrate", "-");
+	}
+	set("entries", c ? fmt(c.entries) : "-");
+	set("cachemb", c ? (c.bytes / 1048576).toFixed(1) : "-");
+
+	history.push(rate);
+	if (history.length > 60) history.shift();
+	var max = Math.max.apply(null, history.concat([1]));
+	$("line").setAttribute("points", history.map(function (v, i) {
+		return (i * 2) + "," + (58 - 56 * v / max).toFixed(1);
+	}).join(" "));
+
+	var ups = $("upstreams");
+	ups.textContent = "";
+	(m.upstreams || []).forEach(function (u) {
+		var state = "healthy", cls = "ok";
+		if (!u.routable) { state = "wrong cluster"; cls = "bad"; }
+		else if (u.throttled_ms > 0) { state = "throttled " + Math.ceil(u.throttled_ms / 1000) + "s"; cls = "warn"; }
+		else if (u.over_budget) { state = "over budget"; cls = "warn"; }
+		if (u.fallback) state += " (fallback)";
+		var c = u.connections || {};
+		var conns = fmt(c.open || 0) + (c.max_conns_per_host ? " / " + fmt(c.max_conns_per_host) : "");
+		row(ups, [cell(u.name), cell(state, cls), cell(fmt(u.requests), "n"), cell(fmt(u.failures), "n"), cell(conns, "n")]);
+	});
+
+	var methods = m.methods || {};
+	var names = Object.keys(methods).sort(function (a, b) { return methods[b] - methods[a]; });
+	var tbody = $("methods");
+	tbody.textContent = "";
+	names.slice(0, 25).forEach(function (name) {
+		var before = prev && prev.m.methods ? prev.m.methods[name] || 0 : methods[name];
+		var r = dt > 0 ? Math.max(0, methods[name] - before) / dt : 0;
+		row(tbody, [cell(name), cell(fmt(r), "n"), cell(fmt(methods[name]), "n")]);
+	});
+
+	prev = { m: m, at: now };
+}
+
+function poll() {
+	fetch("metrics", { cache: "no-store" })
+		.then(function (resp) {
+			if (!resp.ok) throw new Error("metrics: HTTP " + resp.status);
+			return resp.json();
+		})
+		.then(function (m) { set("error", ""); render(m, Date.now()); })
+		.catch(function (err) { set("error", err.message); })
+		.then(function () { setTimeout(poll, 2000); });
+}
+poll();
+</script>
+</body>
+</html>
+`
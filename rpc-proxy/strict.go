@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+)
+
+// methodNamePattern is the charset and length of method names accepted in
+// strict mode
+var methodNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// validateStrict checks a request body against the JSON-RPC 2.0 spec and
+// the shape Solana nodes accept. When it fails, it writes spec-compliant
+// errors, one per request of a batch, and returns false. In a batch every
+// request is refused when any is invalid; the valid ones are told so.
+func (p *RPCProxy) validateStrict(w http.ResponseWriter, body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(trimmed, []byte("[")) {
+		id, rpcErr := validateCall(trimmed)
+		if rpcErr == nil {
+			return true
+		}
+		p.strictRejections.Add(1)
+		p.writeRPCError(w, id, rpcErr.Code, rpcErr.Message, http.StatusBadRequest)
+		return false
+	}
+
+	var items []json.RawMessage
+	if json.Unmarshal(trimmed, &items) != nil {
+		p.strictRejections.Add(1)
+		p.writeRPCError(w, nil, -32700, "Parse error", http.StatusBadRequest)
+		return false
+	}
+	if len(items) == 0 {
+		p.strictRejections.Add(1)
+		p.writeRPCError(w, nil, -32600, "Invalid Request: empty batch", http.StatusBadRequest)
+		return false
+	}
+
+	responses := make([]JSONRPCResponse, len(items))
+	invalid := false
+	for i, item := range items {
+		id, rpcErr := validateCall(item)
+		if rpcErr != nil {
+			invalid = true
+		} else {
+			rpcErr = &JSONRPCError{Code: -32600, Message: "Invalid Request: another request in the batch is invalid"}
+		}
+		responses[i] = JSONRPCResponse{JSONRPC: "2.0", ID: id, Error: rpcErr}
+	}
+	if !invalid {
+		return true
+	}
+	p.strictRejections.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(responses)
+	return false
+}
+
+// validateCall checks one request, returning its id (nil unless valid) and
+// the error when the request is invalid
+func validateCall(raw json.RawMessage) (interface{}, *JSONRPCError) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		if !json.Valid(raw) {
+			return nil, &JSONRPCError{Code: -32700, Message: "Parse error"}
+		}
+		return nil, &JSONRPCError{Code: -32600, Message: "Invalid Request: expected an object"}
+	}
+
+	var id interface{}
+	if rawID, ok := fields["id"]; ok {
+		switch rawID[0] {
+		case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			id = rawID // echoed as sent, so large numbers keep their precision
+		default:
+			return nil, &JSONRPCError{Code: -32600, Message: "Invalid Request: id must be a string, number or null"}
+		}
+	}
+
+	var version string
+	if json.Unmarshal(fields["jsonrpc"], &version) != nil || version != "2.0" {
+		return id, &JSONRPCError{Code: -32600, Message: `Invalid Request: jsonrpc must be "2.0"`}
+	}
+
+	var method string
+	if json.Unmarshal(fields["method"], &method) != nil || !methodNamePattern.MatchString(method) {
+		return id, &JSONRPCError{Code: -32600, Message: "Invalid Request: method must be a name of letters, digits and underscores"}
+	}
+
+	if params, ok := fields["params"]; ok {
+		switch params[0] {
+		case '[', 'n':
+		case '{':
+			return id, &JSONRPCError{Code: -32602, Message: "Invalid params: expected an array"}
+		default:
+			return id, &JSONRPCError{Code: -32600, Message: "Invalid Request: params must be an array"}
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Supervisor states of the local node
+const (
+	nodeUnknown    = "unknown"
+	nodeHealthy    = "healthy"
+	nodeCatchingUp = "catching_up"
+)
+
+// SupervisorConfig watches a validator or RPC node running next to the
+// proxy and moves its traffic to the fallback upstreams while it is behind
+type SupervisorConfig struct {
+	Upstream     string   `json:"upstream"`      // the local node's upstream, default the first upstream that isn't a fallback
+	ClusterURL   string   `json:"cluster_url"`   // endpoint whose slot is the cluster's, default the highest slot of the other upstreams
+	Interval     Duration `json:"interval"`      // how often the node is checked, default 5s
+	MaxLag       uint64   `json:"max_lag"`       // slots behind the cluster at which traffic moves away, default 150
+	RecoverLag   uint64   `json:"recover_lag"`   // slots behind at which traffic may move back, default 20
+	RecoverAfter Duration `json:"recover_after"` // how long the node must stay within recover_lag first, default 30s
+}
+
+// supervisor checks the local node's slot against the cluster's. A node
+// that falls max_lag slots behind, fails getHealth or stops answering is
+// routed after the fallback upstreams until it has stayed within
+// recover_lag for recover_after, so a restarting or catching-up node
+// doesn't serve stale reads.
+type supervisor struct {
+	node    *upstream
+	cluster *upstream // nil = the other upstreams of the pool
+
+	interval     time.Duration
+	maxLag       uint64
+	recoverLag   uint64
+	recoverAfter time.Duration
+
+	mu          sync.Mutex
+	state       string
+	since       time.Time // when the state was entered
+	recovering  time.Time // since when a catching-up node has been within recover_lag
+	nodeSlot    uint64
+	clusterSlot uint64
+	lastErr     string
+	samples     []catchupSample // for /catchup, oldest first
+
+	flips atomic.Int64
+}
+
+// newSupervisor returns nil without supervise
+func newSupervisor(config *Config, pool *upstreamPool) (*supervisor, error) {
+	sc := config.Supervise
+	if sc == nil {
+		return nil, nil
+	}
+	if len(pool.upstreams) < 2 {
+		return nil, fmt.Errorf("supervise: needs another upstream to route to while the node catches up")
+	}
+	s := &supervisor{
+		interval:     sc.Interval.Duration,
+		maxLag:       sc.MaxLag,
+		recoverLag:   sc.RecoverLag,
+		recoverAfter: sc.RecoverAfter.Duration,
+		state:        nodeUnknown,
+		since:        time.Now(),
+	}
+	for _, u := range pool.upstreams {
+		if (sc.Upstream == "" && !u.fallback) || u.name == sc.Upstream {
+			s.node = u
+			break
+		}
+	}
+	if s.node == nil {
+		return nil, fmt.Errorf("supervise: no upstream named %q", sc.Upstream)
+	}
+	if sc.ClusterURL != "" {
+		s.cluster = &upstream{name: "cluster", url: sc.ClusterURL, client: &http.Client{Timeout: config.Timeout.Duration}}
+	}
+	if s.interval <= 0 {
+		s.interval = 5 * time.Second
+	}
+	if s.maxLag == 0 {
+		s.maxLag = 150
+	}
+	if s.recoverLag == 0 || s.recoverLag > s.maxLag {
+		s.recoverLag = min(20, s.maxLag)
+	}
+	if s.recoverAfter <= 0 {
+		s.recoverAfter = 30 * time.Second
+	}
+	return s, nil
+}
+
+// clusterSlot returns the cluster's slot: cluster_url's, or the highest of
+// the other upstreams
+func (p *RPCProxy) clusterSlot(ctx context.Context) (uint64, error) {
+	processed := []interface{}{map[string]string{"commitment": "processed"}}
+	s := p.supervisor
+	if s.cluster != nil {
+		var slot uint64
+		err := p.pool.call(ctx, s.cluster, "getSlot", processed, &slot)
+		return slot, err
+	}
+	var highest uint64
+	err := fmt.Errorf("no other upstream answered getSlot")
+	for _, u := range p.pool.upstreams {
+		if u == s.node {
+			continue
+		}
+		var slot uint64
+		if callErr := p.pool.call(ctx, u, "getSlot", processed, &slot); callErr != nil {
+			continue
+		}
+		highest, err = max(highest, slot), nil
+	}
+	return highest, err
+}
+
+// superviseNode checks the local node once and flips its routing when it
+// falls behind or has caught up
+func (p *RPCProxy) superviseNode(ctx context.Context) {
+	s := p.supervisor
+	// A node that is behind fails getHealth but still reports its slot,
+	// which /catchup needs to measure how fast it is gaining
+	var nodeSlot uint64
+	nodeErr := p.pool.call(ctx, s.node, "getHealth", nil, nil)
+	slotErr := p.pool.call(ctx, s.node, "getSlot", []interface{}{map[string]string{"commitment": "processed"}}, &nodeSlot)
+	if nodeErr == nil {
+		nodeErr = slotErr
+	}
+	clusterSlot, clusterErr := p.clusterSlot(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.lastErr = ""
+	if nodeErr != nil {
+		s.lastErr = nodeErr.Error()
+	}
+	if slotErr == nil {
+		s.nodeSlot = nodeSlot
+	}
+	if clusterErr == nil {
+		s.clusterSlot = clusterSlot
+	}
+	var lag uint64
+	if slotErr == nil && clusterErr == nil {
+		s.recordSample(catchupSample{at: now, nodeSlot: nodeSlot, clusterSlot: clusterSlot})
+		if clusterSlot > nodeSlot {
+			lag = clusterSlot - nodeSlot
+		}
+	}
+
+	switch {
+	case nodeErr != nil || lag > s.maxLag:
+		s.recovering = time.Time{}
+		if s.state == nodeCatchingUp {
+			return
+		}
+		reason := fmt.Sprintf("%d slots behind the cluster", lag)
+		if nodeErr != nil {
+			reason = "unhealthy: " + nodeErr.Error()
+		}
+		s.flip(nodeCatchingUp, now)
+		log.Printf("[WARN] Supervisor: %s is %s, routing to the fallback upstreams while it catches up", s.node.name, reason)
+		p.alerts.notify(alertNodeBehind, p.name, s.node.name, false, "local node %s, traffic moved to the fallback upstreams", reason)
+	case clusterErr != nil:
+		// Without the cluster's slot a healthy node can't be told from a
+		// stalled one, so the routing stays as it is
+		s.recovering = time.Time{}
+	case lag <= s.recoverLag:
+		if s.state == nodeHealthy {
+			return
+		}
+		if s.state == nodeCatchingUp {
+			if s.recovering.IsZero() {
+				s.recovering = now
+			}
+			if now.Sub(s.recovering) < s.recoverAfter {
+				return
+			}
+		}
+		wasCatchingUp := s.state == nodeCatchingUp
+		s.flip(nodeHealthy, now)
+		if wasCatchingUp {
+			log.Printf("Supervisor: %s caught up (%d slots behind), routing to it again", s.node.name, lag)
+			p.alerts.notify(alertNodeBehind, p.name, s.node.name, true, "local node caught up, traffic moved back")
+		}
+	default:
+		// Between recover_lag and max_lag: not behind enough to move away,
+		// not close enough to move back
+		s.recovering = time.Time{}
+		if s.state == nodeUnknown {
+			s.flip(nodeHealthy, now)
+		}
+	}
+}
+
+// flip enters a state, with s.mu held
+func (s *supervisor) flip(state string, now time.Time) {
+	if s.state != nodeUnknown {
+		s.flips.Add(1)
+	}
+	s.state = state
+	s.since = now
+	s.recovering = time.Time{}
+	s.node.catchingUp.Store(state == nodeCatchingUp)
+}
+
+// watchNode supervises the local node every interval
+func (p *RPCProxy) watchNode() {
+	s := p.supervisor
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), s.interval+5*time.Second)
+		p.superviseNode(ctx)
+		cancel()
+		time.Sleep(s.interval)
+	}
+}
+
+func (s *supervisor) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := map[string]interface{}{
+		"upstream":     s.node.name,
+		"state":        s.state,
+		"since":        s.since.UTC(),
+		"node_slot":    s.nodeSlot,
+		"cluster_slot": s.clusterSlot,
+		"flips":        s.flips.Load(),
+	}
+	if s.clusterSlot > s.nodeSlot {
+		snapshot["lag"] = s.clusterSlot - s.nodeSlot
+	} else {
+		snapshot["lag"] = 0
+	}
+	if s.lastErr != "" {
+		snapshot["error"] = s.lastErr
+	}
+	return snapshot
+}
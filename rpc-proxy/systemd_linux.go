@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdListenFDsStart is the first fd passed by socket activation
+const systemdListenFDsStart = 3
+
+// sdNotify sends a state update to the service manager. It is a no-op when
+// not running under systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // abstract socket
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// in the order of the .socket unit's Listen* lines
+func systemdListeners() []net.Listener {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("systemd-%d", i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("[ERROR] Failed to use socket-activated fd %d (%s): %v", systemdListenFDsStart+i, name, err)
+			continue
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners
+}
+
+// sdReadyAfterProbe signals readiness to systemd once the upstream answers
+// and the proxy has warmed up, retrying with backoff, and then keeps the
+// watchdog fed
+func sdReadyAfterProbe(router *Router) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := router.defaultProxy.pool.probe(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+
+		log.Printf("[ERROR] Upstream probe failed, not ready yet: %v", err)
+		sdNotify("STATUS=Waiting for upstream: " + err.Error())
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+
+	// Then for the caches to warm up, bounded by ready_warm_timeout
+	for {
+		err := router.defaultProxy.checkWarm()
+		if err == nil {
+			break
+		}
+		sdNotify("STATUS=" + err.Error())
+		time.Sleep(time.Second)
+	}
+
+	// After a zero-downtime upgrade this process replaces the main pid
+	sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1\nSTATUS=Proxying to %s", os.Getpid(), router.defaultProxy.config.UpstreamURL))
+	log.Println("Notified systemd: ready")
+
+	sdWatchdog()
+}
+
+// sdWatchdog pings the systemd watchdog at half the configured interval
+func sdWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("[ERROR] Failed to ping systemd watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+func sdNotify(state string) error {
+	return nil
+}
+
+func systemdListeners() []net.Listener {
+	return nil
+}
+
+func sdReadyAfterProbe(router *Router) {}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// TenantConfig maps a path prefix (e.g. /devnet) to its own proxy config.
+// Any top-level config field may be set on a tenant to override the base
+// config, e.g. upstream_url, upstreams or the rate limits.
+type TenantConfig struct {
+	Name       string `json:"name"`
+	PathPrefix string `json:"path_prefix"` // defaults to /<name>
+
+	raw json.RawMessage
+}
+
+// UnmarshalJSON keeps the raw tenant object so it can be overlaid onto the
+// base config
+func (t *TenantConfig) UnmarshalJSON(b []byte) error {
+	type plain TenantConfig
+	if err := json.Unmarshal(b, (*plain)(t)); err != nil {
+		return err
+	}
+	t.raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// MarshalJSON returns the tenant object as it was configured
+func (t TenantConfig) MarshalJSON() ([]byte, error) {
+	if t.raw != nil {
+		return t.raw, nil
+	}
+	type plain TenantConfig
+	return json.Marshal(plain(t))
+}
+
+// prefix returns the normalized path prefix for the tenant
+func (t TenantConfig) prefix() string {
+	p := t.PathPrefix
+	if p == "" {
+		p = t.Name
+	}
+	return "/" + strings.Trim(p, "/")
+}
+
+// clone returns a deep copy of the config, so overrides decoded into it
+// don't write through to the maps and pointers of the original
+func (c *Config) clone() (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var clone Config
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, err
+	}
+	clone.secrets = c.secrets
+	return &clone, nil
+}
+
+// forTenant returns a copy of the config with the tenant overrides applied
+func (c *Config) forTenant(t TenantConfig) (*Config, error) {
+	tenantConfig, err := c.clone()
+	if err != nil {
+		return nil, fmt.Errorf("tenant %q: %w", t.Name, err)
+	}
+	tenantConfig.Tenants = nil
+	tenantConfig.Upstreams = nil
+
+	if len(t.raw) > 0 {
+		if err := json.Unmarshal(t.raw, tenantConfig); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+	}
+	// Nested tenants are not supported
+	tenantConfig.Tenants = nil
+
+	return tenantConfig, nil
+}
+
+// tenantRoute is a path prefix served by its own proxy
+type tenantRoute struct {
+	prefix string
+	proxy  *RPCProxy
+}
+
+// Router dispatches requests to per-vhost routers by Host header and to
+// per-tenant proxies by path prefix. Requests that match no vhost or tenant
+// are served by the default proxy.
+type Router struct {
+	name         string
+	defaultProxy *RPCProxy
+	tenants      []*tenantRoute
+	vhosts       map[string]*Router
+	vhostNames   []string
+	usage        *usageTracker
+	drain        *drainState
+	audit        *auditLog   // nil = no admin audit log
+	alerts       *alerter    // nil = no alert webhooks
+	requestLog   *requestLog // nil = no request log sink
+	snapshots    *snapshotServer
+}
+
+// NewRouter builds the default proxy, one router per configured vhost and one
+// proxy per configured tenant
+func NewRouter(config *Config) (*Router, error) {
+	router, err := newRouter("default", config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vc := range config.VHosts {
+		if len(vc.Hosts) == 0 {
+			return nil, fmt.Errorf("vhost %q has no hosts", vc.Name)
+		}
+		if vc.Name == "" {
+			vc.Name = normalizeHost(vc.Hosts[0])
+		}
+
+		vhostConfig, err := config.forVHost(vc)
+		if err != nil {
+			return nil, err
+		}
+
+		vhost, err := newRouter(vc.Name, vhostConfig)
+		if err != nil {
+			return nil, fmt.Errorf("vhost %q: %w", vc.Name, err)
+		}
+
+		if router.vhosts == nil {
+			router.vhosts = make(map[string]*Router)
+		}
+		for _, host := range vc.Hosts {
+			host = normalizeHost(host)
+			if _, exists := router.vhosts[host]; exists {
+				return nil, fmt.Errorf("host %s is configured for more than one vhost", host)
+			}
+			router.vhosts[host] = vhost
+		}
+		router.vhostNames = append(router.vhostNames, vc.Name)
+	}
+
+	// Usage analytics, drain mode, the admin audit log, alert webhooks, the
+	// request log sink, snapshot serving, the buffer budget, the transcode
+	// cache and keys files are shared by every tenant and vhost
+	if config.EnableUsage {
+		router.usage = newUsageTracker(config.UsageWindow.Duration, config.MaxUsageAccounts)
+	}
+	router.drain = &drainState{}
+	if router.audit, err = newAuditLog(config.AdminAuditLog); err != nil {
+		return nil, err
+	}
+	if router.alerts, err = newAlerter(config); err != nil {
+		return nil, err
+	}
+	if router.requestLog, err = newRequestLog(config); err != nil {
+		return nil, err
+	}
+	if router.snapshots, err = newSnapshotServer(config); err != nil {
+		return nil, err
+	}
+	router.defaultProxy.snapshots = router.snapshots
+	var buffers *bufferBudget
+	if config.MaxBufferedBytes > 0 {
+		buffers = newBufferBudget(config.MaxBufferedBytes)
+	}
+	transcoder := newTranscodeCache(config.TranscodeCacheBytes)
+	keyStores := make(map[string]*keyStore)
+	for _, p := range router.proxies() {
+		if path := p.config.APIKeysFile; path != "" {
+			if keyStores[path] == nil {
+				store, err := newKeyStore(path)
+				if err != nil {
+					return nil, err
+				}
+				keyStores[path] = store
+				go store.watch(p.config.APIKeysReloadInterval.Duration)
+			}
+			p.keys = keyStores[path]
+			if p.priorities != nil {
+				p.priorities.file = p.keys
+			}
+		}
+		p.buffers = buffers
+		p.transcoder = transcoder
+		p.usage = router.usage
+		p.drain = router.drain
+		p.alerts = router.alerts
+		p.requestLog = router.requestLog
+		if p.config.ExpectedGenesisHash != "" {
+			go p.watchGenesis(p.config.GenesisCheckInterval.Duration)
+		}
+		if p.shedder != nil {
+			go p.shedder.run(p.name)
+		}
+		if p.rateSchedule != nil {
+			go p.watchRateSchedule()
+		}
+		if p.alerts != nil {
+			go p.watchAlerts(p.config.AlertCheckInterval.Duration)
+		}
+		if p.epochCache != nil {
+			go p.watchEpoch()
+		}
+		if p.gpaPages != nil {
+			go p.gpaPages.expire()
+		}
+		if p.airdrops != nil {
+			go p.airdrops.expire()
+		}
+		if p.pool.watermarks != nil || p.config.MaxBlockDepth > 0 {
+			go p.watchSlots(p.config.SlotCheckInterval.Duration)
+		}
+		if p.pool.ledgerAvailability {
+			go p.watchLedgers(p.config.LedgerCheckInterval.Duration)
+		}
+		if p.supervisor != nil {
+			go p.watchNode()
+		}
+		if p.epochWatch != nil {
+			go p.watchEpochBoundaries()
+		}
+	}
+
+	return router, nil
+}
+
+// newRouter builds the path routing for a single (v)host
+func newRouter(name string, config *Config) (*Router, error) {
+	defaultProxy, err := NewRPCProxy(config)
+	if err != nil {
+		return nil, err
+	}
+	defaultProxy.name = name
+
+	router := &Router{
+		name:         name,
+		defaultProxy: defaultProxy,
+	}
+
+	seen := make(map[string]string)
+	for _, tc := range config.Tenants {
+		if tc.Name == "" {
+			return nil, fmt.Errorf("tenant with path_prefix %q has no name", tc.PathPrefix)
+		}
+
+		prefix := tc.prefix()
+		if prefix == "/" {
+			return nil, fmt.Errorf("tenant %q: path_prefix must not be /", tc.Name)
+		}
+		if other, exists := seen[prefix]; exists {
+			return nil, fmt.Errorf("tenants %q and %q share path_prefix %s", other, tc.Name, prefix)
+		}
+		seen[prefix] = tc.Name
+
+		tenantConfig, err := config.forTenant(tc)
+		if err != nil {
+			return nil, err
+		}
+
+		proxy, err := NewRPCProxy(tenantConfig)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", tc.Name, err)
+		}
+		proxy.name = tc.Name
+		if name != "default" {
+			proxy.name = name + "/" + tc.Name
+		}
+		router.tenants = append(router.tenants, &tenantRoute{prefix: prefix, proxy: proxy})
+	}
+
+	// Longest prefix wins
+	sort.Slice(router.tenants, func(i, j int) bool {
+		return len(router.tenants[i].prefix) > len(router.tenants[j].prefix)
+	})
+
+	return router, nil
+}
+
+// match returns the tenant route for a path, or nil for the default proxy
+func (rt *Router) match(path string) *tenantRoute {
+	for _, t := range rt.tenants {
+		if path == t.prefix || strings.HasPrefix(path, t.prefix+"/") {
+			return t
+		}
+	}
+	return nil
+}
+
+// proxies returns every proxy served by the router, including vhosts
+func (rt *Router) proxies() []*RPCProxy {
+	proxies := []*RPCProxy{rt.defaultProxy}
+	for _, t := range rt.tenants {
+		proxies = append(proxies, t.proxy)
+	}
+
+	seen := make(map[*Router]bool)
+	for _, vhost := range rt.vhosts {
+		if !seen[vhost] {
+			seen[vhost] = true
+			proxies = append(proxies, vhost.proxies()...)
+		}
+	}
+	return proxies
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pw := &panicWriter{ResponseWriter: w}
+	defer rt.recoverPanic(pw, r)
+	rt.serve(pw, r)
+}
+
+// serve routes a request to the admin API, a vhost, a tenant or the
+// default proxy
+func (rt *Router) serve(w http.ResponseWriter, r *http.Request) {
+	// The admin API is served for every host
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		rt.handleAdmin(w, r)
+		return
+	}
+
+	// So are the snapshot archives
+	if rt.snapshots.serve(w, r, rt.defaultProxy.anonymizer.anonymize(getClientIP(r))) {
+		return
+	}
+
+	if vhost, ok := rt.vhosts[normalizeHost(r.Host)]; ok {
+		vhost.ServeHTTP(w, r)
+		return
+	}
+
+	if t := rt.match(r.URL.Path); t != nil {
+		t.proxy.ServeHTTP(w, stripPrefix(r, t.prefix))
+		return
+	}
+
+	// Root metrics include every tenant and vhost
+	if r.URL.Path == "/metrics" && rt.defaultProxy.config.EnableMetrics && (len(rt.tenants) > 0 || len(rt.vhosts) > 0) {
+		if rt.defaultProxy.config.EnableCORS {
+			rt.defaultProxy.setCORSHeaders(w, r)
+		}
+		rt.handleMetrics(w, r)
+		return
+	}
+
+	rt.defaultProxy.ServeHTTP(w, r)
+}
+
+// handleMetrics serves the default proxy metrics plus a per-tenant and
+// per-vhost breakdown
+func (rt *Router) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rt.metricsSnapshot())
+}
+
+// metricsSnapshot returns the default proxy metrics with nested tenant and
+// vhost metrics
+func (rt *Router) metricsSnapshot() map[string]interface{} {
+	snapshot := rt.defaultProxy.metricsSnapshot()
+
+	if len(rt.tenants) > 0 {
+		tenants := make(map[string]interface{}, len(rt.tenants))
+		for _, t := range rt.tenants {
+			tenants[t.proxy.name] = t.proxy.metricsSnapshot()
+		}
+		snapshot["tenants"] = tenants
+	}
+
+	if len(rt.vhosts) > 0 {
+		vhosts := make(map[string]interface{}, len(rt.vhostNames))
+		for _, vhost := range rt.vhosts {
+			vhosts[vhost.name] = vhost.metricsSnapshot()
+		}
+		snapshot["vhosts"] = vhosts
+	}
+
+	return snapshot
+}
+
+// stripPrefix returns a shallow copy of the request with the prefix removed
+// from its path
+func stripPrefix(r *http.Request, prefix string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	if r2.URL.Path == "" {
+		r2.URL.Path = "/"
+	}
+	r2.URL.RawPath = ""
+	return r2
+}
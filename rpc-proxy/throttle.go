@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// throttledError is returned by forward when every candidate upstream has
+// asked us to back off
+type throttledError struct {
+	retryAfter time.Duration // until the first upstream accepts requests again
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("all upstreams throttled, retry in %v", e.retryAfter.Round(time.Second))
+}
+
+// parseRetryAfter parses a Retry-After header in seconds or as an HTTP date,
+// returning 0 when it is missing or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// throttledFor returns how much longer the upstream asked us to back off
+func (u *upstream) throttledFor(now time.Time) time.Duration {
+	until := u.throttledUntil.Load()
+	if until <= now.UnixNano() {
+		return 0
+	}
+	return time.Duration(until - now.UnixNano())
+}
+
+// throttle records a 429 from the upstream, backing off for the Retry-After
+// it sent (or the configured default), capped at the configured maximum
+func (p *upstreamPool) throttle(u *upstream, resp *http.Response) {
+	now := time.Now()
+	d := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if d <= 0 {
+		d = p.throttleDefault
+	}
+	if p.throttleMax > 0 && d > p.throttleMax {
+		d = p.throttleMax
+	}
+	if d <= 0 {
+		return
+	}
+
+	until := now.Add(d).UnixNano()
+	for {
+		old := u.throttledUntil.Load()
+		if old >= until {
+			return
+		}
+		if u.throttledUntil.CompareAndSwap(old, until) {
+			break
+		}
+	}
+	log.Printf("[THROTTLE] %s: upstream returned 429, backing off for %v", u.name, d)
+}
+
+// discard drains and closes a response that won't be passed on, so the
+// connection can be reused
+func discard(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+// throttleSnapshot returns the remaining back-off of throttled upstreams for
+// /metrics
+func (p *upstreamPool) throttleSnapshot() map[string]int64 {
+	now := time.Now()
+	throttled := make(map[string]int64)
+	for _, u := range p.upstreams {
+		if d := u.throttledFor(now); d > 0 {
+			throttled[u.name] = d.Milliseconds()
+		}
+	}
+	return throttled
+}
+
+// writeThrottledError rejects a request because every upstream is throttled,
+// passing on how long the client should wait
+func (p *RPCProxy) writeThrottledError(w http.ResponseWriter, id interface{}, retryAfter time.Duration) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	p.writeRPCError(w, id, -32005, "Upstream throttled. Please retry after "+strconv.Itoa(secs)+" seconds.", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// upstreamTiming is the timing breakdown of one upstream round trip
+type upstreamTiming struct {
+	Queue      time.Duration // waiting for upstream concurrency slots, across attempts
+	Attempts   int           // upstreams tried, including this one
+	DNS        time.Duration
+	Connect    time.Duration
+	TLS        time.Duration
+	TTFB       time.Duration
+	ReusedConn bool
+}
+
+// traceTiming is what the httptrace hooks of one attempt measured. The
+// hooks run on transport goroutines, and a dial can outlive the request
+// that started it, so each attempt has its own, guarded by a mutex.
+type traceTiming struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	timing       upstreamTiming
+}
+
+// withTrace returns a context whose hooks measure an attempt
+func (t *traceTiming) withTrace(ctx context.Context) context.Context {
+	t.start = time.Now()
+	hook := func(f func(now time.Time)) {
+		now := time.Now()
+		t.mu.Lock()
+		f(now)
+		t.mu.Unlock()
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { hook(func(now time.Time) { t.dnsStart = now }) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			hook(func(now time.Time) {
+				if !t.dnsStart.IsZero() {
+					t.timing.DNS = now.Sub(t.dnsStart)
+				}
+			})
+		},
+		ConnectStart: func(string, string) { hook(func(now time.Time) { t.connectStart = now }) },
+		ConnectDone: func(string, string, error) {
+			hook(func(now time.Time) {
+				if !t.connectStart.IsZero() {
+					t.timing.Connect = now.Sub(t.connectStart)
+				}
+			})
+		},
+		TLSHandshakeStart: func() { hook(func(now time.Time) { t.tlsStart = now }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			hook(func(now time.Time) {
+				if !t.tlsStart.IsZero() {
+					t.timing.TLS = now.Sub(t.tlsStart)
+				}
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			hook(func(time.Time) { t.timing.ReusedConn = info.Reused })
+		},
+		GotFirstResponseByte: func() { hook(func(now time.Time) { t.timing.TTFB = now.Sub(t.start) }) },
+	})
+}
+
+// measured returns the attempt's timing so far
+func (t *traceTiming) measured() upstreamTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timing
+}
+
+// logSlowRequest logs and counts a request whose upstream latency exceeded
+// the slow request threshold
+func (p *RPCProxy) logSlowRequest(logIP, method, upstreamName string, paramsSize int, queueWait, latency time.Duration, timing *upstreamTiming) {
+	threshold := p.config.SlowRequestThreshold.Duration
+	if threshold <= 0 || latency < threshold {
+		return
+	}
+
+	p.metrics.SlowRequests.Add(1)
+
+	log.Printf("[SLOW] IP: %s, Method: %s, Upstream: %s, Params: %d bytes, Upstream latency: %v (queue: %v, dns: %v, connect: %v, tls: %v, ttfb: %v, reused conn: %v)",
+		logIP, method, upstreamName, paramsSize, latency.Round(time.Millisecond), queueWait.Round(time.Millisecond),
+		timing.DNS.Round(time.Millisecond), timing.Connect.Round(time.Millisecond), timing.TLS.Round(time.Millisecond),
+		timing.TTFB.Round(time.Millisecond), timing.ReusedConn)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// traceHeader triggers a trace when it carries the trace token
+	traceHeader = "X-Debug-Trace"
+	// traceIDHeader tells a traced client its trace ID, to quote in a
+	// latency complaint
+	traceIDHeader = "X-Trace-Id"
+)
+
+// traceStore records a detailed timing breakdown of sampled requests: one
+// in trace_sample_rate, and every request presenting the trace token. The
+// most recent trace_buffer_size traces are kept for /admin/traces.
+type traceStore struct {
+	sampleRate int64
+	token      string
+
+	seen    atomic.Int64 // requests considered for sampling
+	sampled atomic.Int64
+
+	mu     sync.Mutex
+	traces []*requestTrace // ring buffer
+	next   int
+}
+
+// requestTrace is the timing of one request, in milliseconds
+type requestTrace struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Tenant     string    `json:"tenant"`
+	IP         string    `json:"ip"`
+	Method     string    `json:"method"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Status     int       `json:"status"`
+	Trigger    string    `json:"trigger"` // "sample" or "header"
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	TotalMs    float64   `json:"total_ms"`
+	LimiterMs  float64   `json:"limiter_wait_ms"` // waiting for the rate limiter
+	QueueMs    float64   `json:"queue_ms"`        // waiting for upstream concurrency slots
+	DNSMs      float64   `json:"dns_ms"`
+	ConnectMs  float64   `json:"connect_ms"`
+	TLSMs      float64   `json:"tls_ms"`
+	TTFBMs     float64   `json:"ttfb_ms"`
+	BodyReadMs float64   `json:"body_read_ms"`
+	WriteMs    float64   `json:"write_ms"`
+	ReusedConn bool      `json:"reused_conn"`
+	Attempts   int       `json:"upstream_attempts,omitempty"`
+
+	start time.Time
+}
+
+// newTraceStore returns nil when neither sampling nor the trace token is
+// configured
+func newTraceStore(config *Config) *traceStore {
+	if config.TraceSampleRate <= 0 && config.TraceToken == "" {
+		return nil
+	}
+	size := config.TraceBufferSize
+	if size <= 0 {
+		size = 1000
+	}
+	return &traceStore{
+		sampleRate: int64(config.TraceSampleRate),
+		token:      config.TraceToken,
+		traces:     make([]*requestTrace, 0, size),
+	}
+}
+
+// sample starts a trace if the request is sampled or asks for one
+func (s *traceStore) sample(r *http.Request, tenant, logIP string) *requestTrace {
+	if s == nil {
+		return nil
+	}
+	trigger := ""
+	if header := r.Header.Get(traceHeader); s.token != "" && header != "" && subtle.ConstantTimeCompare([]byte(header), []byte(s.token)) == 1 {
+		trigger = "header"
+	} else if s.sampleRate > 0 && s.seen.Add(1)%s.sampleRate == 0 {
+		trigger = "sample"
+	}
+	if trigger == "" {
+		return nil
+	}
+	s.sampled.Add(1)
+
+	var b [8]byte
+	rand.Read(b[:])
+	now := time.Now()
+	return &requestTrace{ID: hex.EncodeToString(b[:]), Time: now.UTC(), Tenant: tenant, IP: logIP, Trigger: trigger, start: now}
+}
+
+// finish completes a trace and keeps it, dropping the oldest one when the
+// buffer is full
+func (s *traceStore) finish(t *requestTrace, methods []string, upstream string, status int, bytesIn, bytesOut int64, limiterWait time.Duration) {
+	t.Method = "batch"
+	if len(methods) == 1 {
+		t.Method = methods[0]
+	}
+	t.Upstream = upstream
+	t.Status = status
+	t.BytesIn, t.BytesOut = bytesIn, bytesOut
+	t.LimiterMs = milliseconds(limiterWait)
+	t.TotalMs = milliseconds(time.Since(t.start))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.traces) < cap(s.traces) {
+		s.traces = append(s.traces, t)
+		return
+	}
+	s.traces[s.next] = t
+	s.next = (s.next + 1) % len(s.traces)
+}
+
+// recordUpstream copies the upstream round trip's timing into a trace
+func (t *requestTrace) recordUpstream(timing *upstreamTiming) {
+	if t == nil {
+		return
+	}
+	t.QueueMs = milliseconds(timing.Queue)
+	t.DNSMs = milliseconds(timing.DNS)
+	t.ConnectMs = milliseconds(timing.Connect)
+	t.TLSMs = milliseconds(timing.TLS)
+	t.TTFBMs = milliseconds(timing.TTFB)
+	t.ReusedConn = timing.ReusedConn
+	t.Attempts = timing.Attempts
+}
+
+// recordBodyRead notes how long reading the upstream response took
+func (t *requestTrace) recordBodyRead(d time.Duration) {
+	if t != nil {
+		t.BodyReadMs = milliseconds(d)
+	}
+}
+
+// recordWrite notes how long writing the response to the client took
+func (t *requestTrace) recordWrite(d time.Duration) {
+	if t != nil {
+		t.WriteMs = milliseconds(d)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// recent returns the kept traces
+func (s *traceStore) recent() []*requestTrace {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*requestTrace(nil), s.traces...)
+}
+
+func (s *traceStore) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	kept := len(s.traces)
+	s.mu.Unlock()
+	return map[string]interface{}{
+		"sampled": s.sampled.Load(),
+		"kept":    kept,
+	}
+}
+
+// handleTraces serves /admin/traces: the recent traces of every proxy,
+// newest first, filtered by ?id=, ?method=, ?tenant= and ?min_ms=, at most
+// ?limit= (default 100) of them
+func (rt *Router) handleTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := 100
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var minMs float64
+	if v := query.Get("min_ms"); v != "" {
+		var err error
+		if minMs, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, "Invalid min_ms", http.StatusBadRequest)
+			return
+		}
+	}
+
+	traces := []*requestTrace{}
+	for _, p := range rt.proxies() {
+		if p.traces == nil {
+			continue
+		}
+		for _, t := range p.traces.recent() {
+			if (query.Get("id") == "" || t.ID == query.Get("id")) &&
+				(query.Get("method") == "" || t.Method == query.Get("method")) &&
+				(query.Get("tenant") == "" || t.Tenant == query.Get("tenant")) &&
+				t.TotalMs >= minMs {
+				traces = append(traces, t)
+			}
+		}
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].Time.After(traces[j].Time) })
+	if len(traces) > limit {
+		traces = traces[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"traces": traces})
+}
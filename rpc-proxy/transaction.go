@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// errShortTransaction is returned for transactions cut off mid-field
+var errShortTransaction = errors.New("transaction too short")
+
+// errInvalidLength is returned for a malformed compact-u16 length
+var errInvalidLength = errors.New("invalid compact-u16 length")
+
+// txReader reads the fields of a wire-format transaction
+type txReader struct {
+	data []byte
+	err  error
+}
+
+// take returns the next n bytes. After an error it returns nil, keeping the
+// first error.
+func (r *txReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = errShortTransaction
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// u8 returns the next byte
+func (r *txReader) u8() int {
+	if b := r.take(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+// length returns a compact-u16 length: 7 bits per byte, low bits first,
+// the high bit set on all but the last byte. Like the node, it refuses
+// values over 0xffff and encodings with a redundant zero byte.
+func (r *txReader) length() int {
+	n := 0
+	for shift := 0; shift < 21; shift += 7 {
+		b := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		if b == 0 && shift > 0 {
+			break // alias of a shorter encoding
+		}
+		n |= (b & 0x7f) << shift
+		if b&0x80 == 0 {
+			if n > 0xffff {
+				break
+			}
+			return n
+		}
+	}
+	r.err = errInvalidLength
+	return 0
+}
+
+// keys returns n base58-encoded 32-byte keys
+func (r *txReader) keys(n int) []string {
+	keys := make([]string, 0, min(n, len(r.data)/32))
+	for i := 0; i < n && r.err == nil; i++ {
+		keys = append(keys, base58Encode(r.take(32)))
+	}
+	return keys
+}
+
+// indexes returns a compact-u16 prefixed array of account indexes
+func (r *txReader) indexes() []int {
+	raw := r.take(r.length())
+	indexes := make([]int, len(raw))
+	for i, b := range raw {
+		indexes[i] = int(b)
+	}
+	return indexes
+}
+
+// The node's json encoding of a transaction. Fields are in the node's order.
+type uiTransaction struct {
+	Signatures []string  `json:"signatures"`
+	Message    uiMessage `json:"message"`
+}
+
+type uiMessage struct {
+	Header              uiMessageHeader         `json:"header"`
+	AccountKeys         []string                `json:"accountKeys"`
+	RecentBlockhash     string                  `json:"recentBlockhash"`
+	Instructions        []uiInstruction         `json:"instructions"`
+	AddressTableLookups *[]uiAddressTableLookup `json:"addressTableLookups,omitempty"` // versioned messages only
+}
+
+type uiMessageHeader struct {
+	NumRequiredSignatures       int `json:"numRequiredSignatures"`
+	NumReadonlySignedAccounts   int `json:"numReadonlySignedAccounts"`
+	NumReadonlyUnsignedAccounts int `json:"numReadonlyUnsignedAccounts"`
+}
+
+type uiInstruction struct {
+	ProgramIDIndex int    `json:"programIdIndex"`
+	Accounts       []int  `json:"accounts"`
+	Data           string `json:"data"`
+	StackHeight    *int   `json:"stackHeight"` // always null for top-level instructions
+}
+
+type uiAddressTableLookup struct {
+	AccountKey      string `json:"accountKey"`
+	WritableIndexes []int  `json:"writableIndexes"`
+	ReadonlyIndexes []int  `json:"readonlyIndexes"`
+}
+
+// jsonTransaction decodes a wire-format transaction into the node's json
+// encoding of it
+func jsonTransaction(data []byte) (json.RawMessage, error) {
+	tx, err := decodeTransaction(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tx)
+}
+
+// decodeTransaction decodes a wire-format transaction
+func decodeTransaction(data []byte) (*uiTransaction, error) {
+	r := &txReader{data: data}
+	var tx uiTransaction
+	count := r.length()
+	tx.Signatures = make([]string, 0, min(count, len(r.data)/64))
+	for i := 0; i < count && r.err == nil; i++ {
+		tx.Signatures = append(tx.Signatures, base58Encode(r.take(64)))
+	}
+
+	// Versioned messages start with 0x80 | version
+	versioned := len(r.data) > 0 && r.data[0]&0x80 != 0
+	if versioned {
+		if version := r.u8() & 0x7f; version != 0 {
+			return nil, errors.New("unsupported transaction version")
+		}
+	}
+	m := &tx.Message
+	m.Header = uiMessageHeader{r.u8(), r.u8(), r.u8()}
+	m.AccountKeys = r.keys(r.length())
+	m.RecentBlockhash = base58Encode(r.take(32))
+	count = r.length()
+	m.Instructions = make([]uiInstruction, 0, min(count, len(r.data)))
+	for i := 0; i < count && r.err == nil; i++ {
+		ix := uiInstruction{ProgramIDIndex: r.u8(), Accounts: r.indexes()}
+		ix.Data = base58Encode(r.take(r.length()))
+		m.Instructions = append(m.Instructions, ix)
+	}
+	if versioned {
+		count = r.length()
+		lookups := make([]uiAddressTableLookup, 0, min(count, len(r.data)/32))
+		for i := 0; i < count && r.err == nil; i++ {
+			lookup := uiAddressTableLookup{AccountKey: base58Encode(r.take(32))}
+			lookup.WritableIndexes = r.indexes()
+			lookup.ReadonlyIndexes = r.indexes()
+			lookups = append(lookups, lookup)
+		}
+		m.AddressTableLookups = &lookups
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &tx, nil
+}
+
+// programs returns the programs a transaction's instructions invoke, in
+// order of first use. Programs are always static account keys.
+func (tx *uiTransaction) programs() ([]string, error) {
+	var programs []string
+	seen := make(map[int]bool)
+	for _, ix := range tx.Message.Instructions {
+		if ix.ProgramIDIndex >= len(tx.Message.AccountKeys) {
+			return nil, errors.New("program index out of range")
+		}
+		if !seen[ix.ProgramIDIndex] {
+			seen[ix.ProgramIDIndex] = true
+			programs = append(programs, tx.Message.AccountKeys[ix.ProgramIDIndex])
+		}
+	}
+	return programs, nil
+}
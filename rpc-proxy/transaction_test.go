@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Keys used by the test transactions
+var (
+	testPayer   = bytes.Repeat([]byte{0}, 32)
+	testProgram = bytes.Repeat([]byte{1}, 32)
+	testTable   = bytes.Repeat([]byte{2}, 32)
+	testHash    = bytes.Repeat([]byte{3}, 32)
+	testSig     = bytes.Repeat([]byte{4}, 64)
+)
+
+// testMessage returns a message with one signer, one program and one
+// instruction invoking the program on the signer with data 1, 2, 3
+func testMessage(versioned bool) []byte {
+	var m []byte
+	if versioned {
+		m = append(m, 0x80)
+	}
+	m = append(m, 1, 0, 1) // header
+	m = append(m, 2)       // account keys
+	m = append(m, testPayer...)
+	m = append(m, testProgram...)
+	m = append(m, testHash...)
+	m = append(m, 1)          // instructions
+	m = append(m, 1, 1, 0)    // program index, accounts [0]
+	m = append(m, 3, 1, 2, 3) // data
+	if versioned {
+		m = append(m, 1) // address table lookups
+		m = append(m, testTable...)
+		m = append(m, 1, 0)    // writable [0]
+		m = append(m, 2, 1, 2) // readonly [1, 2]
+	}
+	return m
+}
+
+func testTransaction(versioned bool) []byte {
+	tx := append([]byte{1}, testSig...)
+	return append(tx, testMessage(versioned)...)
+}
+
+func TestDecodeTransaction(t *testing.T) {
+	legacy := &uiTransaction{
+		Signatures: []string{base58Encode(testSig)},
+		Message: uiMessage{
+			Header:          uiMessageHeader{1, 0, 1},
+			AccountKeys:     []string{strings.Repeat("1", 32), base58Encode(testProgram)},
+			RecentBlockhash: base58Encode(testHash),
+			Instructions: []uiInstruction{
+				{ProgramIDIndex: 1, Accounts: []int{0}, Data: base58Encode([]byte{1, 2, 3})},
+			},
+		},
+	}
+	v0 := *legacy
+	v0.Message.AddressTableLookups = &[]uiAddressTableLookup{
+		{AccountKey: base58Encode(testTable), WritableIndexes: []int{0}, ReadonlyIndexes: []int{1, 2}},
+	}
+
+	unsupported := testTransaction(true)
+	unsupported[65] = 0x81
+
+	tests := []struct {
+		name string
+		data []byte
+		want *uiTransaction
+		err  error
+	}{
+		{name: "legacy", data: testTransaction(false), want: legacy},
+		{name: "v0", data: testTransaction(true), want: &v0},
+		{name: "empty", data: nil, err: errShortTransaction},
+		{name: "truncated signature", data: testTransaction(false)[:40], err: errShortTransaction},
+		{name: "truncated message", data: testTransaction(false)[:100], err: errShortTransaction},
+		{name: "truncated instruction data", data: testTransaction(false)[:len(testTransaction(false))-1], err: errShortTransaction},
+		{name: "truncated lookups", data: testTransaction(true)[:len(testTransaction(true))-2], err: errShortTransaction},
+		{name: "unsupported version", data: unsupported},
+		{name: "signature count over 0xffff", data: []byte{0xff, 0xff, 0x04}, err: errInvalidLength},
+		{name: "signature count over three bytes", data: []byte{0x80, 0x80, 0x80, 0x01}, err: errInvalidLength},
+		{name: "signature count alias", data: []byte{0x81, 0x00}, err: errInvalidLength},
+		{name: "huge signature count", data: []byte{0xff, 0xff, 0x03}, err: errShortTransaction},
+		{name: "huge instruction count", data: append(testTransaction(false)[:1+64+3+1+64+32], 0xff, 0xff, 0x03), err: errShortTransaction},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeTransaction(tt.data)
+			if tt.want != nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("got %+v, want %+v", got, tt.want)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("decoded %+v, want an error", got)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTxReaderLength(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want int
+		err  error
+	}{
+		{data: []byte{0x00}, want: 0},
+		{data: []byte{0x7f}, want: 0x7f},
+		{data: []byte{0x80, 0x01}, want: 0x80},
+		{data: []byte{0xff, 0x7f}, want: 0x3fff},
+		{data: []byte{0x80, 0x80, 0x01}, want: 0x4000},
+		{data: []byte{0xff, 0xff, 0x03}, want: 0xffff},
+		{data: []byte{0x80, 0x80, 0x04}, err: errInvalidLength},
+		{data: []byte{0xff, 0xff, 0x7f}, err: errInvalidLength},
+		{data: []byte{0x80, 0x80, 0x80, 0x00}, err: errInvalidLength},
+		{data: []byte{0x80, 0x00}, err: errInvalidLength},
+		{data: []byte{0xff, 0x80, 0x00}, err: errInvalidLength},
+		{data: []byte{0x80}, err: errShortTransaction},
+		{data: nil, err: errShortTransaction},
+	}
+	for _, tt := range tests {
+		r := &txReader{data: tt.data}
+		got := r.length()
+		if r.err != tt.err {
+			t.Errorf("length(% x): error %v, want %v", tt.data, r.err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("length(% x) = %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestTransactionPrograms(t *testing.T) {
+	tx, err := decodeTransaction(testTransaction(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	programs, err := tx.programs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{base58Encode(testProgram)}; !reflect.DeepEqual(programs, want) {
+		t.Fatalf("programs = %v, want %v", programs, want)
+	}
+
+	// A program index past the static keys, e.g. into a lookup table, is
+	// refused rather than guessed
+	tx.Message.Instructions[0].ProgramIDIndex = 2
+	if _, err := tx.programs(); err == nil {
+		t.Fatal("want an error for a program index out of range")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransportConfig tunes the connection pool to an upstream. Every upstream
+// has its own pool; zero fields keep the defaults (or the top-level
+// upstream_transport), so a per-upstream transport only lists what differs.
+type TransportConfig struct {
+	MaxIdleConns        int      `json:"max_idle_conns"`        // idle connections kept for reuse, default 100
+	MaxConnsPerHost     int      `json:"max_conns_per_host"`    // connections at once, 0 = unlimited; requests over it wait for a free connection
+	IdleConnTimeout     Duration `json:"idle_conn_timeout"`     // close connections idle this long, default 90s
+	TLSHandshakeTimeout Duration `json:"tls_handshake_timeout"` // default 10s
+	DialTimeout         Duration `json:"dial_timeout"`          // TCP connect timeout, default 30s
+	KeepAlive           Duration `json:"keep_alive"`            // TCP keep-alive probe interval, default 30s
+	DisableKeepAlives   bool     `json:"disable_keep_alives"`   // open a new connection for every request
+}
+
+func defaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:        100,
+		IdleConnTimeout:     Duration{90 * time.Second},
+		TLSHandshakeTimeout: Duration{10 * time.Second},
+		DialTimeout:         Duration{30 * time.Second},
+		KeepAlive:           Duration{30 * time.Second},
+	}
+}
+
+// merge returns t with the non-zero fields of o applied
+func (t TransportConfig) merge(o *TransportConfig) TransportConfig {
+	if o == nil {
+		return t
+	}
+	if o.MaxIdleConns > 0 {
+		t.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	if o.IdleConnTimeout.Duration > 0 {
+		t.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.TLSHandshakeTimeout.Duration > 0 {
+		t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	}
+	if o.DialTimeout.Duration > 0 {
+		t.DialTimeout = o.DialTimeout
+	}
+	if o.KeepAlive.Duration > 0 {
+		t.KeepAlive = o.KeepAlive
+	}
+	if o.DisableKeepAlives {
+		t.DisableKeepAlives = true
+	}
+	return t
+}
+
+// connStats tracks the utilization of an upstream's connection pool
+type connStats struct {
+	open     atomic.Int64 // TCP connections currently open
+	opened   atomic.Int64 // connections opened since start
+	inFlight atomic.Int64 // requests sent and not yet fully read
+	reused   atomic.Int64 // requests sent on an existing connection
+
+	trace *httptrace.ClientTrace
+}
+
+func newConnStats() *connStats {
+	s := &connStats{}
+	s.trace = &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				s.reused.Add(1)
+			}
+		},
+	}
+	return s
+}
+
+// dial wraps a dial function to count the connections it opens
+func (s *connStats) dial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		s.opened.Add(1)
+		s.open.Add(1)
+		return &countedConn{Conn: conn, stats: s}, nil
+	}
+}
+
+// do sends req with client, counting it as in flight until its response
+// body is closed
+func (s *connStats) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	s.inFlight.Add(1)
+	resp, err := client.Do(req)
+	if err != nil {
+		s.inFlight.Add(-1)
+		return nil, err
+	}
+	resp.Body = &inFlightBody{ReadCloser: resp.Body, stats: s}
+	return resp, nil
+}
+
+func (s *connStats) snapshot(maxConns int) map[string]interface{} {
+	return map[string]interface{}{
+		"open":               s.open.Load(),
+		"opened":             s.opened.Load(),
+		"in_flight":          s.inFlight.Load(),
+		"reused":             s.reused.Load(),
+		"max_conns_per_host": maxConns,
+	}
+}
+
+// resetCounters zeroes the cumulative counts, leaving the open and in
+// flight gauges alone
+func (s *connStats) resetCounters() {
+	s.opened.Store(0)
+	s.reused.Store(0)
+}
+
+// countedConn decrements the open count when the connection closes
+type countedConn struct {
+	net.Conn
+	stats *connStats
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.stats.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// inFlightBody ends a request's in-flight period when its body is closed
+type inFlightBody struct {
+	io.ReadCloser
+	stats *connStats
+	once  sync.Once
+}
+
+func (b *inFlightBody) Close() error {
+	b.once.Do(func() { b.stats.inFlight.Add(-1) })
+	return b.ReadCloser.Close()
+}
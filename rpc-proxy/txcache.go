@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// txSubmittedWindow is how long a signature sent through the proxy counts
+// as recently submitted, about the lifetime of a blockhash
+const txSubmittedWindow = 90 * time.Second
+
+// txCache answers getSignatureStatuses and getTransaction for recent
+// signatures from memory. Bots poll the status of their transactions every
+// 400ms after submitting; with several of them behind the proxy most polls
+// can be served without reaching the upstream.
+//
+// Finalized statuses and transactions never change and are kept until
+// evicted. Other answers are reused for ttl, and "not found" only for
+// signatures submitted through the proxy, so an unrelated lookup can't
+// hide a transaction that has since landed.
+type txCache struct {
+	ttl      time.Duration
+	maxBytes int64
+	hits     atomic.Int64
+	misses   atomic.Int64
+
+	mu    sync.Mutex
+	bytes int64
+	order *list.List // of *txCacheEntry, most recent first
+	index map[string]*list.Element
+}
+
+type txCacheEntry struct {
+	key     string
+	data    json.RawMessage // status or transaction, nil for a submitted marker
+	slot    uint64          // context slot of a status
+	expires time.Time       // zero = until evicted
+}
+
+// newTxCache returns nil when caching is disabled
+func newTxCache(ttl time.Duration, maxBytes int64) *txCache {
+	if ttl <= 0 || maxBytes <= 0 {
+		return nil
+	}
+	return &txCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+// txCached reports whether the method's answers are cached
+func txCached(method string) bool {
+	return method == "getSignatureStatuses" || method == "getTransaction"
+}
+
+// lookup returns the cached result of a getSignatureStatuses or
+// getTransaction request, if every signature it asks for is cached
+func (c *txCache) lookup(method string, params json.RawMessage) (json.RawMessage, bool) {
+	var result json.RawMessage
+	var ok bool
+	now := time.Now()
+	switch method {
+	case "getSignatureStatuses":
+		result, ok = c.lookupStatuses(params, now)
+	case "getTransaction":
+		var key string
+		if key, ok = txKey(params); ok {
+			var entry *txCacheEntry
+			entry, ok = c.get("tx:"+key, now)
+			if ok && bytes.Equal(entry.data, []byte("null")) && !c.submitted(txSignature(params), now) {
+				ok = false
+			}
+			if ok {
+				result = entry.data
+			}
+		}
+	}
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return result, ok
+}
+
+// lookupStatuses builds a getSignatureStatuses result from cached statuses
+func (c *txCache) lookupStatuses(params json.RawMessage, now time.Time) (json.RawMessage, bool) {
+	var args []json.RawMessage
+	var signatures []string
+	if json.Unmarshal(params, &args) != nil || len(args) == 0 || json.Unmarshal(args[0], &signatures) != nil || len(signatures) == 0 {
+		return nil, false
+	}
+
+	var slot uint64
+	statuses := make([]json.RawMessage, len(signatures))
+	for i, signature := range signatures {
+		entry, ok := c.get("status:"+signature, now)
+		if !ok || (bytes.Equal(entry.data, []byte("null")) && !c.submitted(signature, now)) {
+			return nil, false
+		}
+		statuses[i] = entry.data
+		if entry.slot > slot {
+			slot = entry.slot
+		}
+	}
+
+	result, err := json.Marshal(map[string]interface{}{
+		"context": map[string]uint64{"slot": slot},
+		"value":   statuses,
+	})
+	return result, err == nil
+}
+
+// store caches the answer to a request
+func (c *txCache) store(method string, params json.RawMessage, body []byte) {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *JSONRPCError   `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error != nil || resp.Result == nil {
+		return
+	}
+	now := time.Now()
+
+	switch method {
+	case "sendTransaction":
+		var signature string
+		if json.Unmarshal(resp.Result, &signature) == nil && signature != "" {
+			c.put(&txCacheEntry{key: "sent:" + signature, expires: now.Add(txSubmittedWindow)})
+		}
+
+	case "getSignatureStatuses":
+		var args []json.RawMessage
+		var signatures []string
+		var result struct {
+			Context struct {
+				Slot uint64 `json:"slot"`
+			} `json:"context"`
+			Value []json.RawMessage `json:"value"`
+		}
+		if json.Unmarshal(params, &args) != nil || len(args) == 0 || json.Unmarshal(args[0], &signatures) != nil ||
+			json.Unmarshal(resp.Result, &result) != nil || len(result.Value) != len(signatures) {
+			return
+		}
+		for i, signature := range signatures {
+			status := result.Value[i]
+			if bytes.Equal(status, []byte("null")) && !c.submitted(signature, now) {
+				continue
+			}
+			var s struct {
+				ConfirmationStatus string `json:"confirmationStatus"`
+			}
+			json.Unmarshal(status, &s)
+			entry := &txCacheEntry{key: "status:" + signature, data: status, slot: result.Context.Slot, expires: now.Add(c.ttl)}
+			if s.ConfirmationStatus == "finalized" {
+				entry.expires = time.Time{}
+			}
+			c.put(entry)
+		}
+
+	case "getTransaction":
+		key, ok := txKey(params)
+		if !ok {
+			return
+		}
+		if bytes.Equal(resp.Result, []byte("null")) && !c.submitted(txSignature(params), now) {
+			return
+		}
+		entry := &txCacheEntry{key: "tx:" + key, data: resp.Result, expires: now.Add(c.ttl)}
+		if !bytes.Equal(resp.Result, []byte("null")) && txFinalized(params) {
+			entry.expires = time.Time{}
+		}
+		c.put(entry)
+	}
+}
+
+// txKey returns the cache key of a getTransaction request: the signature
+// and its config, which selects the encoding
+func txKey(params json.RawMessage) (string, bool) {
+	var compact bytes.Buffer
+	if json.Compact(&compact, params) != nil {
+		return "", false
+	}
+	return compact.String(), txSignature(params) != ""
+}
+
+// txSignature returns the signature of a getTransaction request
+func txSignature(params json.RawMessage) string {
+	var args []json.RawMessage
+	var signature string
+	if json.Unmarshal(params, &args) == nil && len(args) > 0 {
+		json.Unmarshal(args[0], &signature)
+	}
+	return signature
+}
+
+// txFinalized reports whether a getTransaction request asks for a finalized
+// transaction, the default
+func txFinalized(params json.RawMessage) bool {
+	var args []json.RawMessage
+	var config struct {
+		Commitment string `json:"commitment"`
+	}
+	if json.Unmarshal(params, &args) == nil && len(args) > 1 {
+		json.Unmarshal(args[1], &config)
+	}
+	return parseCommitment(config.Commitment) == commitmentFinalized
+}
+
+// submitted reports whether a signature was recently sent through the proxy
+func (c *txCache) submitted(signature string, now time.Time) bool {
+	_, ok := c.get("sent:"+signature, now)
+	return ok
+}
+
+// get returns an unexpired entry
+func (c *txCache) get(key string, now time.Time) (*txCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*txCacheEntry)
+	if !entry.expires.IsZero() && now.After(entry.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry, true
+}
+
+// put adds or replaces an entry, evicting the least recently used ones
+// beyond maxBytes
+func (c *txCache) put(entry *txCacheEntry) {
+	size := int64(len(entry.key) + len(entry.data))
+	if size > c.maxBytes/4 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.index[entry.key]; ok {
+		c.remove(el)
+	}
+	c.index[entry.key] = c.order.PushFront(entry)
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an entry; c.mu must be held
+func (c *txCache) remove(el *list.Element) {
+	entry := el.Value.(*txCacheEntry)
+	c.order.Remove(el)
+	delete(c.index, entry.key)
+	c.bytes -= int64(len(entry.key) + len(entry.data))
+}
+
+// snapshot returns the cache statistics for /metrics
+func (c *txCache) snapshot() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"hits":      c.hits.Load(),
+		"misses":    c.misses.Load(),
+		"entries":   c.order.Len(),
+		"bytes":     c.bytes,
+		"max_bytes": c.maxBytes,
+	}
+}
+
+// resetCounters zeroes the hit and miss counts for /admin/metrics/reset
+func (c *txCache) resetCounters() {
+	if c == nil {
+		return
+	}
+	c.hits.Store(0)
+	c.misses.Store(0)
+}
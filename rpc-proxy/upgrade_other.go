@@ -0,0 +1,21 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func inheritedListeners() map[string]net.Listener {
+	return nil
+}
+
+// watchUpgrade is a no-op: listener handoff needs unix fd passing
+func watchUpgrade(listeners []*proxyListener) {}
+
+func upgrade(listeners []*proxyListener) error {
+	return errors.New("restarting in place needs unix fd passing")
+}
+
+func notifyUpgradeParent(router *Router, listeners []*proxyListener) {}
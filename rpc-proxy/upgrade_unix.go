@@ -0,0 +1,188 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// inheritedFDsEnv lists the addresses of listeners passed as fds 3, 4, ...
+	inheritedFDsEnv = "RPC_PROXY_INHERITED_FDS"
+	// upgradeParentEnv holds the pid of the process handing over its listeners
+	upgradeParentEnv = "RPC_PROXY_UPGRADE_PARENT"
+
+	// upgradeReadyTimeout bounds how long a new process waits for its
+	// upstream and warm-up before taking over anyway
+	upgradeReadyTimeout = 2 * time.Minute
+)
+
+// upgrading is set while an upgraded process is starting, until it takes
+// over or fails
+var upgrading atomic.Bool
+
+var errUpgradeInFlight = errors.New("an upgrade is already in progress")
+
+// inheritedListeners returns the listeners handed over by a parent process
+// during a zero-downtime upgrade, keyed by address
+func inheritedListeners() map[string]net.Listener {
+	addrs := os.Getenv(inheritedFDsEnv)
+	if addrs == "" {
+		return nil
+	}
+	os.Unsetenv(inheritedFDsEnv)
+
+	inherited := make(map[string]net.Listener)
+	for i, addr := range strings.Split(addrs, ",") {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("[ERROR] Failed to inherit listener %s: %v", addr, err)
+			continue
+		}
+		inherited[addr] = ln
+	}
+	return inherited
+}
+
+// watchUpgrade starts a new copy of the binary on SIGUSR2, handing it the
+// listening sockets. Once the new process is serving and ready it stops this
+// one, which then drains in-flight requests through the normal graceful
+// shutdown. Further SIGUSR2s are ignored while an upgrade is in flight.
+func watchUpgrade(listeners []*proxyListener) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+
+	for range sigChan {
+		if upgrading.Load() {
+			log.Println("Received SIGUSR2, ignoring it while an upgrade is in progress")
+			continue
+		}
+		log.Println("Received SIGUSR2, starting upgraded process...")
+		if err := upgrade(listeners); err != nil {
+			log.Printf("[ERROR] Upgrade failed, continuing to serve: %v", err)
+		}
+	}
+}
+
+// upgrade execs the current binary with the listeners as extra files
+func upgrade(listeners []*proxyListener) (err error) {
+	if !upgrading.CompareAndSwap(false, true) {
+		return errUpgradeInFlight
+	}
+	defer func() {
+		if err != nil {
+			upgrading.Store(false)
+		}
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	var addrs []string
+	for _, l := range listeners {
+		var f *os.File
+		switch ln := l.ln.(type) {
+		case *net.TCPListener:
+			f, err = ln.File()
+		case *net.UnixListener:
+			// The new process owns the socket path now
+			ln.SetUnlinkOnClose(false)
+			f, err = ln.File()
+		default:
+			err = fmt.Errorf("listener type %T can't be handed over", l.ln)
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return fmt.Errorf("%s: %w", l.config.Addr, err)
+		}
+		files = append(files, f)
+		addrs = append(addrs, l.config.Addr)
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	env := append(os.Environ(),
+		inheritedFDsEnv+"="+strings.Join(addrs, ","),
+		upgradeParentEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Started upgraded process (pid %d)", proc.Pid)
+	go func() {
+		// Reap the child if it fails before taking over
+		state, err := proc.Wait()
+		if err == nil && !state.Success() {
+			log.Printf("[ERROR] Upgraded process exited: %v", state)
+		}
+		// Taking over ends this process, so the child exiting first means
+		// it failed and another upgrade may be tried
+		upgrading.Store(false)
+	}()
+	return nil
+}
+
+// notifyUpgradeParent tells the process that handed over the listeners that
+// this one is serving and ready, so it can drain and exit. Until then both
+// accept connections on the shared sockets.
+func notifyUpgradeParent(router *Router, listeners []*proxyListener) {
+	pid, err := strconv.Atoi(os.Getenv(upgradeParentEnv))
+	if err != nil || pid <= 0 {
+		return
+	}
+	os.Unsetenv(upgradeParentEnv)
+
+	for _, l := range listeners {
+		<-l.serving
+	}
+	p := router.defaultProxy
+	deadline := time.Now().Add(upgradeReadyTimeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := p.checkUpstream(ctx)
+		cancel()
+		if err == nil {
+			err = p.checkWarm()
+		}
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("[WARN] Not ready after %v, taking over anyway: %v", upgradeReadyTimeout, err)
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	log.Printf("Taking over from pid %d", pid)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		log.Printf("[ERROR] Failed to stop previous process %d: %v", pid, err)
+	}
+}
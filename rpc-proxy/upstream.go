@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamConfig describes a single upstream RPC endpoint in a pool
+type UpstreamConfig struct {
+	Name     string        `json:"name"`
+	URL      string        `json:"url"`
+	Fallback bool          `json:"fallback"` // only used when the other upstreams are down or over budget
+	Budget   *BudgetConfig `json:"budget"`   // provider plan allowance, nil = unlimited
+
+	MaxConcurrency int `json:"max_concurrency"` // requests in flight at once, overriding upstream_max_concurrency, -1 = unlimited
+
+	Transport *TransportConfig `json:"transport"` // connection pool settings, overriding upstream_transport
+}
+
+// upstream is a single upstream RPC endpoint
+type upstream struct {
+	name    string
+	url     string
+	genesis atomic.Int32  // genesisUnverified, genesisMatched or genesisMismatched
+	slot    atomic.Uint64 // highest slot seen with slot_consistency, 0 = unknown
+
+	ledgerFirst atomic.Int64 // first slot whose block the upstream serves, -1 = unknown
+	catchingUp  atomic.Bool  // routed after the fallbacks while the supervisor finds it behind
+
+	client   *http.Client
+	conns    *connStats
+	maxConns int // max_conns_per_host, 0 = unlimited
+
+	boundaryClient *http.Client // with epoch_boundary_timeout, nil = none
+
+	fallback bool
+	budget   *upstreamBudget // nil = unlimited
+
+	concurrency *concurrencyCap // nil = unlimited
+	latency     *upstreamLatency
+	sli         *sliTracker // nil = enable_sla off
+
+	throttledUntil atomic.Int64 // unix nanoseconds, set when the upstream returns 429
+
+	requests atomic.Int64 // requests forwarded
+	failures atomic.Int64 // transport errors and 5xx responses
+}
+
+// upstreamPool balances requests across a set of upstreams
+type upstreamPool struct {
+	upstreams       []*upstream
+	next            atomic.Uint32
+	expectedGenesis string // only route to upstreams verified to serve this cluster
+
+	throttleDefault time.Duration // back-off after a 429 without Retry-After
+	throttleMax     time.Duration // longest back-off honoured, 0 = no cap
+	queueTimeout    time.Duration // longest wait for a max_concurrency slot
+
+	latencyRouting bool          // prefer the faster of two upstreams for each request
+	failurePenalty time.Duration // latency counted for a failed request
+
+	affinity   *affinityTable  // nil = no session affinity
+	watermarks *slotWatermarks // nil = neither slot consistency nor minContextSlot injection
+
+	ledgerAvailability bool // route block reads to upstreams holding the slot, see ledger_check_interval
+
+	epochBoundary atomic.Bool // an epoch boundary is near, so requests get epoch_boundary_timeout
+}
+
+// newUpstreamPool builds the pool for a config. When no explicit upstreams are
+// configured, the pool contains just UpstreamURL.
+func newUpstreamPool(config *Config) (*upstreamPool, error) {
+	pool := &upstreamPool{
+		expectedGenesis: config.ExpectedGenesisHash,
+		throttleDefault: config.UpstreamThrottleDefault.Duration,
+		throttleMax:     config.UpstreamThrottleMax.Duration,
+		queueTimeout:    config.UpstreamQueueTimeout.Duration,
+		latencyRouting:  config.LatencyRouting,
+		failurePenalty:  config.Timeout.Duration,
+
+		ledgerAvailability: config.LedgerCheckInterval.Duration > 0,
+	}
+	if pool.queueTimeout <= 0 {
+		pool.queueTimeout = config.Timeout.Duration
+	}
+
+	upstreams := config.Upstreams
+	if len(upstreams) == 0 {
+		upstreams = []UpstreamConfig{{Name: "primary", URL: config.UpstreamURL, Budget: config.UpstreamBudget}}
+	}
+
+	for i, uc := range upstreams {
+		name := uc.Name
+		if name == "" {
+			name = fmt.Sprintf("upstream-%d", i)
+		}
+		budget, err := newUpstreamBudget(uc.Budget)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", name, err)
+		}
+		tc := defaultTransportConfig().merge(config.UpstreamTransport).merge(uc.Transport)
+		if config.UpstreamHTTP2 == "h2c" && tc.MaxConnsPerHost > 0 {
+			log.Printf("[WARN] Upstream %s: max_conns_per_host is ignored with upstream_http2 h2c", name)
+			tc.MaxConnsPerHost = 0
+		}
+		conns := newConnStats()
+		transport, err := newUpstreamTransport(config, tc, conns)
+		if err != nil {
+			return nil, err
+		}
+		maxConcurrency := uc.MaxConcurrency
+		if maxConcurrency == 0 {
+			maxConcurrency = config.UpstreamMaxConcurrency
+		}
+		pool.upstreams = append(pool.upstreams, &upstream{
+			name:        name,
+			url:         uc.URL,
+			client:      &http.Client{Timeout: config.Timeout.Duration, Transport: transport},
+			conns:       conns,
+			maxConns:    tc.MaxConnsPerHost,
+			fallback:    uc.Fallback,
+			budget:      budget,
+			concurrency: newConcurrencyCap(maxConcurrency),
+			latency:     newUpstreamLatency(),
+			sli:         newSLITracker(config),
+		})
+		u := pool.upstreams[len(pool.upstreams)-1]
+		u.ledgerFirst.Store(-1)
+		if timeout := config.EpochBoundaryTimeout.Duration; timeout > 0 && config.EpochTracking {
+			u.boundaryClient = &http.Client{Timeout: timeout, Transport: transport}
+		}
+	}
+	if len(pool.upstreams) > 1 {
+		pool.affinity = newAffinityTable(config.SessionAffinity.Duration, config.MaxAffinityClients)
+	}
+	if (config.SlotConsistency && len(pool.upstreams) > 1) || config.InjectMinContextSlot {
+		pool.watermarks = newSlotWatermarks()
+	}
+
+	return pool, nil
+}
+
+// order returns the upstreams in the order they should be tried for the next
+// request (round robin start, remaining upstreams as failover)
+func (p *upstreamPool) order() []*upstream {
+	n := len(p.upstreams)
+	if n == 1 {
+		return p.upstreams
+	}
+
+	start := int(p.next.Add(1)-1) % n
+	ordered := make([]*upstream, 0, n)
+	for i := 0; i < n; i++ {
+		ordered = append(ordered, p.upstreams[(start+i)%n])
+	}
+	return ordered
+}
+
+// observeLatency measures an upstream's answer to a request for latency
+// routing and the SLA report. For routing, failures count as slow as a
+// timeout, so a broken upstream that fails fast doesn't win. 429s and
+// requests the client cancelled aren't counted.
+func (p *upstreamPool) observeLatency(ctx context.Context, u *upstream, method string, sent time.Time, resp *http.Response, err error) {
+	now := time.Now()
+	switch {
+	case ctx.Err() != nil:
+	case err != nil || resp.StatusCode >= 500:
+		u.latency.observe(method, max(now.Sub(sent), p.failurePenalty), now)
+		u.sli.record(now, now.Sub(sent), true)
+	case resp.StatusCode != http.StatusTooManyRequests:
+		u.latency.observe(method, now.Sub(sent), now)
+		u.sli.record(now, now.Sub(sent), false)
+	}
+}
+
+// forward sends the body to the pool, failing over to the next upstream on
+// transport errors and 429s. Upstreams serving the wrong cluster are skipped,
+// upstreams over budget are tried last or not at all (see candidates), and
+// upstreams that returned 429 are skipped until their Retry-After expires.
+// If every upstream is throttled the error is a *throttledError. header holds
+// the client headers to pass on. If timing is non-nil it receives the timing
+// breakdown of the last attempt. With latency routing the faster of two
+// upstreams for hint.method goes first, with session affinity the client's
+// pinned upstream, with the slot consistency guard upstreams that have
+// caught up with hint.minSlot, and with ledger availability upstreams whose
+// ledger reaches back to hint.ledgerSlot.
+func (p *upstreamPool) forward(ctx context.Context, body []byte, header http.Header, timing *upstreamTiming, hint routeHint) (*http.Response, *upstream, error) {
+	lastErr := fmt.Errorf("no upstream within budget")
+	if p.expectedGenesis != "" {
+		lastErr = fmt.Errorf("no upstream verified to serve genesis %s and within budget", p.expectedGenesis)
+	}
+
+	// Drop throttled upstreams, remembering when the first one recovers
+	now := time.Now()
+	var candidates []*upstream
+	var throttled time.Duration
+	for _, u := range p.candidates() {
+		if d := u.throttledFor(now); d > 0 {
+			debugf(debugUpstream, "%s skipped, throttled for %v", u.name, d)
+			if throttled == 0 || d < throttled {
+				throttled = d
+			}
+			continue
+		}
+		candidates = append(candidates, u)
+	}
+	if len(candidates) == 0 && throttled > 0 {
+		return nil, nil, &throttledError{retryAfter: throttled}
+	}
+	if p.latencyRouting {
+		candidates = preferFastest(candidates, hint.method, now)
+	}
+	if pinned := p.affinity.lookup(hint.client, now); pinned != nil {
+		candidates = preferUpstream(candidates, pinned)
+	}
+	candidates = p.watermarks.caughtUp(candidates, hint.minSlot)
+	candidates = p.holding(candidates, hint.ledgerSlot)
+
+	var queued time.Duration
+	for i, u := range candidates {
+		queueStart := time.Now()
+		err := u.concurrency.acquire(ctx, p.queueTimeout)
+		queued += time.Since(queueStart)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", u.name, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		reqCtx := httptrace.WithClientTrace(ctx, u.conns.trace)
+		var attempt *traceTiming
+		if timing != nil {
+			attempt = &traceTiming{}
+			reqCtx = attempt.withTrace(reqCtx)
+		}
+
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, u.url, bytes.NewReader(body))
+		if err != nil {
+			u.concurrency.release()
+			lastErr = err
+			continue
+		}
+
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+
+		sent := time.Now()
+		resp, err := u.conns.do(p.client(u), req)
+		if attempt != nil {
+			*timing = attempt.measured()
+			timing.Queue, timing.Attempts = queued, i+1
+		}
+		if err != nil {
+			u.concurrency.release()
+		} else {
+			resp.Body = u.concurrency.hold(resp.Body)
+		}
+		u.requests.Add(1)
+		p.observeLatency(ctx, u, hint.method, sent, resp, err)
+		if err != nil {
+			debugf(debugUpstream, "%s %s failed after %v: %v", u.name, hint.method, time.Since(sent), err)
+		} else {
+			debugf(debugUpstream, "%s %s answered %d in %v", u.name, hint.method, resp.StatusCode, time.Since(sent))
+		}
+		if err != nil || resp.StatusCode >= 500 {
+			u.failures.Add(1)
+		}
+		if err == nil {
+			if resp.StatusCode != http.StatusTooManyRequests {
+				p.affinity.update(hint.client, u, resp.StatusCode < 500, time.Now())
+				return resp, u, nil
+			}
+
+			// Back off from this upstream, and pass the 429 on only if
+			// there is nowhere else to go
+			p.throttle(u, resp)
+			if i == len(candidates)-1 {
+				return resp, u, nil
+			}
+			discard(resp)
+			continue
+		}
+		lastErr = err
+
+		// Don't fail over once the client has gone away
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, lastErr
+}
+
+// String returns the upstream name for logging
+func (u *upstream) String() string {
+	if u == nil {
+		return "none"
+	}
+	return u.name
+}
+
+// urls returns the upstream URLs in the pool
+func (p *upstreamPool) urls() []string {
+	urls := make([]string, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		urls = append(urls, u.url)
+	}
+	return urls
+}
+
+// snapshot returns the state of each upstream for /metrics
+func (p *upstreamPool) snapshot() []map[string]interface{} {
+	now := time.Now()
+	upstreams := make([]map[string]interface{}, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		snapshot := map[string]interface{}{
+			"name":         u.name,
+			"url":          u.url,
+			"fallback":     u.fallback,
+			"routable":     u.routable(p.expectedGenesis),
+			"throttled_ms": u.throttledFor(now).Milliseconds(),
+			"over_budget":  u.budget.exhausted(),
+			"requests":     u.requests.Load(),
+			"failures":     u.failures.Load(),
+			"connections":  u.conns.snapshot(u.maxConns),
+			"latency_ms":   u.latency.snapshot(),
+		}
+		if u.concurrency != nil {
+			snapshot["concurrency"] = u.concurrency.snapshot()
+		}
+		if p.watermarks != nil {
+			snapshot["slot"] = u.slot.Load()
+		}
+		if first := u.ledgerFirst.Load(); p.ledgerAvailability && first >= 0 {
+			snapshot["first_available_block"] = first
+		}
+		upstreams = append(upstreams, snapshot)
+	}
+	return upstreams
+}
+
+// resetCounters zeroes the request, failure and connection counts of each
+// upstream. Budgets, latency averages and SLA windows are state the routing
+// relies on, so they are kept.
+func (p *upstreamPool) resetCounters() {
+	for _, u := range p.upstreams {
+		u.requests.Store(0)
+		u.failures.Store(0)
+		u.conns.resetCounters()
+		u.concurrency.resetCounters()
+	}
+}
+
+// call sends a single JSON-RPC request to one upstream and decodes the
+// result into result (if non-nil)
+func (p *upstreamPool) call(ctx context.Context, u *upstream, method string, params interface{}, result interface{}) error {
+	reqBody := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method}
+	if params != nil {
+		reqBody["params"] = params
+	}
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := u.concurrency.acquire(ctx, p.queueTimeout); err != nil {
+		return err
+	}
+	defer u.concurrency.release()
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var rpcResp JSONRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("invalid response (status %d): %w", resp.StatusCode, err)
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("%s: %s (code %d)", method, rpcResp.Error.Message, rpcResp.Error.Code)
+	}
+	if result != nil {
+		return json.Unmarshal(rpcResp.Result, result)
+	}
+	return nil
+}
+
+// probe checks that every upstream in the pool answers JSON-RPC
+func (p *upstreamPool) probe(ctx context.Context) error {
+	for _, u := range p.upstreams {
+		if err := p.call(ctx, u, "getVersion", nil, nil); err != nil {
+			return fmt.Errorf("%s: %w", u.name, err)
+		}
+	}
+	return nil
+}
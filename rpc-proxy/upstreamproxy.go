@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// upstreamProxyFunc returns how upstream requests reach the internet. By
+// default HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored; upstream_proxy
+// sends everything through an HTTP CONNECT or SOCKS5 proxy instead, and
+// "direct" ignores the environment.
+func upstreamProxyFunc(config *Config) (func(*http.Request) (*url.URL, error), error) {
+	switch config.UpstreamProxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return nil, nil
+	}
+
+	u, err := url.Parse(config.UpstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("upstream_proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("upstream_proxy: unsupported scheme %q (want http, https or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream_proxy: missing host in %q", u.Redacted())
+	}
+	if config.UpstreamHTTP2 == "h2c" {
+		return nil, fmt.Errorf("upstream_proxy is not supported with upstream_http2 h2c")
+	}
+	return http.ProxyURL(u), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+)
+
+// newUpstreamTLSConfig builds the TLS settings for HTTPS upstreams: extra
+// trusted CAs, a client certificate for mutual TLS and, for lab setups
+// only, skipping verification. It returns nil when none are configured, so
+// the transport keeps Go's defaults.
+func newUpstreamTLSConfig(config *Config) (*tls.Config, error) {
+	if config.UpstreamCAFile == "" && config.UpstreamClientCertFile == "" && config.UpstreamClientKeyFile == "" && !config.UpstreamInsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.UpstreamCAFile != "" {
+		pem, err := os.ReadFile(config.UpstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_ca_file: %w", err)
+		}
+		// Trust the bundle on top of the system roots, so public providers
+		// in the same pool keep working
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("upstream_ca_file: no PEM certificates in %s", config.UpstreamCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.UpstreamClientCertFile != "" || config.UpstreamClientKeyFile != "" {
+		if config.UpstreamClientCertFile == "" || config.UpstreamClientKeyFile == "" {
+			return nil, fmt.Errorf("upstream_client_cert_file and upstream_client_key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.UpstreamClientCertFile, config.UpstreamClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.UpstreamInsecureSkipVerify {
+		log.Printf("[WARN] upstream_insecure_skip_verify is set: upstream TLS certificates are NOT verified and connections can be intercepted. Use upstream_ca_file outside of lab setups.")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
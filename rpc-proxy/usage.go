@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageBuckets is the number of buckets the rolling usage window is split into
+const usageBuckets = 60
+
+// overflowAccount collects usage once MaxUsageAccounts is reached
+const overflowAccount = "_overflow"
+
+// maxUsageMethods is how many methods are counted per account, so clients
+// sending made-up method names can't grow the tracker; the rest are
+// counted as "other"
+const maxUsageMethods = 100
+
+// usageBucket holds usage counters for one slice of the rolling window
+type usageBucket struct {
+	start    time.Time
+	requests int64
+	errors   int64
+	bytesIn  int64
+	bytesOut int64
+	methods  map[string]int64
+}
+
+// usageAccount is the rolling usage of one API key or IP within a tenant
+type usageAccount struct {
+	tenant   string
+	account  string
+	kind     string
+	buckets  [usageBuckets]usageBucket
+	lastSeen time.Time
+}
+
+// usageTracker keeps per-tenant, per-account usage over a rolling window
+type usageTracker struct {
+	mu          sync.Mutex
+	window      time.Duration
+	bucketSize  time.Duration
+	maxAccounts int
+	accounts    map[string]*usageAccount
+}
+
+// UsageSummary is the aggregated usage of one account over the window
+type UsageSummary struct {
+	Tenant    string           `json:"tenant"`
+	Account   string           `json:"account"`
+	Type      string           `json:"type"`
+	Requests  int64            `json:"requests"`
+	Errors    int64            `json:"errors"`
+	ErrorRate float64          `json:"error_rate"`
+	BytesIn   int64            `json:"bytes_in"`
+	BytesOut  int64            `json:"bytes_out"`
+	Methods   map[string]int64 `json:"methods"`
+	LastSeen  time.Time        `json:"last_seen"`
+}
+
+func newUsageTracker(window time.Duration, maxAccounts int) *usageTracker {
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	t := &usageTracker{
+		window:      window,
+		bucketSize:  window / usageBuckets,
+		maxAccounts: maxAccounts,
+		accounts:    make(map[string]*usageAccount),
+	}
+	go t.cleanup()
+	return t
+}
+
+// record adds one request to an account's usage
+func (t *usageTracker) record(tenant, account, kind string, methods []string, bytesIn, bytesOut int64, failed bool) {
+	now := time.Now()
+	start := now.Truncate(t.bucketSize)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := tenant + "|" + account
+	acct, exists := t.accounts[id]
+	if !exists {
+		if t.maxAccounts > 0 && len(t.accounts) >= t.maxAccounts {
+			account, kind = overflowAccount, "overflow"
+			id = tenant + "|" + account
+			acct, exists = t.accounts[id]
+		}
+		if !exists {
+			acct = &usageAccount{tenant: tenant, account: account, kind: kind}
+			t.accounts[id] = acct
+		}
+	}
+	acct.lastSeen = now
+
+	b := &acct.buckets[(start.UnixNano()/int64(t.bucketSize))%usageBuckets]
+	if !b.start.Equal(start) {
+		*b = usageBucket{start: start, methods: make(map[string]int64)}
+	}
+
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	b.bytesIn += bytesIn
+	b.bytesOut += bytesOut
+	for _, m := range methods {
+		addUsageMethod(b.methods, m, 1)
+	}
+}
+
+// addUsageMethod counts n calls of a method, as "other" once maxUsageMethods
+// methods are counted
+func addUsageMethod(methods map[string]int64, method string, n int64) {
+	if _, ok := methods[method]; !ok && len(methods) >= maxUsageMethods {
+		method = "other"
+	}
+	methods[method] += n
+}
+
+// summaries aggregates every account over the window, busiest first
+func (t *usageTracker) summaries() []UsageSummary {
+	cutoff := time.Now().Add(-t.window)
+
+	t.mu.Lock()
+	result := make([]UsageSummary, 0, len(t.accounts))
+	for _, acct := range t.accounts {
+		s := UsageSummary{
+			Tenant:   acct.tenant,
+			Account:  acct.account,
+			Type:     acct.kind,
+			Methods:  make(map[string]int64),
+			LastSeen: acct.lastSeen,
+		}
+		for i := range acct.buckets {
+			b := &acct.buckets[i]
+			if b.start.IsZero() || !b.start.After(cutoff) {
+				continue
+			}
+			s.Requests += b.requests
+			s.Errors += b.errors
+			s.BytesIn += b.bytesIn
+			s.BytesOut += b.bytesOut
+			for m, n := range b.methods {
+				addUsageMethod(s.Methods, m, n)
+			}
+		}
+		if s.Requests == 0 {
+			continue
+		}
+		s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+		result = append(result, s)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Account < result[j].Account
+	})
+	return result
+}
+
+// cleanup drops accounts that have been idle for a full window
+func (t *usageTracker) cleanup() {
+	ticker := time.NewTicker(t.bucketSize)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-t.window)
+		t.mu.Lock()
+		for id, acct := range t.accounts {
+			if acct.lastSeen.Before(cutoff) {
+				delete(t.accounts, id)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// handleUsage serves /admin/usage as JSON, or CSV with ?format=csv
+func (rt *Router) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if rt.usage == nil {
+		http.Error(w, "Usage analytics disabled (set enable_usage)", http.StatusNotFound)
+		return
+	}
+
+	summaries := rt.usage.summaries()
+	if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+		filtered := summaries[:0]
+		for _, s := range summaries {
+			if s.Tenant == tenant {
+				filtered = append(filtered, s)
+			}
+		}
+		summaries = filtered
+	}
+
+	if r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		writeUsageCSV(w, summaries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window":       rt.usage.window.String(),
+		"generated_at": time.Now().UTC(),
+		"accounts":     summaries,
+	})
+}
+
+// writeUsageCSV writes one row per account; the method mix is encoded as
+// method:count pairs separated by semicolons
+func writeUsageCSV(w http.ResponseWriter, summaries []UsageSummary) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=usage.csv")
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"tenant", "account", "type", "requests", "errors", "error_rate", "bytes_in", "bytes_out", "methods", "last_seen"})
+	for _, s := range summaries {
+		methods := make([]string, 0, len(s.Methods))
+		for m, n := range s.Methods {
+			methods = append(methods, fmt.Sprintf("%s:%d", m, n))
+		}
+		sort.Strings(methods)
+
+		cw.Write([]string{
+			s.Tenant,
+			s.Account,
+			s.Type,
+			strconv.FormatInt(s.Requests, 10),
+			strconv.FormatInt(s.Errors, 10),
+			strconv.FormatFloat(s.ErrorRate, 'f', 4, 64),
+			strconv.FormatInt(s.BytesIn, 10),
+			strconv.FormatInt(s.BytesOut, 10),
+			strings.Join(methods, ";"),
+			s.LastSeen.UTC().Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+}
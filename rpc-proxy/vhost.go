@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// VHostConfig maps one or more Host header values to their own proxy config.
+// Like tenants, any top-level config field may be overridden, including
+// tenants for path routing within the vhost.
+type VHostConfig struct {
+	Name  string   `json:"name"` // defaults to the first host
+	Hosts []string `json:"hosts"`
+
+	raw json.RawMessage
+}
+
+// UnmarshalJSON keeps the raw vhost object so it can be overlaid onto the
+// base config
+func (v *VHostConfig) UnmarshalJSON(b []byte) error {
+	type plain VHostConfig
+	if err := json.Unmarshal(b, (*plain)(v)); err != nil {
+		return err
+	}
+	v.raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// MarshalJSON returns the vhost object as it was configured
+func (v VHostConfig) MarshalJSON() ([]byte, error) {
+	if v.raw != nil {
+		return v.raw, nil
+	}
+	type plain VHostConfig
+	return json.Marshal(plain(v))
+}
+
+// forVHost returns a copy of the config with the vhost overrides applied
+func (c *Config) forVHost(v VHostConfig) (*Config, error) {
+	vhostConfig, err := c.clone()
+	if err != nil {
+		return nil, fmt.Errorf("vhost %q: %w", v.Name, err)
+	}
+	vhostConfig.Tenants = nil
+	vhostConfig.Upstreams = nil
+	vhostConfig.VHosts = nil
+
+	if len(v.raw) > 0 {
+		if err := json.Unmarshal(v.raw, vhostConfig); err != nil {
+			return nil, fmt.Errorf("vhost %q: %w", v.Name, err)
+		}
+	}
+	// Nested vhosts are not supported
+	vhostConfig.VHosts = nil
+
+	return vhostConfig, nil
+}
+
+// normalizeHost lowercases a host and strips any port
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
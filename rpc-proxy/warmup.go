@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// warmup ramps the effective global and per-IP rate limits from a fraction
+// of their configured value to the full value after startup, so a restarted
+// proxy doesn't send full traffic onto cold upstream connections. It works
+// by raising request costs, which every limiter algorithm honours.
+type warmup struct {
+	start    time.Time
+	duration time.Duration
+	from     float64
+}
+
+// newWarmup returns nil when warmup is disabled
+func newWarmup(config *Config) *warmup {
+	if config.WarmupDuration.Duration <= 0 {
+		return nil
+	}
+	from := config.WarmupStartFraction
+	if from <= 0 || from > 1 {
+		from = 0.1
+	}
+	return &warmup{start: time.Now(), duration: config.WarmupDuration.Duration, from: from}
+}
+
+// factor is the fraction of the configured limits in effect, rising
+// linearly to 1 over the warmup
+func (w *warmup) factor(now time.Time) float64 {
+	if w == nil {
+		return 1
+	}
+	elapsed := now.Sub(w.start)
+	if elapsed >= w.duration {
+		return 1
+	}
+	return w.from + (1-w.from)*elapsed.Seconds()/w.duration.Seconds()
+}
+
+// warming reports whether the limits are still ramping up
+func (w *warmup) warming(now time.Time) bool {
+	return w.factor(now) < 1
+}
+
+// scale divides a request's cost by the warmup factor. Fractions round up
+// or down at random in proportion, so the effective rate follows the factor
+// exactly on average.
+func (w *warmup) scale(cost int) int {
+	f := w.factor(time.Now())
+	if f >= 1 {
+		return cost
+	}
+	scaled := float64(cost) / f
+	whole := math.Floor(scaled)
+	if rand.Float64() < scaled-whole {
+		whole++
+	}
+	return int(whole)
+}
+
+// snapshot returns the warmup progress for /metrics
+func (w *warmup) snapshot() map[string]interface{} {
+	now := time.Now()
+	remaining := w.duration - now.Sub(w.start)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return map[string]interface{}{
+		"warming":           w.warming(now),
+		"factor":            math.Round(w.factor(now)*1000) / 1000,
+		"remaining_seconds": math.Round(remaining.Seconds()),
+	}
+}
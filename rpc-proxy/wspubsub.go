@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"golang.org/x/time/rate"
+)
+
+// wsClientBuffer is how many messages may queue for a WebSocket client
+// before it is disconnected for falling behind
+const wsClientBuffer = 1024
+
+// wsHub multiplexes the pubsub subscriptions of every WebSocket client of a
+// proxy onto one upstream connection. Each distinct (method, params) is
+// subscribed upstream once, and its notifications are fanned out to all
+// clients that asked for it, so a node with room for a handful of
+// subscriptions can serve many clients.
+type wsHub struct {
+	url       string
+	tlsConfig *tls.Config
+
+	mu      sync.Mutex
+	conn    *websocket.Conn // nil while disconnected
+	running bool            // the upstream connection loop is running
+	nextReq uint64          // upstream request ids
+	nextSub uint64          // downstream subscription ids
+	subs    map[string]*wsSub
+	live    map[uint64]*wsSub // by upstream subscription id
+	pending map[uint64]*wsSub // by upstream request id, awaiting the subscription id
+	clients map[*wsClient]bool
+
+	// Limits, per client key (API key or IP) except for the bandwidth,
+	// which is per connection
+	subscribeLimiters   *ipLimiterMap // nil = subscriptions aren't rate limited
+	newSubscribeLimiter func() requestLimiter
+	maxSubs             int
+	egressRate          int64
+	perClient           map[string]int // subscriptions, including pending ones
+
+	notifications atomic.Int64 // notifications received from upstream
+	dropped       atomic.Int64 // clients disconnected for falling behind
+	rejected      atomic.Int64 // subscribes refused by the limits
+}
+
+// wsSub is one upstream subscription and the clients sharing it
+type wsSub struct {
+	key        string
+	method     string // e.g. accountSubscribe
+	params     json.RawMessage
+	upstreamID uint64
+	subscribed bool
+
+	waiters     []wsWaiter          // clients waiting for the upstream subscription
+	subscribers map[int64]*wsClient // client by downstream subscription id
+}
+
+// wsWaiter is a client's subscribe request awaiting the upstream answer
+type wsWaiter struct {
+	client *wsClient
+	id     json.RawMessage
+}
+
+// wsClient is a downstream WebSocket connection
+type wsClient struct {
+	key    string // identity the limits apply to
+	label  string // identity shown in /metrics, anonymized
+	exempt bool   // exempt_ips or exempt_keys
+	since  time.Time
+
+	conn   *websocket.Conn
+	send   chan []byte
+	subs   map[int64]*wsSub // by downstream id, guarded by the hub's mu
+	egress *rate.Limiter    // nil = unlimited
+	close  sync.Once
+
+	notifications atomic.Int64
+	bytesSent     atomic.Int64
+	rejected      atomic.Int64
+}
+
+// newWSHub returns nil when WebSocket pubsub is disabled
+func newWSHub(config *Config) (*wsHub, error) {
+	if !config.EnableWebSocket {
+		return nil, nil
+	}
+	wsURL, err := upstreamWebSocketURL(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newUpstreamTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	h := &wsHub{
+		url:        wsURL,
+		tlsConfig:  tlsConfig,
+		subs:       make(map[string]*wsSub),
+		live:       make(map[uint64]*wsSub),
+		pending:    make(map[uint64]*wsSub),
+		clients:    make(map[*wsClient]bool),
+		maxSubs:    config.WSMaxSubscriptions,
+		egressRate: config.WSEgressBytesPerSecond,
+		perClient:  make(map[string]int),
+	}
+	if config.WSSubscribeRate > 0 {
+		burst := config.WSSubscribeBurst
+		if burst <= 0 {
+			burst = max(1, int(math.Ceil(config.WSSubscribeRate)))
+		}
+		h.subscribeLimiters = newIPLimiterMap(config.MaxIPLimiters)
+		h.newSubscribeLimiter = func() requestLimiter {
+			return newRequestLimiter(config.PerIPRateLimitAlgorithm, config.WSSubscribeRate, burst, config.RateLimitWindow.Duration)
+		}
+		go h.cleanupLimiters(config.IPLimiterTTL.Duration)
+	}
+	return h, nil
+}
+
+// cleanupLimiters removes stale subscribe limiters
+func (h *wsHub) cleanupLimiters(ttl time.Duration) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.subscribeLimiters.cleanup(ttl)
+	}
+}
+
+// upstreamWebSocketURL returns upstream_ws_url, or the (first) upstream URL
+// with a ws:// or wss:// scheme
+func upstreamWebSocketURL(config *Config) (string, error) {
+	raw := config.UpstreamWSURL
+	if raw == "" {
+		raw = config.UpstreamURL
+		if len(config.Upstreams) > 0 {
+			raw = config.Upstreams[0].URL
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("upstream_ws_url: %w", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("upstream_ws_url: unsupported scheme %q", u.Scheme)
+	}
+	return u.String(), nil
+}
+
+// isWebSocketUpgrade reports whether a request opens a WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// handleWebSocket accepts a pubsub client
+func (p *RPCProxy) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if p.drain.rejecting(p.config) {
+		p.writeDrainingError(w)
+		return
+	}
+	if _, err := p.keys.lookup(getAPIKey(r)); err != nil {
+		p.writeRPCError(w, nil, -32001, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	clientIP := getClientIP(r)
+	logIP := p.anonymizer.anonymize(clientIP)
+	account, kind := p.clientAccount(r, clientIP)
+	label, _ := p.clientAccount(r, logIP)
+	client := &wsClient{key: kind + ":" + account, label: label, exempt: p.exempt.match(r)}
+
+	server := websocket.Server{
+		// Browsers don't apply CORS to WebSockets, so check the origin here
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			if origin := r.Header.Get("Origin"); origin != "" && p.config.EnableCORS {
+				if allowed, _, _ := p.cors.lookup(origin); !allowed {
+					return fmt.Errorf("origin %s not allowed", origin)
+				}
+			}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			conn.MaxPayloadBytes = int(p.config.MaxBodySize)
+			if p.config.LogRequests {
+				log.Printf("[WS] IP: %s connected", logIP)
+			}
+			p.pubsub.serve(conn, client)
+			if p.config.LogRequests {
+				log.Printf("[WS] IP: %s disconnected", logIP)
+			}
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// serve runs a client connection until it closes
+func (h *wsHub) serve(conn *websocket.Conn, c *wsClient) {
+	c.conn = conn
+	c.send = make(chan []byte, wsClientBuffer)
+	c.subs = make(map[int64]*wsSub)
+	c.since = time.Now()
+	if h.egressRate > 0 && !c.exempt {
+		c.egress = rate.NewLimiter(rate.Limit(h.egressRate), int(h.egressRate))
+	}
+	h.mu.Lock()
+	h.clients[c] = true
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for msg := range c.send {
+			c.pace(len(msg))
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := websocket.Message.Send(conn, string(msg)); err != nil {
+				c.disconnect()
+				// Keep draining so the hub never blocks on this client
+				for range c.send {
+				}
+				return
+			}
+			c.bytesSent.Add(int64(len(msg)))
+		}
+	}()
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			break
+		}
+		h.handleRequest(c, data)
+	}
+
+	h.mu.Lock()
+	delete(h.clients, c)
+	for id := range c.subs {
+		h.unsubscribeLocked(c, id)
+	}
+	for _, sub := range h.subs {
+		h.dropWaiterLocked(sub, c)
+	}
+	close(c.send)
+	h.mu.Unlock()
+	<-done
+	c.disconnect()
+}
+
+// handleRequest answers a subscribe or unsubscribe request
+func (h *wsHub) handleRequest(c *wsClient, data []byte) {
+	var req struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.reply(nil, nil, &JSONRPCError{Code: -32700, Message: "Parse error"})
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(req.Method, "Unsubscribe"):
+		var params []int64
+		if json.Unmarshal(req.Params, &params) != nil || len(params) != 1 {
+			c.reply(req.ID, nil, &JSONRPCError{Code: -32602, Message: "Invalid params: expected [subscription id]"})
+			return
+		}
+		h.mu.Lock()
+		sub, ok := c.subs[params[0]]
+		if ok && sub.method != strings.TrimSuffix(req.Method, "Unsubscribe")+"Subscribe" {
+			ok = false
+		}
+		if ok {
+			h.unsubscribeLocked(c, params[0])
+		}
+		h.mu.Unlock()
+		if !ok {
+			c.reply(req.ID, nil, &JSONRPCError{Code: -32602, Message: "Invalid subscription id."})
+			return
+		}
+		c.reply(req.ID, json.RawMessage("true"), nil)
+
+	case strings.HasSuffix(req.Method, "Subscribe"):
+		h.subscribe(c, req.ID, req.Method, req.Params)
+
+	default:
+		c.reply(req.ID, nil, &JSONRPCError{Code: -32601, Message: "Method not found: only subscriptions are served over WebSocket"})
+	}
+}
+
+// subscribe adds the client to the upstream subscription for method and
+// params, creating it when it is the first
+func (h *wsHub) subscribe(c *wsClient, id json.RawMessage, method string, params json.RawMessage) {
+	var compact bytes.Buffer
+	if len(params) == 0 || json.Compact(&compact, params) != nil {
+		compact.Reset()
+		compact.WriteString("[]")
+	}
+	key := method + compact.String()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rpcErr := h.admitLocked(c); rpcErr != nil {
+		c.rejected.Add(1)
+		h.rejected.Add(1)
+		c.reply(id, nil, rpcErr)
+		return
+	}
+	h.perClient[c.key]++
+
+	sub, ok := h.subs[key]
+	if !ok {
+		sub = &wsSub{key: key, method: method, params: json.RawMessage(compact.String()), subscribers: make(map[int64]*wsClient)}
+		h.subs[key] = sub
+		h.sendSubscribeLocked(sub)
+		if !h.running {
+			h.running = true
+			go h.run()
+		}
+	}
+	if sub.subscribed {
+		h.addSubscriberLocked(sub, c, id)
+		return
+	}
+	sub.waiters = append(sub.waiters, wsWaiter{client: c, id: id})
+}
+
+// admitLocked checks a new subscription against the client's limits
+func (h *wsHub) admitLocked(c *wsClient) *JSONRPCError {
+	if c.exempt {
+		return nil
+	}
+	if h.maxSubs > 0 && h.perClient[c.key] >= h.maxSubs {
+		return &JSONRPCError{Code: -32005, Message: fmt.Sprintf("Too many subscriptions (max %d).", h.maxSubs)}
+	}
+	if h.subscribeLimiters == nil {
+		return nil
+	}
+	limiter := h.subscribeLimiters.get(c.key, h.newSubscribeLimiter)
+	if limiter.Allow() {
+		return nil
+	}
+	reservation := limiter.Reserve()
+	delay := reservation.Delay()
+	reservation.Cancel()
+	retryAfter := int(delay.Seconds()) + 1
+	return &JSONRPCError{
+		Code:    -32005, // Server is busy
+		Message: fmt.Sprintf("Rate limited. Please retry after %d seconds.", retryAfter),
+		Data: map[string]interface{}{
+			"retry_after_seconds": retryAfter,
+		},
+	}
+}
+
+// forgetLocked releases one of the client's subscriptions from its limit
+func (h *wsHub) forgetLocked(c *wsClient) {
+	if h.perClient[c.key]--; h.perClient[c.key] <= 0 {
+		delete(h.perClient, c.key)
+	}
+}
+
+// addSubscriberLocked gives the client its own id for the subscription
+func (h *wsHub) addSubscriberLocked(sub *wsSub, c *wsClient, id json.RawMessage) {
+	h.nextSub++
+	sub.subscribers[int64(h.nextSub)] = c
+	c.subs[int64(h.nextSub)] = sub
+	c.reply(id, json.RawMessage(strconv.FormatUint(h.nextSub, 10)), nil)
+}
+
+// unsubscribeLocked removes a client's subscription, unsubscribing
+// upstream when it was the last subscriber
+func (h *wsHub) unsubscribeLocked(c *wsClient, id int64) {
+	sub := c.subs[id]
+	delete(c.subs, id)
+	delete(sub.subscribers, id)
+	h.forgetLocked(c)
+	h.releaseLocked(sub)
+}
+
+// dropWaiterLocked removes a disconnected client from the waiters
+func (h *wsHub) dropWaiterLocked(sub *wsSub, c *wsClient) {
+	waiters := sub.waiters[:0]
+	for _, w := range sub.waiters {
+		if w.client != c {
+			waiters = append(waiters, w)
+		} else {
+			h.forgetLocked(c)
+		}
+	}
+	sub.waiters = waiters
+	h.releaseLocked(sub)
+}
+
+// releaseLocked forgets a subscription nobody wants anymore
+func (h *wsHub) releaseLocked(sub *wsSub) {
+	if len(sub.subscribers) > 0 || len(sub.waiters) > 0 || h.subs[sub.key] != sub {
+		return
+	}
+	delete(h.subs, sub.key)
+	if sub.subscribed {
+		delete(h.live, sub.upstreamID)
+		h.sendLocked(strings.TrimSuffix(sub.method, "Subscribe")+"Unsubscribe", json.RawMessage(fmt.Sprintf("[%d]", sub.upstreamID)))
+	}
+	// Free the node's connection when nothing is subscribed
+	if len(h.subs) == 0 && h.conn != nil {
+		h.conn.Close()
+	}
+}
+
+// sendSubscribeLocked subscribes upstream, if connected; otherwise the
+// connection loop subscribes once it is
+func (h *wsHub) sendSubscribeLocked(sub *wsSub) {
+	if id, ok := h.sendLocked(sub.method, sub.params); ok {
+		h.pending[id] = sub
+	}
+}
+
+// sendLocked sends a request upstream, returning its id
+func (h *wsHub) sendLocked(method string, params json.RawMessage) (uint64, bool) {
+	if h.conn == nil {
+		return 0, false
+	}
+	h.nextReq++
+	msg, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": h.nextReq, "method": method, "params": params})
+	h.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := websocket.Message.Send(h.conn, string(msg)); err != nil {
+		// The read loop sees the broken connection and reconnects
+		h.conn.Close()
+		return 0, false
+	}
+	return h.nextReq, true
+}
+
+// run keeps the upstream connection up while there are subscriptions,
+// resubscribing everything after a reconnect
+func (h *wsHub) run() {
+	backoff := time.Second
+	for {
+		conn, err := h.dial()
+		h.mu.Lock()
+		if len(h.subs) == 0 {
+			h.running = false
+			h.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			h.mu.Unlock()
+			log.Printf("[WS] Upstream pubsub %s unreachable, retrying in %v: %v", redactURL(h.url), backoff, err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+		h.conn = conn
+		for _, sub := range h.subs {
+			h.sendSubscribeLocked(sub)
+		}
+		h.mu.Unlock()
+
+		err = h.read(conn)
+
+		h.mu.Lock()
+		h.conn = nil
+		h.live = make(map[uint64]*wsSub)
+		h.pending = make(map[uint64]*wsSub)
+		for _, sub := range h.subs {
+			sub.subscribed = false
+		}
+		if len(h.subs) == 0 {
+			h.running = false
+			h.mu.Unlock()
+			return
+		}
+		h.mu.Unlock()
+		log.Printf("[WS] Upstream pubsub connection lost, resubscribing: %v", err)
+	}
+}
+
+// dial opens the upstream connection
+func (h *wsHub) dial() (*websocket.Conn, error) {
+	return dialWebSocket(h.url, h.tlsConfig)
+}
+
+// dialWebSocket connects to an upstream pubsub endpoint
+func dialWebSocket(wsURL string, tlsConfig *tls.Config) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(wsURL, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = tlsConfig
+	config.Dialer = &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := websocket.DialConfig(config)
+	if dialErr, ok := err.(*websocket.DialError); ok {
+		// DialError prints the URL, which may hold an API key
+		err = dialErr.Err
+	}
+	return conn, err
+}
+
+// read handles upstream messages until the connection fails
+func (h *wsHub) read(conn *websocket.Conn) error {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			return err
+		}
+		var msg struct {
+			ID     *uint64         `json:"id"`
+			Result json.RawMessage `json:"result"`
+			Error  *JSONRPCError   `json:"error"`
+			Method string          `json:"method"`
+			Params struct {
+				Result       json.RawMessage `json:"result"`
+				Subscription uint64          `json:"subscription"`
+			} `json:"params"`
+		}
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		if msg.ID != nil {
+			h.subscribed(*msg.ID, msg.Result, msg.Error)
+		} else if msg.Method != "" {
+			h.notify(msg.Method, msg.Params.Subscription, msg.Params.Result)
+		}
+	}
+}
+
+// subscribed handles the upstream answer to a subscribe request
+func (h *wsHub) subscribed(reqID uint64, result json.RawMessage, rpcErr *JSONRPCError) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub, ok := h.pending[reqID]
+	if !ok {
+		return // an unsubscribe
+	}
+	delete(h.pending, reqID)
+
+	var upstreamID uint64
+	if rpcErr == nil && json.Unmarshal(result, &upstreamID) != nil {
+		rpcErr = &JSONRPCError{Code: -32603, Message: "Invalid subscription id from upstream"}
+	}
+	if rpcErr != nil {
+		for _, w := range sub.waiters {
+			w.client.reply(w.id, nil, rpcErr)
+			h.forgetLocked(w.client)
+		}
+		if len(sub.subscribers) > 0 {
+			log.Printf("[WS] Resubscribing %s failed: %s", sub.method, rpcErr.Message)
+			for id, c := range sub.subscribers {
+				delete(c.subs, id)
+				h.forgetLocked(c)
+			}
+		}
+		delete(h.subs, sub.key)
+		return
+	}
+
+	if h.subs[sub.key] != sub {
+		// Everyone left while the subscription was being made
+		h.sendLocked(strings.TrimSuffix(sub.method, "Subscribe")+"Unsubscribe", json.RawMessage(fmt.Sprintf("[%d]", upstreamID)))
+		return
+	}
+	sub.upstreamID = upstreamID
+	sub.subscribed = true
+	h.live[upstreamID] = sub
+	for _, w := range sub.waiters {
+		h.addSubscriberLocked(sub, w.client, w.id)
+	}
+	sub.waiters = nil
+}
+
+// notify fans a notification out to the subscription's clients, each with
+// its own subscription id
+func (h *wsHub) notify(method string, upstreamID uint64, result json.RawMessage) {
+	h.notifications.Add(1)
+	prefix := []byte(`{"jsonrpc":"2.0","method":` + strconv.Quote(method) + `,"params":{"result":`)
+	prefix = append(append(prefix, result...), `,"subscription":`...)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub, ok := h.live[upstreamID]
+	if !ok {
+		return
+	}
+	for id, c := range sub.subscribers {
+		msg := make([]byte, 0, len(prefix)+24)
+		msg = append(msg, prefix...)
+		msg = strconv.AppendInt(msg, id, 10)
+		msg = append(msg, "}}"...)
+		c.notifications.Add(1)
+		c.enqueue(h, msg)
+	}
+
+	// Signature subscriptions end with their notification, other than the
+	// optional "receivedSignature" one
+	if method == "signatureNotification" && !bytes.Contains(result, []byte(`"receivedSignature"`)) {
+		for id, c := range sub.subscribers {
+			delete(c.subs, id)
+			h.forgetLocked(c)
+		}
+		delete(h.live, upstreamID)
+		delete(h.subs, sub.key)
+	}
+}
+
+// reply sends a JSON-RPC response to the client
+func (c *wsClient) reply(id json.RawMessage, result json.RawMessage, rpcErr *JSONRPCError) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	msg, _ := json.Marshal(struct {
+		JSONRPC string          `json:"jsonrpc"`
+		Result  json.RawMessage `json:"result,omitempty"`
+		Error   *JSONRPCError   `json:"error,omitempty"`
+		ID      json.RawMessage `json:"id"`
+	}{"2.0", result, rpcErr, id})
+	c.enqueue(nil, msg)
+}
+
+// enqueue queues a message for the client, disconnecting it when it has
+// fallen too far behind
+func (c *wsClient) enqueue(h *wsHub, msg []byte) {
+	select {
+	case c.send <- msg:
+	default:
+		if h != nil {
+			h.dropped.Add(1)
+		}
+		c.disconnect()
+	}
+}
+
+// pace waits until the connection's bandwidth allows n more bytes
+func (c *wsClient) pace(n int) {
+	if c.egress == nil {
+		return
+	}
+	for n > 0 {
+		chunk := min(n, c.egress.Burst())
+		c.egress.WaitN(context.Background(), chunk)
+		n -= chunk
+	}
+}
+
+// disconnect closes the client connection once
+func (c *wsClient) disconnect() {
+	c.close.Do(func() { c.conn.Close() })
+}
+
+// snapshot returns the pubsub state for /metrics
+func (h *wsHub) snapshot() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	downstream := 0
+	for _, sub := range h.subs {
+		downstream += len(sub.subscribers)
+	}
+	connections := make([]map[string]interface{}, 0, len(h.clients))
+	for c := range h.clients {
+		connections = append(connections, map[string]interface{}{
+			"client":        c.label,
+			"connected_at":  c.since.UTC().Format(time.RFC3339),
+			"subscriptions": len(c.subs),
+			"notifications": c.notifications.Load(),
+			"bytes_sent":    c.bytesSent.Load(),
+			"rejected":      c.rejected.Load(),
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i]["bytes_sent"].(int64) > connections[j]["bytes_sent"].(int64)
+	})
+	return map[string]interface{}{
+		"connections":              connections,
+		"rejected_subscribes":      h.rejected.Load(),
+		"clients":                  len(h.clients),
+		"upstream_connected":       h.conn != nil,
+		"upstream_subscriptions":   len(h.subs),
+		"downstream_subscriptions": downstream,
+		"notifications":            h.notifications.Load(),
+		"dropped_clients":          h.dropped.Load(),
+	}
+}
+
+// redactURL drops the query and credentials from a URL for logging, since
+// provider API keys often live there
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "upstream"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}